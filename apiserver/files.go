@@ -0,0 +1,234 @@
+package apiserver
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// URLEnv is the address of the API used by clients, e.g. http://localhost:8766.
+const URLEnv = "CONTAINER_USE_API_URL"
+
+// getFiles streams a tar archive of the file or directory at the path query
+// parameter, relative to the workdir. Directories are archived with their
+// content at the root, files as a single entry named after them.
+func getFiles(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		writeError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+	tmp, err := os.MkdirTemp("", "container-use-cp-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	target := filepath.Join(tmp, path.Base(p))
+	if err := env.CopyOut(r.Context(), p, target); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	root := tmp
+	if info.IsDir() {
+		root = target
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := WriteTar(w, root); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// putFiles extracts the tar archive of the request body in the directory at
+// the path query parameter, relative to the workdir, without committing.
+func putFiles(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		writeError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+	tmp, err := os.MkdirTemp("", "container-use-cp-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ExtractTar(r.Body, tmp); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid archive: %w", err))
+		return
+	}
+	if err := env.CopyIn(r.Context(), tmp, p); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WriteTar writes a tar archive of the content of dir to w.
+func WriteTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExtractTar extracts the tar archive r in dir, rejecting entries outside of it.
+func ExtractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fs.ValidPath(strings.TrimSuffix(header.Name, "/")) {
+			return fmt.Errorf("invalid path %q", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		mode := fs.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// Links and special files are skipped.
+		}
+	}
+}
+
+// CopyClient copies files between the host and the environments of a
+// container-use server through its API.
+type CopyClient struct {
+	URL   string
+	Token string
+}
+
+// NewCopyClient returns a client of the API at URLEnv, authenticated with
+// TokenEnv, or nil if URLEnv is not set.
+func NewCopyClient() *CopyClient {
+	apiURL := os.Getenv(URLEnv)
+	if apiURL == "" {
+		return nil
+	}
+	return &CopyClient{URL: strings.TrimSuffix(apiURL, "/"), Token: os.Getenv(TokenEnv)}
+}
+
+func (c *CopyClient) do(ctx context.Context, method, id, p string, body io.Reader) (*http.Response, error) {
+	u := fmt.Sprintf("%s/v1/environments/%s/files?path=%s", c.URL, id, url.QueryEscape(p))
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// CopyOut copies the file or directory source of the environment id to target on the host.
+func (c *CopyClient) CopyOut(ctx context.Context, id, source, target string) error {
+	resp, err := c.do(ctx, http.MethodGet, id, source, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.MkdirTemp(filepath.Dir(target), ".container-use-cp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ExtractTar(resp.Body, tmp); err != nil {
+		return err
+	}
+	// A file is archived as a single entry named after it.
+	file := filepath.Join(tmp, path.Base(source))
+	if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+		if entries, _ := os.ReadDir(tmp); len(entries) == 1 {
+			return os.Rename(file, target)
+		}
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// CopyIn copies the host file or directory source to target in the environment id.
+func (c *CopyClient) CopyIn(ctx context.Context, id, source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	dir, root := target, source
+	if !info.IsDir() {
+		// Archive the file in a directory, as the entry named after the target.
+		tmp, err := os.MkdirTemp("", "container-use-cp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, path.Base(target)), data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		dir, root = path.Dir(target), tmp
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteTar(pw, root))
+	}()
+	resp, err := c.do(ctx, http.MethodPut, id, dir, pr)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
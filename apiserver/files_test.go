@@ -0,0 +1,159 @@
+package apiserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body)), Linkname: e.linkname}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// listFiles returns the contents of the regular files under dir, by relative path.
+func listFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "files and directories",
+			entries: []tarEntry{
+				{name: "src/", typeflag: tar.TypeDir},
+				{name: "src/main.go", typeflag: tar.TypeReg, body: "package main"},
+				{name: "testdata/fixtures/a.json", typeflag: tar.TypeReg, body: "{}"},
+			},
+			want: map[string]string{"src/main.go": "package main", "testdata/fixtures/a.json": "{}"},
+		},
+		{
+			name: "links are skipped",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+				{name: "hosts", typeflag: tar.TypeLink, linkname: "/etc/hosts"},
+				{name: "README", typeflag: tar.TypeReg, body: "hello"},
+			},
+			want: map[string]string{"README": "hello"},
+		},
+		{
+			name:    "parent directory",
+			entries: []tarEntry{{name: "../escape", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "nested parent directory",
+			entries: []tarEntry{{name: "a/../../escape", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{name: "/tmp/escape", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "dir")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := ExtractTar(buildTar(t, tt.entries), dir)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ExtractTar() succeeded, want an error")
+				}
+				if got := listFiles(t, root); len(got) > 0 {
+					t.Errorf("ExtractTar() wrote %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExtractTar() error = %v", err)
+			}
+			if got := listFiles(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extracted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	want := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+	for name, body := range want {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteTar(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := ExtractTar(buf, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := listFiles(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip extracted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,342 @@
+// Package apiserver exposes environment management over a versioned HTTP API,
+// for dashboards, bots and agents that don't speak MCP.
+package apiserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/mcpserver"
+)
+
+// TokenEnv holds the bearer token clients of the API must authenticate with.
+const TokenEnv = "CONTAINER_USE_API_TOKEN"
+
+// clientName is the name API calls are attributed to in environment histories.
+const clientName = "api"
+
+// Environment is an environment as returned by the API.
+type Environment struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Source    string   `json:"source"`
+	BaseImage string   `json:"base_image"`
+	Workdir   string   `json:"workdir"`
+	Branch    string   `json:"branch"`
+	Clients   []string `json:"clients,omitempty"`
+}
+
+func newEnvironment(env *environment.Environment) *Environment {
+	return &Environment{
+		ID:        env.ID,
+		Name:      env.Name,
+		Source:    env.Source,
+		BaseImage: env.BaseImage,
+		Workdir:   env.Workdir,
+		Branch:    "container-use/" + env.ID,
+		Clients:   env.Clients(),
+	}
+}
+
+type createRequest struct {
+	Source      string `json:"source"`
+	Name        string `json:"name"`
+	Explanation string `json:"explanation"`
+}
+
+type runRequest struct {
+	Command     string `json:"command"`
+	Shell       string `json:"shell"`
+	Explanation string `json:"explanation"`
+	// ANSI overrides the ANSI mode of the environment, e.g. "preserve" to display the output in a terminal.
+	ANSI environment.ANSIMode `json:"ansi,omitempty"`
+}
+
+type runResponse struct {
+	Output string `json:"output"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// server serves the API for the environments of envs.
+type server struct {
+	envs environment.Environments
+}
+
+// Handler returns the v1 API of envs, authenticating requests with token.
+//
+//	GET    /v1/environments                      list the open environments
+//	POST   /v1/environments                      create an environment
+//	GET    /v1/environments/{name}/{pet}         get an environment
+//	DELETE /v1/environments/{name}/{pet}         delete an environment (?force=true)
+//	POST   /v1/environments/{name}/{pet}/run     run a command
+//	GET    /v1/environments/{name}/{pet}/diff    diff an environment with its source branch
+//	POST   /v1/environments/{name}/{pet}/merge   merge an environment into a branch that isn't checked out (?branch=)
+//	GET    /v1/environments/{name}/{pet}/ports   list the ports the background commands listen on
+//	GET    /v1/environments/{name}/{pet}/files   download a file or directory as a tar archive (?path=)
+//	PUT    /v1/environments/{name}/{pet}/files   extract a tar archive in a directory, without committing (?path=)
+//
+// Environments that aren't open are opened from the repository given by the
+// source query parameter or, without it, from their persisted state. Source
+// repositories must be registered with container-use already.
+//
+// Calls are subject to the policy of the MCP server, as the client "api": each
+// endpoint is authorized as the tool it's equivalent to, or as
+// environment_delete and environment_merge for the endpoints without one, and
+// counts towards the quotas of the client.
+func Handler(envs environment.Environments, token string) http.Handler {
+	s := &server{envs: envs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/environments", s.listEnvironments)
+	mux.HandleFunc("POST /v1/environments", s.createEnvironment)
+	mux.HandleFunc("GET /v1/environments/{name}/{pet}", s.withEnvironment("environment_list", getEnvironment))
+	mux.HandleFunc("DELETE /v1/environments/{name}/{pet}", s.withEnvironment("environment_delete", deleteEnvironment))
+	mux.HandleFunc("POST /v1/environments/{name}/{pet}/run", s.withEnvironment("environment_run_cmd", runCommand))
+	mux.HandleFunc("GET /v1/environments/{name}/{pet}/diff", s.withEnvironment("environment_diff", diffEnvironment))
+	mux.HandleFunc("POST /v1/environments/{name}/{pet}/merge", s.withEnvironment("environment_merge", mergeEnvironment))
+	mux.HandleFunc("GET /v1/environments/{name}/{pet}/ports", s.withEnvironment("environment_ports", listPorts))
+	mux.HandleFunc("GET /v1/environments/{name}/{pet}/files", s.withEnvironment("environment_file_read", getFiles))
+	mux.HandleFunc("PUT /v1/environments/{name}/{pet}/files", s.withEnvironment("environment_upload", putFiles))
+	return authenticate(token, mux)
+}
+
+// Run serves the API of envs on addr until ctx is done. The token is read from TokenEnv.
+func Run(ctx context.Context, envs environment.Environments, addr string) error {
+	token := os.Getenv(TokenEnv)
+	if token == "" {
+		return fmt.Errorf("%s must be set to serve the API", TokenEnv)
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           Handler(envs, token),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("starting API server", "addr", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return srv.Shutdown(context.Background())
+	}
+}
+
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+		ctx := environment.WithClientInfo(r.Context(), environment.ClientInfo{Name: clientName, Identity: clientName})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authorizeCall authorizes the request as a call of tool with args, see
+// mcpserver.AuthorizeCall, writing the error response if it's denied. The
+// returned function must be called once the request is served.
+func (s *server) authorizeCall(w http.ResponseWriter, r *http.Request, tool string, args map[string]any) (func(), bool) {
+	release, err := mcpserver.AuthorizeCall(r.Context(), s.envs, clientName, tool, args)
+	if err != nil {
+		var quota *mcpserver.QuotaExceededError
+		if errors.As(err, &quota) {
+			writeError(w, http.StatusTooManyRequests, err)
+			return nil, false
+		}
+		writeError(w, http.StatusForbidden, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// registeredSource checks source is a registered repository, writing the error response if it isn't.
+func registeredSource(w http.ResponseWriter, r *http.Request, source string) bool {
+	if err := environment.RegisteredRepository(r.Context(), source); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// withEnvironment resolves the environment of the request path, and
+// authorizes the request as a call of tool on it.
+func (s *server) withEnvironment(tool string, handler func(http.ResponseWriter, *http.Request, *environment.Environment)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("name") + "/" + r.PathValue("pet")
+		env := s.envs.Get(id)
+		if env == nil {
+			var err error
+			if source := r.URL.Query().Get("source"); source != "" {
+				if !registeredSource(w, r, source) {
+					return
+				}
+				release, ok := s.authorizeCall(w, r, "environment_open", map[string]any{"source": source})
+				if !ok {
+					return
+				}
+				env, err = s.envs.OpenFromSource(r.Context(), "Open environment from the API", source, id)
+				release()
+			} else {
+				env, err = s.envs.Open(r.Context(), id)
+			}
+			if err != nil {
+				writeError(w, http.StatusNotFound, fmt.Errorf("failed to open environment %s: %w", id, err))
+				return
+			}
+		}
+		release, ok := s.authorizeCall(w, r, tool, map[string]any{"environment_id": env.ID})
+		if !ok {
+			return
+		}
+		defer release()
+		if err := env.Activate(r.Context()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		handler(w, r, env)
+	}
+}
+
+func (s *server) listEnvironments(w http.ResponseWriter, r *http.Request) {
+	release, ok := s.authorizeCall(w, r, "environment_list", nil)
+	if !ok {
+		return
+	}
+	defer release()
+	envs := []*Environment{}
+	for _, env := range mcpserver.AuthorizedEnvironments(r.Context(), clientName, s.envs.List()) {
+		envs = append(envs, newEnvironment(env))
+	}
+	writeJSON(w, http.StatusOK, envs)
+}
+
+func (s *server) createEnvironment(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if req.Source == "" || req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("source and name are required"))
+		return
+	}
+	if !registeredSource(w, r, req.Source) {
+		return
+	}
+	release, ok := s.authorizeCall(w, r, "environment_open", map[string]any{"source": req.Source, "name": req.Name})
+	if !ok {
+		return
+	}
+	defer release()
+	env, err := s.envs.Create(r.Context(), req.Explanation, req.Source, req.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newEnvironment(env))
+}
+
+func getEnvironment(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	writeJSON(w, http.StatusOK, newEnvironment(env))
+}
+
+func deleteEnvironment(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	if err := env.Delete(r.Context(), r.URL.Query().Get("force") == "true"); err != nil {
+		var unmerged *environment.UnmergedWorkError
+		if errors.As(err, &unmerged) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func runCommand(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if req.Shell == "" {
+		req.Shell = "sh"
+	}
+	if req.ANSI != "" && req.ANSI != environment.ANSIStrip && req.ANSI != environment.ANSIPreserve {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ansi mode %q", req.ANSI))
+		return
+	}
+	output, err := env.Run(environment.WithANSIMode(r.Context(), req.ANSI), req.Explanation, req.Command, req.Shell, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runResponse{Output: output})
+}
+
+func diffEnvironment(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	diff, err := env.Diff(r.Context(), environment.DiffOpts{Patch: r.URL.Query().Get("patch") == "true"})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+func mergeEnvironment(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	branch := r.URL.Query().Get("branch")
+	if branch == "" {
+		writeError(w, http.StatusBadRequest, errors.New("branch is required"))
+		return
+	}
+	if err := environment.Merge(r.Context(), env.Source, env.ID, branch); err != nil {
+		var conflict *environment.ConflictError
+		if errors.As(err, &conflict) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listPorts(w http.ResponseWriter, r *http.Request, env *environment.Environment) {
+	ports, err := env.ListeningPorts(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ports)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write API response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
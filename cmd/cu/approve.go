@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	approveDeny    bool
+	approveComment string
+)
+
+var approveCmd = &cobra.Command{
+	Use:   "approve [<id>]",
+	Short: "Approve or deny an operation waiting for a human",
+	Long: `Approve or deny a command paused by an "approve" rule of the command policy
+of an environment, e.g. in .container-use.yaml:
+
+  command_policy:
+    rules:
+      - regexp: 'git\s+push|terraform\s+apply|npm\s+publish'
+        action: approve
+
+The decision is recorded in the audit log of the environment, along with the
+user who made it. Approvals must be typed in an interactive terminal, so that
+agents running commands can't approve their own operations; denials can be
+scripted with --deny. The operation releases the environment while it waits.
+
+Without arguments, list the operations waiting for approval. Operations are
+denied after 15 minutes without a decision (set CONTAINER_USE_APPROVAL_TIMEOUT,
+in minutes, to change it).`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		out := app.OutOrStdout()
+
+		if len(args) == 0 {
+			pending, err := environment.PendingApprovals()
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 {
+				fmt.Fprintln(out, "No operations waiting for approval.")
+				return nil
+			}
+			tw := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(tw, "ID\tENVIRONMENT\tCLIENT\tREQUESTED\tCOMMAND")
+			for _, request := range pending {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", request.ID, request.Environment, request.Client, request.RequestedAt.Format(time.DateTime), request.Command)
+			}
+			return tw.Flush()
+		}
+
+		request, err := environment.GetApproval(args[0])
+		if err != nil {
+			return err
+		}
+		decision := environment.ApprovalDecision{Comment: approveComment}
+		if !approveDeny {
+			terminal, err := approvalTerminal()
+			if err != nil {
+				return err
+			}
+			decision.Terminal = terminal
+			fmt.Fprintf(out, "Environment: %s (%s)\n", request.Environment, request.Source)
+			if request.Client != "" {
+				fmt.Fprintf(out, "Client:      %s\n", request.Client)
+			}
+			if request.Explanation != "" {
+				fmt.Fprintf(out, "Explanation: %s\n", request.Explanation)
+			}
+			if request.Reason != "" {
+				fmt.Fprintf(out, "Reason:      %s\n", request.Reason)
+			}
+			fmt.Fprintf(out, "Command:     %s\n", request.Command)
+			fmt.Fprint(out, "Approve? [y/N] ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			decision.Approved = answer == "y" || answer == "yes"
+		}
+
+		if err := environment.DecideApproval(request.ID, decision); err != nil {
+			return err
+		}
+		if decision.Approved {
+			fmt.Fprintf(out, "Approved %s.\n", request.ID)
+		} else {
+			fmt.Fprintf(out, "Denied %s.\n", request.ID)
+		}
+		return nil
+	},
+}
+
+func init() {
+	approveCmd.Flags().BoolVar(&approveDeny, "deny", false, "Deny the operation")
+	approveCmd.Flags().StringVar(&approveComment, "comment", "", "Comment recorded with the decision")
+	rootCmd.AddCommand(approveCmd)
+}
+
+// approvalTerminal returns the interactive terminal approvals are typed in.
+func approvalTerminal() (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("approvals must be typed in an interactive terminal (use --deny to deny without one)")
+	}
+	// The terminal is only named where /proc is available.
+	if terminal, err := os.Readlink("/proc/self/fd/0"); err == nil {
+		return terminal, nil
+	}
+	return "/dev/tty", nil
+}
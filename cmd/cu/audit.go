@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit <env>",
+	Short: "Verify the audit log of an environment",
+	Long: `Check the hash chain of the audit log of an environment and the tags
+anchoring it, including their signatures.
+
+The audit log is hash chained when the repository configuration enables it:
+
+  audit:
+    hash_chain: true
+    anchor_every: 50`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		result, err := environment.VerifyAudit(app.Context(), args[0])
+		if err != nil {
+			return err
+		}
+
+		out := app.OutOrStdout()
+		if result.Entries == 0 {
+			fmt.Fprintf(out, "No audit log found for environment '%s'.\n", args[0])
+			return nil
+		}
+		for _, problem := range result.Problems {
+			fmt.Fprintln(out, problem)
+		}
+		fmt.Fprintf(out, "%d entries, %d anchors\n", result.Entries, result.Anchors)
+		if len(result.Problems) > 0 {
+			return fmt.Errorf("audit log of environment '%s' was tampered with", args[0])
+		}
+		fmt.Fprintln(out, "Audit log verified.")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+}
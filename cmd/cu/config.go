@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the repository configuration",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [<repository>]",
+	Short: "Check the configuration file of a repository",
+	Long: fmt.Sprintf(`Check %s against its schema and the settings environments can be
+created with, and list the problems found with their location.`, environment.RepoConfigFile),
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		dir := "."
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		errs, err := environment.ValidateConfig(dir)
+		if err != nil {
+			return err
+		}
+		for _, problem := range errs {
+			fmt.Fprintf(app.OutOrStdout(), "%s:%s\n", environment.RepoConfigFile, problem.Error())
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s is invalid", environment.RepoConfigFile)
+		}
+		fmt.Fprintf(app.OutOrStdout(), "%s is valid\n", environment.RepoConfigFile)
+		return nil
+	},
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON schema of the configuration file",
+	Long: fmt.Sprintf(`Print the JSON schema of %s, e.g. for editors supporting
+yaml-language-server: cu config schema > .container-use.schema.json`, environment.RepoConfigFile),
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		_, err := app.OutOrStdout().Write(environment.ConfigSchema)
+		return err
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd, configSchemaCmd)
+	rootCmd.AddCommand(configCmd)
+}
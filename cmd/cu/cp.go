@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dagger/container-use/apiserver"
+	"github.com/spf13/cobra"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <env>:<path> <local> | <local> <env>:<path>",
+	Short: "Copy files between the host and an environment",
+	Long: `Copy a file or directory between the host and an environment. Paths in the
+environment are relative to its workdir.
+
+Nothing is committed: files copied into the workdir of an environment are
+committed with its next change. Copying into an environment goes through the
+API of the container-use server running it: set ` + apiserver.URLEnv + ` and
+` + apiserver.TokenEnv + ` (see cu serve --api-addr). Copying out of an environment
+without it reads the environment as committed.`,
+	Example: `  cu cp my-feature/fancy-mallard:coverage.html .
+  cu cp ./fixtures my-feature/fancy-mallard:testdata/fixtures`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		srcEnv, src, srcInEnv := parseCopyArg(args[0])
+		dstEnv, dst, dstInEnv := parseCopyArg(args[1])
+		if srcInEnv == dstInEnv {
+			return errors.New("exactly one of the source and the destination must be in an environment (<env>:<path>)")
+		}
+
+		client := apiserver.NewCopyClient()
+		if dstInEnv {
+			if client == nil {
+				return fmt.Errorf("copying into an environment requires the API of the container-use server running it: set %s and %s", apiserver.URLEnv, apiserver.TokenEnv)
+			}
+			if err := client.CopyIn(ctx, dstEnv, src, dst); err != nil {
+				return err
+			}
+			fmt.Fprintf(app.OutOrStdout(), "Copied %s to %s:%s\n", src, dstEnv, dst)
+			return nil
+		}
+
+		// Like cp, copy into existing directories.
+		if info, err := os.Stat(dst); err == nil && info.IsDir() {
+			dst = filepath.Join(dst, path.Base(src))
+		}
+		if client != nil {
+			if err := client.CopyOut(ctx, srcEnv, src, dst); err != nil {
+				return err
+			}
+		} else {
+			dag, envs, err := connectDagger(ctx, os.Stderr)
+			if err != nil {
+				return err
+			}
+			defer dag.Close()
+
+			openCtx, stopSpinner := withSpinner(ctx)
+			env, err := envs.OpenFromSource(openCtx, "copying files", ".", srcEnv)
+			stopSpinner()
+			if err != nil {
+				return err
+			}
+			if err := env.CopyOut(ctx, src, dst); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(app.OutOrStdout(), "Copied %s:%s to %s\n", srcEnv, src, dst)
+		return nil
+	},
+}
+
+// parseCopyArg splits an <env>:<path> argument, environment IDs being
+// <name>/<pet>. Other arguments, and existing host paths, are host paths.
+func parseCopyArg(arg string) (env, p string, ok bool) {
+	env, p, ok = strings.Cut(arg, ":")
+	if !ok || strings.Count(env, "/") != 1 || strings.HasPrefix(env, ".") || strings.HasPrefix(env, "/") {
+		return "", arg, false
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return "", arg, false
+	}
+	return env, p, true
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+}
@@ -1,41 +1,49 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
-	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
 	"github.com/spf13/cobra"
 )
 
+var deleteForce bool
+
 var deleteCmd = &cobra.Command{
 	Use:   "delete <env>",
 	Short: "Delete an environment",
-	Long:  `Delete an environment and its associated resources.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Delete an environment and its associated resources.
+
+Environments with commits that aren't merged into any local branch are only
+deleted with --force.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 		envName := args[0]
 
-		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+		dag, envs, err := connectDagger(ctx, os.Stderr)
 		if err != nil {
-			return fmt.Errorf("failed to connect to dagger: %w", err)
+			return err
 		}
 		defer dag.Close()
-		environment.Initialize(dag)
 
-		env := environment.Get(envName)
+		env := envs.Get(envName)
 		if env == nil {
 			// Try to open if not in memory
 			var openErr error
-			env, openErr = environment.Open(ctx, "delete environment", ".", envName)
+			env, openErr = envs.OpenFromSource(ctx, "delete environment", ".", envName)
 			if openErr != nil {
 				return fmt.Errorf("environment '%s' not found: %w", envName, openErr)
 			}
 		}
 
-		if err := env.Delete(ctx); err != nil {
+		if err := env.Delete(ctx, deleteForce); err != nil {
+			var unmerged *environment.UnmergedWorkError
+			if errors.As(err, &unmerged) {
+				return fmt.Errorf("%w\nMerge them with `cu merge %s` or use --force to delete the environment anyway", err, envName)
+			}
 			return fmt.Errorf("failed to delete environment: %w", err)
 		}
 
@@ -46,5 +54,6 @@ var deleteCmd = &cobra.Command{
 }
 
 func init() {
+	deleteCmd.Flags().BoolVarP(&deleteForce, "force", "f", false, "Delete the environment even if it has unmerged work")
 	rootCmd.AddCommand(deleteCmd)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose common setup problems",
+	Long: `Check that git, the Dagger engine and the container-use configuration
+work for the current repository, and suggest fixes for the problems found.`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+
+		connectCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+		// Connect without provisioning a compatible engine: the version of the
+		// engine is one of the checks.
+		client, err := dagger.Connect(connectCtx, dagger.WithLogOutput(logWriter))
+		if err == nil {
+			defer client.Close()
+		} else {
+			fmt.Fprintf(app.ErrOrStderr(), "Failed to connect to dagger: %s\n", err)
+		}
+
+		envs, err := environment.NewClient(ctx, client, environment.ClientOptions{SkipEngineCheck: true})
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, check := range envs.Diagnose(ctx, ".") {
+			fmt.Fprintf(app.OutOrStdout(), "[%s] %s: %s\n", check.Status, check.Name, check.Message)
+			if check.Fix != "" {
+				fmt.Fprintf(app.OutOrStdout(), "       fix: %s\n", check.Fix)
+			}
+			if check.Status == environment.CheckFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
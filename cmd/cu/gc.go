@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var gcMaxUnused time.Duration
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Report the Dagger engine cache left behind by environments",
+	Long: `Find the Dagger engine cache entries left behind by deleted environments,
+or unused for longer than --max-unused (e.g. the layers of old base images).
+
+The entries are only reported: the engine can't prune selected entries, only
+its whole cache, which other Dagger projects share. Prune it with
+'dagger core engine local-cache prune' once it's safe to.`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+
+		dag, envs, err := connectDagger(ctx, os.Stderr)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		report, err := envs.StaleEngineCache(ctx, environment.CachePolicy{
+			MaxUnused: gcMaxUnused,
+		})
+		if err != nil {
+			return err
+		}
+
+		out := app.OutOrStdout()
+		if len(report.Stale) == 0 {
+			fmt.Fprintln(out, "No stale cache entries.")
+			return nil
+		}
+		for _, entry := range report.Stale {
+			fmt.Fprintf(out, "%s (%s): %s\n", entry.Description, formatBytes(entry.Bytes), entry.Reason)
+		}
+		fmt.Fprintf(out, "%d stale entries, %s\n", len(report.Stale), formatBytes(report.StaleBytes))
+		fmt.Fprintln(out, "Nothing was pruned: the engine can only prune its whole cache, shared with other Dagger projects.")
+		return nil
+	},
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	gcCmd.Flags().DurationVar(&gcMaxUnused, "max-unused", 7*24*time.Hour, "Consider cache entries unused for this long stale (0 to only report the caches of deleted environments)")
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var githubCmd = &cobra.Command{
+	Use:   "github",
+	Short: "GitHub integration",
+}
+
+var githubCommentCmd = &cobra.Command{
+	Use:   "comment <env> <pr-or-issue-number>",
+	Short: "Post a summary of an environment on a pull request or issue",
+	Long: `Post the commands run, the test results and the diff stats of an environment
+as a comment on a GitHub pull request or issue.
+
+The repository is derived from the origin remote unless --repo is set.
+A token must be provided in GITHUB_TOKEN or GH_TOKEN.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		number, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid pull request or issue number %q", args[1])
+		}
+		repo, _ := app.Flags().GetString("repo")
+		if repo == "" {
+			if repo, err = environment.GitHubRepository(ctx, "."); err != nil {
+				return err
+			}
+		}
+
+		summary, err := environment.Summarize(ctx, ".", args[0])
+		if err != nil {
+			return err
+		}
+		url, err := environment.PostGitHubComment(ctx, repo, number, summary.Markdown())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(app.OutOrStdout(), "Posted %s\n", url)
+		return nil
+	},
+}
+
+func init() {
+	githubCommentCmd.Flags().String("repo", "", "GitHub repository (owner/name)")
+	githubCmd.AddCommand(githubCommentCmd)
+	rootCmd.AddCommand(githubCmd)
+}
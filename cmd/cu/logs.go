@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <env>",
+	Short: "Show the log of an environment",
+	Long:  `Print the command output and operation log recorded for an environment.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		logPath, err := environment.LogPath(args[0])
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(logPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("no logs found for environment '%s'", args[0])
+			}
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(app.OutOrStdout(), f)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+}
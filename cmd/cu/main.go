@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,14 +11,17 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/mcpserver"
+	"github.com/dagger/container-use/telemetry"
 	"github.com/spf13/cobra"
 )
 
-var dag *dagger.Client
+// version is the version of cu, set at build time with -ldflags "-X main.version=v0.4.2".
+var version = "dev"
 
 func dumpStacks() {
 	buf := make([]byte, 1<<20) // 1MB buffer
@@ -41,21 +45,140 @@ var (
 
 			slog.Info("connecting to dagger")
 
-			var err error
-			dag, err = dagger.Connect(ctx, dagger.WithLogOutput(logWriter))
+			dag, envs, err := connectDagger(ctx, logWriter)
 			if err != nil {
 				slog.Error("Error starting dagger", "error", err)
 				os.Exit(1)
 			}
 			defer dag.Close()
+			defer shutdown(envs)
+			recoverEnvironments(ctx, envs)
+			reapIdle(app, envs)
+			prewarm(app, envs)
+			sendTelemetry(ctx)
+			checkPinnedVersion(".")
+
+			policy, err := loadPolicy(app)
+			if err != nil {
+				return err
+			}
 
-			environment.Initialize(dag)
-			return mcpserver.RunStdioServer(ctx)
+			client, _ := app.Flags().GetString("client")
+			return mcpserver.RunStdioServer(ctx, envs, policy, client)
 		},
 	}
 )
 
+// connectDagger connects to the Dagger engine and creates the environment
+// client using it. If the engine isn't supported, a compatible one is
+// provisioned instead, unless the session was set up by `dagger run`.
+func connectDagger(ctx context.Context, logOutput io.Writer) (*dagger.Client, *environment.Client, error) {
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(logOutput))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to dagger: %w", err)
+	}
+	envs, err := environment.NewClient(ctx, client, environment.ClientOptions{})
+	var versionErr *environment.EngineVersionError
+	if errors.As(err, &versionErr) && os.Getenv("DAGGER_SESSION_PORT") == "" {
+		client.Close()
+		slog.Warn("Provisioning a compatible Dagger engine", "unsupported", versionErr.Version, "engine", environment.CompatibleEngine)
+		client, err = dagger.Connect(ctx, dagger.WithLogOutput(logOutput), dagger.WithRunnerHost(environment.CompatibleEngine))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to dagger: %w", err)
+		}
+		envs, err = environment.NewClient(ctx, client, environment.ClientOptions{})
+	}
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, envs, nil
+}
+
+// shutdownTimeout bounds how long in-flight operations may take to complete on exit.
+const shutdownTimeout = 30 * time.Second
+
+// shutdown waits for the in-flight environment operations to complete, so
+// their commits and notes are written before the Dagger client is closed.
+func shutdown(envs *environment.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := envs.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down cleanly", "err", err)
+	}
+	telemetry.Flush()
+}
+
+// sendTelemetry sends the usage counts of the past days in the background, when telemetry is on.
+func sendTelemetry(ctx context.Context) {
+	go func() {
+		if err := telemetry.Send(ctx); err != nil {
+			slog.Warn("Failed to send telemetry", "err", err)
+		}
+	}()
+}
+
+// recoverEnvironments registers the environments left on disk by previous runs.
+func recoverEnvironments(ctx context.Context, envs *environment.Client) {
+	recovered, err := envs.Recover(ctx)
+	if err != nil {
+		slog.Warn("Failed to recover environments", "err", err)
+		return
+	}
+	if len(recovered) > 0 {
+		slog.Info("Recovered environments", "count", len(recovered))
+	}
+}
+
+// reapIdle starts reaping the idle environments when the --idle-timeout flag is set.
+func reapIdle(app *cobra.Command, envs *environment.Client) {
+	idleTimeout, _ := app.Flags().GetDuration("idle-timeout")
+	if idleTimeout <= 0 {
+		return
+	}
+	go func() {
+		if err := envs.ReapIdle(app.Context(), idleTimeout); err != nil {
+			slog.Error("Failed to reap idle environments", "err", err)
+		}
+	}()
+}
+
+// loadPolicy loads the tool authorization policy set with the --policy flag.
+func loadPolicy(app *cobra.Command) (*mcpserver.Policy, error) {
+	policyPath, _ := app.Flags().GetString("policy")
+	if policyPath == "" {
+		var err error
+		if policyPath, err = mcpserver.DefaultPolicyPath(); err != nil {
+			return nil, err
+		}
+	}
+	return mcpserver.LoadPolicy(policyPath)
+}
+
+// prewarm starts pre-warming the environment container of the current
+// repository when the --prewarm flag is set.
+func prewarm(app *cobra.Command, envs *environment.Client) {
+	if enabled, _ := app.Flags().GetBool("prewarm"); !enabled {
+		return
+	}
+	if err := envs.Prewarm(app.Context(), "."); err != nil {
+		slog.Warn("Failed to pre-warm environment container", "err", err)
+	}
+}
+
 func init() {
+	rootCmd.Version = version
+	telemetry.Version = version
+
+	stdioCmd.Flags().Bool("prewarm", false, "Provision the environment container of the current repository in the background so new environments start instantly")
+	stdioCmd.Flags().Duration("idle-timeout", 0, "Stop the containers of environments idle for this long, provisioning them again on their next use (disabled by default)")
+	stdioCmd.Flags().String("policy", "", "Path to the tool authorization policy (default ~/.config/container-use/policy.json)")
+	stdioCmd.Flags().String("client", "", "Identity of the client the policy applies to, e.g. the name of its entry in the policy")
+	terminalCmd.Flags().String("shell", "", "Shell to open: sh, bash, zsh or fish (default from ~/.config/container-use/terminal.json, or sh)")
+	terminalCmd.Flags().Bool("ephemeral", false, "Open a new terminal rather than attaching to the persistent terminal session")
+	terminalCmd.Flags().Bool("view-only", false, "Watch the persistent terminal session without typing in it")
+	terminalCmd.Flags().String("dotfiles", "", "Git repository or directory of dotfiles to install before opening the terminal")
+
 	rootCmd.AddCommand(
 		stdioCmd,
 		terminalCmd,
@@ -78,6 +201,11 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	go func() {
+		// Restore the default behavior so a second signal exits immediately.
+		<-ctx.Done()
+		stop()
+	}()
 
 	if err := setupLogger(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to setup logger: %v\n", err)
@@ -6,18 +6,40 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/dagger/container-use/environment"
 	"github.com/spf13/cobra"
 )
 
+var mergeSquash bool
+
 var mergeCmd = &cobra.Command{
 	Use:   "merge <env>",
 	Short: "Merges an environment into the current git branch",
-	Args:  cobra.ExactArgs(1),
+	Long: `Merges an environment into the current git branch.
+
+With --squash, all the commits of the environment are combined into a single
+commit whose message summarizes the environment's history.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(app *cobra.Command, args []string) error {
 		env := args[0]
 		// prevent accidental single quotes to mess up command
 		env = strings.Trim(env, "'")
-		cmd := exec.CommandContext(app.Context(), "bash", "-c", fmt.Sprintf("git stash --include-untracked -q && git merge -m 'Merge environment %s' -- %q && ( git stash pop -q 2>/dev/null )", env, "container-use/"+env))
+		branch := "container-use/" + env
+
+		merge := fmt.Sprintf("git merge -m 'Merge environment %s' -- %q", env, branch)
+		var message string
+		if mergeSquash {
+			var err error
+			message, err = squashMessage(app, env, branch)
+			if err != nil {
+				return err
+			}
+			// Record what was squashed, so the environment's commits count as merged.
+			merge = fmt.Sprintf(`git merge --squash -q -- %q && git commit -q -m "$CU_MERGE_MESSAGE" && git update-ref %q %q`, branch, environment.SquashedRef(env), branch)
+		}
+
+		cmd := exec.CommandContext(app.Context(), "bash", "-c", fmt.Sprintf("git stash --include-untracked -q && %s && ( git stash pop -q 2>/dev/null )", merge))
+		cmd.Env = append(os.Environ(), "CU_MERGE_MESSAGE="+message)
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
 
@@ -25,6 +47,28 @@ var mergeCmd = &cobra.Command{
 	},
 }
 
+// squashMessage builds the message of a squashed merge from the subjects of the
+// environment's commits that aren't in the current branch yet.
+func squashMessage(app *cobra.Command, env, branch string) (string, error) {
+	out, err := exec.CommandContext(app.Context(), "git", "log", "--reverse", "--format=%s", "HEAD.."+branch).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the history of %s: %w", branch, err)
+	}
+
+	subjects := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(subjects) == 1 && subjects[0] == "" {
+		return "", fmt.Errorf("environment '%s' has nothing to merge", env)
+	}
+
+	message := &strings.Builder{}
+	fmt.Fprintf(message, "Merge environment %s (%d changes)\n\n", env, len(subjects))
+	for _, subject := range subjects {
+		fmt.Fprintf(message, "- %s\n", subject)
+	}
+	return message.String(), nil
+}
+
 func init() {
+	mergeCmd.Flags().BoolVar(&mergeSquash, "squash", false, "Squash the environment's commits into a single commit")
 	rootCmd.AddCommand(mergeCmd)
 }
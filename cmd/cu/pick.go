@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var pickCmd = &cobra.Command{
+	Use:   "pick <env> [<commit>...]",
+	Short: "Apply selected commits of an environment to the current git branch",
+	Long: `Cherry-pick selected commits of an environment into the current git branch.
+
+Without commits, list the commits of the environment that can be picked.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+		// prevent accidental single quotes to mess up command
+		env := strings.Trim(args[0], "'")
+
+		if len(args) == 1 {
+			commits, err := environment.UnpickedCommits(ctx, ".", env)
+			if err != nil {
+				return err
+			}
+			if len(commits) == 0 {
+				fmt.Fprintf(app.OutOrStdout(), "Environment '%s' has no commits to pick.\n", env)
+				return nil
+			}
+			for _, commit := range commits {
+				fmt.Fprintf(app.OutOrStdout(), "%s %s\n", commit.Hash[:12], commit.Subject)
+			}
+			return nil
+		}
+
+		if err := environment.CherryPick(ctx, ".", env, args[1:]); err != nil {
+			return err
+		}
+		fmt.Fprintf(app.OutOrStdout(), "Picked %d commits from environment '%s'.\n", len(args)-1, env)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pickCmd)
+}
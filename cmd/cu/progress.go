@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"golang.org/x/term"
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// withSpinner returns a context rendering the stages of the environment
+// operations run with it on stderr: as a spinner on a terminal, as lines
+// otherwise. The returned function clears the spinner.
+func withSpinner(ctx context.Context) (context.Context, func()) {
+	out := os.Stderr
+	if !term.IsTerminal(int(out.Fd())) {
+		return environment.WithProgressEvents(ctx, func(event environment.ProgressEvent) {
+			fmt.Fprintln(out, event)
+		}), func() {}
+	}
+
+	var (
+		mu      sync.Mutex
+		current string
+		started = time.Now()
+	)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			select {
+			case <-done:
+				fmt.Fprint(out, "\r\033[K")
+				return
+			case <-ticker.C:
+				mu.Lock()
+				line := current
+				mu.Unlock()
+				if line != "" {
+					fmt.Fprintf(out, "\r\033[K%s %s (%s)", spinnerFrames[frame%len(spinnerFrames)], line, time.Since(started).Round(time.Second))
+				}
+			}
+		}
+	}()
+	ctx = environment.WithProgressEvents(ctx, func(event environment.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		line := []rune(strings.ReplaceAll(event.String(), "\n", " "))
+		if width, _, err := term.GetSize(int(out.Fd())); err == nil && width > 20 && len(line) > width-20 {
+			line = append(line[:width-21], '…')
+		}
+		current = string(line)
+	})
+	return ctx, func() {
+		close(done)
+		<-stopped
+	}
+}
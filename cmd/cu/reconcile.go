@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var reconcileDryRun bool
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Repair orphaned environment worktrees and branches",
+	Long: `Scan the container-use repositories and worktrees for inconsistencies left
+behind by interrupted operations (orphaned worktrees, branches without a
+worktree, stale worktree registrations) and repair them. Worktrees are never
+removed: the ones in the way are moved to ~/.config/container-use/trash/worktrees.`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		actions, err := environment.Reconcile(app.Context(), reconcileDryRun)
+		if err != nil {
+			return err
+		}
+		if len(actions) == 0 {
+			fmt.Fprintln(app.OutOrStdout(), "Nothing to repair.")
+			return nil
+		}
+		for _, action := range actions {
+			fmt.Fprintln(app.OutOrStdout(), action)
+		}
+		if reconcileDryRun {
+			fmt.Fprintln(app.OutOrStdout(), "Dry run: nothing was changed.")
+		}
+		return nil
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().BoolVar(&reconcileDryRun, "dry-run", false, "Only report the repairs that would be made")
+	rootCmd.AddCommand(reconcileCmd)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [<env>]",
+	Short: "Restore a deleted environment",
+	Long: `Restore an environment deleted with cu delete.
+
+Deleted environments are kept for 7 days (set CONTAINER_USE_TRASH_DAYS to
+change it). Without arguments, list the environments that can be restored.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		if len(args) == 0 {
+			trash, err := environment.ListTrash()
+			if err != nil {
+				return err
+			}
+			if len(trash) == 0 {
+				fmt.Fprintln(app.OutOrStdout(), "No deleted environments.")
+				return nil
+			}
+			tw := tabwriter.NewWriter(app.OutOrStdout(), 0, 0, 3, ' ', 0)
+			fmt.Fprintln(tw, "ID\tSOURCE\tDELETED\tEXPIRES")
+			for _, trashed := range trash {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", trashed.ID, trashed.Source, trashed.DeletedAt.Format(time.DateTime), trashed.ExpiresAt.Format(time.DateTime))
+			}
+			return tw.Flush()
+		}
+
+		trashed, err := environment.RestoreDeleted(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(app.OutOrStdout(), "Environment '%s' restored in %s.\n", trashed.ID, trashed.Source)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
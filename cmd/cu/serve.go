@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dagger/container-use/apiserver"
+	"github.com/dagger/container-use/mcpserver"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Start an HTTP (SSE) server shared by several clients",
+	Long: `Start an MCP server over HTTP with server-sent events.
+
+Several clients (e.g. a planner agent and a coder agent) can connect to the
+same server and attach to the same environments with environment_attach.
+Their operations are applied one at a time and attributed to each client.
+The policy applies to clients according to the bearer token they send, see
+the tokens of the policy: clients can't choose their identity.
+
+With --daemon, the server keeps the environment containers of the --repo
+repositories pre-warmed, provisioning them again whenever their configuration
+or dependencies change, so new environments start instantly.`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+
+		slog.Info("connecting to dagger")
+		dag, envs, err := connectDagger(ctx, logWriter)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		defer shutdown(envs)
+		recoverEnvironments(ctx, envs)
+		reapIdle(app, envs)
+		sendTelemetry(ctx)
+		checkPinnedVersion(".")
+		if daemon, _ := app.Flags().GetBool("daemon"); daemon {
+			repos, _ := app.Flags().GetStringSlice("repo")
+			interval, _ := app.Flags().GetDuration("watch-interval")
+			go func() {
+				if err := envs.Watch(ctx, repos, interval); err != nil {
+					slog.Error("Failed to watch repositories", "err", err)
+				}
+			}()
+		} else {
+			prewarm(app, envs)
+		}
+
+		policy, err := loadPolicy(app)
+		if err != nil {
+			return err
+		}
+
+		// The API is subject to the policy as well.
+		mcpserver.SetPolicy(policy)
+		if apiAddr, _ := app.Flags().GetString("api-addr"); apiAddr != "" {
+			go func() {
+				if err := apiserver.Run(ctx, envs, apiAddr); err != nil {
+					slog.Error("API server failed", "err", err)
+				}
+			}()
+			fmt.Fprintf(app.ErrOrStderr(), "Serving API on http://%s/v1\n", apiAddr)
+		}
+
+		addr, _ := app.Flags().GetString("addr")
+		fmt.Fprintf(app.ErrOrStderr(), "Serving MCP on http://%s/sse\n", addr)
+		return mcpserver.RunSSEServer(ctx, envs, policy, addr)
+	},
+}
+
+func init() {
+	serveCmd.Flags().String("addr", "localhost:8765", "Address to listen on")
+	serveCmd.Flags().Bool("prewarm", false, "Provision the environment container of the current repository in the background so new environments start instantly")
+	serveCmd.Flags().String("api-addr", "", "Address to serve the HTTP control API on, authenticated with $"+apiserver.TokenEnv+" (disabled by default)")
+	serveCmd.Flags().Bool("daemon", false, "Keep the environment containers of the watched repositories pre-warmed")
+	serveCmd.Flags().StringSlice("repo", []string{"."}, "Repository to watch in daemon mode (repeatable)")
+	serveCmd.Flags().Duration("watch-interval", 30*time.Second, "How often daemon mode checks the repositories for changes")
+	serveCmd.Flags().Duration("idle-timeout", 0, "Stop the containers of environments idle for this long, provisioning them again on their next use (disabled by default)")
+	serveCmd.Flags().String("policy", "", "Path to the tool authorization policy (default ~/.config/container-use/policy.json)")
+	rootCmd.AddCommand(serveCmd)
+}
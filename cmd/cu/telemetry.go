@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dagger/container-use/telemetry"
+	"github.com/spf13/cobra"
+)
+
+var telemetryCmd = &cobra.Command{
+	Use:   "telemetry",
+	Short: "Manage anonymous usage telemetry",
+	Long: `Show whether anonymous usage telemetry is enabled.
+
+Telemetry is off by default. When enabled, container-use counts how many
+environments are created, commands run and tools called, along with the
+categories of failures (e.g. build, command_exit, permission). It never
+records names, paths, commands or their output. Inspect what is recorded
+with cu telemetry show.
+
+Set ` + telemetry.ModeEnv + `=off, or DO_NOT_TRACK=1, to disable telemetry regardless
+of the configuration.`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		cfg, err := telemetry.LoadConfig()
+		if err != nil {
+			return err
+		}
+		out := app.OutOrStdout()
+		fmt.Fprintf(out, "Mode: %s\n", telemetry.EffectiveMode(cfg))
+		if cfg.Endpoint != "" {
+			fmt.Fprintf(out, "Endpoint: %s\n", cfg.Endpoint)
+		}
+		if cfg.InstallationID != "" {
+			fmt.Fprintf(out, "Installation ID: %s\n", cfg.InstallationID)
+		}
+		return nil
+	},
+}
+
+var telemetryOnCmd = &cobra.Command{
+	Use:   "on --endpoint <url>",
+	Short: "Record usage counts and send them daily to the endpoint",
+	Args:  cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		endpoint, _ := app.Flags().GetString("endpoint")
+		return setTelemetryMode(app, telemetry.ModeOn, endpoint)
+	},
+}
+
+var telemetryLocalCmd = &cobra.Command{
+	Use:   "local",
+	Short: "Record usage counts on this machine only",
+	Args:  cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		return setTelemetryMode(app, telemetry.ModeLocal, "")
+	},
+}
+
+var telemetryOffCmd = &cobra.Command{
+	Use:   "off",
+	Short: "Stop recording usage counts and delete the ones recorded",
+	Args:  cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		if err := setTelemetryMode(app, telemetry.ModeOff, ""); err != nil {
+			return err
+		}
+		return telemetry.Purge()
+	},
+}
+
+var telemetryShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the usage counts recorded on this machine",
+	Long:  `Print the usage counts recorded on this machine, by day, exactly as they would be sent.`,
+	Args:  cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		cfg, err := telemetry.LoadConfig()
+		if err != nil {
+			return err
+		}
+		reports, err := telemetry.Reports(cfg)
+		if err != nil {
+			return err
+		}
+		if reports == nil {
+			reports = []*telemetry.Report{}
+		}
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(app.OutOrStdout(), string(data))
+		return nil
+	},
+}
+
+func setTelemetryMode(app *cobra.Command, mode telemetry.Mode, endpoint string) error {
+	cfg, err := telemetry.LoadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Mode = mode
+	if endpoint != "" {
+		cfg.Endpoint = endpoint
+	}
+	if err := telemetry.SaveConfig(cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(app.OutOrStdout(), "Telemetry is %s\n", mode)
+	return nil
+}
+
+func init() {
+	telemetryOnCmd.Flags().String("endpoint", "", "URL the daily usage counts are posted to (default to the configured endpoint)")
+	telemetryCmd.AddCommand(telemetryOnCmd, telemetryLocalCmd, telemetryOffCmd, telemetryShowCmd)
+	rootCmd.AddCommand(telemetryCmd)
+}
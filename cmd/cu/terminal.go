@@ -8,7 +8,6 @@ import (
 	"os/exec"
 	"syscall"
 
-	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
 	"github.com/spf13/cobra"
 )
@@ -16,11 +15,31 @@ import (
 var terminalCmd = &cobra.Command{
 	Use:   "terminal <env>",
 	Short: "Drop a terminal into an environment",
-	Long:  `Create a container with the same state as the agent for a given branch or commmit.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `Create a container with the same state as the agent for a given branch or commmit.
+
+If the agent started a persistent terminal session in the environment, attach
+to it instead: detach with ctrl-b d, or after a disconnection, and run cu
+terminal again to reattach with the scrollback intact. With --view-only, only
+watch the session without typing in it.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(app *cobra.Command, args []string) error {
 		ctx := app.Context()
 
+		viewOnly, _ := app.Flags().GetBool("view-only")
+		if ephemeral, _ := app.Flags().GetBool("ephemeral"); !ephemeral {
+			session, err := environment.LoadTerminalSession(args[0])
+			if err != nil {
+				return err
+			}
+			if session != nil {
+				return session.AttachTerminal(os.Stdin, os.Stdout, viewOnly)
+			}
+		}
+
+		if viewOnly {
+			return fmt.Errorf("environment %s has no terminal session to watch", args[0])
+		}
+
 		// FIXME(aluzzardi): This is a hack to make sure we're wrapped in `dagger run` since `Terminal()` only works with the CLI.
 		// If not, it will auto-wrap this command in a `dagger run`.
 		if _, ok := os.LookupEnv("DAGGER_SESSION_TOKEN"); !ok {
@@ -34,19 +53,31 @@ var terminalCmd = &cobra.Command{
 			return syscall.Exec(daggerBin, append([]string{"dagger", "run"}, os.Args...), os.Environ())
 		}
 
-		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+		dag, envs, err := connectDagger(ctx, os.Stderr)
 		if err != nil {
 			slog.Error("Error starting dagger", "error", err)
 			os.Exit(1)
 		}
 		defer dag.Close()
-		environment.Initialize(dag)
 
-		env, err := environment.Open(ctx, "opening terminal", ".", args[0])
+		openCtx, stopSpinner := withSpinner(ctx)
+		env, err := envs.OpenFromSource(openCtx, "opening terminal", ".", args[0])
+		stopSpinner()
 		if err != nil {
 			return err
 		}
 
-		return env.Terminal(ctx)
+		cfg, err := environment.LoadTerminalConfig()
+		if err != nil {
+			return err
+		}
+		if shell, _ := app.Flags().GetString("shell"); shell != "" {
+			cfg.Shell = shell
+		}
+		if dotfiles, _ := app.Flags().GetString("dotfiles"); dotfiles != "" {
+			cfg.Dotfiles = dotfiles
+		}
+
+		return env.Terminal(ctx, cfg)
 	},
 }
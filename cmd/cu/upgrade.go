@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/spf13/cobra"
+)
+
+// releasesURLEnv overrides where releases are downloaded from, e.g. an
+// internal mirror laid out as GitHub releases.
+const releasesURLEnv = "CONTAINER_USE_RELEASES_URL"
+
+const defaultReleasesURL = "https://github.com/dagger/container-use/releases"
+
+// releasePublicKey is the base64 Ed25519 public key release checksums are
+// signed with, set at build time with -ldflags "-X main.releasePublicKey=..."
+// by hack/release.sh, which signs the checksums.
+var releasePublicKey = ""
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade [<version>]",
+	Short: "Upgrade cu to the latest, or pinned, release",
+	Long: fmt.Sprintf(`Download the release of cu for this platform, verify it against the signed
+checksums of the release, and replace the running binary with it.
+
+The version installed is, in order: the version given, the version the
+repository in the current directory pins with cu_version in %s, or the
+latest release. Pinning a version lets teams keep every machine on a
+compatible version of cu, including downgrading when needed.
+
+Releases are downloaded from GitHub, or from $%s.`, environment.RepoConfigFile, releasesURLEnv),
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+		out := app.OutOrStdout()
+		checkOnly, _ := app.Flags().GetBool("check")
+		skipSignature, _ := app.Flags().GetBool("skip-signature")
+
+		target, source, err := upgradeTarget(ctx, args)
+		if err != nil {
+			return err
+		}
+		if normalizeVersion(target) == normalizeVersion(version) {
+			fmt.Fprintf(out, "cu %s is up to date (%s)\n", version, source)
+			return nil
+		}
+		if checkOnly {
+			fmt.Fprintf(out, "cu %s is available (%s), running %s\n", target, source, version)
+			return nil
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if executable, err = filepath.EvalSymlinks(executable); err != nil {
+			return err
+		}
+		binary, err := downloadRelease(ctx, target, skipSignature)
+		if err != nil {
+			return err
+		}
+		if err := replaceExecutable(executable, binary); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Upgraded cu from %s to %s (%s)\n", version, target, source)
+		return nil
+	},
+}
+
+// upgradeTarget returns the version to install and where it comes from.
+func upgradeTarget(ctx context.Context, args []string) (string, string, error) {
+	if len(args) == 1 {
+		return normalizeVersion(args[0]), "requested", nil
+	}
+	if pinned, err := pinnedVersion("."); err != nil {
+		return "", "", err
+	} else if pinned != "" {
+		return pinned, "pinned in " + environment.RepoConfigFile, nil
+	}
+	latest, err := latestRelease(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return latest, "latest", nil
+}
+
+// pinnedVersion returns the version of cu pinned by the repository at dir, if any.
+func pinnedVersion(dir string) (string, error) {
+	cfg, err := environment.LoadRepoConfig(dir)
+	if err != nil || cfg == nil || cfg.CUVersion == "" {
+		return "", err
+	}
+	return normalizeVersion(cfg.CUVersion), nil
+}
+
+// checkPinnedVersion warns when the repository at dir pins another version of cu than the one running.
+func checkPinnedVersion(dir string) {
+	pinned, err := pinnedVersion(dir)
+	if err != nil || pinned == "" || pinned == normalizeVersion(version) {
+		return
+	}
+	slog.Warn("This repository pins another version of cu, run `cu upgrade` to install it", "pinned", pinned, "running", version)
+}
+
+func normalizeVersion(v string) string {
+	if v == "" || v == "dev" || strings.HasPrefix(v, "v") {
+		return v
+	}
+	return "v" + v
+}
+
+func releasesURL() string {
+	if url := os.Getenv(releasesURLEnv); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return defaultReleasesURL
+}
+
+// latestRelease returns the version of the latest release, which releases/latest redirects to.
+func latestRelease(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, releasesURL()+"/latest", nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the latest release: %w", err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("failed to find the latest release: %s", resp.Status)
+	}
+	return normalizeVersion(path.Base(location)), nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// downloadRelease returns the cu binary of release for this platform, once
+// its archive matches the checksums of the release and they are signed.
+func downloadRelease(ctx context.Context, release string, skipSignature bool) ([]byte, error) {
+	base := fmt.Sprintf("%s/download/%s/", releasesURL(), release)
+	archiveName := fmt.Sprintf("container-use_%s_%s_%s.tar.gz", release, runtime.GOOS, runtime.GOARCH)
+
+	checksums, err := download(ctx, base+"checksums.txt")
+	if err != nil {
+		return nil, err
+	}
+	if skipSignature {
+		slog.Warn("Skipping the verification of the release signature")
+	} else {
+		signature, err := download(ctx, base+"checksums.txt.sig")
+		if err != nil {
+			return nil, err
+		}
+		if err := verifySignature(checksums, signature); err != nil {
+			return nil, err
+		}
+	}
+	expected, err := lookupChecksum(checksums, archiveName)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := download(ctx, base+archiveName)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(archive)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", archiveName, expected, actual)
+	}
+	return extractBinary(archive, "cu")
+}
+
+// verifySignature checks that signature, base64-encoded, is the signature of checksums by releasePublicKey.
+func verifySignature(checksums, signature []byte) error {
+	if releasePublicKey == "" {
+		return errors.New("this build of cu has no release signing key to verify releases with, use --skip-signature to only verify checksums")
+	}
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid release signing key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid release signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), checksums, sig) {
+		return errors.New("the checksums of the release are not signed by the release signing key")
+	}
+	return nil
+}
+
+// lookupChecksum returns the SHA-256 of name in checksums, as written by sha256sum.
+func lookupChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no release for %s/%s: %s is not in the checksums", runtime.GOOS, runtime.GOARCH, name)
+}
+
+// extractBinary returns the file named name in the gzipped tar archive.
+func extractBinary(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in the release archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable atomically replaces the binary at executable with binary.
+func replaceExecutable(executable string, binary []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".cu-upgrade-")
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", executable, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", executable, err)
+	}
+	return nil
+}
+
+func init() {
+	upgradeCmd.Flags().Bool("check", false, "Only report whether another version would be installed")
+	upgradeCmd.Flags().Bool("skip-signature", false, "Install releases whose checksums are not signed, or can't be verified (not recommended)")
+	rootCmd.AddCommand(upgradeCmd)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestLookupChecksum(t *testing.T) {
+	checksums := []byte(`0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef  container-use_v0.4.2_linux_amd64.tar.gz
+FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210 *container-use_v0.4.2_darwin_arm64.tar.gz
+malformed line
+`)
+	tests := []struct {
+		name    string
+		archive string
+		want    string
+		wantErr bool
+	}{
+		{name: "text mode", archive: "container-use_v0.4.2_linux_amd64.tar.gz", want: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+		{name: "binary mode, upper case", archive: "container-use_v0.4.2_darwin_arm64.tar.gz", want: "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"},
+		{name: "missing", archive: "container-use_v0.4.2_windows_amd64.tar.gz", wantErr: true},
+		{name: "prefix of a name", archive: "container-use_v0.4.2_linux_amd64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupChecksum(checksums, tt.archive)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lookupChecksum() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupChecksum() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("lookupChecksum() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := []byte("0123456789abcdef  container-use_v0.4.2_linux_amd64.tar.gz\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, checksums)) + "\n")
+
+	tests := []struct {
+		name      string
+		key       string
+		checksums []byte
+		signature []byte
+		wantErr   bool
+	}{
+		{name: "valid", key: base64.StdEncoding.EncodeToString(public), checksums: checksums, signature: signature},
+		{name: "tampered checksums", key: base64.StdEncoding.EncodeToString(public), checksums: append([]byte("x"), checksums...), signature: signature, wantErr: true},
+		{name: "other key", key: base64.StdEncoding.EncodeToString(otherPublic), checksums: checksums, signature: signature, wantErr: true},
+		{name: "no key", key: "", checksums: checksums, signature: signature, wantErr: true},
+		{name: "invalid key", key: "bm90IGEga2V5", checksums: checksums, signature: signature, wantErr: true},
+		{name: "invalid signature", key: base64.StdEncoding.EncodeToString(public), checksums: checksums, signature: []byte("not base64!"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(key string) { releasePublicKey = key }(releasePublicKey)
+			releasePublicKey = tt.key
+			err := verifySignature(tt.checksums, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySignature() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
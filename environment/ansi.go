@@ -0,0 +1,64 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// ANSIMode tells whether the ANSI escape sequences, e.g. colors, of the
+// output of commands are kept.
+type ANSIMode string
+
+const (
+	// ANSIStrip removes escape sequences, which only waste the context of agents.
+	ANSIStrip ANSIMode = "strip"
+	// ANSIPreserve keeps escape sequences, for outputs displayed in a terminal.
+	ANSIPreserve ANSIMode = "preserve"
+)
+
+func (m ANSIMode) validate() error {
+	switch m {
+	case "", ANSIStrip, ANSIPreserve:
+		return nil
+	}
+	return fmt.Errorf("invalid ANSI mode %q: must be %s or %s", m, ANSIStrip, ANSIPreserve)
+}
+
+// ansiSequence matches CSI (e.g. colors, cursor moves), OSC (e.g. titles,
+// hyperlinks) and other two-character escape sequences.
+var ansiSequence = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// StripANSI removes the ANSI escape sequences of s.
+func StripANSI(s string) string {
+	return ansiSequence.ReplaceAllString(s, "")
+}
+
+type ansiModeKey struct{}
+
+// WithANSIMode returns a context in which Run returns the output of commands
+// with mode, instead of the ANSI mode of the environment.
+func WithANSIMode(ctx context.Context, mode ANSIMode) context.Context {
+	return context.WithValue(ctx, ansiModeKey{}, mode)
+}
+
+// ansiMode returns the ANSI mode of the outputs returned in ctx: the one set
+// with WithANSIMode, else the one of the environment, ANSIStrip by default.
+func (env *Environment) ansiMode(ctx context.Context) ANSIMode {
+	if mode, ok := ctx.Value(ansiModeKey{}).(ANSIMode); ok && mode != "" {
+		return mode
+	}
+	if env.ANSI != "" {
+		return env.ANSI
+	}
+	return ANSIStrip
+}
+
+// stripANSI returns output, as returned in ctx: without escape sequences
+// unless the ANSI mode is ANSIPreserve. The audit log keeps the output as is.
+func (env *Environment) stripANSI(ctx context.Context, output string) string {
+	if env.ansiMode(ctx) == ANSIStrip {
+		return StripANSI(output)
+	}
+	return output
+}
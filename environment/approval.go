@@ -0,0 +1,268 @@
+package environment
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// ApprovalTimeoutEnv overrides the number of minutes operations wait for a human approval.
+	ApprovalTimeoutEnv = "CONTAINER_USE_APPROVAL_TIMEOUT"
+
+	defaultApprovalTimeout = 15 * time.Minute
+)
+
+// ApprovalRequest is an operation paused until a human approves or denies it with cu approve.
+type ApprovalRequest struct {
+	ID          string    `json:"id"`
+	Environment string    `json:"environment"`
+	Source      string    `json:"source"`
+	Client      string    `json:"client,omitempty"`
+	Command     string    `json:"command"`
+	Reason      string    `json:"reason,omitempty"`
+	Explanation string    `json:"explanation,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// ApprovalDecision is the answer of a human to an ApprovalRequest.
+type ApprovalDecision struct {
+	Approved bool `json:"approved"`
+	// Approver is the user owning the decision file, set when it's read: the
+	// decision doesn't get to say who made it.
+	Approver string `json:"-"`
+	// Terminal is the terminal the decision was typed in.
+	Terminal  string    `json:"terminal"`
+	Comment   string    `json:"comment,omitempty"`
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+func approvalsDir() (string, error) {
+	return homedir.Expand("~/.config/container-use/approvals")
+}
+
+func approvalPaths(id string) (request, decision string, err error) {
+	dir, err := approvalsDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, id+".json"), filepath.Join(dir, id+".decision.json"), nil
+}
+
+func approvalTimeout() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv(ApprovalTimeoutEnv)); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultApprovalTimeout
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write then rename, so the waiting operation never reads a partial file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// PendingApprovals returns the operations waiting for a human decision, oldest first.
+func PendingApprovals() ([]ApprovalRequest, error) {
+	dir, err := approvalsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	pending := []ApprovalRequest{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || strings.HasSuffix(id, ".decision") {
+			continue
+		}
+		request, err := GetApproval(id)
+		if err != nil {
+			return nil, err
+		}
+		_, decisionPath, _ := approvalPaths(id)
+		if _, err := os.Stat(decisionPath); err == nil {
+			continue
+		}
+		pending = append(pending, *request)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].RequestedAt.Before(pending[j].RequestedAt) })
+	return pending, nil
+}
+
+// GetApproval returns the pending approval request id.
+func GetApproval(id string) (*ApprovalRequest, error) {
+	requestPath, _, err := approvalPaths(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(requestPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("approval request %s not found: it may have been decided or timed out", id)
+		}
+		return nil, err
+	}
+	request := &ApprovalRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("invalid approval request %s: %w", id, err)
+	}
+	return request, nil
+}
+
+// DecideApproval approves or denies the pending approval request id, resuming
+// the paused operation. Approvals must have been typed in Terminal: cu approve
+// only approves in an interactive terminal, which the agents running
+// commands don't have.
+func DecideApproval(id string, decision ApprovalDecision) error {
+	if decision.Approved && decision.Terminal == "" {
+		return errors.New("approvals must be typed in an interactive terminal")
+	}
+	if _, err := GetApproval(id); err != nil {
+		return err
+	}
+	_, decisionPath, err := approvalPaths(id)
+	if err != nil {
+		return err
+	}
+	decision.DecidedAt = time.Now()
+	return writeJSON(decisionPath, decision)
+}
+
+// readDecision reads the decision at path, made by the user owning the file.
+func readDecision(path string) (*ApprovalDecision, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decision := &ApprovalDecision{}
+	if err := json.Unmarshal(data, decision); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("can't tell the owner of %s", path)
+	}
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	decision.Approver = "uid " + uid
+	if u, err := user.LookupId(uid); err == nil {
+		decision.Approver = u.Username
+	}
+	if decision.Terminal != "" {
+		decision.Approver += " on " + decision.Terminal
+	}
+	return decision, nil
+}
+
+// requestApproval pauses the command until a human decides on it with cu
+// approve, recording the decision in the audit log. action is the policy
+// action asking for it, CommandApprove or CommandConfirm. The lock of the
+// environment is released while waiting, see suspendLock.
+func (env *Environment) requestApproval(ctx context.Context, explanation, command, reason string, action CommandAction) error {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	request := ApprovalRequest{
+		ID:          hex.EncodeToString(id),
+		Environment: env.ID,
+		Source:      env.Source,
+		Client:      ClientInfoFromContext(ctx).String(),
+		Command:     env.redact(command),
+		Reason:      reason,
+		Explanation: explanation,
+		RequestedAt: time.Now(),
+	}
+	requestPath, decisionPath, err := approvalPaths(request.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(requestPath, request); err != nil {
+		return err
+	}
+	defer os.Remove(requestPath)
+	defer os.Remove(decisionPath)
+
+	reportProgress(ctx, "Waiting for approval of $ %s: run `cu approve %s`", command, request.ID)
+	env.logf("Waiting for approval of $ %s (cu approve %s)", command, request.ID)
+
+	resume := env.suspendLock(ctx)
+	decision, err := waitDecision(ctx, decisionPath)
+	if err := resume(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if decision == nil {
+		_ = env.addGitNote(ctx, fmt.Sprintf("approval: timed out $ %s\n\n", command))
+		return &CommandPolicyError{Command: command, Action: action, Reason: "no human approved it in time"}
+	}
+	comment := ""
+	if decision.Comment != "" {
+		comment = ": " + decision.Comment
+	}
+	if decision.Approved {
+		_ = env.addGitNote(ctx, fmt.Sprintf("approval: approved by %s $ %s%s\n\n", decision.Approver, command, comment))
+		return nil
+	}
+	_ = env.addGitNote(ctx, fmt.Sprintf("approval: denied by %s $ %s%s\n\n", decision.Approver, command, comment))
+	return &CommandPolicyError{Command: command, Action: action, Reason: "denied by " + decision.Approver + comment}
+}
+
+// waitDecision waits for the decision at path, returning nil if none was made
+// before the approval timeout. Approvals not typed in a terminal are ignored.
+func waitDecision(ctx context.Context, path string) (*ApprovalDecision, error) {
+	deadline := time.After(approvalTimeout())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, nil
+		case <-ticker.C:
+		}
+
+		decision, err := readDecision(path)
+		if err != nil || decision.Approved && decision.Terminal == "" {
+			continue
+		}
+		return decision, nil
+	}
+}
@@ -0,0 +1,68 @@
+package environment
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestReadDecision(t *testing.T) {
+	owner := "uid " + strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+
+	tests := []struct {
+		name         string
+		data         string
+		wantApproved bool
+		wantApprover string
+		wantErr      bool
+	}{
+		{
+			name:         "approved in a terminal",
+			data:         `{"approved": true, "terminal": "/dev/pts/3"}`,
+			wantApproved: true,
+			wantApprover: owner + " on /dev/pts/3",
+		},
+		{
+			name:         "approver is the owner of the file",
+			data:         `{"approved": true, "approver": "admin", "Approver": "admin", "terminal": "/dev/pts/3"}`,
+			wantApproved: true,
+			wantApprover: owner + " on /dev/pts/3",
+		},
+		{
+			name:         "denied without a terminal",
+			data:         `{"approved": false}`,
+			wantApprover: owner,
+		},
+		{
+			name:    "partial file",
+			data:    `{"approved": tr`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "decision.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			decision, err := readDecision(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readDecision() = %+v, want an error", decision)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readDecision() error = %v", err)
+			}
+			if decision.Approved != tt.wantApproved || decision.Approver != tt.wantApprover {
+				t.Errorf("readDecision() = approved %v by %q, want approved %v by %q", decision.Approved, decision.Approver, tt.wantApproved, tt.wantApprover)
+			}
+		})
+	}
+}
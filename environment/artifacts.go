@@ -0,0 +1,117 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/mitchellh/go-homedir"
+)
+
+// defaultArtifacts are the build outputs collected when no globs are given.
+var defaultArtifacts = []string{"dist/", "build/", "target/release/", "*.whl", "*.tar.gz"}
+
+// Artifacts copies the build outputs of the workdir matching globs (e.g.
+// "dist/", "target/release/app", "*.whl") to target on the host, without
+// committing them. target is a directory, or a .tar.gz/.tgz archive, relative
+// to the artifacts directory of the environment, see ArtifactsDir.
+// It returns the paths of the collected files, relative to the workdir.
+func (env *Environment) Artifacts(ctx context.Context, globs []string, target string) ([]string, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+	target, err := env.artifactsTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(globs) == 0 {
+		globs = defaultArtifacts
+	}
+	artifacts := env.container.Directory(env.Workdir).Filter(dagger.DirectoryFilterOpts{Include: globs})
+
+	files, err := artifacts.Glob(ctx, "**/*")
+	if err != nil {
+		return nil, err
+	}
+	// Directories are reported with a trailing slash.
+	files = slices.DeleteFunc(files, func(p string) bool { return strings.HasSuffix(p, "/") })
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no artifacts matching %s", strings.Join(globs, ", "))
+	}
+
+	reportProgress(ctx, "Exporting %d artifacts to %s", len(files), target)
+	if strings.HasSuffix(target, ".tar.gz") || strings.HasSuffix(target, ".tgz") {
+		archive := env.client.dag.Container().From(alpineImage).
+			WithMountedDirectory("/artifacts", artifacts).
+			WithExec([]string{"tar", "-czf", "/artifacts.tar.gz", "-C", "/artifacts", "."}).
+			File("/artifacts.tar.gz")
+		if _, err := archive.Export(ctx, target); err != nil {
+			return nil, err
+		}
+		return files, nil
+	}
+
+	if _, err := artifacts.Export(ctx, target); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// artifactsDir returns the host directory the artifacts of the environment are
+// copied to: ArtifactsDir, relative to the source repository, or
+// ~/.config/container-use/artifacts/<name>/<pet name>.
+func (env *Environment) artifactsDir() (string, error) {
+	if env.ArtifactsDir == "" {
+		dir, err := homedir.Expand("~/.config/container-use/artifacts")
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.FromSlash(env.ID)), nil
+	}
+	dir, err := homedir.Expand(env.ArtifactsDir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(env.Source, dir)
+	}
+	return dir, nil
+}
+
+// artifactsTarget resolves target, relative to the artifacts directory, to its
+// host path. Agents choose targets: they can't escape the artifacts directory,
+// be it with absolute paths, .. or symlinks.
+func (env *Environment) artifactsTarget(target string) (string, error) {
+	if !filepath.IsLocal(target) {
+		return "", fmt.Errorf("invalid artifacts target %q: must be a path relative to the artifacts directory, without ..", target)
+	}
+	root, err := env.artifactsDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, target)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(resolvedRoot, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid artifacts target %q: leads out of the artifacts directory", target)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("invalid artifacts target %q: is a symlink", target)
+	}
+	return path, nil
+}
@@ -0,0 +1,245 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditConfig enables the compliance mode of the audit log, making it tamper-evident.
+type AuditConfig struct {
+	// HashChain records each audit note with the hash of the previous entry,
+	// so that any change to the record breaks the chain. The entries are kept
+	// on their own ref, as a chain of commits, so rewriting or resetting the
+	// environment branch doesn't lose them.
+	HashChain bool `json:"hash_chain,omitempty" yaml:"hash_chain,omitempty"`
+	// AnchorEvery tags the audit log every AnchorEvery entries with
+	// the hash of the chain. Tags are signed if commits are.
+	AnchorEvery int `json:"anchor_every,omitempty" yaml:"anchor_every,omitempty"`
+}
+
+// AuditEntry is an entry of the hash chained audit log.
+type AuditEntry struct {
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Entry  string    `json:"entry"`
+	// Prev is the hash of the previous entry, empty for the first one.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of the entry, covering all of its fields but Hash.
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditTagPrefix returns the prefix of the tags anchoring the audit log of the environment id.
+func auditTagPrefix(id string) string {
+	return "container-use-audit/" + id + "/"
+}
+
+// auditRef returns the ref of the audit log of the environment id. Each entry
+// is a commit of the empty tree with the entry as message, whose parent is the
+// previous entry.
+func auditRef(id string) string {
+	return "refs/container-use-audit/" + id
+}
+
+// appendAuditEntry records note in the hash chained audit log, if enabled.
+func (env *Environment) appendAuditEntry(ctx context.Context, note string) error {
+	if env.Audit == nil || !env.Audit.HashChain || env.Worktree == "" {
+		return nil
+	}
+	env.auditMu.Lock()
+	defer env.auditMu.Unlock()
+
+	ref := auditRef(env.ID)
+	head, parent, err := auditHead(ctx, env.Worktree, ref)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	entry := AuditEntry{
+		Seq:    head.Seq + 1,
+		Time:   time.Now().UTC(),
+		Client: ClientInfoFromContext(ctx).String(),
+		Entry:  note,
+		Prev:   head.Hash,
+	}
+	entry.Hash = entry.computeHash()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tree, err := runGitCommand(ctx, env.Worktree, "hash-object", "-w", "-t", "tree", os.DevNull)
+	if err != nil {
+		return err
+	}
+	args := []string{"commit-tree", strings.TrimSpace(tree), "-m", string(data)}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	if author := env.author(ctx); author != nil {
+		args = append(author.args(), args...)
+	}
+	commit, err := runGitCommand(ctx, env.Worktree, args...)
+	if err != nil {
+		return err
+	}
+	commit = strings.TrimSpace(commit)
+	// Only move the ref from the entry the new one chains to.
+	if _, err := runGitCommand(ctx, env.Worktree, "update-ref", ref, commit, parent); err != nil {
+		return err
+	}
+
+	if env.Audit.AnchorEvery > 0 && entry.Seq%env.Audit.AnchorEvery == 0 {
+		if err := env.anchorAudit(ctx, entry, commit); err != nil {
+			return fmt.Errorf("failed to anchor audit log: %w", err)
+		}
+	}
+	_, err = runGitCommand(ctx, env.Source, "fetch", "container-use", ref+":"+ref)
+	return err
+}
+
+// anchorAudit tags commit, recording entry, with the hash of entry.
+func (env *Environment) anchorAudit(ctx context.Context, entry AuditEntry, commit string) error {
+	tag := auditTagPrefix(env.ID) + strconv.Itoa(entry.Seq)
+	args := []string{}
+	mode := "-a"
+	if signing := env.signingConfig(ctx); signing != nil {
+		args = signing.args()
+		mode = "-s"
+	}
+	args = append(args, "tag", mode, tag, "-m", fmt.Sprintf("audit seq=%d hash=%s", entry.Seq, entry.Hash), commit)
+	if _, err := runGitCommand(ctx, env.Worktree, args...); err != nil {
+		return err
+	}
+	_, err := runGitCommand(ctx, env.Source, "fetch", "container-use", "refs/tags/"+tag+":refs/tags/"+tag)
+	return err
+}
+
+// auditHead returns the last entry of the audit log at ref and its commit,
+// or an empty entry and commit if nothing has been recorded yet.
+func auditHead(ctx context.Context, dir, ref string) (AuditEntry, string, error) {
+	out, err := runGitCommand(ctx, dir, "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return AuditEntry{}, "", nil
+	}
+	commit := strings.TrimSpace(out)
+	message, err := runGitCommand(ctx, dir, "log", "-1", "--format=%B", commit)
+	if err != nil {
+		return AuditEntry{}, "", err
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(strings.TrimSpace(message)), &entry); err != nil {
+		return AuditEntry{}, "", fmt.Errorf("invalid audit entry on commit %s: %w", commit, err)
+	}
+	return entry, commit, nil
+}
+
+// auditLog returns the entries of the audit log at ref in the repository at dir, in order.
+func auditLog(ctx context.Context, dir, ref string) ([]AuditEntry, error) {
+	if _, err := runGitCommand(ctx, dir, "rev-parse", "--verify", "--quiet", ref); err != nil {
+		// No entry has been recorded yet.
+		return nil, nil
+	}
+	out, err := runGitCommand(ctx, dir, "log", "--reverse", "--first-parent", "--format=%H%x00%B%x00", ref)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(out, "\x00")
+	entries := []AuditEntry{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		commit := strings.TrimSpace(fields[i])
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(strings.TrimSpace(fields[i+1])), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit entry on commit %s: %w", commit, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AuditVerification is the result of VerifyAudit.
+type AuditVerification struct {
+	Entries int `json:"entries"`
+	Anchors int `json:"anchors"`
+	// Problems lists the evidence of tampering found, if any.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// verifyAuditChain checks the hash chain of entries, in order. It returns the
+// hashes of the entries by sequence number, and the evidence of tampering found.
+func verifyAuditChain(entries []AuditEntry) (map[int]string, []string) {
+	hashes := map[int]string{}
+	var problems []string
+	prev := AuditEntry{}
+	for _, entry := range entries {
+		if entry.Seq != prev.Seq+1 {
+			problems = append(problems, fmt.Sprintf("entry %d follows entry %d: entries are missing", entry.Seq, prev.Seq))
+		}
+		if entry.Prev != prev.Hash {
+			problems = append(problems, fmt.Sprintf("entry %d doesn't chain to the previous entry", entry.Seq))
+		}
+		if entry.computeHash() != entry.Hash {
+			problems = append(problems, fmt.Sprintf("entry %d was modified", entry.Seq))
+		}
+		hashes[entry.Seq] = entry.Hash
+		prev = entry
+	}
+	return hashes, problems
+}
+
+// VerifyAudit checks the hash chain of the audit log of the environment id and
+// its anchor tags, including their signature when they're signed.
+func VerifyAudit(ctx context.Context, id string) (*AuditVerification, error) {
+	worktreePath, err := (&Environment{ID: id}).GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := auditLog(ctx, worktreePath, auditRef(id))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AuditVerification{Entries: len(entries)}
+	hashes, problems := verifyAuditChain(entries)
+	result.Problems = problems
+
+	tags, err := runGitCommand(ctx, worktreePath, "tag", "--list", auditTagPrefix(id)+"*", "--format=%(refname:short) %(contents:subject)")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(tags), "\n") {
+		tag, message, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		result.Anchors++
+		var seq int
+		var hash string
+		if _, err := fmt.Sscanf(message, "audit seq=%d hash=%s", &seq, &hash); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("anchor %s is malformed", tag))
+			continue
+		}
+		if hashes[seq] != hash {
+			result.Problems = append(result.Problems, fmt.Sprintf("anchor %s doesn't match entry %d", tag, seq))
+		}
+		if signature, _ := runGitCommand(ctx, worktreePath, "cat-file", "-p", tag); strings.Contains(signature, "-----BEGIN") {
+			if _, err := runGitCommand(ctx, worktreePath, "tag", "-v", tag); err != nil {
+				result.Problems = append(result.Problems, fmt.Sprintf("anchor %s has an invalid signature", tag))
+			}
+		}
+	}
+	return result, nil
+}
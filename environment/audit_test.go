@@ -0,0 +1,92 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// auditChain returns a valid audit log of notes.
+func auditChain(notes ...string) []AuditEntry {
+	entries := []AuditEntry{}
+	prev := AuditEntry{}
+	for i, note := range notes {
+		entry := AuditEntry{
+			Seq:   i + 1,
+			Time:  time.Date(2025, 6, 1, 12, i, 0, 0, time.UTC),
+			Entry: note,
+			Prev:  prev.Hash,
+		}
+		entry.Hash = entry.computeHash()
+		entries = append(entries, entry)
+		prev = entry
+	}
+	return entries
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]AuditEntry) []AuditEntry
+		want    []string
+		wantLen int
+	}{
+		{
+			name:    "intact",
+			tamper:  func(entries []AuditEntry) []AuditEntry { return entries },
+			wantLen: 3,
+		},
+		{
+			name: "modified entry",
+			tamper: func(entries []AuditEntry) []AuditEntry {
+				entries[1].Entry = "$ true"
+				return entries
+			},
+			want:    []string{"entry 2 was modified"},
+			wantLen: 3,
+		},
+		{
+			name: "modified entry with its hash recomputed",
+			tamper: func(entries []AuditEntry) []AuditEntry {
+				entries[1].Entry = "$ true"
+				entries[1].Hash = entries[1].computeHash()
+				return entries
+			},
+			want:    []string{"entry 3 doesn't chain to the previous entry"},
+			wantLen: 3,
+		},
+		{
+			name: "removed entry",
+			tamper: func(entries []AuditEntry) []AuditEntry {
+				return append(entries[:1], entries[2:]...)
+			},
+			want:    []string{"entry 3 follows entry 1: entries are missing", "entry 3 doesn't chain to the previous entry"},
+			wantLen: 2,
+		},
+		{
+			name: "truncated start",
+			tamper: func(entries []AuditEntry) []AuditEntry {
+				return entries[1:]
+			},
+			want:    []string{"entry 2 follows entry 0: entries are missing", "entry 2 doesn't chain to the previous entry"},
+			wantLen: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := tt.tamper(auditChain("$ go build", "$ rm -rf /tmp/cache", "$ go test ./..."))
+			hashes, problems := verifyAuditChain(entries)
+			if !reflect.DeepEqual(problems, tt.want) {
+				t.Errorf("verifyAuditChain() problems = %q, want %q", problems, tt.want)
+			}
+			if len(hashes) != tt.wantLen {
+				t.Errorf("verifyAuditChain() returned %d hashes, want %d", len(hashes), tt.wantLen)
+			}
+			for _, entry := range entries {
+				if hashes[entry.Seq] != entry.Hash {
+					t.Errorf("hash of entry %d = %s, want %s", entry.Seq, hashes[entry.Seq], entry.Hash)
+				}
+			}
+		})
+	}
+}
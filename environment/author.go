@@ -0,0 +1,78 @@
+package environment
+
+import (
+	"context"
+)
+
+// GitAuthor is the identity used as author and committer of environment commits.
+type GitAuthor struct {
+	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
+	Email string `json:"email,omitempty" yaml:"email,omitempty"`
+}
+
+type clientKey struct{}
+
+// ClientInfo identifies the client (an MCP client, the API, a human) performing operations.
+type ClientInfo struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Session distinguishes several connections of the same client.
+	Session string `json:"session,omitempty"`
+	// Identity is the identity the server authenticated the client as, which
+	// unlike its name the client can't choose. It's empty if it isn't identified.
+	Identity string `json:"identity,omitempty"`
+}
+
+func (c ClientInfo) String() string {
+	s := c.Name
+	if c.Version != "" {
+		s += " " + c.Version
+	}
+	if c.Session != "" {
+		s += " (session " + c.Session + ")"
+	}
+	return s
+}
+
+// WithClient returns a context carrying the name of the MCP client performing the operations.
+func WithClient(ctx context.Context, client string) context.Context {
+	return WithClientInfo(ctx, ClientInfo{Name: client})
+}
+
+// WithClientInfo returns a context carrying the identity of the client performing the operations.
+func WithClientInfo(ctx context.Context, client ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the name of the MCP client set with WithClient, if any.
+func ClientFromContext(ctx context.Context) string {
+	return ClientInfoFromContext(ctx).Name
+}
+
+// ClientInfoFromContext returns the identity of the client set with WithClientInfo, if any.
+func ClientInfoFromContext(ctx context.Context) ClientInfo {
+	client, _ := ctx.Value(clientKey{}).(ClientInfo)
+	return client
+}
+
+// author returns the identity to commit as for the client in ctx, or nil to use
+// the git configuration.
+func (env *Environment) author(ctx context.Context) *GitAuthor {
+	if author, ok := env.ClientAuthors[ClientFromContext(ctx)]; ok && author != nil {
+		return author
+	}
+	return env.Author
+}
+
+// args returns the git arguments committing as the author.
+// They must come before the git subcommand.
+func (a *GitAuthor) args() []string {
+	args := []string{}
+	if a.Name != "" {
+		args = append(args, "-c", "user.name="+a.Name)
+	}
+	if a.Email != "" {
+		args = append(args, "-c", "user.email="+a.Email)
+	}
+	return args
+}
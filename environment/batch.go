@@ -0,0 +1,206 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Writes, i.e. FileWrite and FileDelete, made in a batch (see BeginBatch), or
+// less than CommitDebounce milliseconds apart, are committed together once
+// the batch ends or the writes stop. Any other operation commits the pending
+// writes along with its own change.
+
+// maxBatchSummaries is the number of changes summarized in the commit of a batch.
+const maxBatchSummaries = 3
+
+// pendingChange is a write not committed yet.
+type pendingChange struct {
+	change      change
+	explanation string
+}
+
+// deferrable returns whether the commit of c can be deferred.
+func (c change) deferrable() bool {
+	return c.Action == "write" || c.Action == "delete"
+}
+
+// BeginBatch starts a batch of writes: they're committed together when the
+// matching EndBatch is called. Batches can be nested.
+func (env *Environment) BeginBatch(ctx context.Context) error {
+	if err := env.checkWritable(ctx); err != nil {
+		return err
+	}
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	env.batching++
+	if env.debounce != nil {
+		env.debounce.Stop()
+	}
+	return nil
+}
+
+// EndBatch ends the batch started by the matching BeginBatch, committing its
+// writes once the outermost batch ends. explanation, if set, explains them
+// all in the commit.
+func (env *Environment) EndBatch(ctx context.Context, explanation string) error {
+	env.batchMu.Lock()
+	if env.batching == 0 {
+		env.batchMu.Unlock()
+		return errors.New("no batch in progress")
+	}
+	env.batching--
+	done := env.batching == 0
+	if done && explanation != "" {
+		env.batchExplanation = explanation
+	}
+	env.batchMu.Unlock()
+	if !done {
+		return nil
+	}
+
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return env.commitPending(ctx)
+}
+
+// Batching returns whether writes are batched, and committed later.
+func (env *Environment) Batching() bool {
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	return env.batching > 0 || env.CommitDebounce > 0
+}
+
+// deferCommit defers the commit of c, if it's a write made in a batch or with
+// a commit debounce window. It returns false if c must be committed now.
+func (env *Environment) deferCommit(ctx context.Context, c change, explanation string) bool {
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	if !c.deferrable() || (env.batching == 0 && env.CommitDebounce <= 0) {
+		return false
+	}
+	env.pending = append(env.pending, pendingChange{change: c, explanation: explanation})
+	env.pendingCtx = context.WithoutCancel(ctx)
+	if env.batching > 0 {
+		return true
+	}
+
+	window := time.Duration(env.CommitDebounce) * time.Millisecond
+	if env.debounce != nil {
+		env.debounce.Reset(window)
+		return true
+	}
+	env.debounce = time.AfterFunc(window, func() {
+		env.batchMu.Lock()
+		ctx := env.pendingCtx
+		env.batchMu.Unlock()
+		unlock, err := env.lock(ctx)
+		if errors.Is(err, ErrShuttingDown) {
+			// Shutdown commits them.
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to commit pending writes", "environment.id", env.ID, "err", err)
+			return
+		}
+		defer unlock()
+		if err := env.commitPending(ctx); err != nil {
+			slog.Error("Failed to commit pending writes", "environment.id", env.ID, "err", err)
+		}
+	})
+	return true
+}
+
+// takePending returns the pending writes, and the explanation of their batch
+// if any, leaving none pending.
+func (env *Environment) takePending() ([]pendingChange, string) {
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	pending, explanation := env.pending, env.batchExplanation
+	env.pending, env.batchExplanation = nil, ""
+	if env.debounce != nil {
+		env.debounce.Stop()
+		env.debounce = nil
+	}
+	return pending, explanation
+}
+
+// commitPending commits the pending writes, if any. The environment must be locked.
+func (env *Environment) commitPending(ctx context.Context) error {
+	pending, explanation := env.takePending()
+	if len(pending) == 0 {
+		return nil
+	}
+	if len(pending) == 1 && explanation == "" {
+		return env.commitChange(ctx, pending[0].change, pending[0].explanation, pending)
+	}
+	summaries := []string{}
+	for i, p := range pending {
+		if i == maxBatchSummaries {
+			summaries = append(summaries, fmt.Sprintf("%d more", len(pending)-i))
+			break
+		}
+		summaries = append(summaries, p.change.Summary)
+	}
+	c := change{Action: "batch", Summary: fmt.Sprintf("%d file changes: %s", len(pending), strings.Join(summaries, ", "))}
+	if explanation == "" {
+		explanation = pendingExplanations(pending)
+	}
+	return env.commitChange(ctx, c, explanation, pending)
+}
+
+// flushPending commits the pending writes on shutdown, once operations can't
+// lock the environment anymore.
+func (env *Environment) flushPending(ctx context.Context) error {
+	env.batchMu.Lock()
+	n := len(env.pending)
+	env.batchMu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	unlock, err := env.flock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return env.commitPending(ctx)
+}
+
+// pendingExplanations lists the changes and explanations of pending.
+func pendingExplanations(pending []pendingChange) string {
+	lines := make([]string, 0, len(pending))
+	for _, p := range pending {
+		line := "- " + p.change.Summary
+		if p.explanation != "" {
+			line += ": " + p.explanation
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// verifyPending checks the files of the last writes of their paths in pending
+// have their checksum in the worktree, once committed.
+func (env *Environment) verifyPending(pending []pendingChange) error {
+	verified := map[string]bool{}
+	for i := len(pending) - 1; i >= 0; i-- {
+		c := pending[i].change
+		if verified[c.Path] {
+			continue
+		}
+		verified[c.Path] = true
+		if c.Checksum == "" {
+			continue
+		}
+		if err := env.verifyWrite(c.Path, c.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
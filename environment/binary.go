@@ -0,0 +1,207 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// BinaryDetectorFunc tells whether the file name of the worktree at
+// worktreePath is binary, and why. ok is false if it can't tell, leaving it
+// to the next detector.
+type BinaryDetectorFunc func(ctx context.Context, env *Environment, worktreePath, name string) (binary bool, reason string, ok bool)
+
+var (
+	binaryDetectorsMu sync.RWMutex
+	binaryDetectors   = map[string]BinaryDetectorFunc{
+		"extensions":    detectBinaryExtension,
+		"content":       detectBinaryContent,
+		"gitattributes": detectBinaryAttributes,
+	}
+)
+
+// defaultBinaryDetection are the binary detectors used by default.
+var defaultBinaryDetection = []string{"extensions", "content"}
+
+// RegisterBinaryDetector registers the binary detector called name,
+// replacing the one with the same name if any.
+func RegisterBinaryDetector(name string, fn BinaryDetectorFunc) {
+	binaryDetectorsMu.Lock()
+	defer binaryDetectorsMu.Unlock()
+	binaryDetectors[name] = fn
+}
+
+func binaryDetector(name string) BinaryDetectorFunc {
+	binaryDetectorsMu.RLock()
+	defer binaryDetectorsMu.RUnlock()
+	return binaryDetectors[name]
+}
+
+func validateBinaryDetection(detectors []string) error {
+	for _, name := range detectors {
+		if binaryDetector(name) == nil {
+			return fmt.Errorf("unknown binary detector %q", name)
+		}
+	}
+	return nil
+}
+
+// SkippedFile is a file left out of a commit.
+type SkippedFile struct {
+	Path string
+	// Detector is the binary detector that skipped it, or symlink.
+	Detector string
+	Reason   string
+}
+
+func (f SkippedFile) String() string {
+	return fmt.Sprintf("%s (%s: %s)", f.Path, f.Detector, f.Reason)
+}
+
+// binaryFile returns why the file name of the worktree at worktreePath isn't
+// committed, or nil if it is: it's binary according to the first binary
+// detector of the environment that can tell, or a symlink leading out of the
+// worktree.
+func (env *Environment) binaryFile(ctx context.Context, worktreePath, name string) *SkippedFile {
+	if symlink, ok := committableSymlink(worktreePath, name); symlink {
+		// Symlinks are committed as such, unless they lead out of the worktree.
+		if ok {
+			return nil
+		}
+		return &SkippedFile{Path: name, Detector: "symlink", Reason: "leads out of the worktree"}
+	}
+	if info, err := os.Stat(filepath.Join(worktreePath, name)); err == nil && info.IsDir() {
+		return nil
+	}
+
+	detectors := env.BinaryDetection
+	if len(detectors) == 0 {
+		detectors = defaultBinaryDetection
+	}
+	for _, detector := range detectors {
+		fn := binaryDetector(detector)
+		if fn == nil {
+			continue
+		}
+		binary, reason, ok := fn(ctx, env, worktreePath, name)
+		if !ok {
+			continue
+		}
+		if !binary {
+			return nil
+		}
+		return &SkippedFile{Path: name, Detector: detector, Reason: reason}
+	}
+	return nil
+}
+
+// binaryExtensions are the extensions of the files the extensions detector
+// considers binary, on top of the BinaryExtensions of the environment.
+var binaryExtensions = []string{
+	".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz",
+	".zip", ".rar", ".7z", ".gz", ".bz2", ".xz",
+	".exe", ".bin", ".dmg", ".pkg", ".msi",
+	".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tiff", ".svg",
+	".mp3", ".mp4", ".avi", ".mov", ".wmv", ".flv", ".mkv",
+	".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx",
+	".so", ".dylib", ".dll", ".a", ".lib",
+}
+
+// detectBinaryExtension considers the files with a binary extension binary,
+// and can't tell for the others.
+func detectBinaryExtension(_ context.Context, env *Environment, _, name string) (bool, string, bool) {
+	lowerName := strings.ToLower(name)
+	for _, ext := range slices.Concat(binaryExtensions, env.BinaryExtensions) {
+		if strings.HasSuffix(lowerName, strings.ToLower(ext)) {
+			return true, "extension " + ext, true
+		}
+	}
+	return false, "", false
+}
+
+// detectBinaryContent considers the files too large to be checked, or with
+// a NUL byte in their first 8000 bytes, as git does, binary.
+func detectBinaryContent(_ context.Context, _ *Environment, worktreePath, name string) (bool, string, bool) {
+	fullPath := filepath.Join(worktreePath, name)
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return true, "can't be read", true
+	}
+	if stat.Size() > maxFileSizeForTextCheck {
+		return true, fmt.Sprintf("larger than %s", formatSize(maxFileSizeForTextCheck)), true
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return true, "can't be read", true
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 8000)
+	n, err := file.Read(buffer)
+	if err != nil && n == 0 {
+		if stat.Size() == 0 {
+			return false, "empty", true
+		}
+		return true, "can't be read", true
+	}
+	if slices.Contains(buffer[:n], 0) {
+		return true, "NUL byte in the first 8000 bytes", true
+	}
+	return false, "", true
+}
+
+// detectBinaryAttributes follows the gitattributes of the worktree: files
+// with the binary attribute, or without the text or diff attributes, are
+// binary, files with the text attribute aren't. It can't tell for the others.
+func detectBinaryAttributes(ctx context.Context, _ *Environment, worktreePath, name string) (bool, string, bool) {
+	out, err := runGitCommand(ctx, worktreePath, "check-attr", "binary", "text", "diff", "--", name)
+	if err != nil {
+		return false, "", false
+	}
+	attrs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		// <path>: <attribute>: <value>
+		parts := strings.Split(line, ": ")
+		if len(parts) < 3 {
+			continue
+		}
+		attrs[parts[len(parts)-2]] = parts[len(parts)-1]
+	}
+	switch {
+	case attrs["binary"] == "set":
+		return true, "binary attribute", true
+	case attrs["text"] == "unset":
+		return true, "-text attribute", true
+	case attrs["diff"] == "unset":
+		return true, "-diff attribute", true
+	case attrs["text"] == "set":
+		return false, "", true
+	}
+	return false, "", false
+}
+
+// maxSkippedTrailers is the number of skipped files listed in commit messages.
+const maxSkippedTrailers = 20
+
+// skippedTrailers returns the git trailers listing the files skipped by a
+// commit, each on a new line.
+func skippedTrailers(skipped []SkippedFile) string {
+	if len(skipped) == 0 {
+		return ""
+	}
+	trailers := ""
+	for i, f := range skipped {
+		if i == maxSkippedTrailers {
+			trailers += fmt.Sprintf("\nSkipped: %d more files", len(skipped)-i)
+			break
+		}
+		trailers += "\nSkipped: " + f.String()
+	}
+	return trailers
+}
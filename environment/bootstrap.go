@@ -0,0 +1,82 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/telemetry"
+)
+
+// bootstrapScript is the script, relative to the root of the repository,
+// every environment runs once built, after the bootstrap commands of the
+// repository configuration.
+const bootstrapScript = configDir + "/bootstrap.sh"
+
+// bootstrapCommands returns the commands bootstrapping the environment: the
+// bootstrap commands of the repository configuration, then its bootstrap
+// script if the worktree has one.
+func (env *Environment) bootstrapCommands() []string {
+	commands := append([]string{}, env.Bootstrap...)
+	if env.Worktree != "" {
+		if _, err := os.Stat(filepath.Join(env.Worktree, filepath.FromSlash(bootstrapScript))); err == nil {
+			commands = append(commands, "sh "+bootstrapScript)
+		}
+	}
+	return commands
+}
+
+// bootstrap runs the bootstrap commands in container, built from the
+// worktree, as the commands of the environment run. Unlike setup commands,
+// they run with the source code when the environment is created, updated or
+// rebuilt, e.g. to install dependencies or generate code. Their output is
+// recorded in the audit log.
+func (env *Environment) bootstrap(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	commands := env.bootstrapCommands()
+	for i, command := range commands {
+		reportStage(ctx, StageBootstrap, i+1, len(commands), "Running bootstrap command: %s", command)
+		if err := env.checkExec(ctx, "Bootstrap command", command); err != nil {
+			return nil, err
+		}
+		spec, err := env.execSpec(ctx, container, []string{"sh", "-c", command}, false)
+		if err != nil {
+			return nil, err
+		}
+		container = container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+			InsecureRootCapabilities: spec.InsecureRootCapabilities,
+		})
+
+		stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running bootstrap command %d/%d", i+1, len(commands)))
+		stdout, err := container.Stdout(ctx)
+		stopHeartbeat()
+		if err != nil {
+			telemetry.Failure("bootstrap")
+			var exitErr *dagger.ExecError
+			if errors.As(err, &exitErr) {
+				_ = env.addGitNote(ctx,
+					fmt.Sprintf("bootstrap $ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
+						command,
+						exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
+					),
+				)
+				return nil, &SetupFailedError{
+					Stage:    StageBootstrap,
+					Step:     i + 1,
+					Steps:    len(commands),
+					Command:  command,
+					ExitCode: exitErr.ExitCode,
+					Output:   fmt.Sprintf("stdout: %s\nstderr: %s", env.redact(exitErr.Stdout), env.redact(exitErr.Stderr)),
+					Err:      err,
+				}
+			}
+			return nil, fmt.Errorf("failed to execute bootstrap command: %w", err)
+		}
+
+		_ = env.addGitNote(ctx, fmt.Sprintf("bootstrap $ %s\n%s\n\n", command, stdout))
+		reportProgress(ctx, "$ %s\n%s", command, env.redact(stdout))
+	}
+	return container, nil
+}
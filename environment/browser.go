@@ -0,0 +1,239 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// browserHost is the hostname the background command of a port is bound to in the browser container.
+	browserHost = "app"
+	// browserWindowSize is the size of the headless browser window, in pixels.
+	browserWindowSize = "1280,800"
+	// browserSettleMillis is how long pages get to run their scripts, in
+	// virtual time, before they're captured.
+	browserSettleMillis = 5000
+)
+
+// browserContainer returns a headless Chromium container reaching the
+// background command exposing port as browserHost, and the URL of urlPath on it.
+func (env *Environment) browserContainer(port int, urlPath string) (*dagger.Container, string, error) {
+	svc, err := env.listener(port)
+	if err != nil {
+		return nil, "", err
+	}
+	container := env.client.dag.Container().From(alpineImage).
+		WithExec([]string{"apk", "add", "--no-cache", "chromium", "font-noto"}).
+		WithServiceBinding(browserHost, svc).
+		WithEnvVariable("CACHEBUSTER", time.Now().String())
+	return container, fmt.Sprintf("http://%s:%d%s", browserHost, port, previewPath(urlPath)), nil
+}
+
+// chromium returns the headless Chromium command line loading url with flags.
+func chromium(url string, flags ...string) []string {
+	args := []string{"chromium-browser", "--headless", "--no-sandbox", "--disable-gpu", "--disable-dev-shm-usage", "--hide-scrollbars", "--window-size=" + browserWindowSize}
+	return append(append(args, flags...), url)
+}
+
+func previewPath(urlPath string) string {
+	if urlPath == "" || strings.HasPrefix(urlPath, "/") {
+		return urlPath
+	}
+	return "/" + urlPath
+}
+
+// Preview is a web page served by a background command of an environment.
+type Preview struct {
+	Port int `json:"port"`
+	// URL is the address of the page on the host.
+	URL string `json:"url"`
+	// Screenshot is the path of the screenshot of the page, relative to the workdir.
+	Screenshot string `json:"screenshot,omitempty"`
+}
+
+// Preview forwards port, exposed by a background command, to the host and
+// returns the URL of urlPath on it. If screenshot is set, a screenshot of the
+// page taken by a headless browser is saved there in the worktree.
+func (env *Environment) Preview(ctx context.Context, explanation string, port int, urlPath, screenshot string) (*Preview, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	done, err := env.client.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	svc, err := env.listener(port)
+	if err != nil {
+		return nil, err
+	}
+	forward := dagger.PortForward{
+		Backend:  port,
+		Frontend: rand.Intn(1000) + 5000,
+		Protocol: dagger.NetworkProtocolTcp,
+	}
+	tunnel, err := env.client.dag.Host().Tunnel(svc, dagger.HostTunnelOpts{Ports: []dagger.PortForward{forward}}).Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env.trackService(tunnel)
+	endpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{Port: forward.Frontend})
+	if err != nil {
+		return nil, err
+	}
+	preview := &Preview{
+		Port: port,
+		URL:  "http://" + endpoint + previewPath(urlPath),
+	}
+	if screenshot == "" {
+		return preview, nil
+	}
+
+	shot, url, err := env.screenshot(ctx, port, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.saveScreenshot(ctx, explanation, url, shot, screenshot); err != nil {
+		return nil, err
+	}
+	preview.Screenshot = screenshot
+	return preview, nil
+}
+
+// screenshot returns a PNG screenshot of urlPath, served on port, and its URL in the browser.
+func (env *Environment) screenshot(ctx context.Context, port int, urlPath string) (*dagger.File, string, error) {
+	browser, url, err := env.browserContainer(port, urlPath)
+	if err != nil {
+		return nil, "", err
+	}
+	reportProgress(ctx, "Taking a screenshot of %s", url)
+	shot := browser.
+		WithExec(chromium(url, "--screenshot=/tmp/screenshot.png", fmt.Sprintf("--virtual-time-budget=%d", browserSettleMillis))).
+		File("/tmp/screenshot.png")
+	return shot, url, nil
+}
+
+// Screenshot returns a PNG screenshot of urlPath, served on port by a
+// background command, as taken by a headless browser. If saveTo is set, the
+// screenshot is also saved there in the worktree.
+func (env *Environment) Screenshot(ctx context.Context, explanation string, port int, urlPath, saveTo string) ([]byte, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	shot, url, err := env.screenshot(ctx, port, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	if saveTo != "" {
+		if err := env.saveScreenshot(ctx, explanation, url, shot, saveTo); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp, err := os.MkdirTemp("", "container-use-screenshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	target := filepath.Join(tmp, "screenshot.png")
+	if _, err := shot.Export(ctx, target); err != nil {
+		return nil, fmt.Errorf("failed to take a screenshot of %s: %w", url, err)
+	}
+	return os.ReadFile(target)
+}
+
+// saveScreenshot saves the screenshot shot of url to target in the worktree.
+func (env *Environment) saveScreenshot(ctx context.Context, explanation, url string, shot *dagger.File, target string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	target = env.containerPath(target)
+	if err := env.apply(ctx, "Screenshot "+url, explanation, "", env.container.WithFile(target, shot, dagger.ContainerWithFileOpts{Owner: env.User.owner()})); err != nil {
+		return fmt.Errorf("failed to take a screenshot of %s: %w", url, err)
+	}
+	return env.propagateToWorktree(ctx, change{Action: "screenshot", Summary: "Screenshot " + url, Path: target}, explanation)
+}
+
+// ConsoleMessage is a message logged to the console of a page.
+type ConsoleMessage struct {
+	// Level is the severity of the message: INFO (console.log and console.info), WARNING or ERROR.
+	Level  string `json:"level"`
+	Text   string `json:"text"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// BrowserPage is a page loaded by the headless browser.
+type BrowserPage struct {
+	URL string `json:"url"`
+	// DOM is the serialized DOM of the page after its scripts ran.
+	DOM     string           `json:"dom,omitempty"`
+	Console []ConsoleMessage `json:"console"`
+}
+
+// consoleLogPattern matches the console messages Chromium logs to stderr, e.g.
+// [12:12:1016/101010.123456:ERROR:CONSOLE(3)] "Uncaught TypeError: x is undefined", source: http://app:3000/main.js (3)
+var consoleLogPattern = regexp.MustCompile(`^\[[^\]]*:([A-Z]+):CONSOLE[(:](\d+)\)?\] "(.*)", source: (.*?)(?: \(\d+\))?$`)
+
+// Navigate loads urlPath, served on port by a background command, in a
+// headless browser and returns its DOM once its scripts ran, along with the
+// messages it logged to the console. Navigations don't change the environment.
+func (env *Environment) Navigate(ctx context.Context, port int, urlPath string) (*BrowserPage, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	browser, url, err := env.browserContainer(port, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	reportProgress(ctx, "Loading %s", url)
+	browser = browser.WithExec(chromium(url, "--dump-dom", "--enable-logging=stderr", "--v=0", fmt.Sprintf("--virtual-time-budget=%d", browserSettleMillis)))
+	dom, err := browser.Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", url, err)
+	}
+	logs, err := browser.Stderr(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", url, err)
+	}
+	return &BrowserPage{
+		URL:     url,
+		DOM:     env.redact(strings.TrimSpace(dom)),
+		Console: parseConsoleMessages(env.redact(logs)),
+	}, nil
+}
+
+// parseConsoleMessages returns the console messages of the Chromium logs.
+func parseConsoleMessages(logs string) []ConsoleMessage {
+	messages := []ConsoleMessage{}
+	for _, line := range strings.Split(logs, "\n") {
+		match := consoleLogPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		messages = append(messages, ConsoleMessage{
+			Level:  match[1],
+			Text:   match[3],
+			Source: match[4],
+			Line:   lineNumber,
+		})
+	}
+	return messages
+}
@@ -0,0 +1,45 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConsoleMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		logs string
+		want []ConsoleMessage
+	}{
+		{
+			name: "messages among other logs",
+			logs: `[1016/101010.123:WARNING:dns_config_service_linux.cc(429)] Failed to read DnsConfig.
+[12:12:1016/101010.123456:INFO:CONSOLE(12)] "app started", source: http://app:3000/main.js (12)
+[12:12:1016/101010.123456:ERROR:CONSOLE(3)] "Uncaught TypeError: x is undefined", source: http://app:3000/main.js (3)
+`,
+			want: []ConsoleMessage{
+				{Level: "INFO", Text: "app started", Source: "http://app:3000/main.js", Line: 12},
+				{Level: "ERROR", Text: "Uncaught TypeError: x is undefined", Source: "http://app:3000/main.js", Line: 3},
+			},
+		},
+		{
+			name: "newer chromium format",
+			logs: `[12:12:1016/101010.123456:WARNING:CONSOLE:7] "deprecated API", source: http://app:3000/vendor.js (7)`,
+			want: []ConsoleMessage{
+				{Level: "WARNING", Text: "deprecated API", Source: "http://app:3000/vendor.js", Line: 7},
+			},
+		},
+		{
+			name: "no messages",
+			logs: "[1016/101010.123:INFO:headless_shell.cc(620)] Written to file /tmp/screenshot.png.",
+			want: []ConsoleMessage{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseConsoleMessages(tt.logs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConsoleMessages() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"gopkg.in/yaml.v3"
+)
+
+// CICheck is a check defined by the CI configuration of a repository.
+type CICheck struct {
+	// Name identifies the check, e.g. "ci.yml/test" or "npm/lint".
+	Name string `json:"name"`
+	// Source is the file the check was found in.
+	Source  string `json:"source"`
+	Command string `json:"command"`
+	// SkippedSteps are workflow steps that can't run in the environment
+	// (actions, or steps using ${{ }} expressions).
+	SkippedSteps int `json:"skipped_steps,omitempty"`
+}
+
+// CICheckResult is the outcome of a CI check run in an environment.
+type CICheckResult struct {
+	CICheck
+	Passed   bool          `json:"passed"`
+	ExitCode int           `json:"exit_code"`
+	Output   string        `json:"output,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// Error is set when the check couldn't be run at all.
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	// ciScripts are the package.json scripts run as checks.
+	ciScripts = []string{"lint", "typecheck", "build", "test"}
+	// ciMakeTarget matches the Makefile targets run as checks.
+	ciMakeTarget = regexp.MustCompile(`(?m)^(lint|vet|check|build|test):`)
+)
+
+// CIChecks returns the checks defined by the CI configuration of the
+// environment: GitHub Actions workflow jobs, package.json scripts and Makefile targets.
+func (env *Environment) CIChecks() ([]CICheck, error) {
+	checks, err := workflowChecks(env.Worktree)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := os.ReadFile(filepath.Join(env.Worktree, "package.json")); err == nil {
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			return nil, fmt.Errorf("invalid package.json: %w", err)
+		}
+		for _, script := range ciScripts {
+			if _, ok := pkg.Scripts[script]; ok {
+				checks = append(checks, CICheck{Name: "npm/" + script, Source: "package.json", Command: "npm run " + script})
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(env.Worktree, "Makefile")); err == nil {
+		for _, match := range ciMakeTarget.FindAllStringSubmatch(string(data), -1) {
+			checks = append(checks, CICheck{Name: "make/" + match[1], Source: "Makefile", Command: "make " + match[1]})
+		}
+	}
+
+	return checks, nil
+}
+
+func workflowChecks(dir string) ([]CICheck, error) {
+	files, err := filepath.Glob(filepath.Join(dir, ".github", "workflows", "*.y*ml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	checks := []CICheck{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var workflow struct {
+			Jobs map[string]struct {
+				Steps []struct {
+					Uses             string `yaml:"uses"`
+					Run              string `yaml:"run"`
+					WorkingDirectory string `yaml:"working-directory"`
+				} `yaml:"steps"`
+			} `yaml:"jobs"`
+		}
+		if err := yaml.Unmarshal(data, &workflow); err != nil {
+			return nil, fmt.Errorf("invalid workflow %s: %w", filepath.Base(file), err)
+		}
+
+		jobs := make([]string, 0, len(workflow.Jobs))
+		for job := range workflow.Jobs {
+			jobs = append(jobs, job)
+		}
+		sort.Strings(jobs)
+		for _, job := range jobs {
+			check := CICheck{
+				Name:   filepath.Base(file) + "/" + job,
+				Source: filepath.Join(".github", "workflows", filepath.Base(file)),
+			}
+			script := []string{"set -e"}
+			for _, step := range workflow.Jobs[job].Steps {
+				if step.Run == "" || strings.Contains(step.Run, "${{") {
+					check.SkippedSteps++
+					continue
+				}
+				run := strings.TrimSpace(step.Run)
+				if step.WorkingDirectory != "" {
+					run = fmt.Sprintf("(cd %s && %s)", shellQuote(step.WorkingDirectory), run)
+				}
+				script = append(script, run)
+			}
+			if len(script) == 1 {
+				continue
+			}
+			check.Command = strings.Join(script, "\n")
+			checks = append(checks, check)
+		}
+	}
+	return checks, nil
+}
+
+// RunChecks runs the CI checks of the environment (all of them, or the ones
+// named) and reports their results. Checks run on a copy of the environment:
+// their side effects are not kept.
+func (env *Environment) RunChecks(ctx context.Context, names []string) ([]CICheckResult, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	checks, err := env.CIChecks()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		checks = slices.DeleteFunc(checks, func(check CICheck) bool { return !slices.Contains(names, check.Name) })
+		if len(checks) == 0 {
+			return nil, fmt.Errorf("no CI checks named %s", strings.Join(names, ", "))
+		}
+	}
+
+	results := make([]CICheckResult, 0, len(checks))
+	for i, check := range checks {
+		reportProgress(ctx, "Running check %s (%d/%d)", check.Name, i+1, len(checks))
+		results = append(results, env.runCheck(ctx, check))
+	}
+	return results, nil
+}
+
+func (env *Environment) runCheck(ctx context.Context, check CICheck) CICheckResult {
+	result := CICheckResult{CICheck: check}
+	explanation := "CI check " + check.Name
+	if err := env.checkExec(ctx, explanation, check.Command); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	spec, err := env.execSpec(ctx, env.container, []string{"sh", "-c", check.Command}, false)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	started := time.Now()
+	stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running check %s", check.Name))
+	defer stopHeartbeat()
+	ran := env.container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+		Expect:                   dagger.ReturnTypeAny,
+	})
+
+	if result.ExitCode, err = ran.ExitCode(ctx); err != nil {
+		var execErr *dagger.ExecError
+		if errors.As(err, &execErr) {
+			result.ExitCode = execErr.ExitCode
+		} else {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	stdout, _ := ran.Stdout(ctx)
+	stderr, _ := ran.Stderr(ctx)
+	result.Output = tail(strings.TrimSpace(stdout+"\n"+stderr), maxSummaryOutput)
+	result.Duration = time.Since(started).Round(time.Millisecond)
+	result.Passed = result.ExitCode == 0
+	return result
+}
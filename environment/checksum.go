@@ -0,0 +1,190 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// checksum returns the checksum of data as recorded in history, sha256:<hex>.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// listingChecksum returns the checksum of a directory whose regular files
+// have the SHA-256 digests sums, by path relative to it: the checksum of their
+// sha256sum listing, sorted by path.
+func listingChecksum(sums map[string]string) string {
+	listing := &strings.Builder{}
+	for _, name := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(listing, "%s  %s\n", sums[name], name)
+	}
+	return checksum([]byte(listing.String()))
+}
+
+// hostChecksum returns the SHA-256 digest of the host file p.
+func hostChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// containerChecksums returns the SHA-256 digests of the regular files files,
+// all of them if nil, of the directory dir of container, by path relative to
+// it. It requires sha256sum in the container.
+func containerChecksums(ctx context.Context, container *dagger.Container, dir string, files []string) (map[string]string, error) {
+	if files != nil && len(files) == 0 {
+		return map[string]string{}, nil
+	}
+	script := fmt.Sprintf("cd %s && find . -type f -exec sha256sum {} +", shellQuote(dir))
+	opts := dagger.ContainerWithExecOpts{}
+	if files != nil {
+		script = fmt.Sprintf("cd %s && xargs -0 sha256sum --", shellQuote(dir))
+		opts.Stdin = strings.Join(files, "\x00")
+	}
+	out, err := container.WithExec([]string{"sh", "-c", script}, opts).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		// <digest>  <path>, prefixed with \ if the path is escaped.
+		escaped := strings.HasPrefix(line, `\`)
+		line = strings.TrimPrefix(line, `\`)
+		if len(line) < 66 {
+			continue
+		}
+		name := line[66:]
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+		}
+		sums[strings.TrimPrefix(name, "./")] = line[:64]
+	}
+	return sums, nil
+}
+
+// verifyChecksums returns a ChecksumMismatchError if the files of the
+// directory dir, by path relative to it, transferred to where have other
+// digests than expected.
+func verifyChecksums(expected, actual map[string]string, dir, where string) error {
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		if actual[name] == expected[name] {
+			continue
+		}
+		mismatch := &ChecksumMismatchError{Path: path.Join(dir, name), Where: where, Expected: "sha256:" + expected[name]}
+		if actual[name] != "" {
+			mismatch.Actual = "sha256:" + actual[name]
+		}
+		return mismatch
+	}
+	return nil
+}
+
+// verifyUpload checks the files of the host directory dir transferred by
+// upload have the same digests in the container, and records the checksum of
+// the target. Uploads can't be verified in containers without sha256sum.
+func (env *Environment) verifyUpload(ctx context.Context, upload *hostUpload, dir string) error {
+	expected := map[string]string{}
+	for _, name := range upload.transferred {
+		if file := upload.manifest.files[name]; !file.symlink {
+			expected[name] = file.hash
+		}
+	}
+	actual, err := containerChecksums(ctx, upload.container, upload.target, slices.Collect(maps.Keys(expected)))
+	if err != nil {
+		slog.Warn("Failed to verify upload checksums", "source", dir, "target", upload.target, "err", err)
+	} else if err := verifyChecksums(expected, actual, upload.target, "container"); err != nil {
+		return err
+	}
+
+	all := map[string]string{}
+	for name, file := range upload.manifest.files {
+		if !file.symlink {
+			all[name] = file.hash
+		}
+	}
+	upload.checksum = listingChecksum(all)
+	return nil
+}
+
+// verifyDownload checks the file or directory source of the container,
+// downloaded to target, has the same digests on the host, and returns its checksum.
+// Downloads can't be verified from containers without sha256sum.
+func (env *Environment) verifyDownload(ctx context.Context, source, target string, file bool) (string, error) {
+	dir, files := source, []string(nil)
+	if file {
+		dir, files = path.Dir(source), []string{path.Base(source)}
+	}
+	expected, err := containerChecksums(ctx, env.container, dir, files)
+	if err != nil {
+		slog.Warn("Failed to verify download checksums", "source", source, "target", target, "err", err)
+		return "", nil
+	}
+
+	actual := map[string]string{}
+	for name := range expected {
+		p := filepath.Join(target, filepath.FromSlash(name))
+		if file {
+			p = target
+		}
+		sum, err := hostChecksum(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		actual[name] = sum
+	}
+	if err := verifyChecksums(expected, actual, dir, "host"); err != nil {
+		return "", err
+	}
+	if file {
+		return "sha256:" + expected[path.Base(source)], nil
+	}
+	return listingChecksum(expected), nil
+}
+
+// verifyWrite checks the file written to the workdir of the environment has
+// the checksum sum in the worktree too, once propagated.
+func (env *Environment) verifyWrite(targetFile, sum string) error {
+	rel, ok := strings.CutPrefix(env.containerPath(targetFile), strings.TrimSuffix(env.Workdir, "/")+"/")
+	if !ok {
+		return nil
+	}
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(worktreePath, filepath.FromSlash(rel))
+	if info, err := os.Lstat(p); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		// e.g. excluded from the worktree, or written through a symlink never followed on the host
+		return nil
+	}
+	actual, err := hostChecksum(p)
+	if err != nil {
+		return err
+	}
+	if "sha256:"+actual != sum {
+		return &ChecksumMismatchError{Path: targetFile, Where: "worktree", Expected: sum, Actual: "sha256:" + actual}
+	}
+	return nil
+}
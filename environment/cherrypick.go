@@ -0,0 +1,186 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Commit is a commit of an environment branch.
+type Commit struct {
+	Hash    string `json:"hash"`
+	Subject string `json:"subject"`
+}
+
+// ConflictError is returned when changes can't be applied because of conflicts.
+type ConflictError struct {
+	// Commit is the commit that failed to apply.
+	Commit string
+	// Files are the conflicting files.
+	Files []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("commit %s conflicts with the current branch in: %s", shortCommit(e.Commit), strings.Join(e.Files, ", "))
+}
+
+// UnpickedCommits lists the commits of the environment branch that aren't in
+// the branch checked out in the source repository, oldest first.
+func UnpickedCommits(ctx context.Context, source, envID string) ([]Commit, error) {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "container-use", envID); err != nil {
+		return nil, err
+	}
+
+	out, err := runGitCommand(ctx, localRepoPath, "log", "--reverse", "--cherry-pick", "--right-only", "--no-merges", "--format=%H %s", "HEAD...container-use/"+envID)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommits(out), nil
+}
+
+// CherryPick applies the given commits of an environment branch, in order, to
+// the branch checked out in the source repository.
+//
+// The commits must belong to the environment. If one of them conflicts, the
+// cherry-pick is aborted, the source branch is left unchanged and a *ConflictError is returned.
+func CherryPick(ctx context.Context, source, envID string, commits []string) error {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "container-use", envID); err != nil {
+		return err
+	}
+
+	branch := "container-use/" + envID
+	hashes := make([]string, 0, len(commits))
+	for _, commit := range commits {
+		out, err := runGitCommand(ctx, localRepoPath, "rev-parse", "--verify", "--quiet", commit+"^{commit}")
+		if err != nil {
+			return fmt.Errorf("unknown commit %q", commit)
+		}
+		hash := strings.TrimSpace(out)
+		if _, err := runGitCommand(ctx, localRepoPath, "merge-base", "--is-ancestor", hash, branch); err != nil {
+			return fmt.Errorf("commit %q is not part of environment %s", commit, envID)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	head, err := runGitCommand(ctx, localRepoPath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := runGitCommand(ctx, localRepoPath, "cherry-pick", "--allow-empty", hash); err != nil {
+			conflicts, _ := runGitCommand(ctx, localRepoPath, "diff", "--name-only", "--diff-filter=U")
+			if _, abortErr := runGitCommand(ctx, localRepoPath, "cherry-pick", "--abort"); abortErr != nil {
+				return fmt.Errorf("failed to abort cherry-pick (%v): %w", err, abortErr)
+			}
+			// Drop the commits picked before the conflict so the branch is left as it was.
+			if _, resetErr := runGitCommand(ctx, localRepoPath, "reset", "--keep", strings.TrimSpace(head)); resetErr != nil {
+				return fmt.Errorf("failed to restore the branch (%v): %w", err, resetErr)
+			}
+			if strings.TrimSpace(conflicts) == "" {
+				return err
+			}
+			return &ConflictError{Commit: hash, Files: strings.Split(strings.TrimSpace(conflicts), "\n")}
+		}
+	}
+	return nil
+}
+
+// UnmergedWorkError is returned when deleting an environment whose branch has
+// commits that haven't landed in any branch of the source repository.
+type UnmergedWorkError struct {
+	Environment string
+	Commits     []Commit
+}
+
+func (e *UnmergedWorkError) Error() string {
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "environment %s has %d commits not merged into the source repository:", e.Environment, len(e.Commits))
+	for _, commit := range e.Commits {
+		fmt.Fprintf(msg, "\n  %s %s", shortCommit(commit.Hash), commit.Subject)
+	}
+	return msg.String()
+}
+
+// SquashedRef returns the ref recording the last commit of the environment id
+// squash merged into the source repository: the commits it contains count as
+// merged work.
+func SquashedRef(id string) string {
+	return "refs/container-use-squashed/" + id
+}
+
+// UnmergedCommits lists the commits of the environment branch that haven't
+// landed in any local branch of the source repository, oldest first. Commits
+// squash merged, or with an equivalent change in a branch (picked or rebased),
+// have landed.
+func (env *Environment) UnmergedCommits(ctx context.Context) ([]Commit, error) {
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "container-use", env.ID); err != nil {
+		return nil, err
+	}
+
+	// The local branch tracking the environment doesn't count as merged work.
+	args := []string{"log", "--reverse", "--format=%H %s", "container-use/" + env.ID, "--not", "--exclude=" + env.ID, "--branches"}
+	if _, err := runGitCommand(ctx, localRepoPath, "rev-parse", "--verify", "--quiet", SquashedRef(env.ID)); err == nil {
+		args = append(args, SquashedRef(env.ID))
+	}
+	out, err := runGitCommand(ctx, localRepoPath, args...)
+	if err != nil {
+		return nil, err
+	}
+	commits := parseCommits(out)
+	if len(commits) == 0 {
+		return commits, nil
+	}
+
+	branches, err := runGitCommand(ctx, localRepoPath, "for-each-ref", "--format=%(refname:short)", "refs/heads/")
+	if err != nil {
+		return nil, err
+	}
+	landed := map[string]bool{}
+	for _, branch := range strings.Fields(branches) {
+		if branch == env.ID {
+			continue
+		}
+		out, err := runGitCommand(ctx, localRepoPath, "cherry", branch, "container-use/"+env.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if hash, ok := strings.CutPrefix(line, "- "); ok {
+				landed[strings.TrimSpace(hash)] = true
+			}
+		}
+	}
+	unmerged := []Commit{}
+	for _, commit := range commits {
+		if !landed[commit.Hash] {
+			unmerged = append(unmerged, commit)
+		}
+	}
+	return unmerged, nil
+}
+
+// parseCommits parses the output of git log --format="%H %s".
+func parseCommits(out string) []Commit {
+	commits := []Commit{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		hash, subject, _ := strings.Cut(line, " ")
+		commits = append(commits, Commit{Hash: hash, Subject: subject})
+	}
+	return commits
+}
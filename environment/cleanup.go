@@ -0,0 +1,39 @@
+package environment
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// abandon removes what was created for an environment whose creation failed
+// or was canceled: the services it started, its worktree and its branch.
+// Failures are only logged, so that the error of the creation is reported.
+func (env *Environment) abandon(ctx context.Context) {
+	slog.Info("Cleaning up partially created environment", "environment.id", env.ID)
+	env.mu.Lock()
+	env.unwatch(nil)
+	env.mu.Unlock()
+	for name, svc := range env.services {
+		if _, err := svc.Stop(ctx); err != nil {
+			slog.Warn("Failed to stop service", "environment.id", env.ID, "service", name, "err", err)
+		}
+	}
+	env.services = nil
+
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		slog.Warn("Failed to get worktree path", "environment.id", env.ID, "err", err)
+		return
+	}
+	if err := os.RemoveAll(worktreePath); err != nil {
+		slog.Warn("Failed to remove worktree", "environment.id", env.ID, "path", worktreePath, "err", err)
+	}
+	// The parent directory is shared by the environments with the same name.
+	_ = os.Remove(filepath.Dir(worktreePath))
+
+	if err := env.DeleteLocalRemoteBranch(); err != nil {
+		slog.Warn("Failed to delete branch", "environment.id", env.ID, "err", err)
+	}
+}
@@ -0,0 +1,101 @@
+package environment
+
+import (
+	"context"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// Client creates and keeps track of environments running on a Dagger engine.
+// Programs embedding container-use create their own client with NewClient.
+type Client struct {
+	dag *dagger.Client
+
+	mu           sync.Mutex
+	environments map[string]*Environment
+
+	pool *containerPool
+
+	subscribers subscribers
+
+	// opsMu guards the tracking of the in-flight operations waited for by Shutdown.
+	opsMu   sync.Mutex
+	active  int
+	closing bool
+	idle    chan struct{}
+}
+
+// Environments are the environments of a Client, as the servers exposing them
+// use them. Depending on Environments rather than Client lets tests fake them.
+type Environments interface {
+	Create(ctx context.Context, explanation, source, name string) (*Environment, error)
+	Open(ctx context.Context, id string) (*Environment, error)
+	OpenFromSource(ctx context.Context, explanation, source, id string) (*Environment, error)
+	Get(idOrName string) *Environment
+	List() []*Environment
+	Subscribe(fn EventFunc) func()
+}
+
+var _ Environments = (*Client)(nil)
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// SkipEngineCheck doesn't check the Dagger engine is supported, e.g. to
+	// diagnose the engine rather than use it.
+	SkipEngineCheck bool
+}
+
+// NewClient returns a client creating environments with dag, once the Dagger
+// engine it is connected to is known to be supported (see CheckEngineVersion).
+func NewClient(ctx context.Context, dag *dagger.Client, opts ClientOptions) (*Client, error) {
+	if !opts.SkipEngineCheck {
+		if _, err := CheckEngineVersion(ctx, dag); err != nil {
+			return nil, err
+		}
+	}
+	return &Client{
+		dag:          dag,
+		environments: map[string]*Environment{},
+		pool:         &containerPool{containers: map[string]pooledContainer{}},
+	}, nil
+}
+
+// Get returns the environment with the given ID or name, or nil.
+func (c *Client) Get(idOrName string) *Environment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if environment, ok := c.environments[idOrName]; ok {
+		return environment
+	}
+	for _, environment := range c.environments {
+		if environment.Name == idOrName {
+			return environment
+		}
+	}
+	return nil
+}
+
+// List returns the environments created or opened by the client.
+func (c *Client) List() []*Environment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	env := make([]*Environment, 0, len(c.environments))
+	for _, environment := range c.environments {
+		env = append(env, environment)
+	}
+	return env
+}
+
+func (c *Client) register(env *Environment) {
+	env.touch()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.environments[env.ID] = env
+}
+
+func (c *Client) unregister(env *Environment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.environments, env.ID)
+}
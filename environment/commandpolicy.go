@@ -0,0 +1,207 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dagger/container-use/telemetry"
+)
+
+type CommandAction string
+
+const (
+	CommandAllow CommandAction = "allow"
+	CommandDeny  CommandAction = "deny"
+	// CommandConfirm pauses the command until a human confirms it with cu
+	// approve, the first time the environment runs it.
+	CommandConfirm CommandAction = "confirm"
+	// CommandApprove pauses the command until a human approves it with cu approve, every time.
+	CommandApprove CommandAction = "approve"
+)
+
+// CommandRule matches commands about to be executed in an environment.
+// A rule matches if any of its criteria match.
+type CommandRule struct {
+	// Regexp is matched against the full command text.
+	Regexp string `json:"regexp,omitempty" yaml:"regexp,omitempty"`
+	// Glob is matched against the full command text.
+	Glob string `json:"glob,omitempty" yaml:"glob,omitempty"`
+	// Binaries matches any pipeline segment invoking one of these programs (e.g. "curl", "sudo").
+	Binaries []string `json:"binaries,omitempty" yaml:"binaries,omitempty"`
+
+	Action CommandAction `json:"action" yaml:"action"`
+	Reason string        `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// CommandPolicy is evaluated before commands run. Rules are evaluated in order
+// and the first matching rule decides, falling back to Default (allow if empty).
+//
+// Example:
+//
+//	{
+//	  "rules": [
+//	    {"regexp": "(curl|wget)[^|]*\\|\\s*(ba|z)?sh", "action": "deny", "reason": "piping downloads into a shell"},
+//	    {"regexp": "rm\\s+-[a-zA-Z]*r[a-zA-Z]*f", "action": "confirm"},
+//	    {"binaries": ["sudo"], "action": "deny"},
+//	    {"regexp": "git\\s+push|terraform\\s+apply|npm\\s+publish", "action": "approve"}
+//	  ]
+//	}
+type CommandPolicy struct {
+	Rules   []CommandRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Default CommandAction `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// CommandPolicyError is returned when a command is denied or requires confirmation.
+type CommandPolicyError struct {
+	Command string
+	Action  CommandAction
+	Reason  string
+}
+
+func (e *CommandPolicyError) Error() string {
+	reason := ""
+	if e.Reason != "" {
+		reason = ": " + e.Reason
+	}
+	switch e.Action {
+	case CommandConfirm:
+		return fmt.Sprintf("command %q was not confirmed%s", e.Command, reason)
+	case CommandApprove:
+		return fmt.Sprintf("command %q was not approved%s", e.Command, reason)
+	default:
+		return fmt.Sprintf("command %q is denied by policy%s", e.Command, reason)
+	}
+}
+
+var commandSeparators = regexp.MustCompile(`\|\||&&|[|;&\n]`)
+
+// commandBinaries returns the program invoked by each segment of a shell command.
+func commandBinaries(command string) []string {
+	binaries := []string{}
+	for _, segment := range commandSeparators.Split(command, -1) {
+		fields := strings.Fields(segment)
+		for len(fields) > 0 && strings.Contains(fields[0], "=") {
+			// skip variable assignments (FOO=bar cmd)
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		binaries = append(binaries, path.Base(fields[0]))
+	}
+	return binaries
+}
+
+func (r *CommandRule) matches(command string) (bool, error) {
+	if r.Regexp != "" {
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return false, fmt.Errorf("invalid command rule regexp %q: %w", r.Regexp, err)
+		}
+		if re.MatchString(command) {
+			return true, nil
+		}
+	}
+	if r.Glob != "" {
+		if ok, _ := path.Match(r.Glob, command); ok {
+			return true, nil
+		}
+	}
+	if len(r.Binaries) > 0 {
+		for _, binary := range commandBinaries(command) {
+			for _, blocked := range r.Binaries {
+				if binary == blocked {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// Evaluate returns the action to take for command, along with the reason of the matching rule.
+func (p *CommandPolicy) Evaluate(command string) (CommandAction, string, error) {
+	if p == nil {
+		return CommandAllow, "", nil
+	}
+	for _, rule := range p.Rules {
+		ok, err := rule.matches(command)
+		if err != nil {
+			return "", "", err
+		}
+		if ok {
+			return rule.Action, rule.Reason, nil
+		}
+	}
+	if p.Default != "" {
+		return p.Default, "", nil
+	}
+	return CommandAllow, "", nil
+}
+
+// checkExec checks command, about to run in the environment for explanation,
+// against the command policy and the policy hook of the environment. Every
+// command run in the environment, by agents or on their behalf (checks,
+// linters, bootstrap commands, background commands), must go through it.
+func (env *Environment) checkExec(ctx context.Context, explanation, command string) error {
+	if err := env.checkCommand(ctx, explanation, command); err != nil {
+		return err
+	}
+	return env.checkPolicyHook(ctx, PolicyRequest{Operation: "run", Explanation: explanation, Command: command})
+}
+
+// checkCommand evaluates the environment's command policy, recording violations in the audit log.
+// Commands needing a confirmation or approval wait for a human decision with
+// cu approve: the client running them can't confirm them itself.
+func (env *Environment) checkCommand(ctx context.Context, explanation, command string) error {
+	action, reason, err := env.CommandPolicy.Evaluate(command)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case CommandAllow:
+		return nil
+	case CommandConfirm:
+		if env.confirmedCommand(command) {
+			return nil
+		}
+		if err := env.requestApproval(ctx, explanation, command, reason, CommandConfirm); err != nil {
+			return err
+		}
+		env.confirmCommand(command)
+		return nil
+	case CommandApprove:
+		return env.requestApproval(ctx, explanation, command, reason, CommandApprove)
+	default:
+		action = CommandDeny
+	}
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("policy: %s $ %s (%s)\n\n", action, command, reason))
+	telemetry.Failure("command_policy")
+	return &CommandPolicyError{
+		Command: command,
+		Action:  action,
+		Reason:  reason,
+	}
+}
+
+// confirmedCommand returns whether a human already confirmed command in the environment.
+func (env *Environment) confirmedCommand(command string) bool {
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	return env.confirmed[command]
+}
+
+// confirmCommand records that a human confirmed command, so it's not asked for again.
+func (env *Environment) confirmCommand(command string) {
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	if env.confirmed == nil {
+		env.confirmed = map[string]bool{}
+	}
+	env.confirmed[command] = true
+}
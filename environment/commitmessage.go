@@ -0,0 +1,98 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// change describes the operation recorded by an environment commit.
+type change struct {
+	// Action is the kind of operation: create, update, run, write, delete, upload, set_env, revert, undo,
+	// stash, unstash, sync, import, publish, install, screenshot, add_service or batch.
+	Action string
+	// Summary is a short human readable description, e.g. "Write main.go".
+	Summary string
+	Command string
+	Path    string
+	// Checksum is the checksum of the file written, verified in the worktree once committed.
+	Checksum string
+}
+
+// CommitMessageData is the data available to commit message templates.
+//
+// For instance, conventional commits can be produced with:
+//
+//	commit_message: "chore({{.Action}}): {{.Summary}}\n\n{{.Explanation}}\n\nEnvironment: {{.EnvironmentID}}"
+type CommitMessageData struct {
+	Action          string
+	Summary         string
+	Explanation     string
+	Command         string
+	Path            string
+	EnvironmentID   string
+	EnvironmentName string
+	// Client is the name of the MCP client that made the change, if known.
+	Client        string
+	ClientVersion string
+	Session       string
+	// Skipped are the files left out of the commit, as binary.
+	Skipped []SkippedFile
+}
+
+// commitMessage renders the commit message of c using the environment's template, if any.
+// The files skipped as binary are listed in Skipped trailers.
+func (env *Environment) commitMessage(ctx context.Context, c change, explanation string, skipped []SkippedFile) (string, error) {
+	client := ClientInfoFromContext(ctx)
+	if env.CommitMessage == "" {
+		trailers := clientTrailers(client)
+		if s := skippedTrailers(skipped); s != "" {
+			if trailers == "" {
+				trailers = "\n"
+			}
+			trailers += s
+		}
+		return env.redact(fmt.Sprintf("%s\n\n%s", c.Summary, explanation)) + trailers, nil
+	}
+
+	tmpl, err := template.New("commit_message").Option("missingkey=error").Parse(env.CommitMessage)
+	if err != nil {
+		return "", fmt.Errorf("invalid commit message template: %w", err)
+	}
+	msg := &strings.Builder{}
+	if err := tmpl.Execute(msg, CommitMessageData{
+		Action:          c.Action,
+		Summary:         c.Summary,
+		Explanation:     explanation,
+		Command:         c.Command,
+		Path:            c.Path,
+		EnvironmentID:   env.ID,
+		EnvironmentName: env.Name,
+		Client:          client.Name,
+		ClientVersion:   client.Version,
+		Session:         client.Session,
+		Skipped:         skipped,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render commit message template: %w", err)
+	}
+	if strings.TrimSpace(msg.String()) == "" {
+		return "", fmt.Errorf("commit message template rendered an empty message")
+	}
+	return env.redact(msg.String()), nil
+}
+
+// clientTrailers returns the git trailers attributing a commit to client.
+func clientTrailers(client ClientInfo) string {
+	if client.Name == "" {
+		return ""
+	}
+	trailers := "\n\nClient: " + client.Name
+	if client.Version != "" {
+		trailers += "\nClient-Version: " + client.Version
+	}
+	if client.Session != "" {
+		trailers += "\nSession: " + client.Session
+	}
+	return trailers
+}
@@ -0,0 +1,364 @@
+package environment
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how the directories uploaded to and downloaded from
+// environments are compressed between the host and the container.
+// Compressing requires tar, and gzip or zstd, in the container: transfers
+// fall back to uncompressed ones without them.
+type Compression string
+
+const (
+	// CompressionAuto compresses transfers of at least compressionThreshold
+	// bytes with gzip. It's the default.
+	CompressionAuto Compression = "auto"
+	// CompressionGzip compresses every transfer with gzip.
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd compresses every transfer with zstd, faster than gzip.
+	CompressionZstd Compression = "zstd"
+	// CompressionNone never compresses transfers.
+	CompressionNone Compression = "none"
+)
+
+// compressionThreshold is the size of the transfers compressed with CompressionAuto.
+const compressionThreshold = 8 << 20
+
+func (c Compression) validate() error {
+	switch c {
+	case "", CompressionAuto, CompressionGzip, CompressionZstd, CompressionNone:
+		return nil
+	}
+	return fmt.Errorf("invalid compression %q: must be %s, %s, %s or %s", c, CompressionAuto, CompressionGzip, CompressionZstd, CompressionNone)
+}
+
+// compressionFor returns the compression of a transfer of size bytes, none
+// if it shouldn't be compressed.
+func (env *Environment) compressionFor(size int64) Compression {
+	switch env.Compression {
+	case CompressionGzip, CompressionZstd, CompressionNone:
+		return env.Compression
+	}
+	if size >= compressionThreshold {
+		return CompressionGzip
+	}
+	return CompressionNone
+}
+
+// decompressCommand returns the command decompressing c from stdin to stdout in the container.
+func (c Compression) decompressCommand() string {
+	if c == CompressionZstd {
+		return "zstd -dc"
+	}
+	return "gzip -dc"
+}
+
+func (c Compression) compressCommand() string {
+	if c == CompressionZstd {
+		return "zstd -c"
+	}
+	return "gzip -c"
+}
+
+// Transfer describes the files moved between the host and an environment.
+type Transfer struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// Compression is how the files were compressed, if they were.
+	Compression    Compression `json:"compression,omitempty"`
+	CompressedSize int64       `json:"compressed_size,omitempty"`
+}
+
+// Ratio returns the compressed size of the transfer relative to its size, 1 if it wasn't compressed.
+func (t *Transfer) Ratio() float64 {
+	if t.Compression == "" || t.Size == 0 {
+		return 1
+	}
+	return float64(t.CompressedSize) / float64(t.Size)
+}
+
+func (t *Transfer) String() string {
+	s := fmt.Sprintf("%d files, %s", t.Files, formatSize(t.Size))
+	if t.Compression != "" {
+		s += fmt.Sprintf(", %s to %s (%.0f%%)", t.Compression, formatSize(t.CompressedSize), t.Ratio()*100)
+	}
+	return s
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func compressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	if c == CompressionZstd {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+func decompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	if c == CompressionZstd {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// writeArchive writes the files of the host directory dir, relative to it,
+// to a tar archive compressed with c, owned by uid:gid. It returns the path
+// of the archive, to remove once transferred, and its size.
+func writeArchive(dir string, files []string, c Compression, uid, gid int) (string, int64, error) {
+	f, err := os.CreateTemp("", "container-use-upload-*.tar")
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	fail := func(err error) (string, int64, error) {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	counter := &countingWriter{w: f}
+	zw, err := compressor(counter, c)
+	if err != nil {
+		return fail(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Lstat(p)
+		if err != nil {
+			return fail(err)
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return fail(err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fail(err)
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uid, header.Gid = uid, gid
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return fail(err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFileTo(tw, p); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	return f.Name(), counter.n, nil
+}
+
+func copyFileTo(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// withCompressedUpload returns container with files, of the host directory
+// dir, extracted to target from an archive compressed with c.
+func (env *Environment) withCompressedUpload(ctx context.Context, container *dagger.Container, dir, target string, files []string, c Compression) (*dagger.Container, int64, error) {
+	uid, gid := 0, 0
+	if env.User != nil {
+		uid, gid = env.User.ids()
+	}
+	archive, size, err := writeArchive(dir, files, c, uid, gid)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(archive)
+
+	const mountPath = "/tmp/.container-use-upload.tar"
+	script := fmt.Sprintf("set -e\nmkdir -p %s\n%s < %s | tar -xf - -C %s\n",
+		shellQuote(target), c.decompressCommand(), mountPath, shellQuote(target))
+	extracted := container.
+		WithMountedFile(mountPath, env.client.dag.Host().File(archive, dagger.HostFileOpts{NoCache: true})).
+		WithExec([]string{"sh", "-c", script}).
+		WithoutMount(mountPath)
+	// The archive is read when the container is evaluated: before it's removed.
+	if _, err := extracted.Sync(ctx); err != nil {
+		return nil, 0, err
+	}
+	return extracted, size, nil
+}
+
+// downloadCompressed exports the directory source of the environment
+// container to target on the host, compressed in the container as configured.
+// It returns false if the download isn't compressed: source is too small, or
+// the container can't compress it.
+func (env *Environment) downloadCompressed(ctx context.Context, source, target string) (*Transfer, bool, error) {
+	if env.Compression == CompressionNone {
+		return nil, false, nil
+	}
+	if env.Compression == "" || env.Compression == CompressionAuto {
+		usage, err := env.container.WithExec([]string{"du", "-sk", source}).Stdout(ctx)
+		if err != nil {
+			return nil, false, nil
+		}
+		fields := strings.Fields(usage)
+		if len(fields) == 0 {
+			return nil, false, nil
+		}
+		kib, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || kib*1024 < compressionThreshold {
+			return nil, false, nil
+		}
+	}
+	c := env.compressionFor(compressionThreshold)
+
+	const archivePath = "/tmp/.container-use-download.tar"
+	script := fmt.Sprintf("set -e\ntar -cf - -C %s . | %s > %s\n", shellQuote(source), c.compressCommand(), archivePath)
+	archive, err := os.CreateTemp("", "container-use-download-*.tar")
+	if err != nil {
+		return nil, false, err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+	if _, err := env.container.WithExec([]string{"sh", "-c", script}).File(archivePath).Export(ctx, archive.Name()); err != nil {
+		slog.Warn("Failed to compress download, downloading it uncompressed", "source", source, "compression", c, "err", err)
+		return nil, false, nil
+	}
+
+	transfer, err := extractArchive(archive.Name(), target, c)
+	if err != nil {
+		return nil, false, err
+	}
+	return transfer, true, nil
+}
+
+// extractArchive extracts the tar archive compressed with c at archive to the host directory target.
+func extractArchive(archive, target string, c Compression) (*Transfer, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := decompressor(f, c)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	transfer := &Transfer{Compression: c, CompressedSize: info.Size()}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return transfer, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.FromSlash(strings.TrimPrefix(header.Name, "./"))
+		if name == "" || name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("invalid path in archive: %s", header.Name)
+		}
+		p := filepath.Join(root, name)
+		// Symlinks extracted before mustn't lead entries out of target.
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+			if rel, err := filepath.Rel(root, parent); err != nil || !filepath.IsLocal(rel) {
+				return nil, fmt.Errorf("invalid path in archive: %s", header.Name)
+			}
+		}
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, mode|0700); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			os.Remove(p)
+			if err := os.Symlink(header.Linkname, p); err != nil {
+				return nil, err
+			}
+			transfer.Files++
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return nil, err
+			}
+			out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return nil, err
+			}
+			n, err := io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return nil, err
+			}
+			transfer.Files++
+			transfer.Size += n
+		}
+	}
+}
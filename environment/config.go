@@ -0,0 +1,275 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RepoConfigFile is the name of the configuration file checked in at the root of a repository.
+const RepoConfigFile = ".container-use.yaml"
+
+// RepoConfig declares how environments created from a repository are set up.
+//
+// Example:
+//
+//	base_image: golang:1.24
+//	packages: [make, jq]
+//	setup_commands:
+//	  - go install golang.org/x/tools/cmd/goimports@latest
+//	env:
+//	  CGO_ENABLED: "0"
+//	ports: [8080]
+//	author:
+//	  name: Agent via container-use
+//	  email: bot@example.com
+//	exclude:
+//	  - testdata/fixtures/
+type RepoConfig struct {
+	Instructions string `yaml:"instructions,omitempty"`
+	BaseImage    string `yaml:"base_image,omitempty"`
+	// Workdir is the path of the project in the container, /workdir by default.
+	Workdir string `yaml:"workdir,omitempty"`
+	// Packages are installed with the package manager of the base image (apt, apk or dnf).
+	Packages      []string `yaml:"packages,omitempty"`
+	SetupCommands []string `yaml:"setup_commands,omitempty"`
+	// SetupGroups are groups of independent setup commands run in parallel
+	// after SetupCommands, e.g. [[apt-get install -y postgresql-client, npm ci]].
+	SetupGroups [][]string `yaml:"setup_groups,omitempty"`
+	// Bootstrap are commands every environment runs once built with the source
+	// code, e.g. to install dependencies, before .container-use/bootstrap.sh.
+	Bootstrap []string `yaml:"bootstrap,omitempty"`
+	// Nix runs commands in the project's Nix dev shell: "flake" (flake.nix) or "shell" (shell.nix).
+	Nix   string            `yaml:"nix,omitempty"`
+	Env   map[string]string `yaml:"env,omitempty"`
+	Ports []int             `yaml:"ports,omitempty"`
+	// Hostname is the hostname commands run with, e.g. for license checks.
+	Hostname string `yaml:"hostname,omitempty"`
+	// Labels are OCI labels added to environment containers.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Exclude lists additional patterns of files that are never committed.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// PersistentDirs are dependency directories (e.g. node_modules, .venv) preserved across rebuilds.
+	PersistentDirs []string `yaml:"persistent_dirs,omitempty"`
+	// Linters run by the environment_lint tool. Defaults to the linters configured in the project.
+	Linters []string `yaml:"linters,omitempty"`
+	// OutputLimit is the size, in bytes, of the command outputs returned to
+	// agents, 32KiB by default. Longer outputs are truncated in the middle and
+	// saved in full.
+	OutputLimit int `yaml:"output_limit,omitempty"`
+	// ANSI is "strip" (the default) to remove the escape sequences, e.g.
+	// colors, of the command outputs returned to agents, or "preserve".
+	ANSI ANSIMode `yaml:"ansi,omitempty"`
+	// OutputProcessors transform the outputs of the commands they match before
+	// they're returned to agents, see OutputProcessor.
+	OutputProcessors []OutputProcessor `yaml:"output_processors,omitempty"`
+	// Compression is how the directories uploaded to and downloaded from the
+	// environment are compressed: auto (the default, gzip for 8MiB or more),
+	// gzip, zstd or none.
+	Compression Compression `yaml:"compression,omitempty"`
+	// Symlinks is how symlinks are uploaded and read: preserve (the default),
+	// follow or reject. Symlinks leading out of the worktree are never committed.
+	Symlinks SymlinkPolicy `yaml:"symlinks,omitempty"`
+	// BinaryDetection are the detectors, tried in order, deciding which files
+	// are binary and not committed: extensions, content (NUL bytes) or
+	// gitattributes. Defaults to [extensions, content].
+	BinaryDetection []string `yaml:"binary_detection,omitempty"`
+	// BinaryExtensions are extensions of binary files, e.g. [.psd, .onnx], on
+	// top of the ones the extensions detector knows.
+	BinaryExtensions []string `yaml:"binary_extensions,omitempty"`
+	// CommitDebounce is how long, in milliseconds, file writes wait for the
+	// next ones to be committed together, e.g. 2000. By default every write
+	// is committed.
+	CommitDebounce int `yaml:"commit_debounce,omitempty"`
+	// DetectInput stops commands blocked reading their stdin once their output
+	// stalled, reporting them as waiting for input. By default commands read an
+	// empty stdin.
+	DetectInput bool `yaml:"detect_input,omitempty"`
+	// ArtifactsDir is the host directory, relative to the repository, build
+	// artifacts are copied to, e.g. out/artifacts. Defaults to
+	// ~/.config/container-use/artifacts/<environment>.
+	ArtifactsDir string `yaml:"artifacts_dir,omitempty"`
+	// Services are sidecars, e.g. databases, started in order and waited for
+	// before the environment is built, e.g. [{image: postgres:16, seed: [db/schema.sql]}].
+	Services []Sidecar `yaml:"services,omitempty"`
+	// Requires are services of other environments the environment needs, e.g. [{environment: api, service: http}].
+	Requires []Requirement `yaml:"requires,omitempty"`
+	// Tools are project-specific MCP tools running commands in environments, see PluginTool.
+	Tools []PluginTool `yaml:"tools,omitempty"`
+
+	CommandPolicy *CommandPolicy `yaml:"command_policy,omitempty"`
+	Network       *NetworkPolicy `yaml:"network,omitempty"`
+	Proxy         *ProxyConfig   `yaml:"proxy,omitempty"`
+	// User runs commands as a non-root user, e.g. {name: dev}. Its UID/GID default to the host user's.
+	User *UserConfig `yaml:"user,omitempty"`
+	// Signing configures the signing of environment commits, e.g. {format: ssh, key: ~/.ssh/id_ed25519.pub}.
+	Signing *SigningConfig `yaml:"signing,omitempty"`
+	// Author is the identity environment commits are made with.
+	Author *GitAuthor `yaml:"author,omitempty"`
+	// ClientAuthors overrides Author for commits made on behalf of the named MCP clients.
+	ClientAuthors map[string]*GitAuthor `yaml:"client_authors,omitempty"`
+	// CommitMessage is a text/template for environment commit messages, see CommitMessageData.
+	CommitMessage string `yaml:"commit_message,omitempty"`
+	// Mirror pushes environment branches and notes to a remote after each change, e.g. {remote: origin}.
+	Mirror *MirrorConfig `yaml:"mirror,omitempty"`
+	// Notes configures where environments keep their log and state, e.g. {backend: file} for hosts stripping git notes.
+	Notes *NotesConfig `yaml:"notes,omitempty"`
+	// Audit makes the audit log tamper-evident, e.g. {hash_chain: true, anchor_every: 50}.
+	Audit *AuditConfig `yaml:"audit,omitempty"`
+	// CUVersion pins the version of cu installed by cu upgrade in the repository, e.g. v0.4.2.
+	CUVersion string `yaml:"cu_version,omitempty"`
+}
+
+// LoadRepoConfig reads the configuration of the repository at dir.
+// It returns nil if the repository doesn't have a configuration file.
+func LoadRepoConfig(dir string) (*RepoConfig, error) {
+	data, err := os.ReadFile(filepath.Join(dir, RepoConfigFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if errs := validateConfig(data); len(errs) > 0 {
+		return nil, errs
+	}
+	cfg := &RepoConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", RepoConfigFile, err)
+	}
+	return cfg, nil
+}
+
+// applyDefaults sets the environment settings declared by the repository configuration.
+func (cfg *RepoConfig) applyDefaults(env *Environment) {
+	if cfg.Instructions != "" {
+		env.Instructions = cfg.Instructions
+	}
+	if cfg.BaseImage != "" {
+		env.BaseImage = cfg.BaseImage
+	}
+	if cfg.Workdir != "" {
+		env.Workdir = cfg.Workdir
+	}
+	if len(cfg.Packages) > 0 {
+		env.Packages = slices.Clone(cfg.Packages)
+	}
+	if len(cfg.SetupCommands) > 0 {
+		env.SetupCommands = slices.Clone(cfg.SetupCommands)
+	}
+	if len(cfg.SetupGroups) > 0 {
+		env.SetupGroups = make([][]string, len(cfg.SetupGroups))
+		for i, group := range cfg.SetupGroups {
+			env.SetupGroups[i] = slices.Clone(group)
+		}
+	}
+	if len(cfg.Bootstrap) > 0 {
+		env.Bootstrap = slices.Clone(cfg.Bootstrap)
+	}
+	if cfg.Nix != "" {
+		env.Nix = cfg.Nix
+		if cfg.BaseImage == "" {
+			env.BaseImage = nixImage
+		}
+	}
+	if len(cfg.Env) > 0 {
+		env.Env = []string{}
+		for k, v := range cfg.Env {
+			env.Env = append(env.Env, k+"="+v)
+		}
+		sort.Strings(env.Env)
+	}
+	if len(cfg.Ports) > 0 {
+		env.Ports = slices.Clone(cfg.Ports)
+	}
+	env.Exclude = slices.Clone(cfg.Exclude)
+	if cfg.Hostname != "" {
+		env.Hostname = cfg.Hostname
+	}
+	if len(cfg.Labels) > 0 {
+		env.Labels = maps.Clone(cfg.Labels)
+	}
+	if len(cfg.PersistentDirs) > 0 {
+		env.PersistentDirs = slices.Clone(cfg.PersistentDirs)
+	}
+	if len(cfg.Linters) > 0 {
+		env.Linters = slices.Clone(cfg.Linters)
+	}
+	if cfg.OutputLimit > 0 {
+		env.OutputLimit = cfg.OutputLimit
+	}
+	if cfg.ANSI != "" {
+		env.ANSI = cfg.ANSI
+	}
+	if len(cfg.OutputProcessors) > 0 {
+		env.OutputProcessors = slices.Clone(cfg.OutputProcessors)
+	}
+	if cfg.Compression != "" {
+		env.Compression = cfg.Compression
+	}
+	if cfg.Symlinks != "" {
+		env.Symlinks = cfg.Symlinks
+	}
+	if len(cfg.BinaryDetection) > 0 {
+		env.BinaryDetection = slices.Clone(cfg.BinaryDetection)
+	}
+	if len(cfg.BinaryExtensions) > 0 {
+		env.BinaryExtensions = slices.Clone(cfg.BinaryExtensions)
+	}
+	if cfg.CommitDebounce > 0 {
+		env.CommitDebounce = cfg.CommitDebounce
+	}
+	env.DetectInput = cfg.DetectInput
+	env.ArtifactsDir = cfg.ArtifactsDir
+	if len(cfg.Services) > 0 {
+		env.Sidecars = slices.Clone(cfg.Services)
+	}
+	if len(cfg.Requires) > 0 {
+		env.Requires = slices.Clone(cfg.Requires)
+	}
+	if cfg.Proxy != nil {
+		env.Proxy = cfg.Proxy
+	}
+	if cfg.Signing != nil {
+		env.Signing = cfg.Signing
+	}
+	if cfg.Author != nil {
+		env.Author = cfg.Author
+	}
+	if len(cfg.ClientAuthors) > 0 {
+		env.ClientAuthors = cfg.ClientAuthors
+	}
+	if cfg.CommitMessage != "" {
+		env.CommitMessage = cfg.CommitMessage
+	}
+	if cfg.Mirror != nil {
+		env.Mirror = cfg.Mirror
+	}
+	if cfg.Notes != nil {
+		env.Notes = cfg.Notes
+	}
+}
+
+// applyPolicies enforces the policies declared by the repository configuration.
+// Unlike other settings, they take precedence over any saved environment state.
+func (cfg *RepoConfig) applyPolicies(env *Environment) {
+	if cfg.CommandPolicy != nil {
+		env.CommandPolicy = cfg.CommandPolicy
+	}
+	if cfg.Network != nil {
+		env.Network = cfg.Network
+	}
+	if cfg.User != nil {
+		env.User = cfg.User
+	}
+	if cfg.Audit != nil {
+		env.Audit = cfg.Audit
+	}
+}
@@ -0,0 +1,416 @@
+package environment
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSchema is the JSON schema of the repository configuration file, e.g.
+// for editors: # yaml-language-server: $schema=<path of the schema>
+//
+//go:embed config.schema.json
+var ConfigSchema []byte
+
+// ConfigError is a problem of the repository configuration file.
+type ConfigError struct {
+	// Path locates the setting, e.g. services[0].image.
+	Path   string `json:"path,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	location := strconv.Itoa(e.Line)
+	if e.Column > 0 {
+		location += ":" + strconv.Itoa(e.Column)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", location, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, e.Path, e.Message)
+}
+
+// ConfigErrors are the problems of a repository configuration file.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return fmt.Sprintf("invalid %s:\n%s", RepoConfigFile, strings.Join(lines, "\n"))
+}
+
+// ValidateConfig checks the configuration file of the repository at dir
+// against ConfigSchema and the settings environments can be created with.
+// It returns no errors if the repository doesn't have a configuration file.
+func ValidateConfig(dir string) (ConfigErrors, error) {
+	data, err := os.ReadFile(filepath.Join(dir, RepoConfigFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return validateConfig(data), nil
+}
+
+// yamlErrorLine matches the line of YAML syntax errors, e.g. "yaml: line 3: mapping values are not allowed in this context".
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func validateConfig(data []byte) ConfigErrors {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		line, message := 0, strings.TrimPrefix(err.Error(), "yaml: ")
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			message = strings.TrimPrefix(err.Error(), m[0])
+		}
+		return ConfigErrors{{Line: line, Message: message}}
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	document := root.Content[0]
+
+	schema, err := loadConfigSchema()
+	if err != nil {
+		// The embedded schema is valid.
+		panic(err)
+	}
+	v := &schemaValidator{root: schema}
+	v.validate(document, schema, "")
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+
+	cfg := &RepoConfig{}
+	if err := document.Decode(cfg); err != nil {
+		return ConfigErrors{{Line: document.Line, Column: document.Column, Message: err.Error()}}
+	}
+	return cfg.check(document)
+}
+
+// check returns the problems of the settings of cfg not expressed by the schema, located in document.
+func (cfg *RepoConfig) check(document *yaml.Node) ConfigErrors {
+	errs := ConfigErrors{}
+	add := func(err error, path ...any) {
+		node := lookupNode(document, path...)
+		errs = append(errs, ConfigError{Path: formatPath(path...), Line: node.Line, Column: node.Column, Message: err.Error()})
+	}
+
+	if cfg.Workdir != "" {
+		if err := validateWorkdir(cfg.Workdir); err != nil {
+			add(err, "workdir")
+		}
+	}
+	if cfg.CommandPolicy != nil {
+		for i, rule := range cfg.CommandPolicy.Rules {
+			if rule.Regexp == "" {
+				continue
+			}
+			if _, err := regexp.Compile(rule.Regexp); err != nil {
+				add(err, "command_policy", "rules", i, "regexp")
+			}
+		}
+	}
+	if err := cfg.Network.validate(); err != nil {
+		add(err, "network")
+	}
+	if err := cfg.Notes.validate(); err != nil {
+		add(err, "notes")
+	}
+	if err := cfg.User.validate(); err != nil {
+		add(err, "user", "name")
+	}
+	if cfg.Nix != "" && cfg.User != nil {
+		add(errors.New("a non-root user is not supported with a Nix dev shell"), "user")
+	}
+	toolNames := map[string]bool{}
+	for i, tool := range cfg.Tools {
+		if err := tool.validate(); err != nil {
+			add(err, "tools", i)
+		} else if toolNames[tool.Name] {
+			add(fmt.Errorf("duplicate tool %s", tool.Name), "tools", i, "name")
+		}
+		toolNames[tool.Name] = true
+	}
+	for i, processor := range cfg.OutputProcessors {
+		if err := processor.validate(); err != nil {
+			add(err, "output_processors", i)
+		}
+	}
+	for i, detector := range cfg.BinaryDetection {
+		if err := validateBinaryDetection([]string{detector}); err != nil {
+			add(err, "binary_detection", i)
+		}
+	}
+	for i, service := range cfg.Services {
+		if _, err := newSidecar(service.Image, service.options()); err != nil {
+			add(err, "services", i)
+		}
+	}
+	if len(errs) == 0 {
+		env := &Environment{Sidecars: cfg.Services}
+		if err := env.resolveSidecars(); err != nil {
+			add(err, "services")
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// jsonSchema is the subset of JSON schema used by ConfigSchema.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Maximum              *int                   `json:"maximum,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+func loadConfigSchema() (*jsonSchema, error) {
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(ConfigSchema, schema); err != nil {
+		return nil, fmt.Errorf("invalid configuration schema: %w", err)
+	}
+	return schema, nil
+}
+
+type schemaValidator struct {
+	root   *jsonSchema
+	errors ConfigErrors
+}
+
+func (v *schemaValidator) fail(node *yaml.Node, path, format string, args ...any) {
+	v.errors = append(v.errors, ConfigError{Path: path, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+// validate checks node, at path, against schema.
+func (v *schemaValidator) validate(node *yaml.Node, schema *jsonSchema, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if ref, ok := strings.CutPrefix(schema.Ref, "#/$defs/"); ok {
+		schema = v.root.Defs[ref]
+	}
+	// Empty values leave settings unset.
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	switch schema.Type {
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			v.fail(node, path, "expected a mapping, got %s", describeNode(node))
+			return
+		}
+		v.validateMapping(node, schema, path)
+		return
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			v.fail(node, path, "expected a list, got %s", describeNode(node))
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range node.Content {
+				v.validate(item, schema.Items, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+		return
+	case "string":
+		// Any scalar is decoded as a string.
+		if node.Kind != yaml.ScalarNode {
+			v.fail(node, path, "expected a string, got %s", describeNode(node))
+			return
+		}
+	case "integer":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			v.fail(node, path, "expected an integer, got %s", describeNode(node))
+			return
+		}
+		value, err := strconv.Atoi(node.Value)
+		if err != nil {
+			v.fail(node, path, "invalid integer %s", node.Value)
+			return
+		}
+		if schema.Minimum != nil && value < *schema.Minimum {
+			v.fail(node, path, "must be at least %d", *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			v.fail(node, path, "must be at most %d", *schema.Maximum)
+		}
+	case "boolean":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			v.fail(node, path, "expected true or false, got %s", describeNode(node))
+			return
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		if node.Kind != yaml.ScalarNode || !slices.Contains(schema.Enum, node.Value) {
+			values := make([]string, 0, len(schema.Enum))
+			for _, value := range schema.Enum {
+				values = append(values, strconv.Quote(value))
+			}
+			v.fail(node, path, "must be one of %s", strings.Join(values, ", "))
+			return
+		}
+	}
+	if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(node.Value) {
+		v.fail(node, path, "invalid value %q (must match %s)", node.Value, schema.Pattern)
+	}
+}
+
+func (v *schemaValidator) validateMapping(node *yaml.Node, schema *jsonSchema, path string) {
+	var additional *jsonSchema
+	allowAdditional := true
+	if len(schema.AdditionalProperties) > 0 {
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowAdditional); err != nil {
+			additional = &jsonSchema{}
+			if err := json.Unmarshal(schema.AdditionalProperties, additional); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyPath := key.Value
+		if path != "" {
+			keyPath = path + "." + key.Value
+		}
+		if seen[key.Value] {
+			v.fail(key, keyPath, "duplicate key")
+			continue
+		}
+		seen[key.Value] = true
+
+		if property, ok := schema.Properties[key.Value]; ok {
+			v.validate(value, property, keyPath)
+			continue
+		}
+		switch {
+		case additional != nil:
+			v.validate(value, additional, keyPath)
+		case !allowAdditional:
+			v.fail(key, keyPath, "unknown setting%s", suggestKey(key.Value, schema.Properties))
+		}
+	}
+	for _, required := range schema.Required {
+		if !seen[required] {
+			v.fail(node, path, "missing required setting %s", required)
+		}
+	}
+}
+
+// suggestKey returns a hint naming the property closest to key, if any is close enough to be a typo.
+func suggestKey(key string, properties map[string]*jsonSchema) string {
+	best, bestDistance := "", 3
+	for property := range properties {
+		if d := editDistance(key, property); d < bestDistance || d == bestDistance && best != "" && property < best {
+			best, bestDistance = property, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %s?)", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	return fmt.Sprintf("%q", node.Value)
+}
+
+// lookupNode returns the node at path (mapping keys and sequence indexes) in
+// document, or its closest existing parent.
+func lookupNode(document *yaml.Node, path ...any) *yaml.Node {
+	node := document
+	for _, element := range path {
+		var next *yaml.Node
+		switch element := element.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == element {
+						next = node.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && element < len(node.Content) {
+				next = node.Content[element]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
+
+// formatPath formats path as in ConfigError, e.g. services[0].image.
+func formatPath(path ...any) string {
+	s := &strings.Builder{}
+	for _, element := range path {
+		switch element := element.(type) {
+		case string:
+			if s.Len() > 0 {
+				s.WriteString(".")
+			}
+			s.WriteString(element)
+		case int:
+			fmt.Fprintf(s, "[%d]", element)
+		}
+	}
+	return s.String()
+}
@@ -0,0 +1,72 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// StateConflictError is returned when the state of an environment changed
+// since it was read, e.g. because another session updated it. The environment
+// is refreshed with the new state: re-read it and retry.
+type StateConflictError struct {
+	Environment string
+	Expected    int64
+	Current     int64
+}
+
+func (e *StateConflictError) Error() string {
+	return fmt.Sprintf("environment %s changed since it was read (state version %d, now %d): re-read it and retry", e.Environment, e.Expected, e.Current)
+}
+
+// Retryable reports that the operation may succeed once retried against the new state.
+func (e *StateConflictError) Retryable() bool {
+	return true
+}
+
+// checkStateVersion fails with a *StateConflictError if the state saved in the
+// worktree was changed by another process, or if expected (when not zero)
+// isn't the current state version. Must be called with the environment locked.
+func (env *Environment) checkStateVersion(expected int64) error {
+	if env.Worktree != "" {
+		saved, err := savedStateVersion(env.Worktree)
+		if err != nil {
+			return err
+		}
+		if saved > env.StateVersion {
+			known := env.StateVersion
+			if err := env.load(env.Worktree); err != nil {
+				return fmt.Errorf("failed to refresh environment state: %w", err)
+			}
+			return &StateConflictError{Environment: env.ID, Expected: known, Current: saved}
+		}
+	}
+	if expected != 0 && expected != env.StateVersion {
+		return &StateConflictError{Environment: env.ID, Expected: expected, Current: env.StateVersion}
+	}
+	return nil
+}
+
+// savedStateVersion returns the version of the environment state saved in baseDir.
+func savedStateVersion(baseDir string) (int64, error) {
+	envState, err := os.ReadFile(path.Join(baseDir, configDir, environmentFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	envState, err = openState(envState)
+	if err != nil {
+		return 0, err
+	}
+	var state struct {
+		StateVersion int64 `json:"state_version"`
+	}
+	if err := json.Unmarshal(envState, &state); err != nil {
+		return 0, err
+	}
+	return state.StateVersion, nil
+}
@@ -0,0 +1,82 @@
+package environment
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckStateVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		// update saves a change of the environment from another session.
+		update      bool
+		expected    int64
+		wantErr     *StateConflictError
+		wantVersion int64
+		wantImage   string
+	}{
+		{
+			name:        "unchanged",
+			wantVersion: 1,
+			wantImage:   "v1",
+		},
+		{
+			name:        "expected version",
+			expected:    1,
+			wantVersion: 1,
+			wantImage:   "v1",
+		},
+		{
+			name:        "unexpected version",
+			expected:    5,
+			wantErr:     &StateConflictError{Environment: "env/test", Expected: 5, Current: 1},
+			wantVersion: 1,
+			wantImage:   "v1",
+		},
+		{
+			name:        "changed by another session",
+			update:      true,
+			wantErr:     &StateConflictError{Environment: "env/test", Expected: 1, Current: 2},
+			wantVersion: 2,
+			wantImage:   "v2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worktree := t.TempDir()
+			env := &Environment{ID: "env/test", BaseImage: "v1", Worktree: worktree}
+			if err := env.save(worktree); err != nil {
+				t.Fatal(err)
+			}
+			if tt.update {
+				other := &Environment{Worktree: worktree}
+				if err := other.load(worktree); err != nil {
+					t.Fatal(err)
+				}
+				other.BaseImage = "v2"
+				if err := other.save(worktree); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := env.checkStateVersion(tt.expected)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("checkStateVersion(%d) error = %v", tt.expected, err)
+				}
+			} else {
+				var conflict *StateConflictError
+				if !errors.As(err, &conflict) || *conflict != *tt.wantErr {
+					t.Fatalf("checkStateVersion(%d) error = %v, want %v", tt.expected, err, tt.wantErr)
+				}
+			}
+			// Conflicts refresh the environment, so that it can be retried.
+			if env.StateVersion != tt.wantVersion || env.BaseImage != tt.wantImage {
+				t.Errorf("environment at version %d with base image %q, want %d and %q", env.StateVersion, env.BaseImage, tt.wantVersion, tt.wantImage)
+			}
+			if err := env.checkStateVersion(0); err != nil {
+				t.Errorf("checkStateVersion(0) after refresh error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+// containerPath resolves p relative to the workdir of the environment.
+func (env *Environment) containerPath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(env.Workdir, p)
+}
+
+// CopyOut copies the file or directory source of the environment container,
+// relative to its workdir, to target on the host.
+func (env *Environment) CopyOut(ctx context.Context, source, target string) error {
+	return env.Download(ctx, env.containerPath(source), target)
+}
+
+// CopyIn copies the host file or directory source to target in the
+// environment container, relative to its workdir. Unlike Upload, nothing is
+// committed: files copied to the workdir are committed with the next change.
+func (env *Environment) CopyIn(ctx context.Context, source, target string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	source, err = filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	target = env.containerPath(target)
+
+	var container *dagger.Container
+	if info.IsDir() {
+		container = env.container.WithDirectory(target, env.client.dag.Host().Directory(source), dagger.ContainerWithDirectoryOpts{Owner: env.User.owner()})
+	} else {
+		container = env.container.WithFile(target, env.client.dag.Host().File(source), dagger.ContainerWithFileOpts{Owner: env.User.owner()})
+	}
+	if _, err := container.Sync(ctx); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", source, target, err)
+	}
+
+	env.mu.Lock()
+	env.container = container
+	env.mu.Unlock()
+	return env.addGitNote(ctx, fmt.Sprintf("cp %s %s\n\n", source, target))
+}
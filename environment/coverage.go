@@ -0,0 +1,359 @@
+package environment
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// coverageReports are the workdir relative paths where test runners write
+// coverage reports by default.
+var coverageReports = []string{
+	"lcov.info",
+	"coverage/lcov.info",
+	"coverage.xml",
+	"coverage/cobertura-coverage.xml",
+	"coverage.out",
+	"cover.out",
+	"coverage.txt",
+}
+
+// FileCoverage is the line coverage of a single file.
+type FileCoverage struct {
+	Path    string `json:"path"`
+	Covered int    `json:"covered"`
+	Total   int    `json:"total"`
+}
+
+// Coverage is the coverage collected after a test run, normalized from the
+// lcov, Cobertura and Go cover profile reports found in the workdir.
+type Coverage struct {
+	Reports []string       `json:"reports"`
+	Covered int            `json:"covered"`
+	Total   int            `json:"total"`
+	Files   []FileCoverage `json:"files,omitempty"`
+}
+
+// Percent returns the percentage of covered lines.
+func (c *Coverage) Percent() float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return float64(c.Covered) * 100 / float64(c.Total)
+}
+
+// withoutCoverageReports removes the coverage reports of the container before a
+// test run, so that collectCoverage only reads the reports written by the run.
+func (env *Environment) withoutCoverageReports(container *dagger.Container) *dagger.Container {
+	reports := make([]string, 0, len(coverageReports))
+	for _, report := range coverageReports {
+		reports = append(reports, path.Join(env.Workdir, report))
+	}
+	return container.WithoutFiles(reports)
+}
+
+// collectCoverage reads the coverage reports of the container. It returns nil
+// when no report is found.
+func (env *Environment) collectCoverage(ctx context.Context, container *dagger.Container) *Coverage {
+	workdir := container.Directory(env.Workdir)
+	files := map[string]*FileCoverage{}
+	coverage := &Coverage{}
+	for _, report := range coverageReports {
+		matches, err := workdir.Glob(ctx, report)
+		if err != nil || len(matches) == 0 {
+			continue
+		}
+		contents, err := workdir.File(report).Contents(ctx)
+		if err != nil {
+			continue
+		}
+		parsed, err := parseCoverage(contents)
+		if err != nil {
+			env.logf("Ignoring coverage report %s: %s", report, err)
+			continue
+		}
+		coverage.Reports = append(coverage.Reports, report)
+		for _, f := range parsed {
+			if existing, ok := files[f.Path]; ok {
+				existing.Covered = max(existing.Covered, f.Covered)
+				existing.Total = max(existing.Total, f.Total)
+				continue
+			}
+			files[f.Path] = &f
+		}
+	}
+	if len(coverage.Reports) == 0 {
+		return nil
+	}
+
+	for _, f := range files {
+		coverage.Covered += f.Covered
+		coverage.Total += f.Total
+		coverage.Files = append(coverage.Files, *f)
+	}
+	sort.Slice(coverage.Files, func(i, j int) bool { return coverage.Files[i].Path < coverage.Files[j].Path })
+	return coverage
+}
+
+// parseCoverage parses a coverage report, detecting its format from its contents.
+func parseCoverage(contents string) ([]FileCoverage, error) {
+	trimmed := strings.TrimSpace(contents)
+	switch {
+	case strings.HasPrefix(trimmed, "mode:"):
+		return parseGoCoverProfile(trimmed)
+	case strings.HasPrefix(trimmed, "<"):
+		return parseCobertura(trimmed)
+	case strings.HasPrefix(trimmed, "TN:"), strings.HasPrefix(trimmed, "SF:"):
+		return parseLcov(trimmed)
+	default:
+		return nil, errors.New("unknown coverage format")
+	}
+}
+
+func parseLcov(contents string) ([]FileCoverage, error) {
+	var (
+		files   []FileCoverage
+		current *FileCoverage
+	)
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		switch key {
+		case "SF":
+			current = &FileCoverage{Path: value}
+		case "LF", "LH":
+			if current == nil {
+				return nil, errors.New("invalid lcov report: record without source file")
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lcov report: %w", err)
+			}
+			if key == "LF" {
+				current.Total = n
+			} else {
+				current.Covered = n
+			}
+		case "end_of_record":
+			if current != nil {
+				files = append(files, *current)
+				current = nil
+			}
+		}
+	}
+	return files, scanner.Err()
+}
+
+type coberturaReport struct {
+	Classes []struct {
+		Filename string `xml:"filename,attr"`
+		Lines    []struct {
+			Number int `xml:"number,attr"`
+			Hits   int `xml:"hits,attr"`
+		} `xml:"lines>line"`
+	} `xml:"packages>package>classes>class"`
+}
+
+func parseCobertura(contents string) ([]FileCoverage, error) {
+	var report coberturaReport
+	if err := xml.Unmarshal([]byte(contents), &report); err != nil {
+		return nil, fmt.Errorf("invalid cobertura report: %w", err)
+	}
+	files := map[string]*FileCoverage{}
+	var order []string
+	for _, class := range report.Classes {
+		f, ok := files[class.Filename]
+		if !ok {
+			f = &FileCoverage{Path: class.Filename}
+			files[class.Filename] = f
+			order = append(order, class.Filename)
+		}
+		for _, line := range class.Lines {
+			f.Total++
+			if line.Hits > 0 {
+				f.Covered++
+			}
+		}
+	}
+	result := make([]FileCoverage, 0, len(order))
+	for _, name := range order {
+		result = append(result, *files[name])
+	}
+	return result, nil
+}
+
+// parseGoCoverProfile parses a go test -coverprofile report. Go coverage is
+// counted in statements rather than lines.
+func parseGoCoverProfile(contents string) ([]FileCoverage, error) {
+	// Blocks can be repeated when profiles of several packages are merged:
+	// keep the highest count of each block.
+	type block struct {
+		statements int
+		covered    bool
+	}
+	blocks := map[string]map[string]*block{}
+	var order []string
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// file.go:start.col,end.col statements count
+		fields := strings.Fields(line)
+		colon := strings.LastIndex(fields[0], ":")
+		if len(fields) != 3 || colon < 0 {
+			return nil, fmt.Errorf("invalid cover profile line: %q", line)
+		}
+		file, position := fields[0][:colon], fields[0][colon+1:]
+		statements, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cover profile line: %q", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cover profile line: %q", line)
+		}
+
+		if _, ok := blocks[file]; !ok {
+			blocks[file] = map[string]*block{}
+			order = append(order, file)
+		}
+		b, ok := blocks[file][position]
+		if !ok {
+			b = &block{statements: statements}
+			blocks[file][position] = b
+		}
+		b.covered = b.covered || count > 0
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]FileCoverage, 0, len(order))
+	for _, file := range order {
+		f := FileCoverage{Path: file}
+		for _, b := range blocks[file] {
+			f.Total += b.statements
+			if b.covered {
+				f.Covered += b.statements
+			}
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// CoveragePoint is the coverage of a revision of the environment.
+type CoveragePoint struct {
+	Version Version `json:"version"`
+	Name    string  `json:"name"`
+	Percent float64 `json:"percent"`
+}
+
+// FileCoverageDelta is the change of coverage of a file between two revisions.
+type FileCoverageDelta struct {
+	Path string  `json:"path"`
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+}
+
+// CoverageDelta is the change of coverage between two revisions.
+type CoverageDelta struct {
+	From  CoveragePoint       `json:"from"`
+	To    CoveragePoint       `json:"to"`
+	Delta float64             `json:"delta"`
+	Files []FileCoverageDelta `json:"files,omitempty"`
+}
+
+// CoverageTrend returns the coverage of every revision of the environment with
+// a coverage report, oldest first.
+func (env *Environment) CoverageTrend() []CoveragePoint {
+	trend := []CoveragePoint{}
+	for _, revision := range env.History {
+		if revision.Coverage == nil {
+			continue
+		}
+		trend = append(trend, CoveragePoint{
+			Version: revision.Version,
+			Name:    revision.Name,
+			Percent: revision.Coverage.Percent(),
+		})
+	}
+	return trend
+}
+
+// CompareCoverage returns the coverage delta between the from and to revisions.
+// A zero version selects, respectively, the previous and the latest revision with coverage.
+func (env *Environment) CompareCoverage(from, to Version) (*CoverageDelta, error) {
+	var covered []*Revision
+	for _, revision := range env.History {
+		if revision.Coverage != nil {
+			covered = append(covered, revision)
+		}
+	}
+
+	find := func(version Version, fallback int) (*Revision, error) {
+		if version == 0 {
+			if fallback < 0 || fallback >= len(covered) {
+				return nil, errors.New("not enough revisions with coverage to compare")
+			}
+			return covered[fallback], nil
+		}
+		i := slices.IndexFunc(covered, func(r *Revision) bool { return r.Version == version })
+		if i < 0 {
+			return nil, fmt.Errorf("no coverage recorded for version %d", version)
+		}
+		return covered[i], nil
+	}
+	toRevision, err := find(to, len(covered)-1)
+	if err != nil {
+		return nil, err
+	}
+	fromRevision, err := find(from, slices.Index(covered, toRevision)-1)
+	if err != nil {
+		return nil, err
+	}
+
+	point := func(r *Revision) CoveragePoint {
+		return CoveragePoint{Version: r.Version, Name: r.Name, Percent: r.Coverage.Percent()}
+	}
+	delta := &CoverageDelta{
+		From: point(fromRevision),
+		To:   point(toRevision),
+	}
+	delta.Delta = delta.To.Percent - delta.From.Percent
+
+	percents := func(c *Coverage) map[string]float64 {
+		m := map[string]float64{}
+		for _, f := range c.Files {
+			if f.Total > 0 {
+				m[path.Clean(f.Path)] = float64(f.Covered) * 100 / float64(f.Total)
+			}
+		}
+		return m
+	}
+	fromFiles, toFiles := percents(fromRevision.Coverage), percents(toRevision.Coverage)
+	for file, to := range toFiles {
+		if from, ok := fromFiles[file]; !ok || from != to {
+			delta.Files = append(delta.Files, FileCoverageDelta{Path: file, From: from, To: to})
+		}
+	}
+	for file, from := range fromFiles {
+		if _, ok := toFiles[file]; !ok {
+			delta.Files = append(delta.Files, FileCoverageDelta{Path: file, From: from})
+		}
+	}
+	sort.Slice(delta.Files, func(i, j int) bool { return delta.Files[i].Path < delta.Files[j].Path })
+	return delta, nil
+}
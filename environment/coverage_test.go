@@ -0,0 +1,180 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCoverage(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []FileCoverage
+		wantErr  bool
+	}{
+		{
+			name: "lcov",
+			contents: `TN:
+SF:src/a.js
+DA:1,1
+LF:10
+LH:7
+end_of_record
+SF:src/b.js
+LF:4
+LH:0
+end_of_record
+`,
+			want: []FileCoverage{
+				{Path: "src/a.js", Covered: 7, Total: 10},
+				{Path: "src/b.js", Covered: 0, Total: 4},
+			},
+		},
+		{
+			name:     "lcov record without source file",
+			contents: "TN:\nLF:10\n",
+			wantErr:  true,
+		},
+		{
+			name: "cobertura",
+			contents: `<?xml version="1.0" ?>
+<coverage>
+  <packages>
+    <package name="app">
+      <classes>
+        <class filename="app/a.py">
+          <lines>
+            <line number="1" hits="1"/>
+            <line number="2" hits="0"/>
+          </lines>
+        </class>
+        <class filename="app/b.py">
+          <lines>
+            <line number="1" hits="3"/>
+          </lines>
+        </class>
+        <class filename="app/a.py">
+          <lines>
+            <line number="3" hits="2"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`,
+			want: []FileCoverage{
+				{Path: "app/a.py", Covered: 2, Total: 3},
+				{Path: "app/b.py", Covered: 1, Total: 1},
+			},
+		},
+		{
+			name: "go cover profile",
+			contents: `mode: set
+example.com/m/a.go:3.14,5.2 2 1
+example.com/m/a.go:7.14,9.2 3 0
+example.com/m/b.go:3.14,5.2 1 0
+`,
+			want: []FileCoverage{
+				{Path: "example.com/m/a.go", Covered: 2, Total: 5},
+				{Path: "example.com/m/b.go", Covered: 0, Total: 1},
+			},
+		},
+		{
+			name: "merged go cover profiles",
+			contents: `mode: count
+example.com/m/a.go:3.14,5.2 2 0
+example.com/m/a.go:3.14,5.2 2 4
+`,
+			want: []FileCoverage{
+				{Path: "example.com/m/a.go", Covered: 2, Total: 2},
+			},
+		},
+		{
+			name:     "invalid go cover profile",
+			contents: "mode: set\nexample.com/m/a.go:3.14,5.2 two 1\n",
+			wantErr:  true,
+		},
+		{
+			name:     "unknown format",
+			contents: "coverage: 42%",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCoverage(tt.contents)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCoverage() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCoverage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCoverage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareCoverage(t *testing.T) {
+	env := &Environment{History: History{
+		{Version: 1, Coverage: &Coverage{Covered: 5, Total: 10, Files: []FileCoverage{
+			{Path: "a.go", Covered: 5, Total: 10},
+		}}},
+		{Version: 2},
+		{Version: 3, Coverage: &Coverage{Covered: 8, Total: 10, Files: []FileCoverage{
+			{Path: "./a.go", Covered: 6, Total: 8},
+			{Path: "b.go", Covered: 2, Total: 2},
+		}}},
+	}}
+
+	tests := []struct {
+		name     string
+		from, to Version
+		want     *CoverageDelta
+		wantErr  bool
+	}{
+		{
+			name: "latest against previous",
+			want: &CoverageDelta{
+				From:  CoveragePoint{Version: 1, Percent: 50},
+				To:    CoveragePoint{Version: 3, Percent: 80},
+				Delta: 30,
+				Files: []FileCoverageDelta{
+					{Path: "a.go", From: 50, To: 75},
+					{Path: "b.go", From: 0, To: 100},
+				},
+			},
+		},
+		{
+			name:    "revision without coverage",
+			from:    2,
+			wantErr: true,
+		},
+		{
+			name:    "nothing to compare the first revision to",
+			to:      1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := env.CompareCoverage(tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("CompareCoverage() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CompareCoverage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompareCoverage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
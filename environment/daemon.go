@@ -0,0 +1,68 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dependencyFiles are the files, on top of rebuildTriggers, that environment
+// containers are provisioned from.
+var dependencyFiles = []string{
+	"go.mod", "go.sum",
+	"package.json", "package-lock.json", "yarn.lock", "pnpm-lock.yaml",
+	"pyproject.toml", "requirements.txt", "poetry.lock", "uv.lock",
+	"Cargo.toml", "Cargo.lock",
+	"Gemfile", "Gemfile.lock",
+}
+
+// dependencyFingerprint identifies the state of the dependency files of the repository at source.
+func dependencyFingerprint(source string) string {
+	h := sha256.New()
+	for _, name := range append(rebuildTriggers, dependencyFiles...) {
+		info, err := os.Stat(filepath.Join(source, name))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Watch keeps the environment containers of repos pre-warmed until ctx is
+// done: each repository is checked every interval, and when its configuration
+// or dependencies change its container is provisioned again and its
+// dependencies prefetched, see Prewarm. Environments created by the client
+// then start from the pre-warmed container, with their dependencies cached.
+func (c *Client) Watch(ctx context.Context, repos []string, interval time.Duration) error {
+	fingerprints := map[string]string{}
+	for {
+		for _, repo := range repos {
+			source, err := filepath.Abs(repo)
+			if err != nil {
+				return err
+			}
+			fingerprint := dependencyFingerprint(source)
+			if fingerprints[source] == fingerprint {
+				continue
+			}
+			if _, seen := fingerprints[source]; seen {
+				slog.Info("Dependencies changed, pre-warming environment container", "source", source)
+			}
+			fingerprints[source] = fingerprint
+			if err := c.Prewarm(ctx, source); err != nil {
+				slog.Warn("Failed to pre-warm environment container", "source", source, "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
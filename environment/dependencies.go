@@ -0,0 +1,135 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// defaultReadyTimeout is how long, in seconds, sidecars have to become ready by default.
+const defaultReadyTimeout = 60
+
+// Requirement is a service exposed by another environment (see Expose) that
+// an environment needs, e.g. the API a frontend talks to. It's reachable
+// from the environment under Alias.
+type Requirement struct {
+	// Environment is the name or ID of the environment exposing the service.
+	Environment string `json:"environment" yaml:"environment"`
+	Service     string `json:"service" yaml:"service"`
+	// Alias is the hostname of the service, defaults to its name.
+	Alias string `json:"alias,omitempty" yaml:"alias,omitempty"`
+}
+
+// sidecarOrder returns sidecars in start order: each after the ones it depends on.
+func sidecarOrder(sidecars []Sidecar) ([]Sidecar, error) {
+	ordered := make([]Sidecar, 0, len(sidecars))
+	// state is 1 while a sidecar's dependencies are visited, 2 once it's ordered.
+	state := map[string]int{}
+	var visit func(sidecar Sidecar, path []string) error
+	visit = func(sidecar Sidecar, path []string) error {
+		switch state[sidecar.Name] {
+		case 1:
+			return fmt.Errorf("services depend on each other: %s", strings.Join(append(path, sidecar.Name), " -> "))
+		case 2:
+			return nil
+		}
+		state[sidecar.Name] = 1
+		for _, name := range sidecar.DependsOn {
+			i := slices.IndexFunc(sidecars, func(s Sidecar) bool { return s.Name == name })
+			if i < 0 {
+				return fmt.Errorf("service %s depends on unknown service %s", sidecar.Name, name)
+			}
+			if err := visit(sidecars[i], append(path, sidecar.Name)); err != nil {
+				return err
+			}
+		}
+		state[sidecar.Name] = 2
+		ordered = append(ordered, sidecar)
+		return nil
+	}
+	for _, sidecar := range sidecars {
+		if err := visit(sidecar, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// startSidecar starts the service of sidecar and waits for it to be ready.
+func (env *Environment) startSidecar(ctx context.Context, sidecar Sidecar) (*dagger.Service, error) {
+	svc, err := env.sidecarService(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	reportStage(ctx, StageServices, 0, 0, "Starting service %s (%s)", sidecar.Name, sidecar.Image)
+	if _, err := svc.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start service %s: %w", sidecar.Name, err)
+	}
+	if sidecar.Ready == "" {
+		return svc, nil
+	}
+
+	timeout := sidecar.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	reportStage(ctx, StageServices, 0, 0, "Waiting for service %s to be ready", sidecar.Name)
+	stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Waiting for service %s to be ready", sidecar.Name))
+	defer stopHeartbeat()
+	// The last attempt isn't silenced, so its output explains the failure.
+	script := fmt.Sprintf(`i=1
+while [ $i -lt %d ]; do
+	(%s) >/dev/null 2>&1 && exit 0
+	sleep 1
+	i=$((i + 1))
+done
+%s`, timeout, sidecar.Ready, sidecar.Ready)
+	_, err = env.client.dag.Container().From(sidecar.Image).
+		WithServiceBinding(sidecar.Name, svc).
+		WithEnvVariable("CACHEBUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", script}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("service %s isn't ready after %ds (%s): %w", sidecar.Name, timeout, sidecar.Ready, err)
+	}
+	return svc, nil
+}
+
+// startDependencies starts the sidecars of the environment in order, each
+// once the ones it depends on are ready, and links the services of other
+// environments it requires. It fails if a required service isn't running.
+func (env *Environment) startDependencies(ctx context.Context) error {
+	sidecars, err := sidecarOrder(env.Sidecars)
+	if err != nil {
+		return err
+	}
+	for _, sidecar := range sidecars {
+		if _, err := env.startSidecar(ctx, sidecar); err != nil {
+			return err
+		}
+	}
+
+	for _, requirement := range env.Requires {
+		target := env.client.Get(requirement.Environment)
+		if target == nil {
+			return fmt.Errorf("environment %s, required by %s, isn't open: create or open it first", requirement.Environment, env.Name)
+		}
+		if target.service(requirement.Service) == nil {
+			return fmt.Errorf("environment %s, required by %s, doesn't expose service %s: expose it first", target.ID, env.Name, requirement.Service)
+		}
+		alias := requirement.Alias
+		if alias == "" {
+			alias = requirement.Service
+		}
+		if err := validateHostname(alias); err != nil {
+			return err
+		}
+		link := ServiceLink{Alias: alias, Environment: target.ID, Service: requirement.Service}
+		env.Links = append(slices.DeleteFunc(env.Links, func(l ServiceLink) bool { return l.Alias == alias }), link)
+	}
+	return nil
+}
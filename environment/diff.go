@@ -0,0 +1,210 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type DiffOpts struct {
+	// Patch includes the full patch text in the result.
+	Patch bool
+	// Paths restricts the diff to the given paths (relative to the repository root).
+	Paths []string
+}
+
+type FileDiff struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+type Diff struct {
+	Base      string     `json:"base"`
+	Head      string     `json:"head"`
+	Files     []FileDiff `json:"files"`
+	Additions int        `json:"additions"`
+	Deletions int        `json:"deletions"`
+	Patch     string     `json:"patch,omitempty"`
+}
+
+// Diff returns the changes made in the environment branch since it diverged from
+// the branch currently checked out in the source repository.
+func (env *Environment) Diff(ctx context.Context, opts DiffOpts) (*Diff, error) {
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := runGitCommand(ctx, localRepoPath, "branch", "--show-current")
+	if err != nil {
+		return nil, err
+	}
+	base = strings.TrimSpace(base)
+	if base == "" {
+		base = "HEAD"
+	}
+	head := fmt.Sprintf("container-use/%s", env.ID)
+
+	return diffRefs(ctx, localRepoPath, base+"..."+head, base, head, opts)
+}
+
+func diffRefs(ctx context.Context, repoPath, revRange, base, head string, opts DiffOpts) (*Diff, error) {
+	pathArgs := append([]string{"--"}, opts.Paths...)
+
+	numstat, err := runGitCommand(ctx, repoPath, append([]string{"diff", "--numstat", "--no-renames", revRange}, pathArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &Diff{
+		Base:  base,
+		Head:  head,
+		Files: []FileDiff{},
+	}
+	for _, line := range strings.Split(strings.TrimSpace(numstat), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		file := FileDiff{Path: fields[2]}
+		if fields[0] == "-" && fields[1] == "-" {
+			file.Binary = true
+		} else {
+			if file.Additions, err = strconv.Atoi(fields[0]); err != nil {
+				return nil, fmt.Errorf("unexpected numstat output %q: %w", line, err)
+			}
+			if file.Deletions, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("unexpected numstat output %q: %w", line, err)
+			}
+		}
+		diff.Additions += file.Additions
+		diff.Deletions += file.Deletions
+		diff.Files = append(diff.Files, file)
+	}
+
+	if opts.Patch {
+		patch, err := runGitCommand(ctx, repoPath, append([]string{"diff", "--no-renames", revRange}, pathArgs...)...)
+		if err != nil {
+			return nil, err
+		}
+		diff.Patch = patch
+	}
+
+	return diff, nil
+}
+
+// ValueDiff is a setting whose value differs between two environments.
+// An empty value means the setting is unset.
+type ValueDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// ListDiff lists the entries of a setting only present in one of two environments.
+type ListDiff struct {
+	OnlyA []string `json:"only_a,omitempty"`
+	OnlyB []string `json:"only_b,omitempty"`
+}
+
+func (d *ListDiff) empty() bool {
+	return len(d.OnlyA) == 0 && len(d.OnlyB) == 0
+}
+
+// EnvironmentDiff compares two environments.
+type EnvironmentDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// Files are the changes from the branch of A to the branch of B.
+	Files         *Diff                `json:"files"`
+	BaseImage     *ValueDiff           `json:"base_image,omitempty"`
+	Env           map[string]ValueDiff `json:"env,omitempty"`
+	Packages      *ListDiff            `json:"packages,omitempty"`
+	SetupCommands *ListDiff            `json:"setup_commands,omitempty"`
+}
+
+// DiffEnvironments compares the files and configuration of two environments
+// created from the same source repository, e.g. two forks exploring different approaches.
+func DiffEnvironments(ctx context.Context, a, b *Environment, opts DiffOpts) (*EnvironmentDiff, error) {
+	sourceA, err := filepath.Abs(a.Source)
+	if err != nil {
+		return nil, err
+	}
+	sourceB, err := filepath.Abs(b.Source)
+	if err != nil {
+		return nil, err
+	}
+	if sourceA != sourceB {
+		return nil, fmt.Errorf("environments %s and %s come from different repositories", a.ID, b.ID)
+	}
+
+	headA := fmt.Sprintf("container-use/%s", a.ID)
+	headB := fmt.Sprintf("container-use/%s", b.ID)
+	files, err := diffRefs(ctx, sourceA, headA+".."+headB, headA, headB, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &EnvironmentDiff{
+		A:     a.ID,
+		B:     b.ID,
+		Files: files,
+	}
+	if a.BaseImage != b.BaseImage {
+		diff.BaseImage = &ValueDiff{A: a.BaseImage, B: b.BaseImage}
+	}
+	if packages := diffLists(a.Packages, b.Packages); !packages.empty() {
+		diff.Packages = packages
+	}
+	if setup := diffLists(a.SetupCommands, b.SetupCommands); !setup.empty() {
+		diff.SetupCommands = setup
+	}
+
+	envA, envB := envMap(a.Env), envMap(b.Env)
+	for key, value := range envA {
+		if envB[key] != value {
+			if diff.Env == nil {
+				diff.Env = map[string]ValueDiff{}
+			}
+			diff.Env[key] = ValueDiff{A: value, B: envB[key]}
+		}
+	}
+	for key, value := range envB {
+		if _, ok := envA[key]; !ok {
+			if diff.Env == nil {
+				diff.Env = map[string]ValueDiff{}
+			}
+			diff.Env[key] = ValueDiff{B: value}
+		}
+	}
+
+	return diff, nil
+}
+
+func diffLists(a, b []string) *ListDiff {
+	diff := &ListDiff{}
+	for _, entry := range a {
+		if !slices.Contains(b, entry) {
+			diff.OnlyA = append(diff.OnlyA, entry)
+		}
+	}
+	for _, entry := range b {
+		if !slices.Contains(a, entry) {
+			diff.OnlyB = append(diff.OnlyB, entry)
+		}
+	}
+	return diff
+}
+
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		m[key] = value
+	}
+	return m
+}
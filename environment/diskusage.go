@@ -0,0 +1,31 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DiskUsage returns the number of bytes used by the files of the environment's workdir.
+func (env *Environment) DiskUsage(ctx context.Context) (int64, error) {
+	env.mu.Lock()
+	container := env.container
+	env.mu.Unlock()
+	if container == nil {
+		return 0, fmt.Errorf("environment %s is not provisioned", env.ID)
+	}
+	out, err := container.WithExec([]string{"du", "-sk", env.Workdir}).Stdout(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure disk usage: %w", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected du output: %q", out)
+	}
+	kb, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected du output: %q", out)
+	}
+	return kb * 1024, nil
+}
@@ -0,0 +1,227 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/mitchellh/go-homedir"
+)
+
+// CheckStatus is the outcome of a diagnostic check.
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// Check is the result of a diagnostic check, with a suggested fix when it didn't pass.
+type Check struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Fix     string      `json:"fix,omitempty"`
+}
+
+// Diagnose checks that container-use can work with the repository at source:
+// git installation and configuration, Dagger engine connectivity (when
+// the client is connected), configuration directory integrity, repository
+// configuration, stale locks and dangling environment branches or worktrees.
+func (c *Client) Diagnose(ctx context.Context, source string) []Check {
+	checks := []Check{
+		checkGit(ctx),
+		checkGitIdentity(ctx, source),
+		checkRepository(ctx, source),
+		checkDagger(ctx, c.dag),
+		checkConfigDir(),
+		checkRepoConfig(source),
+		checkLock(source),
+	}
+	return append(checks, checkDangling(ctx)...)
+}
+
+func checkGit(ctx context.Context) Check {
+	check := Check{Name: "git"}
+	if _, err := exec.LookPath("git"); err != nil {
+		check.Status = CheckFail
+		check.Message = "git is not installed"
+		check.Fix = "Install git and make sure it's in your PATH"
+		return check
+	}
+	version, err := exec.CommandContext(ctx, "git", "--version").Output()
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("failed to run git: %s", err)
+		check.Fix = "Make sure the git in your PATH works"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = strings.TrimSpace(string(version))
+	return check
+}
+
+func checkGitIdentity(ctx context.Context, source string) Check {
+	check := Check{Name: "git identity"}
+	missing := []string{}
+	for _, key := range []string{"user.name", "user.email"} {
+		if out, err := runGitCommand(ctx, source, "config", "--get", key); err != nil || strings.TrimSpace(out) == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s not configured, environment commits will fail", strings.Join(missing, " and "))
+		check.Fix = `Run git config --global user.name "Your Name" and git config --global user.email you@example.com`
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "commit identity configured"
+	return check
+}
+
+func checkRepository(ctx context.Context, source string) Check {
+	check := Check{Name: "repository"}
+	if _, err := runGitCommand(ctx, source, "rev-parse", "--is-inside-work-tree"); err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s is not a git repository", source)
+		check.Fix = "Run container-use from a git repository, or create one with git init"
+		return check
+	}
+	if _, err := runGitCommand(ctx, source, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		check.Status = CheckFail
+		check.Message = "the repository has no commits, environments can't branch off it"
+		check.Fix = "Create an initial commit with git commit --allow-empty -m 'Initial commit'"
+		return check
+	}
+	if branch, err := runGitCommand(ctx, source, "branch", "--show-current"); err != nil || strings.TrimSpace(branch) == "" {
+		check.Status = CheckWarn
+		check.Message = "HEAD is detached, environments are created from a branch"
+		check.Fix = "Check out a branch with git switch <branch>"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "git repository with commits"
+	return check
+}
+
+func checkDagger(ctx context.Context, dag *dagger.Client) Check {
+	check := Check{Name: "dagger"}
+	if dag == nil {
+		check.Status = CheckFail
+		check.Message = "not connected to the Dagger engine"
+		check.Fix = "Make sure Docker (or another container runtime) is installed and running"
+		return check
+	}
+	version, err := CheckEngineVersion(ctx, dag)
+	var versionErr *EngineVersionError
+	if errors.As(err, &versionErr) {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("Dagger engine %s is not supported, container-use requires >= %s and < %s", version, MinEngineVersion, MaxEngineVersion)
+		check.Fix = fmt.Sprintf("Unset _EXPERIMENTAL_DAGGER_RUNNER_HOST to let container-use provision a compatible engine, or set it to %s", CompatibleEngine)
+		return check
+	}
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("the Dagger engine doesn't respond: %s", err)
+		check.Fix = "Make sure Docker is running, then remove the dagger-engine container to restart the engine"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("Dagger engine %s", version)
+	return check
+}
+
+func checkConfigDir() Check {
+	check := Check{Name: "config directory"}
+	dir, err := homedir.Expand("~/.config/container-use")
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("failed to resolve the configuration directory: %s", err)
+		check.Fix = "Make sure HOME is set"
+		return check
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s can't be created: %s", dir, err)
+		check.Fix = fmt.Sprintf("Fix the permissions of %s", filepath.Dir(dir))
+		return check
+	}
+	probe, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s is not writable: %s", dir, err)
+		check.Fix = fmt.Sprintf("Fix the permissions of %s", dir)
+		return check
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("%s is writable", dir)
+	return check
+}
+
+func checkRepoConfig(source string) Check {
+	check := Check{Name: "configuration"}
+	errs, err := ValidateConfig(source)
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("failed to read %s: %s", RepoConfigFile, err)
+		return check
+	}
+	if len(errs) > 0 {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s has %d problems, the first one at %s", RepoConfigFile, len(errs), errs[0].Error())
+		check.Fix = "Run `cu config validate` to list them"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("%s is valid or absent", RepoConfigFile)
+	return check
+}
+
+func checkLock(source string) Check {
+	check := Check{Name: "lock"}
+	lockPath := path.Join(source, configDir, lockFile)
+	if _, err := os.Stat(lockPath); err == nil {
+		check.Status = CheckWarn
+		check.Message = "environments of this repository are locked, updates are refused"
+		check.Fix = fmt.Sprintf("Remove %s if the lock is stale", lockPath)
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "no lock"
+	return check
+}
+
+func checkDangling(ctx context.Context) []Check {
+	actions, err := Reconcile(ctx, true)
+	if err != nil {
+		return []Check{{
+			Name:    "environments",
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("failed to scan environments: %s", err),
+		}}
+	}
+	if len(actions) == 0 {
+		return []Check{{Name: "environments", Status: CheckOK, Message: "no dangling branches or worktrees"}}
+	}
+	checks := []Check{}
+	for _, action := range actions {
+		checks = append(checks, Check{
+			Name:    "environments",
+			Status:  CheckWarn,
+			Message: fmt.Sprintf("%s: %s", action.Path, action.Problem),
+			Fix:     "Run cu reconcile to " + action.Action,
+		})
+	}
+	return checks
+}
@@ -0,0 +1,143 @@
+package environment
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// StateKeyEnv holds the passphrase used to encrypt the environment state kept in git notes.
+	StateKeyEnv = "CONTAINER_USE_STATE_KEY"
+
+	// encryptedStatePrefix marks encrypted state so it can be told apart from
+	// plaintext JSON. Its key is derived from the passphrase with argon2id and
+	// a random salt, stored before the nonce.
+	encryptedStatePrefix = "container-use-encrypted:v2:"
+	// legacyEncryptedStatePrefix marks state encrypted with the SHA-256 of the
+	// passphrase, which can still be read.
+	legacyEncryptedStatePrefix = "container-use-encrypted:v1:"
+
+	stateSaltSize = 16
+)
+
+// StateKeyPath returns the path of the file holding the state encryption passphrase.
+// It is used when StateKeyEnv is not set.
+func StateKeyPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/state.key")
+}
+
+// statePassphrase returns the passphrase used to encrypt environment state, or
+// an empty string if state encryption is not configured.
+func statePassphrase() (string, error) {
+	passphrase := os.Getenv(StateKeyEnv)
+	if passphrase == "" {
+		keyPath, err := StateKeyPath()
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return "", nil
+			}
+			return "", err
+		}
+		passphrase = strings.TrimSpace(string(data))
+	}
+	return passphrase, nil
+}
+
+// stateKey derives the AES-256 key encrypting environment state from passphrase and salt.
+func stateKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+}
+
+func stateCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealState encrypts state when a state key is configured and returns it unchanged otherwise.
+func sealState(state []byte) ([]byte, error) {
+	passphrase, err := statePassphrase()
+	if err != nil || passphrase == "" {
+		return state, err
+	}
+	salt := make([]byte, stateSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := stateCipher(stateKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(append(salt, nonce...), nonce, state, nil)
+	return []byte(encryptedStatePrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openState decrypts state produced by sealState. Plaintext state is returned as is.
+func openState(state []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(state)
+	var prefix string
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(encryptedStatePrefix)):
+		prefix = encryptedStatePrefix
+	case bytes.HasPrefix(trimmed, []byte(legacyEncryptedStatePrefix)):
+		prefix = legacyEncryptedStatePrefix
+	default:
+		return state, nil
+	}
+
+	passphrase, err := statePassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("environment state is encrypted: set %s or create a key file", StateKeyEnv)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(trimmed[len(prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted state: %w", err)
+	}
+	var key []byte
+	if prefix == legacyEncryptedStatePrefix {
+		sum := sha256.Sum256([]byte(passphrase))
+		key = sum[:]
+	} else {
+		if len(sealed) < stateSaltSize {
+			return nil, errors.New("invalid encrypted state: too short")
+		}
+		key, sealed = stateKey(passphrase, sealed[:stateSaltSize]), sealed[stateSaltSize:]
+	}
+	aead, err := stateCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid encrypted state: too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt environment state (wrong key?): %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,52 @@
+package environment
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealState(t *testing.T) {
+	state := []byte(`{"version":1}`)
+	tests := []struct {
+		name       string
+		passphrase string
+		encrypted  bool
+	}{
+		{name: "encrypted", passphrase: "correct horse battery staple", encrypted: true},
+		{name: "plaintext", passphrase: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(StateKeyEnv, tt.passphrase)
+			if passphrase, _ := statePassphrase(); passphrase != tt.passphrase {
+				t.Skip("a state key file is configured")
+			}
+			sealed, err := sealState(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted := bytes.HasPrefix(sealed, []byte(encryptedStatePrefix)); encrypted != tt.encrypted {
+				t.Fatalf("sealState() = %q, encrypted = %v, want %v", sealed, encrypted, tt.encrypted)
+			}
+			opened, err := openState(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, state) {
+				t.Errorf("openState(sealState()) = %q, want %q", opened, state)
+			}
+		})
+	}
+}
+
+func TestOpenStateWrongPassphrase(t *testing.T) {
+	t.Setenv(StateKeyEnv, "correct horse battery staple")
+	sealed, err := sealState([]byte(`{"version":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(StateKeyEnv, "wrong")
+	if opened, err := openState(sealed); err == nil {
+		t.Errorf("openState() = %q with the wrong passphrase, want an error", opened)
+	}
+}
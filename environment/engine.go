@@ -0,0 +1,85 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+	"dagger.io/dagger/engineconn"
+)
+
+const (
+	// MinEngineVersion is the oldest Dagger engine container-use works with.
+	MinEngineVersion = "v0.18.0"
+	// MaxEngineVersion is the first Dagger engine release whose API container-use doesn't support yet.
+	MaxEngineVersion = "v0.19.0"
+)
+
+// CompatibleEngine is the runner host of the Dagger engine container-use is
+// built against, e.g. to provision it with dagger.WithRunnerHost.
+var CompatibleEngine = "docker-image://registry.dagger.io/engine:v" + engineconn.CLIVersion
+
+// EngineVersionError is returned when the Dagger engine container-use is
+// connected to is outside the supported range of versions.
+type EngineVersionError struct {
+	Version string
+}
+
+func (e *EngineVersionError) Error() string {
+	return fmt.Sprintf("Dagger engine %s is not supported: container-use requires an engine >= %s and < %s. "+
+		"Unset _EXPERIMENTAL_DAGGER_RUNNER_HOST (or run outside of `dagger run`) to let container-use provision v%s, "+
+		"or point it to a compatible engine with _EXPERIMENTAL_DAGGER_RUNNER_HOST=%s",
+		e.Version, MinEngineVersion, MaxEngineVersion, engineconn.CLIVersion, CompatibleEngine)
+}
+
+// CheckEngineVersion returns the version of the Dagger engine dag is
+// connected to, and an EngineVersionError if it isn't supported.
+func CheckEngineVersion(ctx context.Context, dag *dagger.Client) (string, error) {
+	version, err := dag.Version(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the version of the Dagger engine: %w", err)
+	}
+	current, ok := parseEngineVersion(version)
+	if !ok {
+		// Development builds of the engine aren't versioned.
+		slog.Warn("Unknown Dagger engine version, assuming it is compatible", "version", version)
+		return version, nil
+	}
+	minimum, _ := parseEngineVersion(MinEngineVersion)
+	maximum, _ := parseEngineVersion(MaxEngineVersion)
+	if compareEngineVersions(current, minimum) < 0 || compareEngineVersions(current, maximum) >= 0 {
+		return version, &EngineVersionError{Version: version}
+	}
+	return version, nil
+}
+
+// parseEngineVersion returns the major, minor and patch numbers of version,
+// e.g. v0.18.9 or v0.18.10-250612120000-abcdef (ignoring the pre-release).
+func parseEngineVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	version, _, _ = strings.Cut(strings.TrimPrefix(version, "v"), "-")
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+func compareEngineVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return 0
+}
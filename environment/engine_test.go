@@ -0,0 +1,44 @@
+package environment
+
+import "testing"
+
+func TestParseEngineVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		wantOK  bool
+	}{
+		{version: "v0.18.9", want: [3]int{0, 18, 9}, wantOK: true},
+		{version: "0.18.10", want: [3]int{0, 18, 10}, wantOK: true},
+		{version: "v0.18.10-250612120000-abcdef", want: [3]int{0, 18, 10}, wantOK: true},
+		{version: "v0.18", wantOK: false},
+		{version: "devel", wantOK: false},
+		{version: "v0.x.1", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, ok := parseEngineVersion(tt.version)
+			if ok != tt.wantOK || ok && got != tt.want {
+				t.Errorf("parseEngineVersion(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCompareEngineVersions(t *testing.T) {
+	tests := []struct {
+		a, b [3]int
+		want int
+	}{
+		{a: [3]int{0, 18, 9}, b: [3]int{0, 18, 9}, want: 0},
+		{a: [3]int{0, 18, 9}, b: [3]int{0, 18, 10}, want: -1},
+		{a: [3]int{0, 19, 0}, b: [3]int{0, 18, 10}, want: 1},
+		{a: [3]int{1, 0, 0}, b: [3]int{0, 99, 99}, want: 1},
+	}
+	for _, tt := range tests {
+		got := compareEngineVersions(tt.a, tt.b)
+		if got < 0 && tt.want >= 0 || got > 0 && tt.want <= 0 || got == 0 && tt.want != 0 {
+			t.Errorf("compareEngineVersions(%v, %v) = %d, want the sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
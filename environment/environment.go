@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,19 +10,22 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dagger.io/dagger"
 
+	"github.com/dagger/container-use/telemetry"
 	petname "github.com/dustinkirkland/golang-petname"
 )
 
-var dag *dagger.Client
-
 const (
 	defaultImage     = "ubuntu:24.04"
+	defaultWorkdir   = "/workdir"
 	alpineImage      = "alpine:3.21.3@sha256:a8560b36e8b8210634f77d9f7f9efd7ffa463e380b75e2e74aff4511df3ef88c"
 	configDir        = ".container-use"
 	instructionsFile = "AGENT.md"
@@ -38,6 +42,23 @@ type Revision struct {
 	Output      string    `json:"output,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	State       string    `json:"state"`
+	// Signer identifies the key the revision's commit was signed with, if any.
+	Signer string `json:"signer,omitempty"`
+	// Client is the name of the MCP client that made the revision, if known.
+	Client string `json:"client,omitempty"`
+	// ClientVersion and Session further identify the client that made the revision.
+	ClientVersion string `json:"client_version,omitempty"`
+	Session       string `json:"session,omitempty"`
+	// Coverage is the coverage collected after a test run, if any.
+	Coverage *Coverage `json:"coverage,omitempty"`
+	// FailedTests are the test runs that failed on the revision, which
+	// didn't make revisions of their own.
+	FailedTests []CommandRun `json:"failed_tests,omitempty"`
+	// Transfer describes the files uploaded from the host, if any.
+	Transfer *Transfer `json:"transfer,omitempty"`
+	// Checksums are the checksums of the files written and the directories
+	// uploaded, by path, see checksum and listingChecksum.
+	Checksums map[string]string `json:"checksums,omitempty"`
 
 	container *dagger.Container `json:"-"`
 }
@@ -68,11 +89,6 @@ func (h History) Get(version Version) *Revision {
 	return nil
 }
 
-func Initialize(client *dagger.Client) error {
-	dag = client
-	return nil
-}
-
 type Environment struct {
 	ID       string `json:"-"`
 	Name     string `json:"-"`
@@ -82,13 +98,145 @@ type Environment struct {
 	Instructions  string   `json:"-"`
 	Workdir       string   `json:"workdir"`
 	BaseImage     string   `json:"base_image"`
+	Packages      []string `json:"packages,omitempty"`
 	SetupCommands []string `json:"setup_commands,omitempty"`
-	Secrets       []string `json:"secrets,omitempty"`
+	// SetupGroups are groups of independent setup commands, run after
+	// SetupCommands: groups run in order, the commands of a group in parallel.
+	SetupGroups [][]string `json:"setup_groups,omitempty"`
+	// BaseImageDigest is the reference, with its digest, of the base image the container was last built from.
+	BaseImageDigest string `json:"base_image_digest,omitempty"`
+	// Bootstrap are commands run in the environment each time it is built, see bootstrap.
+	Bootstrap []string `json:"bootstrap,omitempty"`
+	Secrets   []string `json:"secrets,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	Ports     []int    `json:"ports,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+	// PersistentDirs are workdir relative directories (e.g. node_modules) kept in a
+	// per-environment cache volume that survives rebuilds.
+	PersistentDirs []string `json:"persistent_dirs,omitempty"`
+	// Signing overrides the git signing settings used for the environment's commits.
+	Signing *SigningConfig `json:"signing,omitempty"`
+	// Author is the identity of the environment's commits, ClientAuthors overrides it per MCP client.
+	Author        *GitAuthor            `json:"author,omitempty"`
+	ClientAuthors map[string]*GitAuthor `json:"client_authors,omitempty"`
+	// CommitMessage is a text/template rendering commit messages from CommitMessageData.
+	CommitMessage string `json:"commit_message,omitempty"`
+	// Mirror pushes the environment to a remote shared with other machines.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// Notes is where the log and state of the environment are kept, see NotesConfig.
+	Notes         *NotesConfig   `json:"notes,omitempty"`
+	CommandPolicy *CommandPolicy `json:"command_policy,omitempty"`
+	Network       *NetworkPolicy `json:"network,omitempty"`
+	Proxy         *ProxyConfig   `json:"proxy,omitempty"`
+	Audit         *AuditConfig   `json:"audit,omitempty"`
+	Links         []ServiceLink  `json:"links,omitempty"`
+	// Sidecars are the service containers, e.g. databases, started alongside the environment.
+	Sidecars []Sidecar `json:"sidecars,omitempty"`
+	// Requires are the services of other environments the environment needs, linked when it's created or updated.
+	Requires []Requirement `json:"requires,omitempty"`
+	// Nix runs every command in the project's Nix dev shell ("flake" or "shell").
+	Nix string `json:"nix,omitempty"`
+	// ToolVersions pins tool versions (e.g. node: 20.11.0) installed with mise.
+	ToolVersions map[string]string `json:"tool_versions,omitempty"`
+	// Linters are the linters run by RunLinters (eslint, ruff, golangci-lint).
+	Linters []string `json:"linters,omitempty"`
+	// OutputLimit is the size, in bytes, of the command outputs returned by Run, see limitOutput.
+	OutputLimit int `json:"output_limit,omitempty"`
+	// ANSI tells whether Run keeps the escape sequences of command outputs, see ansiMode.
+	ANSI ANSIMode `json:"ansi,omitempty"`
+	// OutputProcessors transform the command outputs returned by Run.
+	OutputProcessors []OutputProcessor `json:"output_processors,omitempty"`
+	// Compression is how directories uploaded and downloaded are compressed, see compressionFor.
+	Compression Compression `json:"compression,omitempty"`
+	// Symlinks is how Upload and FileRead handle symlinks, see SymlinkPolicy.
+	Symlinks SymlinkPolicy `json:"symlinks,omitempty"`
+	// BinaryDetection are the binary detectors, see RegisterBinaryDetector,
+	// deciding which files aren't committed, extensions and content by default.
+	BinaryDetection []string `json:"binary_detection,omitempty"`
+	// BinaryExtensions are extensions of binary files, on top of the ones the extensions detector knows.
+	BinaryExtensions []string `json:"binary_extensions,omitempty"`
+	// CommitDebounce is how long, in milliseconds, writes wait for the next
+	// ones to be committed together, see BeginBatch. 0 commits every write.
+	CommitDebounce int `json:"commit_debounce,omitempty"`
+	// DetectInput stops commands waiting for interactive input, see watchStdin.
+	DetectInput bool `json:"detect_input,omitempty"`
+	// ArtifactsDir is the host directory Artifacts copies build outputs to, see artifactsDir.
+	ArtifactsDir string `json:"artifacts_dir,omitempty"`
+	// User runs the environment's commands as a non-root user.
+	User *UserConfig `json:"user,omitempty"`
+	// Hostname is the hostname commands run with.
+	Hostname string `json:"hostname,omitempty"`
+	// Labels are OCI labels added to the container, on top of the ones identifying the environment.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Images are the images of the environment published to a registry.
+	Images []PublishedImage `json:"images,omitempty"`
+	// StateVersion is incremented each time the configuration changes, to detect concurrent changes.
+	StateVersion int64 `json:"state_version"`
 
 	History History `json:"-"`
 
+	// savedState is the last state saved or loaded, see save.
+	savedState []byte
+
+	client *Client
+
 	mu        sync.Mutex
 	container *dagger.Container
+	// background are the services started by RunBackground.
+	background []*dagger.Service
+	// listeners are the services of background commands by the ports they expose.
+	listeners map[int]*dagger.Service
+	// watchers cancel the waits for the background commands to exit, by service, see watchProcess.
+	watchers map[*dagger.Service]context.CancelFunc
+	// provisionMu serializes the provisioning of recovered or reaped environments.
+	provisionMu sync.Mutex
+	// setupCheckpoint is kept by a failed provisioning for the next one to resume from, see runSetup.
+	setupCheckpoint *setupCheckpoint
+	lastActivity    atomic.Int64
+	services        map[string]*dagger.Service
+
+	logMu   sync.Mutex
+	logFile *rotatingFile
+
+	// secretsMu guards resolvedSecrets, the secret values resolved by withEnv,
+	// and fileSecrets, the values of the file:// secrets by path.
+	secretsMu       sync.Mutex
+	resolvedSecrets []string
+	fileSecrets     map[string]string
+
+	// batchMu guards the batches of writes: their depth, the writes pending
+	// and the context they were made in, and the debounce timer committing them.
+	batchMu          sync.Mutex
+	batching         int
+	batchExplanation string
+	pending          []pendingChange
+	pendingCtx       context.Context
+	debounce         *time.Timer
+
+	// uploadsMu guards uploads, the manifests of the host directories
+	// uploaded, by host directory and target, see withUpload.
+	uploadsMu sync.Mutex
+	uploads   map[string]*uploadManifest
+
+	// auditMu serializes the entries of the hash chained audit log.
+	auditMu sync.Mutex
+
+	// lockMu guards held, the lock of the environment held by an operation of this process.
+	lockMu sync.Mutex
+	held   *heldLock
+
+	// ops queues the operations of the clients sharing the environment, in order.
+	opsOnce sync.Once
+	ops     chan struct{}
+	queued  atomic.Int32
+
+	clientsMu sync.Mutex
+	clients   map[string]time.Time
+	// identities are the identities of the clients, see ClientInfo.Identity.
+	identities map[string]bool
+	// confirmed are the commands a human confirmed, see CommandConfirm.
+	confirmed map[string]bool
+	readOnly  map[string]bool
 }
 
 func (env *Environment) save(baseDir string) error {
@@ -105,8 +253,19 @@ func (env *Environment) save(baseDir string) error {
 	if err != nil {
 		return err
 	}
+	// Only changes of the configuration make a new state version: operations
+	// leaving it as is write the file as it was.
+	// The file is merged into the source repository, so unlike the state in
+	// the notes it's never encrypted.
+	if env.savedState == nil || !bytes.Equal(env.savedState, envState) {
+		env.StateVersion++
+		if envState, err = json.MarshalIndent(env, "", "  "); err != nil {
+			return err
+		}
+		env.savedState = envState
+	}
 
-	if err := os.WriteFile(path.Join(cfg, environmentFile), envState, 0644); err != nil {
+	if err := os.WriteFile(path.Join(cfg, environmentFile), env.savedState, 0644); err != nil {
 		return err
 	}
 
@@ -126,9 +285,15 @@ func (env *Environment) load(baseDir string) error {
 	if err != nil {
 		return err
 	}
+	// Environment files encrypted by earlier versions can still be read.
+	envState, err = openState(envState)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(envState, env); err != nil {
 		return err
 	}
+	env.savedState = envState
 
 	return nil
 }
@@ -147,13 +312,17 @@ func (env *Environment) apply(ctx context.Context, name, explanation, output str
 
 	env.mu.Lock()
 	defer env.mu.Unlock()
+	client := ClientInfoFromContext(ctx)
 	revision := &Revision{
-		Version:     env.History.LatestVersion() + 1,
-		Name:        name,
-		Explanation: explanation,
-		Output:      output,
-		CreatedAt:   time.Now(),
-		container:   newState,
+		Version:       env.History.LatestVersion() + 1,
+		Name:          name,
+		Explanation:   explanation,
+		Output:        output,
+		CreatedAt:     time.Now(),
+		Client:        client.Name,
+		ClientVersion: client.Version,
+		Session:       client.Session,
+		container:     newState,
 	}
 	containerID, err := revision.container.ID(ctx)
 	if err != nil {
@@ -162,35 +331,121 @@ func (env *Environment) apply(ctx context.Context, name, explanation, output str
 	revision.State = string(containerID)
 	env.container = revision.container
 	env.History = append(env.History, revision)
+	if client.Name != "" {
+		env.logf("[v%d] %s: %s (by %s)", revision.Version, name, explanation, client)
+	} else {
+		env.logf("[v%d] %s: %s", revision.Version, name, explanation)
+	}
 
 	return nil
 }
 
-var environments = map[string]*Environment{}
+// configure sets up a new environment from the repository at source: its
+// configuration file, saved state or detected toolchain.
+func (env *Environment) configure(source string) error {
+	cfg, err := LoadRepoConfig(source)
+	if err != nil {
+		return err
+	}
+	if cfg != nil {
+		cfg.applyDefaults(env)
+	}
+	if err := env.load(source); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if cfg == nil {
+			if tc := detectToolchain(source); tc != nil {
+				slog.Info("Detected toolchain", "toolchain", tc.Name, "base-image", tc.BaseImage)
+				tc.applyDefaults(env)
+			}
+		}
+	}
+	if cfg != nil {
+		cfg.applyPolicies(env)
+	}
+	if err := env.resolveSidecars(); err != nil {
+		return err
+	}
+	toolVersions, err := detectToolVersions(source)
+	if err != nil {
+		return err
+	}
+	if len(toolVersions) > 0 {
+		env.ToolVersions = toolVersions
+	}
+	if err := env.Network.validate(); err != nil {
+		return err
+	}
+	if err := validateWorkdir(env.Workdir); err != nil {
+		return err
+	}
+	if err := env.ANSI.validate(); err != nil {
+		return err
+	}
+	if err := env.Compression.validate(); err != nil {
+		return err
+	}
+	if err := env.Notes.validate(); err != nil {
+		return err
+	}
+	if err := env.Symlinks.validate(); err != nil {
+		return err
+	}
+	if err := env.User.validate(); err != nil {
+		return err
+	}
+	if err := validateBinaryDetection(env.BinaryDetection); err != nil {
+		return err
+	}
+	return nil
+}
 
-func Create(ctx context.Context, explanation, source, name string) (*Environment, error) {
+// Create creates an environment called name from the repository at source.
+// If it fails or ctx is canceled before the environment is registered, the
+// worktree, branch and services already created for it are removed.
+func (c *Client) Create(ctx context.Context, explanation, source, name string) (_ *Environment, rerr error) {
 	env := &Environment{
+		client:       c,
 		ID:           fmt.Sprintf("%s/%s", name, petname.Generate(2, "-")),
 		Name:         name,
 		Source:       source,
 		BaseImage:    defaultImage,
 		Instructions: "No instructions found. Please look around the filesystem and update me",
-		Workdir:      "/workdir",
+		Workdir:      defaultWorkdir,
 	}
-	if err := env.load(source); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, err
-		}
+	if err := env.configure(source); err != nil {
+		return nil, err
 	}
 
+	registered := false
+	defer func() {
+		if rerr != nil && !registered {
+			env.abandon(context.WithoutCancel(ctx))
+		}
+	}()
+
+	reportStage(ctx, StageWorktree, 0, 0, "Initializing worktree for %s", env.ID)
 	worktreePath, err := env.InitializeWorktree(ctx, source)
 	if err != nil {
 		return nil, fmt.Errorf("failed intializing worktree: %w", err)
 	}
 	env.Worktree = worktreePath
 
+	waitPrefetch := env.prefetchDependencies(ctx)
+	defer waitPrefetch()
+	if err := env.startDependencies(ctx); err != nil {
+		telemetry.Failure("dependencies")
+		return nil, err
+	}
 	container, err := env.buildBase(ctx)
 	if err != nil {
+		telemetry.Failure("build")
+		return nil, err
+	}
+	// The first install of the dependencies, e.g. by bootstrap commands, uses the prefetched caches.
+	waitPrefetch()
+	if container, err = env.bootstrap(ctx, container); err != nil {
 		return nil, err
 	}
 
@@ -199,24 +454,46 @@ func Create(ctx context.Context, explanation, source, name string) (*Environment
 	if err := env.apply(ctx, "Create environment", "Create the environment", "", container); err != nil {
 		return nil, err
 	}
-	environments[env.ID] = env
+	env.touchClient(ClientInfoFromContext(ctx))
+	c.register(env)
+	registered = true
 
-	if err := env.propagateToWorktree(ctx, "Init env "+name, explanation); err != nil {
+	if err := env.propagateToWorktree(ctx, change{Action: "create", Summary: "Init env " + name}, explanation); err != nil {
 		return nil, fmt.Errorf("failed to propagate to worktree: %w", err)
 	}
+	telemetry.Count("environments_created")
 
 	return env, nil
 }
 
-func Open(ctx context.Context, explanation, source, id string) (*Environment, error) {
-	// FIXME(aluzzardi): DO NOT USE THIS FUNCTION. It's broken.
+// OpenFromSource opens the environment id of the repository at source,
+// fetching it from the mirror remote if it was created on another machine.
+// If the environment has no saved state, it is created.
+func (c *Client) OpenFromSource(ctx context.Context, explanation, source, id string) (*Environment, error) {
+	if env := c.Get(id); env != nil {
+		return env, env.Provision(ctx)
+	}
 
 	name, _, _ := strings.Cut(id, "/")
 	env := &Environment{
+		client: c,
 		Name:   name,
 		ID:     id,
 		Source: source,
 	}
+	// Environments created on another machine are fetched from the mirror remote.
+	if cfg, err := LoadRepoConfig(source); err != nil {
+		return nil, err
+	} else if cfg != nil && cfg.Mirror != nil && cfg.Mirror.Remote != "" {
+		localRepoPath, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		if err := hydrateFromMirror(ctx, localRepoPath, cfg.Mirror.Remote, id, cfg.Notes); err != nil {
+			slog.Warn("Failed to fetch environment from mirror", "environment.id", id, "remote", cfg.Mirror.Remote, "err", err)
+		}
+	}
+
 	worktreePath, err := env.InitializeWorktree(ctx, source)
 	if err != nil {
 		return nil, fmt.Errorf("failed intializing worktree: %w", err)
@@ -225,10 +502,13 @@ func Open(ctx context.Context, explanation, source, id string) (*Environment, er
 
 	if err := env.load(worktreePath); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return Create(ctx, explanation, source, name)
+			return c.Create(ctx, explanation, source, name)
 		}
 		return nil, err
 	}
+	if err := env.loadStateFromNotes(ctx, worktreePath); err != nil {
+		slog.Warn("Failed to load environment history", "environment.id", id, "err", err)
+	}
 
 	container, err := env.buildBase(ctx)
 	if err != nil {
@@ -238,81 +518,219 @@ func Open(ctx context.Context, explanation, source, id string) (*Environment, er
 		return nil, err
 	}
 
-	environments[env.ID] = env
+	c.register(env)
 
 	return env, nil
+}
+
+// Open rehydrates the environment id from its persisted state (worktree,
+// configuration, environment variables and history) and provisions its
+// container, so that a process can continue the work started by another one.
+// Revisions made by other processes are listed in the history but can't be
+// restored, their containers being gone.
+func (c *Client) Open(ctx context.Context, id string) (*Environment, error) {
+	if env := c.Get(id); env != nil {
+		return env, env.Provision(ctx)
+	}
 
-	// FIXME(aluzzardi): BROKEN
-	// if err := env.loadStateFromNotes(ctx, worktreePath); err != nil {
-	// 	return nil, fmt.Errorf("failed to load state from notes: %w", err)
-	// }
-
-	// for _, revision := range env.History {
-	// 	revision.container = dag.LoadContainerFromID(dagger.ContainerID(revision.State))
-	// }
-	// if latest := env.History.Latest(); latest != nil {
-	// 	env.container = latest.container
-	// }
+	source, err := findSource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	env, err := c.recoverEnvironment(ctx, source, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.Provision(ctx); err != nil {
+		return nil, err
+	}
+	c.register(env)
+	return env, nil
 }
 
 func (env *Environment) buildBase(ctx context.Context) (*dagger.Container, error) {
-	sourceDir := dag.Host().Directory(env.Worktree)
+	if env.User != nil && env.Nix != "" {
+		return nil, errors.New("a non-root user is not supported with a Nix dev shell")
+	}
+	sourceDir := env.client.dag.Host().Directory(env.Worktree)
+
+	container, err := env.provision(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.User != nil {
+		container = env.withUser(container)
+	}
+	container = container.WithDirectory(".", sourceDir, dagger.ContainerWithDirectoryOpts{Owner: env.User.owner()})
+
+	for _, dir := range env.PersistentDirs {
+		container = container.WithMountedCache(
+			path.Join(env.Workdir, dir),
+			env.client.dag.CacheVolume(fmt.Sprintf("container-use-%s-%s", env.ID, dir)),
+			dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared, Owner: env.User.owner()},
+		)
+	}
+
+	container = env.withDependencyCaches(container)
+	container = env.withLabels(ctx, container)
+
+	return container, nil
+}
+
+// provision builds the container of the environment, up to its setup commands.
+// It doesn't depend on the source code, so it can be pre-warmed.
+func (env *Environment) provision(ctx context.Context, sourceDir *dagger.Directory) (*dagger.Container, error) {
+	key, poolable := env.poolKey()
+	if poolable {
+		if container, digest := env.client.pool.get(key); container != nil {
+			reportProgress(ctx, "Using pre-warmed container")
+			env.setBaseImageDigest(digest)
+			return container, nil
+		}
+	}
 
-	container := dag.
+	reportStage(ctx, StageImage, 0, 0, "Pulling base image %s", env.BaseImage)
+	// The container is built from the digest the base image resolves to now,
+	// recorded for provenance.
+	digest, err := env.client.dag.Container().From(env.BaseImage).ImageRef(ctx)
+	if err != nil {
+		return nil, &ImagePullError{Image: env.BaseImage, Err: err}
+	}
+	env.setBaseImageDigest(digest)
+	container := env.client.dag.
 		Container().
-		From(env.BaseImage).
-		WithWorkdir(env.Workdir)
+		From(digest)
+	container = container.WithWorkdir(env.Workdir)
+	container = env.withTools(container)
+
+	container = env.withProxy(container)
+	container = env.withHostEnv(container)
+	container = env.withLinks(container)
+	container, err = env.withSidecars(container)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err = env.withEnv(ctx, container, env.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, port := range env.Ports {
+		container = container.WithExposedPort(port, dagger.ContainerWithExposedPortOpts{
+			Protocol:    dagger.NetworkProtocolTcp,
+			Description: fmt.Sprintf("Port %d", port),
+		})
+	}
+
+	if len(env.Packages) > 0 {
+		var err error
+		if container, err = env.withPackages(ctx, container); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.Nix != "" {
+		var err error
+		if container, err = env.withNixShell(ctx, container, sourceDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(env.ToolVersions) > 0 {
+		var err error
+		if container, err = env.withToolVersions(ctx, container); err != nil {
+			return nil, err
+		}
+	}
 
 	for _, secret := range env.Secrets {
 		k, v, found := strings.Cut(secret, "=")
 		if !found {
 			return nil, fmt.Errorf("invalid secret: %s", secret)
 		}
-		container = container.WithSecretVariable(k, dag.Secret(v))
+		container = container.WithSecretVariable(k, env.client.dag.Secret(v))
 	}
 
-	for _, command := range env.SetupCommands {
-		var err error
-
-		container = container.WithExec([]string{"sh", "-c", command})
+	container, err = env.runSetup(ctx, container)
+	if err != nil {
+		return nil, err
+	}
 
-		stdout, err := container.Stdout(ctx)
-		if err != nil {
-			var exitErr *dagger.ExecError
-			if errors.As(err, &exitErr) {
-				_ = env.addGitNote(ctx,
-					fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
-						command,
-						exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
-					),
-				)
-				return nil, fmt.Errorf("setup command failed with exit code %d.\nstdout: %s\nstderr: %s\n%w\n", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, err)
-			}
+	if poolable {
+		env.client.pool.put(key, container, digest)
+	}
+	return container, nil
+}
 
-			return nil, fmt.Errorf("failed to execute setup command: %w", err)
-		}
+func (env *Environment) setBaseImageDigest(digest string) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.BaseImageDigest = digest
+}
 
-		_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
+// Update rebuilds the environment with a new configuration. Unless
+// expectedState is zero, it fails with a *StateConflictError if the state
+// version changed since the caller read it. If it fails or ctx is canceled,
+// the environment keeps its configuration, and updating it again resumes
+// from the last setup step completed (see runSetup).
+func (env *Environment) Update(ctx context.Context, explanation, instructions, baseImage, workdir string, packages, setupCommands, secrets []string, expectedState int64) (rerr error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	container = container.WithDirectory(".", sourceDir)
+	if err := env.checkStateVersion(expectedState); err != nil {
+		return err
+	}
 
-	return container, nil
-}
+	if err := env.checkPolicyHook(ctx, PolicyRequest{
+		Operation:     "update",
+		Explanation:   explanation,
+		BaseImage:     baseImage,
+		Packages:      packages,
+		SetupCommands: setupCommands,
+		Secrets:       secrets,
+	}); err != nil {
+		return err
+	}
 
-func (env *Environment) Update(ctx context.Context, explanation, instructions, baseImage string, setupCommands, secrets []string) error {
 	if env.isLocked(env.Source) {
 		return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Source, configDir, lockFile))
 	}
 
+	if err := validateWorkdir(workdir); err != nil {
+		return err
+	}
+
+	previous := env.updateSettings()
+	defer func() {
+		if rerr != nil {
+			previous.restore(env)
+		}
+	}()
+
 	env.Instructions = instructions
 	env.BaseImage = baseImage
+	env.Workdir = workdir
+	env.Packages = packages
 	env.SetupCommands = setupCommands
 	env.Secrets = secrets
 
+	if err := env.startDependencies(ctx); err != nil {
+		telemetry.Failure("dependencies")
+		return err
+	}
 	// Re-build the base image from the worktree
+	reportProgress(ctx, "Rebuilding environment %s", env.ID)
 	container, err := env.buildBase(ctx)
 	if err != nil {
+		telemetry.Failure("build")
+		return err
+	}
+	if container, err = env.bootstrap(ctx, container); err != nil {
 		return err
 	}
 
@@ -320,57 +738,151 @@ func (env *Environment) Update(ctx context.Context, explanation, instructions, b
 		return err
 	}
 
-	return env.propagateToWorktree(ctx, "Update environment "+env.Name, explanation)
+	return env.propagateToWorktree(ctx, change{Action: "update", Summary: "Update environment " + env.Name}, explanation)
 }
 
-func Get(idOrName string) *Environment {
-	if environment, ok := environments[idOrName]; ok {
-		return environment
-	}
-	for _, environment := range environments {
-		if environment.Name == idOrName {
-			return environment
-		}
+// updateSettings are the settings of an environment changed by Update.
+type updateSettings struct {
+	instructions    string
+	baseImage       string
+	baseImageDigest string
+	workdir         string
+	packages        []string
+	setupCommands   []string
+	secrets         []string
+	links           []ServiceLink
+}
+
+func (env *Environment) updateSettings() updateSettings {
+	return updateSettings{
+		instructions:    env.Instructions,
+		baseImage:       env.BaseImage,
+		baseImageDigest: env.BaseImageDigest,
+		workdir:         env.Workdir,
+		packages:        env.Packages,
+		setupCommands:   env.SetupCommands,
+		secrets:         env.Secrets,
+		links:           env.Links,
 	}
-	return nil
 }
 
-func List() []*Environment {
-	env := make([]*Environment, 0, len(environments))
-	for _, environment := range environments {
-		env = append(env, environment)
+func (s updateSettings) restore(env *Environment) {
+	env.Instructions = s.instructions
+	env.BaseImage = s.baseImage
+	env.BaseImageDigest = s.baseImageDigest
+	env.Workdir = s.workdir
+	env.Packages = s.packages
+	env.SetupCommands = s.setupCommands
+	env.Secrets = s.secrets
+	env.Links = s.links
+}
+
+// validateWorkdir checks the project path in the container is an absolute path
+// other than the root directory, which the source directory would clobber.
+func validateWorkdir(workdir string) error {
+	if !path.IsAbs(workdir) {
+		return fmt.Errorf("invalid workdir %q: must be an absolute path", workdir)
+	}
+	if path.Clean(workdir) == "/" {
+		return fmt.Errorf("invalid workdir %q: can't be the root directory", workdir)
 	}
-	return env
+	return nil
 }
 
 func (env *Environment) Run(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (string, error) {
+	return env.run(ctx, explanation, command, shell, nil, useEntrypoint)
+}
+
+// run runs command like Run, with the variables vars (KEY=VALUE) set for this command only.
+func (env *Environment) run(ctx context.Context, explanation, command, shell string, vars []string, useEntrypoint bool) (string, error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return "", err
+	}
+
+	if err := env.checkExec(ctx, explanation, command); err != nil {
+		return "", err
+	}
+
+	telemetry.Count("commands_run")
+	container := env.container
+	if testCommand.MatchString(command) {
+		container = env.withoutCoverageReports(container)
+	}
+	for _, v := range vars {
+		key, value, _ := strings.Cut(v, "=")
+		container = container.WithEnvVariable(key, value)
+	}
+	container, stream := env.streamOutput(ctx, container)
 	args := []string{}
 	if command != "" {
 		args = []string{shell, "-c", command}
+		if env.DetectInput {
+			args = watchStdin(args)
+		}
+	}
+	spec, err := env.execSpec(ctx, container, args, useEntrypoint)
+	if err != nil {
+		return "", err
 	}
-	newState := env.container.WithExec(args, dagger.ContainerWithExecOpts{
-		UseEntrypoint: useEntrypoint,
+	newState := container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		UseEntrypoint:            spec.UseEntrypoint,
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
 	})
+	for _, v := range vars {
+		key, _, _ := strings.Cut(v, "=")
+		newState = newState.WithoutEnvVariable(key)
+	}
+	if stream != "" {
+		newState = withoutStream(newState)
+	}
+	stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running %s", command))
+	stopStream := env.pollStream(ctx, stream)
 	stdout, err := newState.Stdout(ctx)
+	stopStream()
+	stopHeartbeat()
 	if err != nil {
 		var exitErr *dagger.ExecError
 		if errors.As(err, &exitErr) {
+			if needsInput := needsInput(command, exitErr.ExitCode, env.redact(exitErr.Stdout), env.redact(exitErr.Stderr)); needsInput != nil {
+				telemetry.Failure("needs_input")
+				_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\nwaiting for input: %s\n\n", command, needsInput.Prompt))
+				return "", needsInput
+			}
+			telemetry.Failure("command_exit")
 			_ = env.addGitNote(ctx,
 				fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
 					command,
 					exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
 				),
 			)
-			return fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr), nil
+			stdout := env.processOutput(command, env.stripANSI(ctx, exitErr.Stdout))
+			stderr := env.processOutput(command, env.stripANSI(ctx, exitErr.Stderr))
+			if testCommand.MatchString(command) {
+				if err := env.recordFailedTest(ctx, command, exitErr.ExitCode, env.redact(stdout+"\n"+stderr)); err != nil {
+					slog.Warn("Failed to record the failed test run", "environment.id", env.ID, "err", err)
+				}
+			}
+			return env.limitOutput(env.redact(fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, stdout, stderr))), nil
 		}
 		return "", err
 	}
+	stdout = env.redact(stdout)
 	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
+	stdout = env.limitOutput(env.processOutput(command, env.stripANSI(ctx, stdout)))
 	if err := env.apply(ctx, "Run "+command, explanation, stdout, newState); err != nil {
 		return "", err
 	}
+	if testCommand.MatchString(command) {
+		env.History.Latest().Coverage = env.collectCoverage(ctx, newState)
+	}
 
-	if err := env.propagateToWorktree(ctx, "Run "+command, explanation); err != nil {
+	if err := env.propagateToWorktree(ctx, change{Action: "run", Summary: "Run " + command, Command: command}, explanation); err != nil {
 		return "", fmt.Errorf("failed to propagate to worktree: %w", err)
 	}
 
@@ -385,32 +897,32 @@ type EndpointMapping struct {
 type EndpointMappings map[int]*EndpointMapping
 
 func (env *Environment) RunBackground(ctx context.Context, explanation, command, shell string, ports []int, useEntrypoint bool) (EndpointMappings, error) {
-	args := []string{}
-	if command != "" {
-		args = []string{shell, "-c", command}
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
 	}
-	serviceState := env.container
 
-	// Expose ports
-	for _, port := range ports {
-		serviceState = serviceState.WithExposedPort(port, dagger.ContainerWithExposedPortOpts{
-			Protocol:    dagger.NetworkProtocolTcp,
-			Description: fmt.Sprintf("Port %d", port),
-		})
+	done, err := env.client.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := env.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+	if err := env.checkExec(ctx, explanation, command); err != nil {
+		return nil, err
+	}
+
+	telemetry.Count("commands_run")
+	if len(ports) == 0 {
+		ports = env.Ports
 	}
 
-	// Start the service
-	svc, err := serviceState.AsService(dagger.ContainerAsServiceOpts{
-		Args:          args,
-		UseEntrypoint: useEntrypoint,
-	}).Start(ctx)
+	svc, report, err := env.startService(ctx, command, shell, ports, useEntrypoint)
 	if err != nil {
-		var exitErr *dagger.ExecError
-		if errors.As(err, &exitErr) {
-			return nil, fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
-		}
 		return nil, err
 	}
+	env.watchProcess(svc, report, command)
 
 	_ = env.addGitNote(ctx,
 		fmt.Sprintf("$ %s &\n\n", command),
@@ -429,10 +941,12 @@ func (env *Environment) RunBackground(ctx context.Context, explanation, command,
 	}
 
 	// Expose ports on the host
-	tunnel, err := dag.Host().Tunnel(svc, dagger.HostTunnelOpts{Ports: hostForwards}).Start(ctx)
+	tunnel, err := env.client.dag.Host().Tunnel(svc, dagger.HostTunnelOpts{Ports: hostForwards}).Start(ctx)
 	if err != nil {
 		return nil, err
 	}
+	env.trackService(svc)
+	env.trackService(tunnel)
 
 	// Retrieve endpoints
 	for _, forward := range hostForwards {
@@ -458,27 +972,61 @@ func (env *Environment) RunBackground(ctx context.Context, explanation, command,
 	return endpoints, nil
 }
 
-func (env *Environment) SetEnv(ctx context.Context, explanation string, envs []string) error {
-	state := env.container
-	for _, env := range envs {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid environment variable: %s", env)
-		}
-		state = state.WithEnvVariable(parts[0], parts[1])
+// SetEnv sets environment variables in the environment. The variables are
+// persisted in the environment state so they are re-applied on rebuilds.
+// Like Update, it fails with a *StateConflictError if the state changed since
+// the caller read it at expectedState.
+func (env *Environment) SetEnv(ctx context.Context, explanation string, envs []string, expectedState int64) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	if err := env.checkStateVersion(expectedState); err != nil {
+		return err
+	}
+
+	state, err := env.withEnv(ctx, env.container, envs)
+	if err != nil {
+		return err
+	}
+	for _, kv := range envs {
+		key, _, _ := strings.Cut(kv, "=")
+		env.Env = slices.DeleteFunc(env.Env, func(existing string) bool {
+			return strings.HasPrefix(existing, key+"=")
+		})
+		env.Env = append(env.Env, kv)
+	}
+	if err := env.apply(ctx, "Set env "+strings.Join(envs, ", "), explanation, "", state); err != nil {
+		return err
 	}
-	return env.apply(ctx, "Set env "+strings.Join(envs, ", "), explanation, "", state)
+
+	return env.propagateToWorktree(ctx, change{Action: "set_env", Summary: "Set env " + strings.Join(envs, ", ")}, explanation)
 }
 
 func (env *Environment) Revert(ctx context.Context, explanation string, version Version) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	revision := env.History.Get(version)
 	if revision == nil {
 		return errors.New("no revisions found")
 	}
+	if revision.container == nil {
+		return fmt.Errorf("version %d was made before the environment was recovered and can't be restored", version)
+	}
 	if err := env.apply(ctx, "Revert to "+revision.Name, explanation, "", revision.container); err != nil {
 		return err
 	}
-	return env.propagateToWorktree(ctx, "Revert to "+revision.Name, explanation)
+	return env.propagateToWorktree(ctx, change{Action: "revert", Summary: "Revert to " + revision.Name}, explanation)
 }
 
 func (env *Environment) Fork(ctx context.Context, explanation, name string, version *Version) (*Environment, error) {
@@ -489,35 +1037,63 @@ func (env *Environment) Fork(ctx context.Context, explanation, name string, vers
 	if revision == nil {
 		return nil, errors.New("version not found")
 	}
+	if revision.container == nil {
+		return nil, fmt.Errorf("version %d was made before the environment was recovered and can't be forked", revision.Version)
+	}
 
 	forkedEnvironment := &Environment{
-		ID:   fmt.Sprintf("%s/%s", name, petname.Generate(2, "-")),
-		Name: name,
+		ID:     fmt.Sprintf("%s/%s", name, petname.Generate(2, "-")),
+		Name:   name,
+		client: env.client,
 	}
 	if err := forkedEnvironment.apply(ctx, "Fork from "+env.Name, explanation, "", revision.container); err != nil {
 		return nil, err
 	}
-	environments[forkedEnvironment.ID] = forkedEnvironment
+	forkedEnvironment.touchClient(ClientInfoFromContext(ctx))
+	env.client.register(forkedEnvironment)
 	return forkedEnvironment, nil
 }
 
-func (env *Environment) Terminal(ctx context.Context) error {
-	container := env.container
-	// In case there's bash in the container, show the same pretty PS1 as for the default /bin/sh terminal in dagger
-	container = container.WithNewFile("/root/.bash_aliases", `export PS1="\033[33mdagger\033[0m \033[02m\$(pwd | sed \"s|^\$HOME|~|\")\033[0m \$ "`+"\n")
-	if _, err := container.Terminal(dagger.ContainerTerminalOpts{}).Sync(ctx); err != nil {
-		return err
+func (env *Environment) Checkpoint(ctx context.Context, target string) (string, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return "", err
 	}
-	return nil
-}
 
-func (env *Environment) Checkpoint(ctx context.Context, target string) (string, error) {
 	return env.container.Publish(ctx, target)
 }
 
-func (env *Environment) Delete(ctx context.Context) error {
+// Delete removes the environment, its worktree and its branch. The branch is
+// kept in the trash for a few days so the environment can be brought back with RestoreDeleted.
+// Unless force is set, it refuses to delete an environment whose branch has
+// commits missing from the source repository and returns an *UnmergedWorkError.
+func (env *Environment) Delete(ctx context.Context, force bool) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.checkPolicyHook(ctx, PolicyRequest{Operation: "delete"}); err != nil {
+		return err
+	}
+
+	if !force {
+		commits, err := env.UnmergedCommits(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check for unmerged work (use force to delete anyway): %w", err)
+		}
+		if len(commits) > 0 {
+			return &UnmergedWorkError{Environment: env.ID, Commits: commits}
+		}
+	}
+
 	env.mu.Lock()
 	defer env.mu.Unlock()
+	env.unwatch(nil)
+
+	if err := env.moveToTrash(ctx); err != nil {
+		return fmt.Errorf("failed to move environment to the trash: %w", err)
+	}
 
 	if err := env.DeleteWorktree(); err != nil {
 		return err
@@ -527,8 +1103,21 @@ func (env *Environment) Delete(ctx context.Context) error {
 		return err
 	}
 
-	// Remove from global environments map
-	delete(environments, env.ID)
+	env.client.unregister(env)
+	env.publish(ctx, EventDeleted, fmt.Sprintf("Environment %s was deleted", env.ID))
+
+	if err := env.closeLog(); err != nil {
+		slog.Error("Failed to close environment log", "environment.id", env.ID, "err", err)
+	}
+	if dir, err := OutputDir(env.ID); err == nil {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("Failed to remove saved command outputs", "environment.id", env.ID, "err", err)
+		}
+	}
+
+	if err := PurgeTrash(ctx); err != nil {
+		slog.Error("Failed to purge expired environments from the trash", "err", err)
+	}
 
 	return nil
 }
@@ -0,0 +1,152 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// envReference matches the references of environment variable values to
+// secrets, ${secret:NAME}, and to other variables, ${NAME}.
+var envReference = regexp.MustCompile(`\$\{(secret:)?([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// withEnv sets the environment variables vars, KEY=value, in container.
+// Values can reference the secrets of the environment, e.g.
+// DATABASE_URL=postgres://app:${secret:DB_PASS}@db:5432/app, and other
+// variables of vars or of container, e.g. PATH=/opt/bin:${PATH}. Variables
+// referencing secrets, even indirectly, are set as secrets: the state of the
+// environment only has their template, and their value is redacted.
+func (env *Environment) withEnv(ctx context.Context, container *dagger.Container, vars []string) (*dagger.Container, error) {
+	templates := map[string]string{}
+	for _, variable := range vars {
+		k, v, found := strings.Cut(variable, "=")
+		if !found || k == "" {
+			return nil, fmt.Errorf("invalid environment variable: %s", variable)
+		}
+		templates[k] = v
+	}
+
+	r := &envResolver{env: env, container: container, templates: templates, resolved: map[string]resolvedEnv{}}
+	for _, variable := range vars {
+		k, _, _ := strings.Cut(variable, "=")
+		value, err := r.resolve(ctx, k, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !value.secret {
+			container = container.WithEnvVariable(k, value.value)
+			continue
+		}
+		env.addResolvedSecret(value.value)
+		// Secrets are named after their value, which changes when the secrets it references do.
+		sum := sha256.Sum256([]byte(value.value))
+		name := fmt.Sprintf("container-use-env-%s-%s", k, hex.EncodeToString(sum[:8]))
+		container = container.WithSecretVariable(k, env.client.dag.SetSecret(name, value.value))
+	}
+	return container, nil
+}
+
+type resolvedEnv struct {
+	value string
+	// secret is set if the value references a secret.
+	secret bool
+}
+
+// envResolver resolves the references of the values of environment variables, see withEnv.
+type envResolver struct {
+	env       *Environment
+	container *dagger.Container
+	templates map[string]string
+	resolved  map[string]resolvedEnv
+}
+
+// resolve returns the value of the variable name, the path of references
+// leading to it being used to detect cycles.
+func (r *envResolver) resolve(ctx context.Context, name string, path []string) (resolvedEnv, error) {
+	if value, ok := r.resolved[name]; ok {
+		return value, nil
+	}
+	if slices.Contains(path, name) {
+		return resolvedEnv{}, fmt.Errorf("environment variables reference each other: %s", strings.Join(append(path, name), " -> "))
+	}
+	template, ok := r.templates[name]
+	if !ok {
+		return r.previous(ctx, name)
+	}
+
+	result := resolvedEnv{}
+	var resolveErr error
+	result.value = envReference.ReplaceAllStringFunc(template, func(reference string) string {
+		match := envReference.FindStringSubmatch(reference)
+		if resolveErr != nil {
+			return ""
+		}
+		if match[1] != "" {
+			result.secret = true
+			plaintext, err := r.env.secretPlaintext(ctx, match[2])
+			if err != nil {
+				resolveErr = fmt.Errorf("environment variable %s: %w", name, err)
+			}
+			return plaintext
+		}
+		var value resolvedEnv
+		var err error
+		if match[2] == name {
+			// e.g. PATH=/opt/bin:${PATH}
+			value, err = r.previous(ctx, name)
+		} else {
+			value, err = r.resolve(ctx, match[2], append(path, name))
+		}
+		if err != nil {
+			resolveErr = err
+		}
+		result.secret = result.secret || value.secret
+		return value.value
+	})
+	if resolveErr != nil {
+		return resolvedEnv{}, resolveErr
+	}
+	r.resolved[name] = result
+	return result, nil
+}
+
+// previous returns the value of the variable name in the container, e.g. set by the base image.
+func (r *envResolver) previous(ctx context.Context, name string) (resolvedEnv, error) {
+	value, err := r.container.EnvVariable(ctx, name)
+	if err != nil {
+		return resolvedEnv{}, fmt.Errorf("failed to read environment variable %s: %w", name, err)
+	}
+	return resolvedEnv{value: value}, nil
+}
+
+// secretPlaintext returns the value of the secret name of the environment.
+func (env *Environment) secretPlaintext(ctx context.Context, name string) (string, error) {
+	for _, secret := range env.Secrets {
+		k, ref, _ := strings.Cut(secret, "=")
+		if k != name {
+			continue
+		}
+		plaintext, err := env.client.dag.Secret(ref).Plaintext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret %s: %w", name, err)
+		}
+		env.addResolvedSecret(plaintext)
+		return plaintext, nil
+	}
+	return "", fmt.Errorf("unknown secret %s: add it to the secrets of the environment", name)
+}
+
+// addResolvedSecret records a secret value resolved by withEnv, for redact to mask it.
+func (env *Environment) addResolvedSecret(value string) {
+	env.secretsMu.Lock()
+	defer env.secretsMu.Unlock()
+	if !slices.Contains(env.resolvedSecrets, value) {
+		env.resolvedSecrets = append(env.resolvedSecrets, value)
+	}
+}
@@ -0,0 +1,145 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode identifies, in a machine-readable way, why an operation on an
+// environment failed, so that clients can react to it.
+type ErrorCode string
+
+const (
+	CodeEnvNotFound  ErrorCode = "env_not_found"
+	CodeSetupFailed  ErrorCode = "setup_failed"
+	CodeCommitFailed ErrorCode = "commit_failed"
+	CodeImagePull    ErrorCode = "image_pull_failed"
+	CodeChecksum     ErrorCode = "checksum_mismatch"
+)
+
+// CodedError is an error with an ErrorCode.
+type CodedError interface {
+	error
+	Code() ErrorCode
+}
+
+// Code returns the code of the first CodedError in the tree of err, if any.
+func Code(err error) ErrorCode {
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return ""
+}
+
+// EnvNotFoundError is returned when no environment has the ID.
+type EnvNotFoundError struct {
+	ID string
+}
+
+func (e *EnvNotFoundError) Error() string {
+	return fmt.Sprintf("environment %s not found", e.ID)
+}
+
+func (e *EnvNotFoundError) Code() ErrorCode {
+	return CodeEnvNotFound
+}
+
+// SetupFailedError is returned when a setup or bootstrap command fails.
+type SetupFailedError struct {
+	// Stage is StageSetup or StageBootstrap.
+	Stage Stage
+	// Step is the number of the failing step, from 1, out of Steps.
+	Step, Steps int
+	Command     string
+	ExitCode    int
+	// Output is the redacted output of the command.
+	Output string
+	// Resumable is set if provisioning the environment again resumes from
+	// the failing step, see runSetup.
+	Resumable bool
+	Err       error
+}
+
+func (e *SetupFailedError) Error() string {
+	msg := fmt.Sprintf("%s command failed", e.Stage)
+	if e.Steps > 0 {
+		msg = fmt.Sprintf("%s step %d/%d failed", e.Stage, e.Step, e.Steps)
+	}
+	if e.ExitCode != 0 {
+		msg += fmt.Sprintf(" with exit code %d", e.ExitCode)
+	}
+	if e.Resumable {
+		msg += ", provisioning the environment again resumes from it"
+	}
+	if e.Output != "" {
+		msg += ".\n" + e.Output
+	}
+	return fmt.Sprintf("%s\n%v", msg, e.Err)
+}
+
+func (e *SetupFailedError) Code() ErrorCode {
+	return CodeSetupFailed
+}
+
+func (e *SetupFailedError) Unwrap() error {
+	return e.Err
+}
+
+// CommitFailedError is returned when the changes of an environment can't be
+// committed to its branch. The environment has the changes nevertheless.
+type CommitFailedError struct {
+	Err error
+}
+
+func (e *CommitFailedError) Error() string {
+	return fmt.Sprintf("failed to commit worktree changes: %v", e.Err)
+}
+
+func (e *CommitFailedError) Code() ErrorCode {
+	return CodeCommitFailed
+}
+
+func (e *CommitFailedError) Unwrap() error {
+	return e.Err
+}
+
+// ImagePullError is returned when the base image of an environment can't be pulled.
+type ImagePullError struct {
+	Image string
+	Err   error
+}
+
+func (e *ImagePullError) Error() string {
+	return fmt.Sprintf("failed to pull image %s: %v", e.Image, e.Err)
+}
+
+func (e *ImagePullError) Code() ErrorCode {
+	return CodeImagePull
+}
+
+func (e *ImagePullError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumMismatchError is returned when a file written, uploaded or
+// downloaded doesn't have the same content once transferred.
+type ChecksumMismatchError struct {
+	Path string
+	// Where is where the file was transferred to: container, worktree or host.
+	Where    string
+	Expected string
+	// Actual is the checksum of the file transferred, empty if it's missing.
+	Actual string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("checksum mismatch for %s: missing in the %s, expected %s", e.Path, e.Where, e.Expected)
+	}
+	return fmt.Sprintf("checksum mismatch for %s in the %s: expected %s, got %s", e.Path, e.Where, e.Expected, e.Actual)
+}
+
+func (e *ChecksumMismatchError) Code() ErrorCode {
+	return CodeChecksum
+}
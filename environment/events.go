@@ -0,0 +1,81 @@
+package environment
+
+import (
+	"context"
+	"sync"
+)
+
+// EventType identifies a change in the state of an environment.
+type EventType string
+
+const (
+	// EventCommitted is published when a change is committed to the environment branch.
+	EventCommitted EventType = "committed"
+	// EventDeleted is published when the environment is deleted.
+	EventDeleted EventType = "deleted"
+	// EventProcessExited is published when a command started in the background exits.
+	EventProcessExited EventType = "process_exited"
+)
+
+// Event describes a change in the state of an environment.
+type Event struct {
+	Type        EventType `json:"type"`
+	Environment string    `json:"environment_id"`
+	// Client is the MCP client that caused the change, if any.
+	Client  string `json:"client,omitempty"`
+	Message string `json:"message"`
+}
+
+// EventFunc receives events. ctx is the context of the operation causing the
+// event, or a background context for events that happen on their own.
+type EventFunc func(ctx context.Context, event Event)
+
+type subscribers struct {
+	mu   sync.Mutex
+	next int
+	fns  map[int]EventFunc
+}
+
+// Subscribe calls fn for each event of the environments of the client, until
+// the returned function is called. fn is called synchronously and must not block.
+func (c *Client) Subscribe(fn EventFunc) func() {
+	c.subscribers.mu.Lock()
+	defer c.subscribers.mu.Unlock()
+	if c.subscribers.fns == nil {
+		c.subscribers.fns = map[int]EventFunc{}
+	}
+	id := c.subscribers.next
+	c.subscribers.next++
+	c.subscribers.fns[id] = fn
+	return func() {
+		c.subscribers.mu.Lock()
+		defer c.subscribers.mu.Unlock()
+		delete(c.subscribers.fns, id)
+	}
+}
+
+func (c *Client) publish(ctx context.Context, event Event) {
+	c.subscribers.mu.Lock()
+	fns := make([]EventFunc, 0, len(c.subscribers.fns))
+	for _, fn := range c.subscribers.fns {
+		fns = append(fns, fn)
+	}
+	c.subscribers.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(ctx, event)
+	}
+}
+
+// publish notifies the subscribers of the environment's client.
+func (env *Environment) publish(ctx context.Context, eventType EventType, message string) {
+	if env.client == nil {
+		return
+	}
+	env.client.publish(ctx, Event{
+		Type:        eventType,
+		Environment: env.ID,
+		Client:      ClientFromContext(ctx),
+		Message:     message,
+	})
+}
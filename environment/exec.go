@@ -0,0 +1,95 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// execSpec describes how to execute a command in an environment container.
+type execSpec struct {
+	Args                     []string
+	UseEntrypoint            bool
+	InsecureRootCapabilities bool
+}
+
+// execSpec returns how to execute args in container: inside the Nix dev shell if
+// the environment uses one, as the environment's user, with the environment's
+// hostname and enforcing the environment's network policy.
+func (env *Environment) execSpec(ctx context.Context, container *dagger.Container, args []string, useEntrypoint bool) (execSpec, error) {
+	return env.execSpecAs(ctx, container, args, useEntrypoint, env.User)
+}
+
+// rootExecSpec is like execSpec for the commands provisioning the environment
+// (packages, tools, setup commands), which always run as root.
+func (env *Environment) rootExecSpec(ctx context.Context, container *dagger.Container, args []string, useEntrypoint bool) (execSpec, error) {
+	return env.execSpecAs(ctx, container, args, useEntrypoint, nil)
+}
+
+func (env *Environment) execSpecAs(ctx context.Context, container *dagger.Container, args []string, useEntrypoint bool, user *UserConfig) (execSpec, error) {
+	if !env.privileged() && env.Nix == "" && user == nil {
+		return execSpec{Args: args, UseEntrypoint: useEntrypoint}, nil
+	}
+
+	// Wrappers must be the first process, so resolve the default args and
+	// entrypoint ourselves.
+	if len(args) == 0 {
+		defaultArgs, err := container.DefaultArgs(ctx)
+		if err != nil {
+			return execSpec{}, err
+		}
+		args = defaultArgs
+	}
+	if useEntrypoint {
+		entrypoint, err := container.Entrypoint(ctx)
+		if err != nil {
+			return execSpec{}, err
+		}
+		args = append(entrypoint, args...)
+	}
+
+	spec := execSpec{Args: args}
+	if env.Nix != "" {
+		spec.Args = env.nixArgs(spec.Args)
+	}
+	if env.privileged() {
+		wrapper := append(toolArgs("busybox", "sh", "-c", env.privilegedScript(user), "cu-exec"), user.envArgs()...)
+		spec.Args = append(wrapper, spec.Args...)
+		spec.InsecureRootCapabilities = true
+	} else {
+		spec.Args = user.wrap(spec.Args)
+	}
+	return spec, nil
+}
+
+// privileged returns whether commands must be set up with root capabilities:
+// to set the hostname, or to install the network policy firewall.
+func (env *Environment) privileged() bool {
+	return env.Network.restricted() || env.Hostname != ""
+}
+
+// privilegedScript sets up the command with root capabilities, then runs its
+// arguments with all capabilities dropped, as user, so it can't undo the setup.
+// It runs with the tools mounted by withTools, so it doesn't depend on the
+// base image.
+func (env *Environment) privilegedScript(user *UserConfig) string {
+	script := &strings.Builder{}
+	script.WriteString("set -e\n")
+	script.WriteString(toolFunctions)
+	if env.Hostname != "" {
+		fmt.Fprintf(script, "hostname %s\n", shellQuote(env.Hostname))
+	}
+	if env.Network.restricted() {
+		script.WriteString(env.Network.firewallRules())
+	}
+	// exec doesn't run shell functions, so run the tool directly.
+	setpriv := append(toolArgs("setpriv", "--inh-caps=-all", "--bounding-set=-all"), user.setprivArgs()...)
+	script.WriteString("exec")
+	for _, arg := range setpriv {
+		script.WriteString(" " + arg)
+	}
+	script.WriteString(` -- "$@"` + "\n")
+	return script.String()
+}
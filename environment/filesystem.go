@@ -4,13 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"dagger.io/dagger"
 )
 
 func (s *Environment) FileRead(ctx context.Context, targetFile string, shouldReadEntireFile bool, startLineOneIndexed int, endLineOneIndexedInclusive int) (string, error) {
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return "", err
+	}
+
+	if err := s.checkReadSymlink(ctx, targetFile); err != nil {
+		return "", err
+	}
 	file, err := s.container.File(targetFile).Contents(ctx)
 	if err != nil {
 		return "", err
@@ -35,25 +44,85 @@ func (s *Environment) FileRead(ctx context.Context, targetFile string, shouldRea
 	return strings.Join(lines[start:end], "\n"), nil
 }
 
-func (s *Environment) FileWrite(ctx context.Context, explanation, targetFile, contents string) error {
-	err := s.apply(ctx, "Write "+targetFile, explanation, "", s.container.WithNewFile(targetFile, contents))
+// FileWrite writes contents to targetFile with the permissions mode, or, if
+// mode is 0, the ones of the file it replaces, 0644 for new files. Git only
+// records whether files are executable: other permissions, e.g. 0600, are
+// kept in the container only.
+func (s *Environment) FileWrite(ctx context.Context, explanation, targetFile, contents string, mode os.FileMode) error {
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	if mode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid mode %#o: only permissions can be set", mode)
+	}
+	if mode == 0 {
+		mode = s.fileMode(ctx, targetFile)
+	}
+
+	sum := checksum([]byte(contents))
+	newState := s.container.WithNewFile(targetFile, contents, dagger.ContainerWithNewFileOpts{Owner: s.User.owner(), Permissions: int(mode)})
+	written, err := newState.File(targetFile).Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed applying file write, skipping git propogation: %w", err)
+	}
+	if actual := checksum([]byte(written)); actual != sum {
+		return &ChecksumMismatchError{Path: targetFile, Where: "container", Expected: sum, Actual: actual}
+	}
+
+	err = s.apply(ctx, "Write "+targetFile, explanation, "", newState)
 	if err != nil {
 		return fmt.Errorf("failed applying file write, skipping git propogation: %w", err)
 	}
+	s.History.Latest().Checksums = map[string]string{targetFile: sum}
+
+	return s.propagateToWorktree(ctx, change{Action: "write", Summary: "Write " + targetFile, Path: targetFile, Checksum: sum}, explanation)
+}
 
-	return s.propagateToWorktree(ctx, "Write "+targetFile, explanation)
+// fileMode returns the permissions of the file path of the container, 0644
+// if it doesn't exist, or they can't be read without stat in the container.
+func (s *Environment) fileMode(ctx context.Context, path string) os.FileMode {
+	out, err := s.container.WithExec([]string{"stat", "-c", "%a", path}).Stdout(ctx)
+	if err != nil {
+		return 0644
+	}
+	mode, err := strconv.ParseUint(strings.TrimSpace(out), 8, 32)
+	if err != nil {
+		return 0644
+	}
+	return os.FileMode(mode) & os.ModePerm
 }
 
 func (s *Environment) FileDelete(ctx context.Context, explanation, targetFile string) error {
-	err := s.apply(ctx, "Delete "+targetFile, explanation, "", s.container.WithoutFile(targetFile))
+	unlock, err := s.lock(ctx)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return err
+	}
 
-	return s.propagateToWorktree(ctx, "Delete "+targetFile, explanation)
+	err = s.apply(ctx, "Delete "+targetFile, explanation, "", s.container.WithoutFile(targetFile))
+	if err != nil {
+		return err
+	}
+
+	return s.propagateToWorktree(ctx, change{Action: "delete", Summary: "Delete " + targetFile, Path: targetFile}, explanation)
 }
 
 func (s *Environment) FileList(ctx context.Context, path string) (string, error) {
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return "", err
+	}
+
 	entries, err := s.container.Directory(path).Entries(ctx)
 	if err != nil {
 		return "", err
@@ -65,47 +134,117 @@ func (s *Environment) FileList(ctx context.Context, path string) (string, error)
 	return out.String(), nil
 }
 
-func urlToDirectory(url string) *dagger.Directory {
+func (s *Environment) urlToDirectory(url string) *dagger.Directory {
 	switch {
 	case strings.HasPrefix(url, "file://"):
-		return dag.Host().Directory(url[len("file://"):])
+		return s.client.dag.Host().Directory(url[len("file://"):])
 	case strings.HasPrefix(url, "git://"):
-		return dag.Git(url[len("git://"):]).Head().Tree()
+		return s.client.dag.Git(url[len("git://"):]).Head().Tree()
 	case strings.HasPrefix(url, "https://"):
-		return dag.Git(url[len("https://"):]).Head().Tree()
+		return s.client.dag.Git(url[len("https://"):]).Head().Tree()
 	default:
-		return dag.Host().Directory(url)
+		return s.client.dag.Host().Directory(url)
 	}
 }
 
 func (s *Environment) Upload(ctx context.Context, explanation, source string, target string) error {
-	err := s.apply(ctx, "Upload "+source+" to "+target, explanation, "", s.container.WithDirectory(target, urlToDirectory(source)))
+	unlock, err := s.lock(ctx)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	return s.propagateToWorktree(ctx, "Upload "+source+" to "+target, explanation)
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	if err := s.checkPolicyHook(ctx, PolicyRequest{Operation: "upload", Explanation: explanation, UploadSource: source, Path: target}); err != nil {
+		return err
+	}
+
+	var upload *hostUpload
+	if dir, ok := hostDirectoryPath(source); ok {
+		// Host directories uploaded before only transfer the files that changed.
+		if upload, err = s.withUpload(ctx, s.container, dir, target); err != nil {
+			return err
+		}
+		if err := s.verifyUpload(ctx, upload, dir); err != nil {
+			return err
+		}
+	} else {
+		upload = &hostUpload{container: s.container.WithDirectory(target, s.urlToDirectory(source), dagger.ContainerWithDirectoryOpts{Owner: s.User.owner()})}
+	}
+
+	if err := s.apply(ctx, "Upload "+source+" to "+target, explanation, upload.summary, upload.container); err != nil {
+		return err
+	}
+	if upload.manifest != nil {
+		s.History.Latest().Transfer = upload.transfer
+		s.History.Latest().Checksums = map[string]string{target: upload.checksum}
+		s.recordUpload(ctx, upload)
+	}
+
+	return s.propagateToWorktree(ctx, change{Action: "upload", Summary: "Upload " + source + " to " + target, Path: target}, explanation)
 }
 
 func (s *Environment) Download(ctx context.Context, source string, target string) error {
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	transfer, file, err := s.download(ctx, source, target)
+	if err != nil {
+		return err
+	}
+	sum, err := s.verifyDownload(ctx, source, target, file)
+	if err != nil {
+		return err
+	}
+
+	note := fmt.Sprintf("Download %s to %s", source, target)
+	if transfer != nil {
+		note += ": " + transfer.String()
+	}
+	if sum != "" {
+		note += fmt.Sprintf(" (%s)", sum)
+	}
+	_ = s.addGitNote(ctx, note+"\n")
+	return nil
+}
+
+// download exports the file or directory source of the container to target,
+// and returns whether it's a file, and the compressed transfer, if it was.
+func (s *Environment) download(ctx context.Context, source string, target string) (*Transfer, bool, error) {
+	transfer, compressed, err := s.downloadCompressed(ctx, source, target)
+	if err != nil {
+		return nil, false, err
+	}
+	if compressed {
+		return transfer, false, nil
+	}
+
 	if _, err := s.container.Directory(source).Export(ctx, target); err != nil {
 		if strings.Contains(err.Error(), "not a directory") {
 			if _, err := s.container.File(source).Export(ctx, target); err != nil {
-				return err
+				return nil, false, err
 			}
-			return nil
+			return nil, true, nil
 		}
-		return err
+		return nil, false, err
 	}
 
-	return nil
+	return nil, false, nil
 }
 
 func (s *Environment) RemoteDiff(ctx context.Context, source string, target string) (string, error) {
-	sourceDir := urlToDirectory(source)
+	if err := s.ensureProvisioned(ctx); err != nil {
+		return "", err
+	}
+
+	sourceDir := s.urlToDirectory(source)
 	targetDir := s.container.Directory(target)
 
-	diff, err := dag.Container().From(alpineImage).
+	diff, err := s.client.dag.Container().From(alpineImage).
 		WithMountedDirectory("/source", sourceDir).
 		WithMountedDirectory("/target", targetDir).
 		WithExec([]string{"diff", "-burN", "/source", "/target"}, dagger.ContainerWithExecOpts{
@@ -136,7 +275,7 @@ func (s *Environment) revisionDiff(ctx context.Context, path string, fromVersion
 	if path == "" {
 		path = s.Workdir
 	}
-	diffCtr := dag.Container().
+	diffCtr := s.client.dag.Container().
 		From(alpineImage).
 		WithWorkdir("/diffs")
 	if directory {
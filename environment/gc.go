@@ -0,0 +1,116 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// CachePolicy selects the engine cache entries StaleEngineCache considers stale.
+type CachePolicy struct {
+	// MaxUnused is how long an entry (e.g. the layers of an old base image) may
+	// go unused before it is stale. Zero only selects the entries of deleted environments.
+	MaxUnused time.Duration
+}
+
+// CacheEntry is a stale engine cache entry.
+type CacheEntry struct {
+	Description string    `json:"description"`
+	Bytes       int64     `json:"bytes"`
+	LastUsed    time.Time `json:"last_used"`
+	Reason      string    `json:"reason"`
+}
+
+// CacheReport is the result of StaleEngineCache.
+type CacheReport struct {
+	Stale      []CacheEntry `json:"stale"`
+	StaleBytes int64        `json:"stale_bytes"`
+}
+
+// environmentCacheRE matches the names of the cache volumes of an environment (see buildBase).
+var environmentCacheRE = regexp.MustCompile(`container-use-([\w.-]+/[a-z]+-[a-z]+)-`)
+
+const engineCacheQuery = `query {
+	engine {
+		localCache {
+			entrySet {
+				diskSpaceBytes
+				entries {
+					description
+					diskSpaceBytes
+					activelyUsed
+					mostRecentUseTimeUnixNano
+				}
+			}
+		}
+	}
+}`
+
+type engineCacheResponse struct {
+	Engine struct {
+		LocalCache struct {
+			EntrySet struct {
+				DiskSpaceBytes int64 `json:"diskSpaceBytes"`
+				Entries        []struct {
+					Description               string `json:"description"`
+					DiskSpaceBytes            int64  `json:"diskSpaceBytes"`
+					ActivelyUsed              bool   `json:"activelyUsed"`
+					MostRecentUseTimeUnixNano int64  `json:"mostRecentUseTimeUnixNano"`
+				} `json:"entries"`
+			} `json:"entrySet"`
+		} `json:"localCache"`
+	} `json:"engine"`
+}
+
+func (c *Client) engineCache(ctx context.Context) (*engineCacheResponse, error) {
+	resp := &engineCacheResponse{}
+	if err := c.dag.Do(ctx, &dagger.Request{Query: engineCacheQuery}, &dagger.Response{Data: resp}); err != nil {
+		return nil, fmt.Errorf("failed to list engine cache entries: %w", err)
+	}
+	return resp, nil
+}
+
+// StaleEngineCache finds the engine cache entries left behind by deleted
+// environments, or unused for longer than policy.MaxUnused.
+//
+// They're only reported: the engine can't prune selected entries, only its
+// whole cache, which is shared with the other users of the engine.
+func (c *Client) StaleEngineCache(ctx context.Context, policy CachePolicy) (*CacheReport, error) {
+	live, err := environmentSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := c.engineCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CacheReport{Stale: []CacheEntry{}}
+	for _, entry := range cache.Engine.LocalCache.EntrySet.Entries {
+		if entry.ActivelyUsed {
+			continue
+		}
+		lastUsed := time.Unix(0, entry.MostRecentUseTimeUnixNano)
+		reason := ""
+		if match := environmentCacheRE.FindStringSubmatch(entry.Description); match != nil && live[match[1]] == "" && c.Get(match[1]) == nil {
+			reason = "environment " + match[1] + " was deleted"
+		} else if policy.MaxUnused > 0 && time.Since(lastUsed) > policy.MaxUnused {
+			reason = fmt.Sprintf("unused for %s", time.Since(lastUsed).Round(time.Hour))
+		}
+		if reason == "" {
+			continue
+		}
+		report.Stale = append(report.Stale, CacheEntry{
+			Description: entry.Description,
+			Bytes:       entry.DiskSpaceBytes,
+			LastUsed:    lastUsed,
+			Reason:      reason,
+		})
+		report.StaleBytes += entry.DiskSpaceBytes
+	}
+
+	return report, nil
+}
@@ -8,14 +8,15 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"slices"
 	"strings"
 
 	"dagger.io/dagger"
 	"github.com/mitchellh/go-homedir"
 )
 
+// Default notes refs, see NotesConfig.
 const (
 	gitNotesLogRef   = "container-use"
 	gitNotesStateRef = "container-use-state"
@@ -32,7 +33,11 @@ func getRepoPath(repoName string) (string, error) {
 }
 
 func (env *Environment) GetWorktreePath() (string, error) {
-	return homedir.Expand(fmt.Sprintf("~/.config/container-use/worktrees/%s", env.ID))
+	dir, err := WorktreesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(env.ID)), nil
 }
 
 func (env *Environment) DeleteWorktree() error {
@@ -116,13 +121,15 @@ func (env *Environment) InitializeWorktree(ctx context.Context, localRepoPath st
 	// create worktree, accomodating past partial failures where the branch pushed but the worktree wasn't created
 	_, err = runGitCommand(ctx, cuRepoPath, "show-ref", "--verify", "--quiet", fmt.Sprintf("refs/heads/%s", env.ID))
 	if err != nil {
-		_, err = runGitCommand(ctx, cuRepoPath, "worktree", "add", "-b", env.ID, worktreePath, currentBranch)
-		if err != nil {
+		if err := addWorktree(ctx, cuRepoPath, localRepoPath, worktreePath, "-b", env.ID, worktreePath, currentBranch); err != nil {
 			return "", err
 		}
 	} else {
-		_, err = runGitCommand(ctx, cuRepoPath, "worktree", "add", worktreePath, env.ID)
-		if err != nil {
+		// The worktree may be registered but gone, e.g. from a tmpfs after a reboot.
+		if _, err := runGitCommand(ctx, cuRepoPath, "worktree", "prune"); err != nil {
+			return "", err
+		}
+		if err := addWorktree(ctx, cuRepoPath, localRepoPath, worktreePath, worktreePath, env.ID); err != nil {
 			return "", err
 		}
 	}
@@ -148,6 +155,24 @@ func (env *Environment) InitializeWorktree(ctx context.Context, localRepoPath st
 	return worktreePath, nil
 }
 
+// RegisteredRepository checks environments were already created from the
+// repository at source on this machine, i.e. it has a container-use repository.
+func RegisteredRepository(ctx context.Context, source string) error {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	cuRepoPath, err := getRepoPath(localRepoPath)
+	if err != nil {
+		return err
+	}
+	origin, err := runGitCommand(ctx, cuRepoPath, "config", "--get", "remote.origin.url")
+	if err != nil || strings.TrimSpace(origin) != localRepoPath {
+		return fmt.Errorf("repository %s is not registered with container-use", localRepoPath)
+	}
+	return nil
+}
+
 func InitializeLocalRemote(ctx context.Context, localRepoPath string) (string, error) {
 	localRepoPath, err := filepath.Abs(localRepoPath)
 	if err != nil {
@@ -213,7 +238,25 @@ func runGitCommand(ctx context.Context, dir string, args ...string) (out string,
 	return string(output), nil
 }
 
-func (env *Environment) propagateToWorktree(ctx context.Context, name, explanation string) (rerr error) {
+// propagateToWorktree commits c to the branch of the environment, unless it's
+// deferred, see deferCommit. The writes pending are committed along with it.
+func (env *Environment) propagateToWorktree(ctx context.Context, c change, explanation string) error {
+	if env.deferCommit(ctx, c, explanation) {
+		return nil
+	}
+	pending, batchExplanation := env.takePending()
+	if len(pending) > 0 {
+		explanation = strings.TrimSpace(strings.Join([]string{explanation, batchExplanation, pendingExplanations(pending)}, "\n\n"))
+	}
+	return env.commitChange(ctx, c, explanation, append(pending, pendingChange{change: c}))
+}
+
+// commitChange syncs the worktree with the container and commits c, then
+// verifies the files written by changes.
+func (env *Environment) commitChange(ctx context.Context, c change, explanation string, changes []pendingChange) (rerr error) {
+	// Once started, the commit completes even if the operation is canceled
+	// (e.g. on shutdown), so the worktree isn't left half committed.
+	ctx = context.WithoutCancel(ctx)
 	slog.Info("Propagating to worktree...",
 		"environment.id", env.ID,
 		"environment.name", env.Name,
@@ -233,6 +276,12 @@ func (env *Environment) propagateToWorktree(ctx context.Context, name, explanati
 		return err
 	}
 
+	// Don't overwrite the state saved by another process since this one read it.
+	if err := env.checkStateVersion(0); err != nil {
+		return err
+	}
+
+	reportStage(ctx, StageSync, 0, 0, "Syncing %s to worktree", env.Workdir)
 	_, err = env.container.Directory(env.Workdir).Export(
 		ctx,
 		worktreePath,
@@ -247,12 +296,13 @@ func (env *Environment) propagateToWorktree(ctx context.Context, name, explanati
 		return err
 	}
 
-	if err := env.commitWorktreeChanges(ctx, worktreePath, name, explanation); err != nil {
-		return fmt.Errorf("failed to commit worktree changes: %w", err)
+	reportStage(ctx, StageSync, 0, 0, "Committing changes to container-use/%s", env.ID)
+	if err := env.commitWorktreeChanges(ctx, worktreePath, c, explanation); err != nil {
+		return &CommitFailedError{Err: err}
 	}
 
 	if err := env.commitStateToNotes(ctx); err != nil {
-		return fmt.Errorf("failed to add notes: %w", err)
+		return &CommitFailedError{Err: fmt.Errorf("failed to add notes: %w", err)}
 	}
 
 	localRepoPath, err := filepath.Abs(env.Source)
@@ -265,11 +315,13 @@ func (env *Environment) propagateToWorktree(ctx context.Context, name, explanati
 		return err
 	}
 
-	if err := env.propagateGitNotes(ctx, gitNotesStateRef); err != nil {
+	if err := env.propagateNotes(ctx, env.Notes.stateRef()); err != nil {
 		return err
 	}
 
-	return nil
+	env.mirror(ctx)
+	env.publish(ctx, EventCommitted, c.Summary)
+	return env.verifyPending(changes)
 }
 
 func (env *Environment) propagateGitNotes(ctx context.Context, ref string) error {
@@ -295,55 +347,66 @@ func (env *Environment) commitStateToNotes(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	f, err := os.CreateTemp(os.TempDir(), ".container-use-git-notes-*")
+	buff, err = sealState(buff)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := f.Write(buff); err != nil {
-		return err
-	}
-
-	_, err = runGitCommand(ctx, env.Worktree, "notes", "--ref", gitNotesStateRef, "add", "-f", "-F", f.Name())
-	if err != nil {
-		return err
-	}
-	return nil
+	return env.Notes.add(ctx, env.Worktree, env.Notes.stateRef(), string(buff))
 }
 
 func (env *Environment) addGitNote(ctx context.Context, note string) error {
-	_, err := runGitCommand(ctx, env.Worktree, "notes", "--ref", "container-use", "append", "-m", note)
-	if err != nil {
+	if env.Worktree == "" {
+		// Pre-warmed containers don't belong to an environment yet.
+		return nil
+	}
+	note = env.redact(note)
+	if client := ClientInfoFromContext(ctx); client.Name != "" {
+		note = fmt.Sprintf("[%s] %s", client, note)
+	}
+	env.logf("%s", note)
+	if err := env.Notes.append(ctx, env.Worktree, env.Notes.logRef(), note); err != nil {
+		return err
+	}
+	if err := env.appendAuditEntry(ctx, note); err != nil {
 		return err
 	}
-	return env.propagateGitNotes(ctx, gitNotesLogRef)
+	return env.propagateNotes(ctx, env.Notes.logRef())
 }
 
 func StateFromCommit(ctx context.Context, repoDir, commit string) (History, error) {
-	buff, err := runGitCommand(ctx, repoDir, "notes", "--ref", gitNotesStateRef, "show")
+	notes := repoNotes(ctx, repoDir)
+	buff, err := notes.show(ctx, repoDir, notes.stateRef(), commit)
 	if err != nil {
 		return nil, err
 	}
 
+	state, err := openState([]byte(buff))
+	if err != nil {
+		return nil, err
+	}
 	var history History
-	if err := json.Unmarshal([]byte(buff), &history); err != nil {
+	if err := json.Unmarshal(state, &history); err != nil {
 		return nil, err
 	}
 	return history, nil
 }
 
 func (env *Environment) loadStateFromNotes(ctx context.Context, worktreePath string) error {
-	buff, err := runGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "show")
+	buff, err := env.Notes.show(ctx, worktreePath, env.Notes.stateRef(), "HEAD")
 	if err != nil {
-		if strings.Contains(err.Error(), "no note found") {
+		if errors.Is(err, errNoNote) {
 			return nil
 		}
 		return err
 	}
-	return json.Unmarshal([]byte(buff), &env.History)
+	state, err := openState([]byte(buff))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(state, &env.History)
 }
 
-func (env *Environment) commitWorktreeChanges(ctx context.Context, worktreePath, name, explanation string) error {
+func (env *Environment) commitWorktreeChanges(ctx context.Context, worktreePath string, c change, explanation string) error {
 	status, err := runGitCommand(ctx, worktreePath, "status", "--porcelain")
 	if err != nil {
 		return err
@@ -353,21 +416,58 @@ func (env *Environment) commitWorktreeChanges(ctx context.Context, worktreePath,
 		return nil
 	}
 
-	if err := env.addNonBinaryFiles(ctx, worktreePath); err != nil {
+	skipped, err := env.addNonBinaryFiles(ctx, worktreePath)
+	if err != nil {
+		return err
+	}
+
+	commitMsg, err := env.commitMessage(ctx, c, explanation, skipped)
+	if err != nil {
+		return err
+	}
+	args, signing := env.identityArgs(ctx)
+	if _, err := runGitCommand(ctx, worktreePath, append(args, "commit", "-m", commitMsg)...); err != nil {
 		return err
 	}
 
-	commitMsg := fmt.Sprintf("%s\n\n%s", name, explanation)
-	_, err = runGitCommand(ctx, worktreePath, "commit", "-m", commitMsg)
-	return err
+	if signing != nil {
+		if revision := env.History.Latest(); revision != nil {
+			revision.Signer = signing.String()
+		}
+	}
+	return nil
+}
+
+// identityArgs returns the git arguments setting the author and signing key of
+// the environment's commits, along with the signing configuration in use if any.
+func (env *Environment) identityArgs(ctx context.Context) ([]string, *SigningConfig) {
+	args := []string{}
+	if author := env.author(ctx); author != nil {
+		args = append(args, author.args()...)
+	}
+	signing := env.signingConfig(ctx)
+	if signing != nil {
+		args = append(args, signing.args()...)
+	}
+	return args, signing
 }
 
 // AI slop below!
 // this is just to keep us moving fast because big git repos get hard to work with
 // and our demos like to download large dependencies.
-func (env *Environment) addNonBinaryFiles(ctx context.Context, worktreePath string) error {
+func (env *Environment) addNonBinaryFiles(ctx context.Context, worktreePath string) ([]SkippedFile, error) {
 	statusOutput, err := runGitCommand(ctx, worktreePath, "status", "--porcelain")
 	if err != nil {
+		return nil, err
+	}
+
+	skipped := []SkippedFile{}
+	add := func(fileName string) error {
+		if f := env.binaryFile(ctx, worktreePath, fileName); f != nil {
+			skipped = append(skipped, *f)
+			return nil
+		}
+		_, err := runGitCommand(ctx, worktreePath, "add", fileName)
 		return err
 	}
 
@@ -398,16 +498,13 @@ func (env *Environment) addNonBinaryFiles(ctx context.Context, worktreePath stri
 			if strings.HasSuffix(fileName, "/") {
 				// Untracked directory - traverse and add non-binary files
 				dirName := strings.TrimSuffix(fileName, "/")
-				if err := env.addFilesFromUntrackedDirectory(ctx, worktreePath, dirName); err != nil {
-					return err
+				if err := env.addFilesFromUntrackedDirectory(worktreePath, dirName, add); err != nil {
+					return nil, err
 				}
 			} else {
 				// Untracked file - add if not binary
-				if !env.isBinaryFile(worktreePath, fileName) {
-					_, err = runGitCommand(ctx, worktreePath, "add", fileName)
-					if err != nil {
-						return err
-					}
+				if err := add(fileName); err != nil {
+					return nil, err
 				}
 			}
 		case indexStatus == 'A':
@@ -417,40 +514,21 @@ func (env *Environment) addNonBinaryFiles(ctx context.Context, worktreePath stri
 			// D = deleted files (always stage deletion)
 			_, err = runGitCommand(ctx, worktreePath, "add", fileName)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		default:
 			// M, R, C and other statuses - add if not binary
-			if !env.isBinaryFile(worktreePath, fileName) {
-				_, err = runGitCommand(ctx, worktreePath, "add", fileName)
-				if err != nil {
-					return err
-				}
+			if err := add(fileName); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	return nil
+	return skipped, nil
 }
 
 func (env *Environment) shouldSkipFile(fileName string) bool {
-	skipExtensions := []string{
-		".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz",
-		".zip", ".rar", ".7z", ".gz", ".bz2", ".xz",
-		".exe", ".bin", ".dmg", ".pkg", ".msi",
-		".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tiff", ".svg",
-		".mp3", ".mp4", ".avi", ".mov", ".wmv", ".flv", ".mkv",
-		".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx",
-		".so", ".dylib", ".dll", ".a", ".lib",
-	}
-
 	lowerName := strings.ToLower(fileName)
-	for _, ext := range skipExtensions {
-		if strings.HasSuffix(lowerName, ext) {
-			return true
-		}
-	}
-
 	skipPatterns := []string{
 		"node_modules/", ".git/", "__pycache__/", ".DS_Store",
 		"venv/", ".venv/", "env/", ".env/",
@@ -464,6 +542,21 @@ func (env *Environment) shouldSkipFile(fileName string) bool {
 		}
 	}
 
+	for _, pattern := range env.Exclude {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(fileName, pattern) || strings.Contains(fileName, "/"+pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, fileName); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(fileName)); ok {
+			return true
+		}
+	}
+
 	return false
 }
 
@@ -514,10 +607,10 @@ func (env *Environment) applyUncommittedChanges(ctx context.Context, localRepoPa
 		}
 	}
 
-	return env.commitWorktreeChanges(ctx, worktreePath, "Copy uncommitted changes", "Applied uncommitted changes from local repository")
+	return env.commitWorktreeChanges(ctx, worktreePath, change{Action: "import", Summary: "Copy uncommitted changes"}, "Applied uncommitted changes from local repository")
 }
 
-func (env *Environment) addFilesFromUntrackedDirectory(ctx context.Context, worktreePath, dirName string) error {
+func (env *Environment) addFilesFromUntrackedDirectory(worktreePath, dirName string, add func(string) error) error {
 	dirPath := filepath.Join(worktreePath, dirName)
 
 	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
@@ -541,50 +634,6 @@ func (env *Environment) addFilesFromUntrackedDirectory(ctx context.Context, work
 			return nil
 		}
 
-		if !env.isBinaryFile(worktreePath, relPath) {
-			_, err = runGitCommand(ctx, worktreePath, "add", relPath)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
+		return add(relPath)
 	})
 }
-
-func (env *Environment) isBinaryFile(worktreePath, fileName string) bool {
-	fullPath := filepath.Join(worktreePath, fileName)
-
-	stat, err := os.Stat(fullPath)
-	if err != nil {
-		return true
-	}
-
-	if stat.IsDir() {
-		return false
-	}
-
-	if stat.Size() > maxFileSizeForTextCheck {
-		return true
-	}
-
-	file, err := os.Open(fullPath)
-	if err != nil {
-		slog.Error("Error opening file", "err", err)
-		return true
-	}
-	defer file.Close()
-
-	buffer := make([]byte, 8000)
-	n, err := file.Read(buffer)
-	if err != nil && n == 0 {
-		return true
-	}
-
-	buffer = buffer[:n]
-	if slices.Contains(buffer, 0) {
-		return true
-	}
-
-	return false
-}
@@ -0,0 +1,96 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// githubAPIURL returns the GitHub API endpoint, which GITHUB_API_URL overrides for GitHub Enterprise.
+func githubAPIURL() string {
+	if url := os.Getenv("GITHUB_API_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "https://api.github.com"
+}
+
+// githubRemote extracts owner/name from GitHub remote URLs (https or ssh).
+var githubRemote = regexp.MustCompile(`github\.com[:/]([^/]+/[^/]+?)(\.git)?/?$`)
+
+// GitHubRepository returns the owner/name of the GitHub repository the origin
+// remote of the repository at source points to.
+func GitHubRepository(ctx context.Context, source string) (string, error) {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+	url, err := runGitCommand(ctx, localRepoPath, "remote", "get-url", "origin")
+	if err != nil {
+		return "", err
+	}
+	match := githubRemote.FindStringSubmatch(strings.TrimSpace(url))
+	if match == nil {
+		return "", fmt.Errorf("origin (%s) is not a GitHub repository", strings.TrimSpace(url))
+	}
+	return match[1], nil
+}
+
+func githubToken() (string, error) {
+	for _, name := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+		if token := os.Getenv(name); token != "" {
+			return token, nil
+		}
+	}
+	return "", errors.New("set GITHUB_TOKEN or GH_TOKEN to post to GitHub")
+}
+
+// PostGitHubComment posts body as a comment on the issue or pull request
+// number of the GitHub repository (owner/name) and returns the comment URL.
+func PostGitHubComment(ctx context.Context, repo string, number int, body string) (string, error) {
+	token, err := githubToken()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/issues/%d/comments", githubAPIURL(), repo, number)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("GitHub returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var comment struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.Unmarshal(data, &comment); err != nil {
+		return "", err
+	}
+	return comment.HTMLURL, nil
+}
@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// HostEnvAllowlistEnv lists, separated by commas, the host environment
+// variables forwarded into environments, e.g. "AWS_PROFILE,NPM_TOKEN".
+//
+// The allowlist is configured on the host rather than in the repository
+// configuration so a repository can't request the host's credentials.
+const HostEnvAllowlistEnv = "CONTAINER_USE_HOST_ENV"
+
+// sensitiveEnv matches the names of variables holding credentials.
+var sensitiveEnv = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|AUTH|_KEY$|^KEY$)`)
+
+// hostEnvAllowlist returns the names of the host variables forwarded into environments.
+func hostEnvAllowlist() []string {
+	return strings.FieldsFunc(os.Getenv(HostEnvAllowlistEnv), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// withHostEnv forwards the allowlisted host variables set on the host into container.
+// Credentials are passed as secrets so they don't leak into the state.
+func (env *Environment) withHostEnv(container *dagger.Container) *dagger.Container {
+	for _, name := range hostEnvAllowlist() {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if sensitiveEnv.MatchString(name) {
+			container = container.WithSecretVariable(name, env.client.dag.SetSecret("host-env-"+strings.ToLower(name), value))
+		} else {
+			container = container.WithEnvVariable(name, value)
+		}
+	}
+	return container
+}
@@ -0,0 +1,97 @@
+package environment
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// touch records activity on the environment.
+func (env *Environment) touch() {
+	env.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleSince returns the time of the last activity on the environment.
+func (env *Environment) idleSince() time.Time {
+	return time.Unix(0, env.lastActivity.Load())
+}
+
+// Activate records activity on the environment and provisions its container
+// if it has none, because it was recovered from disk or reaped while idle.
+// Callers serving requests on an environment must call it first.
+func (env *Environment) Activate(ctx context.Context) error {
+	return env.ensureProvisioned(ctx)
+}
+
+// trackService records a service started by the environment, stopped when the environment is reaped.
+func (env *Environment) trackService(svc *dagger.Service) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.background = append(env.background, svc)
+}
+
+// reap stops the services of the environment and releases its container,
+// unless an operation is in progress or it was used in the last idleTimeout.
+// It reports whether the environment was reaped.
+func (env *Environment) reap(ctx context.Context, idleTimeout time.Duration) bool {
+	env.opsOnce.Do(func() {
+		env.ops = make(chan struct{}, 1)
+	})
+	select {
+	case env.ops <- struct{}{}:
+		defer func() { <-env.ops }()
+	default:
+		return false
+	}
+	env.provisionMu.Lock()
+	defer env.provisionMu.Unlock()
+	if time.Since(env.idleSince()) < idleTimeout {
+		return false
+	}
+
+	env.mu.Lock()
+	services := env.background
+	for _, svc := range env.services {
+		services = append(services, svc)
+	}
+	env.unwatch(nil)
+	env.background = nil
+	env.services = nil
+	env.listeners = nil
+	env.container = nil
+	env.mu.Unlock()
+
+	for _, svc := range services {
+		if _, err := svc.Stop(ctx); err != nil {
+			slog.Warn("Failed to stop service", "environment.id", env.ID, "err", err)
+		}
+	}
+	return true
+}
+
+// ReapIdle releases the containers and stops the services of the environments
+// without activity for idleTimeout, checking periodically until ctx is done.
+// Reaped environments are provisioned again from their worktree by Activate:
+// changes made outside of the workdir by commands (rather than by setup
+// commands) are lost.
+func (c *Client) ReapIdle(ctx context.Context, idleTimeout time.Duration) error {
+	interval := max(idleTimeout/4, time.Minute)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		for _, env := range c.List() {
+			if env.NeedsProvisioning() || time.Since(env.idleSince()) < idleTimeout {
+				continue
+			}
+			if env.reap(ctx, idleTimeout) {
+				slog.Info("Reaped idle environment", "environment.id", env.ID, "idle", time.Since(env.idleSince()).Round(time.Second))
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package environment
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+// labelPrefix namespaces the labels identifying environments.
+const labelPrefix = "dev.container-use."
+
+// withLabels adds the labels identifying the environment (its ID, repository
+// and the MCP client that built it) and the configured labels to container.
+func (env *Environment) withLabels(ctx context.Context, container *dagger.Container) *dagger.Container {
+	labels := map[string]string{
+		labelPrefix + "environment.id":   env.ID,
+		labelPrefix + "environment.name": env.Name,
+	}
+	if source, err := filepath.Abs(env.Source); err == nil {
+		labels[labelPrefix+"repository"] = source
+	}
+	if client := ClientFromContext(ctx); client != "" {
+		labels[labelPrefix+"client"] = client
+	}
+	maps.Copy(labels, env.Labels)
+
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		container = container.WithLabel(name, labels[name])
+	}
+	return container
+}
@@ -0,0 +1,286 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// Diagnostic is a problem reported by a linter.
+type Diagnostic struct {
+	Linter   string `json:"linter"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Rule     string `json:"rule,omitempty"`
+	Message  string `json:"message"`
+}
+
+// LintResult is the outcome of a linter run in an environment.
+type LintResult struct {
+	Linter      string       `json:"linter"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	// Error is set when the linter couldn't be run or its output couldn't be parsed.
+	Error string `json:"error,omitempty"`
+}
+
+// linter runs a linter with machine readable output and parses its diagnostics.
+type linter struct {
+	command string
+	// detect lists the files indicating the project uses the linter.
+	detect []string
+	parse  func(workdir, output string) ([]Diagnostic, error)
+}
+
+var linters = map[string]linter{
+	"eslint": {
+		command: "npx --no-install eslint --format json .",
+		detect:  []string{"eslint.config.js", "eslint.config.mjs", "eslint.config.cjs", ".eslintrc", ".eslintrc.js", ".eslintrc.cjs", ".eslintrc.json", ".eslintrc.yml", ".eslintrc.yaml"},
+		parse:   parseESLint,
+	},
+	"ruff": {
+		command: "ruff check --output-format json .",
+		detect:  []string{"ruff.toml", ".ruff.toml"},
+		parse:   parseRuff,
+	},
+	"golangci-lint": {
+		command: "golangci-lint run --output.json.path stdout --show-stats=false ./...",
+		detect:  []string{".golangci.yml", ".golangci.yaml", ".golangci.toml", ".golangci.json"},
+		parse:   parseGolangciLint,
+	},
+}
+
+// Linters returns the names of the supported linters.
+func Linters() []string {
+	names := make([]string, 0, len(linters))
+	for name := range linters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// enabledLinters returns the linters configured for the environment, or the
+// ones detected from the configuration files of the project.
+func (env *Environment) enabledLinters() []string {
+	if len(env.Linters) > 0 {
+		return env.Linters
+	}
+	var enabled []string
+	for _, name := range Linters() {
+		for _, file := range linters[name].detect {
+			if _, err := os.Stat(filepath.Join(env.Worktree, file)); err == nil {
+				enabled = append(enabled, name)
+				break
+			}
+		}
+	}
+	if !slices.Contains(enabled, "ruff") {
+		if data, err := os.ReadFile(filepath.Join(env.Worktree, "pyproject.toml")); err == nil && strings.Contains(string(data), "[tool.ruff") {
+			enabled = append(enabled, "ruff")
+		}
+	}
+	return enabled
+}
+
+// RunLinters runs the given linters, or all the linters enabled for the
+// environment, and returns their diagnostics. Linters don't change the
+// environment.
+func (env *Environment) RunLinters(ctx context.Context, names []string) ([]LintResult, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		names = env.enabledLinters()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no linters configured: set linters in %s", RepoConfigFile)
+		}
+	}
+	for _, name := range names {
+		if _, ok := linters[name]; !ok {
+			return nil, fmt.Errorf("unsupported linter %q, must be one of %s", name, strings.Join(Linters(), ", "))
+		}
+	}
+
+	results := make([]LintResult, 0, len(names))
+	for i, name := range names {
+		reportProgress(ctx, "Running %s (%d/%d)", name, i+1, len(names))
+		results = append(results, env.runLinter(ctx, name))
+	}
+	return results, nil
+}
+
+func (env *Environment) runLinter(ctx context.Context, name string) LintResult {
+	l := linters[name]
+	result := LintResult{Linter: name, Diagnostics: []Diagnostic{}}
+
+	if err := env.checkExec(ctx, "Linter "+name, l.command); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	spec, err := env.execSpec(ctx, env.container, []string{"sh", "-c", l.command}, false)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running %s", name))
+	defer stopHeartbeat()
+	// Linters exit with a non-zero code when they report diagnostics.
+	ran := env.container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+		Expect:                   dagger.ReturnTypeAny,
+	})
+	stdout, err := ran.Stdout(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	diagnostics, err := l.parse(env.Workdir, stdout)
+	if err != nil {
+		stderr, _ := ran.Stderr(ctx)
+		result.Error = fmt.Sprintf("%s\n%s", err, tail(strings.TrimSpace(stderr), maxSummaryOutput))
+		return result
+	}
+	for i := range diagnostics {
+		diagnostics[i].Linter = name
+	}
+	result.Diagnostics = append(result.Diagnostics, diagnostics...)
+	return result
+}
+
+// relativePath returns path relative to the workdir when it is inside it.
+func relativePath(workdir, path string) string {
+	if rel, err := filepath.Rel(workdir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// lintOutput returns the JSON document printed by a linter, or an error when it printed none.
+func lintOutput(output string) ([]byte, error) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return nil, errors.New("linter produced no output")
+	}
+	return []byte(output), nil
+}
+
+func parseESLint(workdir, output string) ([]Diagnostic, error) {
+	data, err := lintOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		FilePath string `json:"filePath"`
+		Messages []struct {
+			RuleID   string `json:"ruleId"`
+			Severity int    `json:"severity"`
+			Message  string `json:"message"`
+			Line     int    `json:"line"`
+			Column   int    `json:"column"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("invalid eslint output: %w", err)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, file := range files {
+		for _, msg := range file.Messages {
+			severity := "warning"
+			if msg.Severity == 2 {
+				severity = "error"
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     relativePath(workdir, file.FilePath),
+				Line:     msg.Line,
+				Column:   msg.Column,
+				Severity: severity,
+				Rule:     msg.RuleID,
+				Message:  msg.Message,
+			})
+		}
+	}
+	return diagnostics, nil
+}
+
+func parseRuff(workdir, output string) ([]Diagnostic, error) {
+	data, err := lintOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	var violations []struct {
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Filename string `json:"filename"`
+		Location struct {
+			Row    int `json:"row"`
+			Column int `json:"column"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(data, &violations); err != nil {
+		return nil, fmt.Errorf("invalid ruff output: %w", err)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, v := range violations {
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     relativePath(workdir, v.Filename),
+			Line:     v.Location.Row,
+			Column:   v.Location.Column,
+			Severity: "error",
+			Rule:     v.Code,
+			Message:  v.Message,
+		})
+	}
+	return diagnostics, nil
+}
+
+func parseGolangciLint(workdir, output string) ([]Diagnostic, error) {
+	data, err := lintOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	var report struct {
+		Issues []struct {
+			FromLinter string `json:"FromLinter"`
+			Text       string `json:"Text"`
+			Severity   string `json:"Severity"`
+			Pos        struct {
+				Filename string `json:"Filename"`
+				Line     int    `json:"Line"`
+				Column   int    `json:"Column"`
+			} `json:"Pos"`
+		} `json:"Issues"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid golangci-lint output: %w", err)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, issue := range report.Issues {
+		severity := issue.Severity
+		if severity == "" {
+			severity = "error"
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     relativePath(workdir, issue.Pos.Filename),
+			Line:     issue.Pos.Line,
+			Column:   issue.Pos.Column,
+			Severity: severity,
+			Rule:     issue.FromLinter,
+			Message:  issue.Text,
+		})
+	}
+	return diagnostics, nil
+}
@@ -0,0 +1,86 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinterOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		parse   func(workdir, output string) ([]Diagnostic, error)
+		output  string
+		want    []Diagnostic
+		wantErr bool
+	}{
+		{
+			name:  "eslint",
+			parse: parseESLint,
+			output: `[{"filePath":"/app/src/a.js","messages":[
+				{"ruleId":"no-unused-vars","severity":2,"message":"'x' is defined but never used.","line":3,"column":7},
+				{"ruleId":"eqeqeq","severity":1,"message":"Expected '===' and instead saw '=='.","line":5,"column":9}
+			]},{"filePath":"/app/src/b.js","messages":[]}]`,
+			want: []Diagnostic{
+				{File: "src/a.js", Line: 3, Column: 7, Severity: "error", Rule: "no-unused-vars", Message: "'x' is defined but never used."},
+				{File: "src/a.js", Line: 5, Column: 9, Severity: "warning", Rule: "eqeqeq", Message: "Expected '===' and instead saw '=='."},
+			},
+		},
+		{
+			name:  "ruff",
+			parse: parseRuff,
+			output: `[{"code":"F401","message":"os imported but unused","filename":"/app/main.py","location":{"row":1,"column":8}},
+				{"code":"E501","message":"Line too long","filename":"/elsewhere/lib.py","location":{"row":10,"column":89}}]`,
+			want: []Diagnostic{
+				{File: "main.py", Line: 1, Column: 8, Severity: "error", Rule: "F401", Message: "os imported but unused"},
+				{File: "/elsewhere/lib.py", Line: 10, Column: 89, Severity: "error", Rule: "E501", Message: "Line too long"},
+			},
+		},
+		{
+			name:  "golangci-lint",
+			parse: parseGolangciLint,
+			output: `{"Issues":[
+				{"FromLinter":"errcheck","Text":"Error return value is not checked","Severity":"","Pos":{"Filename":"main.go","Line":12,"Column":2}},
+				{"FromLinter":"gocritic","Text":"ifElseChain","Severity":"warning","Pos":{"Filename":"pkg/util.go","Line":4,"Column":1}}
+			]}`,
+			want: []Diagnostic{
+				{File: "main.go", Line: 12, Column: 2, Severity: "error", Rule: "errcheck", Message: "Error return value is not checked"},
+				{File: "pkg/util.go", Line: 4, Column: 1, Severity: "warning", Rule: "gocritic", Message: "ifElseChain"},
+			},
+		},
+		{
+			name:   "golangci-lint without issues",
+			parse:  parseGolangciLint,
+			output: `{"Issues":null}`,
+			want:   []Diagnostic{},
+		},
+		{
+			name:    "no output",
+			parse:   parseRuff,
+			output:  "  \n",
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			parse:   parseESLint,
+			output:  "Oops! Something went wrong!",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse("/app", tt.output)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// lockPollInterval is how often a blocked operation retries to acquire the environment lock.
+const lockPollInterval = 100 * time.Millisecond
+
+func lockPath(id string) (string, error) {
+	return homedir.Expand(fmt.Sprintf("~/.config/container-use/locks/%s.lock", strings.ReplaceAll(id, "/", "_")))
+}
+
+// lock acquires the advisory lock of the environment, serializing the
+// operations made on it by any process. It blocks until the lock is acquired
+// or ctx is done. The returned function releases the lock.
+//
+// Within a process, clients sharing the environment are served in order.
+// Across processes, locks are held with flock(2) and are released
+// automatically if the process dies.
+func (env *Environment) lock(ctx context.Context) (func(), error) {
+	done, err := env.client.begin()
+	if err != nil {
+		return nil, err
+	}
+	env.touch()
+	if err := env.enqueue(ctx); err != nil {
+		done()
+		return nil, err
+	}
+	unlock, err := env.flock(ctx)
+	if err != nil {
+		<-env.ops
+		done()
+		return nil, err
+	}
+	held := &heldLock{ctx: ctx, release: func() {
+		unlock()
+		<-env.ops
+	}}
+	env.lockMu.Lock()
+	env.held = held
+	env.lockMu.Unlock()
+	return func() {
+		env.lockMu.Lock()
+		if env.held == held {
+			env.held = nil
+		}
+		release := held.release
+		held.release = nil
+		env.lockMu.Unlock()
+		if release != nil {
+			release()
+		}
+		done()
+	}, nil
+}
+
+// heldLock is the lock of the environment held by the operation made in ctx.
+type heldLock struct {
+	ctx context.Context
+	// release releases the lock, nil if it's not held.
+	release func()
+}
+
+// suspendLock releases the lock of the environment if the operation made in
+// ctx holds it, e.g. while it waits for a human, letting other operations run
+// in the meantime. The returned function acquires it again: the operation
+// must not rely on the state it read before.
+func (env *Environment) suspendLock(ctx context.Context) func() error {
+	env.lockMu.Lock()
+	held := env.held
+	if held == nil || held.ctx != ctx || held.release == nil {
+		env.lockMu.Unlock()
+		return func() error { return nil }
+	}
+	env.held = nil
+	release := held.release
+	held.release = nil
+	env.lockMu.Unlock()
+	release()
+
+	return func() error {
+		if err := env.enqueue(ctx); err != nil {
+			return err
+		}
+		unlock, err := env.flock(ctx)
+		if err != nil {
+			<-env.ops
+			return err
+		}
+		env.lockMu.Lock()
+		held.release = func() {
+			unlock()
+			<-env.ops
+		}
+		env.held = held
+		env.lockMu.Unlock()
+		return nil
+	}
+}
+
+// enqueue waits for the turn of the operation among the ones of this process.
+func (env *Environment) enqueue(ctx context.Context) error {
+	if err := env.checkWritable(ctx); err != nil {
+		return err
+	}
+	env.opsOnce.Do(func() {
+		env.ops = make(chan struct{}, 1)
+	})
+	env.touchClient(ClientInfoFromContext(ctx))
+
+	if ahead := env.queued.Add(1) - 1; ahead > 0 {
+		reportProgress(ctx, "Queued behind %d operations on environment %s", ahead, env.ID)
+	}
+	defer env.queued.Add(-1)
+
+	select {
+	case env.ops <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for environment %s: %w", env.ID, ctx.Err())
+	}
+}
+
+func (env *Environment) flock(ctx context.Context) (func(), error) {
+	path, err := lockPath(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock environment %s: %w", env.ID, err)
+		}
+		if !waiting {
+			waiting = true
+			holder, _ := os.ReadFile(path)
+			reportProgress(ctx, "Waiting for environment %s, in use by %s", env.ID, strings.TrimSpace(string(holder)))
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for environment %s: %w", env.ID, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	// Record the holder to help diagnose contention.
+	holder := fmt.Sprintf("pid %d", os.Getpid())
+	if client := ClientFromContext(ctx); client != "" {
+		holder += fmt.Sprintf(" (%s)", client)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(holder+"\n"), 0)
+	}
+
+	return func() {
+		f.Truncate(0)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// touchClient records that client operates on the environment.
+func (env *Environment) touchClient(client ClientInfo) {
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	if client.Identity != "" {
+		if env.identities == nil {
+			env.identities = map[string]bool{}
+		}
+		env.identities[client.Identity] = true
+	}
+	if client.Name == "" {
+		return
+	}
+	if env.clients == nil {
+		env.clients = map[string]time.Time{}
+	}
+	env.clients[client.Name] = time.Now()
+}
+
+// ReadOnlyError is returned when a client attached in read-only mode tries to modify an environment.
+type ReadOnlyError struct {
+	Environment string
+	Client      string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("environment %s is attached read-only by %s, changes are not allowed", e.Environment, e.Client)
+}
+
+// Attach registers client as working in the environment. A client attached
+// with readOnly can inspect the environment (read files, diff, logs) but any
+// operation modifying it fails with a *ReadOnlyError. Read-only mode applies
+// to the session of the client, and lasts as long as it: attaching again
+// doesn't lift it.
+func (env *Environment) Attach(client ClientInfo, readOnly bool) {
+	env.touchClient(client)
+	key := client.attachKey()
+	if key == "" || !readOnly {
+		return
+	}
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	if env.readOnly == nil {
+		env.readOnly = map[string]bool{}
+	}
+	env.readOnly[key] = true
+}
+
+// attachKey identifies the session of the client for Attach: its name can be
+// chosen by any client, so it's only used if the client has no session.
+func (c ClientInfo) attachKey() string {
+	switch {
+	case c.Session != "":
+		return "session:" + c.Identity + "/" + c.Session
+	case c.Identity != "":
+		return "identity:" + c.Identity
+	case c.Name != "":
+		return "name:" + c.Name
+	}
+	return ""
+}
+
+// checkWritable fails if the client in ctx attached to the environment in read-only mode.
+func (env *Environment) checkWritable(ctx context.Context) error {
+	client := ClientInfoFromContext(ctx)
+	key := client.attachKey()
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	if env.readOnly[key] {
+		return &ReadOnlyError{Environment: env.ID, Client: client.String()}
+	}
+	return nil
+}
+
+// Identities returns the identities of the authenticated clients that operated
+// on the environment in this process, see ClientInfo.Identity.
+func (env *Environment) Identities() []string {
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	return slices.Sorted(maps.Keys(env.identities))
+}
+
+// Clients returns the MCP clients that operated on the environment in this process, sorted by name.
+func (env *Environment) Clients() []string {
+	env.clientsMu.Lock()
+	defer env.clientsMu.Unlock()
+	clients := make([]string, 0, len(env.clients))
+	for client := range env.clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	return clients
+}
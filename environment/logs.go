@@ -0,0 +1,155 @@
+package environment
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// 10MB
+	maxLogFileSize    = 10 * 1024 * 1024
+	maxLogFileBackups = 3
+)
+
+// LogPath returns the path of the log file for the environment with the given ID.
+func LogPath(id string) (string, error) {
+	return homedir.Expand(fmt.Sprintf("~/.config/container-use/logs/%s.log", id))
+}
+
+// rotatingFile is an io.Writer appending to a file which gets rotated to
+// <path>.1, <path>.2, ... once it grows over maxSize.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) *rotatingFile {
+	return &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+			return err
+		}
+	}
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// logf appends a timestamped entry to the environment's log file.
+// Logging is best effort: failures are reported through slog but never returned.
+func (env *Environment) logf(format string, args ...any) {
+	env.logMu.Lock()
+	if env.logFile == nil {
+		logPath, err := LogPath(env.ID)
+		if err != nil {
+			env.logMu.Unlock()
+			slog.Error("Failed to resolve environment log path", "environment.id", env.ID, "err", err)
+			return
+		}
+		env.logFile = newRotatingFile(logPath, maxLogFileSize, maxLogFileBackups)
+	}
+	logFile := env.logFile
+	env.logMu.Unlock()
+
+	entry := fmt.Sprintf("%s %s\n", time.Now().Format(time.RFC3339), env.redact(fmt.Sprintf(format, args...)))
+	if _, err := logFile.Write([]byte(entry)); err != nil {
+		slog.Error("Failed to write environment log", "environment.id", env.ID, "err", err)
+	}
+}
+
+func (env *Environment) closeLog() error {
+	env.logMu.Lock()
+	defer env.logMu.Unlock()
+
+	if env.logFile == nil {
+		return nil
+	}
+	err := env.logFile.Close()
+	env.logFile = nil
+	return err
+}
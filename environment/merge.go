@@ -0,0 +1,82 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Merge merges the environment envID into branch of the repository at source,
+// without touching its checkout: branch can't be checked out in any of the
+// worktrees of source. On conflicts, nothing changes and a *ConflictError is
+// returned.
+func Merge(ctx context.Context, source, envID, branch string) error {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "check-ref-format", "--branch", branch); err != nil {
+		return fmt.Errorf("invalid branch %q", branch)
+	}
+	checkedOut, err := worktreeBranches(ctx, localRepoPath)
+	if err != nil {
+		return err
+	}
+	if worktree, ok := checkedOut[branch]; ok {
+		return fmt.Errorf("branch %s is checked out in %s: merge it there with cu merge", branch, worktree)
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "container-use", envID); err != nil {
+		return err
+	}
+
+	ref := "refs/heads/" + branch
+	head, err := runGitCommand(ctx, localRepoPath, "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return fmt.Errorf("unknown branch %s", branch)
+	}
+	head = strings.TrimSpace(head)
+	envBranch := "container-use/" + envID
+	commit, err := runGitCommand(ctx, localRepoPath, "rev-parse", envBranch)
+	if err != nil {
+		return err
+	}
+	commit = strings.TrimSpace(commit)
+
+	tree, conflicts, err := mergeTree(ctx, localRepoPath, head, commit)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Commit: commit, Files: conflicts}
+	}
+	merge, err := runGitCommand(ctx, localRepoPath, "commit-tree", tree, "-p", head, "-p", commit, "-m", fmt.Sprintf("Merge environment %s", envID))
+	if err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, localRepoPath, "update-ref", ref, strings.TrimSpace(merge), head)
+	return err
+}
+
+// mergeTree merges the commits ours and theirs without a worktree. It returns
+// the merged tree, or the conflicting files.
+func mergeTree(ctx context.Context, dir, ours, theirs string) (string, []string, error) {
+	cmd := exec.CommandContext(ctx, "git", "merge-tree", "--write-tree", "--name-only", "--no-messages", ours, theirs)
+	cmd.Dir = dir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return lines[0], nil, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return "", lines[1:], nil
+	default:
+		return "", nil, fmt.Errorf("git merge-tree failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+}
@@ -0,0 +1,248 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// MirrorConfig mirrors environment branches and notes to a git remote of the
+// source repository, so environments can be opened from other machines.
+type MirrorConfig struct {
+	// Remote is the name of the remote to push to, e.g. origin.
+	Remote string `json:"remote" yaml:"remote"`
+}
+
+// mirrorBranch is the name of the branch of an environment on the mirror remote.
+func mirrorBranch(id string) string {
+	return "container-use/" + id
+}
+
+// mirroredNotes returns the git notes refs mirrored with the settings notes.
+func mirroredNotes(notes *NotesConfig) []string {
+	return []string{notes.logRef(), notes.stateRef(), gitNotesSBOMRef}
+}
+
+// mirror pushes the environment branch and notes to the mirror remote.
+// Mirroring is best effort: failures are logged but don't fail the operation.
+func (env *Environment) mirror(ctx context.Context) {
+	if env.Mirror == nil || env.Mirror.Remote == "" {
+		return
+	}
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		slog.Error("Failed to mirror environment", "environment.id", env.ID, "err", err)
+		return
+	}
+
+	reportProgress(ctx, "Pushing container-use/%s to %s", env.ID, env.Mirror.Remote)
+	branch := fmt.Sprintf("+refs/remotes/container-use/%s:refs/heads/%s", env.ID, mirrorBranch(env.ID))
+	if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", env.Mirror.Remote, branch); err != nil {
+		slog.Error("Failed to mirror environment branch", "environment.id", env.ID, "remote", env.Mirror.Remote, "err", err)
+		env.logf("Failed to push environment branch to %s: %s", env.Mirror.Remote, err)
+		return
+	}
+	for _, ref := range mirroredNotes(env.Notes) {
+		fullRef := "refs/notes/" + ref
+		if _, err := runGitCommand(ctx, localRepoPath, "show-ref", "--verify", "--quiet", fullRef); err != nil {
+			continue
+		}
+		// Notes are never forced: they may hold the history of environments from other machines.
+		if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", env.Mirror.Remote, fullRef+":"+fullRef); err != nil {
+			slog.Error("Failed to mirror environment notes", "environment.id", env.ID, "ref", fullRef, "err", err)
+		}
+	}
+	if env.Notes.backend() == NotesFile {
+		if err := mirrorNoteFiles(ctx, localRepoPath, env.Mirror.Remote, env.Notes); err != nil {
+			slog.Error("Failed to mirror environment note files", "environment.id", env.ID, "err", err)
+		}
+	}
+	if env.Audit != nil && env.Audit.HashChain {
+		ref := auditRef(env.ID)
+		if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", env.Mirror.Remote, ref+":"+ref); err != nil {
+			slog.Error("Failed to mirror audit log", "environment.id", env.ID, "err", err)
+		}
+	}
+	if env.Audit != nil && env.Audit.AnchorEvery > 0 {
+		anchors := "refs/tags/" + auditTagPrefix(env.ID) + "*"
+		if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", env.Mirror.Remote, anchors+":"+anchors); err != nil {
+			slog.Error("Failed to mirror audit anchors", "environment.id", env.ID, "err", err)
+		}
+	}
+}
+
+// hydrateFromMirror fetches the branch and notes of the environment id from
+// the mirror remote into the container-use repository, so its worktree can be
+// created on this machine.
+func hydrateFromMirror(ctx context.Context, localRepoPath, remote, id string, notes *NotesConfig) error {
+	cuRepoPath, err := InitializeLocalRemote(ctx, localRepoPath)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, "show-ref", "--verify", "--quiet", "refs/heads/"+id); err == nil {
+		// Already known locally.
+		return nil
+	}
+
+	slog.Info("Fetching environment from mirror", "environment.id", id, "remote", remote)
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "--quiet", remote, "refs/heads/"+mirrorBranch(id)); err != nil {
+		return fmt.Errorf("environment %s not found on %s: %w", id, remote, err)
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", "container-use", "FETCH_HEAD:refs/heads/"+id); err != nil {
+		return err
+	}
+
+	for _, ref := range mirroredNotes(notes) {
+		fullRef := "refs/notes/" + ref
+		if _, err := runGitCommand(ctx, localRepoPath, "fetch", "--quiet", remote, fullRef); err != nil {
+			if strings.Contains(err.Error(), "couldn't find remote ref") {
+				continue
+			}
+			return err
+		}
+		// Merge the remote notes with the local ones, then hand them to the container-use repository.
+		if _, err := runGitCommand(ctx, localRepoPath, "show-ref", "--verify", "--quiet", fullRef); err != nil {
+			if _, err := runGitCommand(ctx, localRepoPath, "update-ref", fullRef, "FETCH_HEAD"); err != nil {
+				return err
+			}
+		} else if _, err := runGitCommand(ctx, localRepoPath, "notes", "--ref", ref, "merge", "-s", "theirs", "FETCH_HEAD"); err != nil {
+			return err
+		}
+		if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", "--force", "container-use", fullRef+":"+fullRef); err != nil {
+			return err
+		}
+	}
+
+	ref := auditRef(id)
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "--quiet", remote, ref+":"+ref); err != nil {
+		if !strings.Contains(err.Error(), "couldn't find remote ref") {
+			return err
+		}
+	} else if _, err := runGitCommand(ctx, localRepoPath, "push", "--quiet", "container-use", ref+":"+ref); err != nil {
+		return err
+	}
+
+	if notes.backend() != NotesFile {
+		return nil
+	}
+	if _, err := fetchNoteFiles(ctx, localRepoPath, remote, notes); err != nil {
+		return err
+	}
+	// Hand the note files to the container-use repository.
+	for _, ref := range []string{notes.logRef(), notes.stateRef()} {
+		from, err := noteFile(ctx, localRepoPath, ref)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(from)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		to, err := noteFile(ctx, cuRepoPath, ref)
+		if err != nil {
+			return err
+		}
+		if err := mergeNoteFile(to, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notesBranch is the branch of the mirror remote holding the note files of
+// the file notes backend, one per ref.
+const notesBranch = "container-use-notes"
+
+// fetchNoteFiles merges the note files of the notes branch of remote into the
+// ones of the repository at localRepoPath. It returns the head of the notes
+// branch, or an empty string if remote doesn't have one yet.
+func fetchNoteFiles(ctx context.Context, localRepoPath, remote string, notes *NotesConfig) (string, error) {
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "--quiet", remote, "refs/heads/"+notesBranch); err != nil {
+		if strings.Contains(err.Error(), "couldn't find remote ref") {
+			return "", nil
+		}
+		return "", err
+	}
+	head, err := runGitCommand(ctx, localRepoPath, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+	head = strings.TrimSpace(head)
+	for _, ref := range []string{notes.logRef(), notes.stateRef()} {
+		data, err := runGitCommand(ctx, localRepoPath, "show", head+":"+ref+".jsonl")
+		if err != nil {
+			// Not recorded on remote yet.
+			continue
+		}
+		path, err := noteFile(ctx, localRepoPath, ref)
+		if err != nil {
+			return "", err
+		}
+		if err := mergeNoteFile(path, []byte(data)); err != nil {
+			return "", err
+		}
+	}
+	return head, nil
+}
+
+// mirrorNoteFiles pushes the note files of the repository at localRepoPath,
+// merged with the ones of remote, to the notes branch of remote.
+func mirrorNoteFiles(ctx context.Context, localRepoPath, remote string, notes *NotesConfig) error {
+	parent, err := fetchNoteFiles(ctx, localRepoPath, remote, notes)
+	if err != nil {
+		return err
+	}
+
+	entries := ""
+	for _, ref := range []string{notes.logRef(), notes.stateRef()} {
+		path, err := noteFile(ctx, localRepoPath, ref)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		blob, err := runGitCommand(ctx, localRepoPath, "hash-object", "-w", path)
+		if err != nil {
+			return err
+		}
+		entries += fmt.Sprintf("100644 blob %s\t%s.jsonl\n", strings.TrimSpace(blob), ref)
+	}
+	if entries == "" {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "git", "mktree")
+	cmd.Dir = localRepoPath
+	cmd.Stdin = strings.NewReader(entries)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git mktree failed: %w", err)
+	}
+	tree := strings.TrimSpace(string(out))
+
+	args := []string{"commit-tree", tree, "-m", "Update container-use notes"}
+	if parent != "" {
+		parentTree, err := runGitCommand(ctx, localRepoPath, "rev-parse", parent+"^{tree}")
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(parentTree) == tree {
+			return nil
+		}
+		args = append(args, "-p", parent)
+	}
+	commit, err := runGitCommand(ctx, localRepoPath, args...)
+	if err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, localRepoPath, "push", "--quiet", remote, strings.TrimSpace(commit)+":refs/heads/"+notesBranch)
+	return err
+}
@@ -0,0 +1,86 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+)
+
+type NetworkMode string
+
+// allowedHostsRefresh is how often, in seconds, the allowed hosts are resolved again.
+const allowedHostsRefresh = 60
+
+const (
+	// NetworkOpen leaves networking unrestricted.
+	NetworkOpen NetworkMode = ""
+	// NetworkNone only allows loopback traffic.
+	NetworkNone NetworkMode = "none"
+	// NetworkAllowlist only allows loopback, DNS and traffic to AllowedHosts.
+	NetworkAllowlist NetworkMode = "allowlist"
+)
+
+// NetworkPolicy restricts the outbound network access of commands running in an environment.
+//
+// Restrictions are enforced with a firewall installed in the network namespace of
+// every command, as each gets its own, which then runs with all capabilities
+// dropped so it can't lift them. The firewall is installed with tools mounted
+// in the environment, so it works whatever the base image. Allowed hosts are
+// resolved again every allowedHostsRefresh seconds while the command runs, to
+// follow their DNS records.
+type NetworkPolicy struct {
+	Mode         NetworkMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	AllowedHosts []string    `json:"allowed_hosts,omitempty" yaml:"allowed_hosts,omitempty"`
+}
+
+func (p *NetworkPolicy) restricted() bool {
+	return p != nil && p.Mode != NetworkOpen
+}
+
+func (p *NetworkPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Mode {
+	case NetworkOpen, NetworkNone, NetworkAllowlist:
+	default:
+		return fmt.Errorf("invalid network mode %q", p.Mode)
+	}
+	if p.Mode != NetworkAllowlist && len(p.AllowedHosts) > 0 {
+		return fmt.Errorf("allowed_hosts requires network mode %q", NetworkAllowlist)
+	}
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// firewallRules returns the commands installing the firewall.
+func (p *NetworkPolicy) firewallRules() string {
+	script := &strings.Builder{}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		optional := ""
+		if iptables == "ip6tables" {
+			optional = "[ -e /proc/net/if_inet6 ] && "
+		}
+		fmt.Fprintf(script, "%s%s -P OUTPUT DROP\n", optional, iptables)
+		fmt.Fprintf(script, "%s%s -A OUTPUT -o lo -j ACCEPT\n", optional, iptables)
+		// Allow replies to inbound connections (e.g. exposed ports of background commands)
+		fmt.Fprintf(script, "%s%s -A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT || true\n", optional, iptables)
+		if p.Mode == NetworkAllowlist {
+			fmt.Fprintf(script, "%s%s -A OUTPUT -p udp --dport 53 -j ACCEPT\n", optional, iptables)
+			fmt.Fprintf(script, "%s%s -A OUTPUT -p tcp --dport 53 -j ACCEPT\n", optional, iptables)
+		}
+	}
+	if p.Mode == NetworkAllowlist && len(p.AllowedHosts) > 0 {
+		hosts := make([]string, 0, len(p.AllowedHosts))
+		for _, host := range p.AllowedHosts {
+			hosts = append(hosts, shellQuote(host))
+		}
+		fmt.Fprintf(script, "allow() { for host in %s; do iptables -C OUTPUT -d \"$host\" -j ACCEPT 2>/dev/null || iptables -A OUTPUT -d \"$host\" -j ACCEPT; done; }\n", strings.Join(hosts, " "))
+		script.WriteString("allow\n")
+		// The loop must not keep the output of the command open.
+		fmt.Fprintf(script, "(while sleep %d; do allow || true; done) </dev/null >/dev/null 2>&1 &\n", allowedHostsRefresh)
+	}
+	return script.String()
+}
@@ -0,0 +1,71 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	NixFlake = "flake"
+	NixShell = "shell"
+
+	nixImage = "nixos/nix:latest"
+)
+
+// nixFiles are the files needed to evaluate the dev shell before the rest of the source is available.
+var nixFiles = []string{"flake.nix", "flake.lock", "shell.nix", "default.nix", "nix/**"}
+
+func detectNix(dir string) string {
+	switch {
+	case fileExists(dir, "flake.nix"):
+		return NixFlake
+	case fileExists(dir, "shell.nix"):
+		return NixShell
+	}
+	return ""
+}
+
+// nixArgs wraps args to run inside the project's dev shell.
+func (env *Environment) nixArgs(args []string) []string {
+	switch env.Nix {
+	case NixFlake:
+		return append([]string{"nix", "develop", "path:" + env.Workdir, "--command"}, args...)
+	default:
+		quoted := make([]string, 0, len(args))
+		for _, arg := range args {
+			quoted = append(quoted, shellQuote(arg))
+		}
+		return []string{"nix-shell", env.Workdir + "/shell.nix", "--run", strings.Join(quoted, " ")}
+	}
+}
+
+// withNixShell prepares container to run commands in the project's dev shell and pre-builds it,
+// so the toolchain is ready before setup commands run.
+func (env *Environment) withNixShell(ctx context.Context, container *dagger.Container, sourceDir *dagger.Directory) (*dagger.Container, error) {
+	if env.Nix != NixFlake && env.Nix != NixShell {
+		return nil, fmt.Errorf("invalid nix mode %q", env.Nix)
+	}
+
+	container = container.
+		WithExec([]string{"sh", "-c", "mkdir -p /etc/nix && echo 'experimental-features = nix-command flakes' >> /etc/nix/nix.conf"}).
+		WithDirectory(env.Workdir, sourceDir, dagger.ContainerWithDirectoryOpts{Include: nixFiles})
+
+	reportStage(ctx, StagePackages, 0, 0, "Building Nix dev shell")
+	spec, err := env.rootExecSpec(ctx, container, []string{"true"}, false)
+	if err != nil {
+		return nil, err
+	}
+	container = container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	})
+
+	stopHeartbeat := heartbeat(ctx, "Building Nix dev shell")
+	defer stopHeartbeat()
+	if _, err := container.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to build nix dev shell: %w", err)
+	}
+	return container, nil
+}
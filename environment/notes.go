@@ -0,0 +1,352 @@
+package environment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NotesBackend is where environments keep the notes attached to their
+// commits: the log of their operations and their state.
+type NotesBackend string
+
+const (
+	// NotesGit keeps notes in git notes, under refs/notes. It's the default.
+	NotesGit NotesBackend = "git"
+	// NotesFile keeps notes in JSONL files in the git directory of the
+	// repositories, for hosts stripping git notes on push. They're mirrored on
+	// the container-use-notes branch of the mirror remote.
+	NotesFile NotesBackend = "file"
+)
+
+// NotesConfig configures the notes of environments. The audit log and the
+// SBOMs are always kept in git notes.
+type NotesConfig struct {
+	// Backend is where the notes are kept, see NotesBackend.
+	Backend NotesBackend `json:"backend,omitempty" yaml:"backend,omitempty"`
+	// LogRef is the notes ref of the operations log, container-use by default.
+	LogRef string `json:"log_ref,omitempty" yaml:"log_ref,omitempty"`
+	// StateRef is the notes ref of the environment state, container-use-state by default.
+	StateRef string `json:"state_ref,omitempty" yaml:"state_ref,omitempty"`
+}
+
+var notesRefPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (n *NotesConfig) validate() error {
+	if n == nil {
+		return nil
+	}
+	switch n.Backend {
+	case "", NotesGit, NotesFile:
+	default:
+		return fmt.Errorf("invalid notes backend %q: must be %s or %s", n.Backend, NotesGit, NotesFile)
+	}
+	for _, ref := range []string{n.LogRef, n.StateRef} {
+		if ref != "" && (!notesRefPattern.MatchString(ref) || strings.HasSuffix(ref, ".lock") || strings.Contains(ref, "..")) {
+			return fmt.Errorf("invalid notes ref %q", ref)
+		}
+	}
+	if n.logRef() == n.stateRef() {
+		return fmt.Errorf("the log and state notes refs must differ, both are %q", n.logRef())
+	}
+	if n.logRef() == gitNotesSBOMRef || n.stateRef() == gitNotesSBOMRef {
+		return fmt.Errorf("notes ref %q is reserved", gitNotesSBOMRef)
+	}
+	return nil
+}
+
+func (n *NotesConfig) backend() NotesBackend {
+	if n == nil || n.Backend == "" {
+		return NotesGit
+	}
+	return n.Backend
+}
+
+func (n *NotesConfig) logRef() string {
+	if n == nil || n.LogRef == "" {
+		return gitNotesLogRef
+	}
+	return n.LogRef
+}
+
+func (n *NotesConfig) stateRef() string {
+	if n == nil || n.StateRef == "" {
+		return gitNotesStateRef
+	}
+	return n.StateRef
+}
+
+// repoNotes returns the notes settings of the repository at dir, a checkout
+// of the source repository or a container-use repository, whose origin is
+// the source repository. It falls back to the defaults if it can't tell.
+func repoNotes(ctx context.Context, dir string) *NotesConfig {
+	if bare, err := runGitCommand(ctx, dir, "rev-parse", "--is-bare-repository"); err == nil && strings.TrimSpace(bare) == "true" {
+		source, err := runGitCommand(ctx, dir, "config", "--get", "remote.origin.url")
+		if err != nil {
+			return nil
+		}
+		dir = strings.TrimSpace(source)
+	}
+	cfg, err := LoadRepoConfig(dir)
+	if err != nil || cfg == nil {
+		return nil
+	}
+	return cfg.Notes
+}
+
+// errNoNote is returned when a commit has no note.
+var errNoNote = errors.New("no note found")
+
+// add sets the note of ref on the HEAD commit of the repository at dir,
+// replacing the existing one.
+func (n *NotesConfig) add(ctx context.Context, dir, ref, note string) error {
+	if n.backend() == NotesFile {
+		return appendNoteRecord(ctx, dir, ref, "add", note)
+	}
+	f, err := os.CreateTemp(os.TempDir(), ".container-use-git-notes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(note); err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, dir, "notes", "--ref", ref, "add", "-f", "-F", f.Name())
+	return err
+}
+
+// append appends note to the note of ref on the HEAD commit of the
+// repository at dir.
+func (n *NotesConfig) append(ctx context.Context, dir, ref, note string) error {
+	if n.backend() == NotesFile {
+		return appendNoteRecord(ctx, dir, ref, "append", note)
+	}
+	_, err := runGitCommand(ctx, dir, "notes", "--ref", ref, "append", "-m", note)
+	return err
+}
+
+// show returns the note of ref on commit, or errNoNote.
+func (n *NotesConfig) show(ctx context.Context, dir, ref, commit string) (string, error) {
+	if n.backend() == NotesFile {
+		return showNoteRecords(ctx, dir, ref, commit)
+	}
+	note, err := runGitCommand(ctx, dir, "notes", "--ref", ref, "show", commit)
+	if err != nil && strings.Contains(err.Error(), "no note found") {
+		return "", fmt.Errorf("%w for %s", errNoNote, commit)
+	}
+	return note, err
+}
+
+// list returns the commits with a note of ref.
+func (n *NotesConfig) list(ctx context.Context, dir, ref string) (map[string]bool, error) {
+	commits := map[string]bool{}
+	if n.backend() == NotesFile {
+		path, err := noteFile(ctx, dir, ref)
+		if err != nil {
+			return nil, err
+		}
+		records, err := readNoteRecords(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			commits[record.Commit] = true
+		}
+		return commits, nil
+	}
+	if _, err := runGitCommand(ctx, dir, "rev-parse", "--verify", "--quiet", "refs/notes/"+ref); err != nil {
+		// No note has been recorded yet.
+		return commits, nil
+	}
+	out, err := runGitCommand(ctx, dir, "notes", "--ref", ref, "list")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if _, commit, ok := strings.Cut(line, " "); ok {
+			commits[commit] = true
+		}
+	}
+	return commits, nil
+}
+
+// propagateNotes hands the notes of ref recorded in the worktree to the
+// source repository.
+func (env *Environment) propagateNotes(ctx context.Context, ref string) error {
+	if env.Notes.backend() != NotesFile {
+		return env.propagateGitNotes(ctx, ref)
+	}
+	from, err := noteFile(ctx, env.Worktree, ref)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(from)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	to, err := noteFile(ctx, env.Source, ref)
+	if err != nil {
+		return err
+	}
+	return mergeNoteFile(to, data)
+}
+
+// noteRecord is a line of the note files of the file notes backend.
+type noteRecord struct {
+	Commit string    `json:"commit"`
+	Time   time.Time `json:"time"`
+	// Op is add, replacing the note of the commit, or append.
+	Op   string `json:"op"`
+	Note string `json:"note"`
+}
+
+// noteFile returns the path of the file holding the notes of ref of the
+// repository at dir. Worktrees share the one of their repository.
+func noteFile(ctx context.Context, dir, ref string) (string, error) {
+	common, err := runGitCommand(ctx, dir, "rev-parse", "--git-common-dir")
+	if err != nil {
+		return "", err
+	}
+	common = strings.TrimSpace(common)
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(dir, common)
+	}
+	return filepath.Join(common, "container-use", "notes", ref+".jsonl"), nil
+}
+
+func appendNoteRecord(ctx context.Context, dir, ref, op, note string) error {
+	commit, err := runGitCommand(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	return writeNoteRecord(ctx, dir, ref, strings.TrimSpace(commit), op, note)
+}
+
+// writeNoteRecord records note on commit in the note file of ref.
+func writeNoteRecord(ctx context.Context, dir, ref, commit, op, note string) error {
+	path, err := noteFile(ctx, dir, ref)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(noteRecord{Commit: commit, Time: time.Now().UTC(), Op: op, Note: note})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func readNoteRecords(path string) ([]noteRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []noteRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record noteRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid note in %s: %w", path, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// showNoteRecords returns the note of ref on commit: the last one added,
+// followed by the ones appended since, as git notes append does.
+func showNoteRecords(ctx context.Context, dir, ref, commit string) (string, error) {
+	hash, err := runGitCommand(ctx, dir, "rev-parse", "--verify", commit+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	hash = strings.TrimSpace(hash)
+	path, err := noteFile(ctx, dir, ref)
+	if err != nil {
+		return "", err
+	}
+	records, err := readNoteRecords(path)
+	if err != nil {
+		return "", err
+	}
+	notes := []string{}
+	for _, record := range records {
+		if record.Commit != hash {
+			continue
+		}
+		if record.Op == "add" {
+			notes = notes[:0]
+		}
+		notes = append(notes, strings.TrimRight(record.Note, "\n"))
+	}
+	if len(notes) == 0 {
+		return "", fmt.Errorf("%w for %s", errNoNote, commit)
+	}
+	return strings.Join(notes, "\n\n") + "\n", nil
+}
+
+// mergeNoteFile appends to the note file at path the records of data it
+// doesn't have yet.
+func mergeNoteFile(path string, data []byte) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	known := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		known[line] = true
+	}
+	missing := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" || known[line] {
+			continue
+		}
+		known[line] = true
+		missing = append(missing, line)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		missing = slices.Insert(missing, 0, "")
+	}
+	_, err = f.WriteString(strings.Join(missing, "\n") + "\n")
+	return err
+}
@@ -0,0 +1,119 @@
+package environment
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// defaultOutputLimit is the size, in bytes, of the output of the commands
+	// returned by Run, unless the repository configures another one.
+	defaultOutputLimit = 32 * 1024
+	// maxSavedOutputs is the number of full outputs kept per environment.
+	maxSavedOutputs = 50
+)
+
+var outputIDPattern = regexp.MustCompile(`^[0-9a-z]+$`)
+
+// OutputDir returns the directory the full outputs of the truncated commands
+// of the environment with the given ID are saved to.
+func OutputDir(id string) (string, error) {
+	return homedir.Expand(fmt.Sprintf("~/.config/container-use/outputs/%s", id))
+}
+
+// outputLimit returns the size, in bytes, of the command outputs returned by Run.
+func (env *Environment) outputLimit() int {
+	if env.OutputLimit > 0 {
+		return env.OutputLimit
+	}
+	return defaultOutputLimit
+}
+
+// limitOutput returns output, already redacted, if it fits the output limit
+// of the environment. Otherwise, it saves it and returns its beginning and
+// end, around a marker telling how much was truncated and the ID the full
+// output can be read with (see CommandOutput).
+func (env *Environment) limitOutput(output string) string {
+	limit := env.outputLimit()
+	if len(output) <= limit {
+		return output
+	}
+	where := "it couldn't be saved"
+	if id, err := env.saveOutput(output); err == nil {
+		where = "read the full output with output ID " + id
+	}
+	// Runes cut in half are dropped.
+	head := strings.ToValidUTF8(output[:limit/2], "")
+	tail := strings.ToValidUTF8(output[len(output)-limit/2:], "")
+	return fmt.Sprintf("%s\n\n[... %d of %d bytes truncated, %s ...]\n\n%s", head, len(output)-limit, len(output), where, tail)
+}
+
+// saveOutput saves output, keeping the last maxSavedOutputs, and returns its ID.
+func (env *Environment) saveOutput(output string) (string, error) {
+	dir, err := OutputDir(env.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := os.WriteFile(filepath.Join(dir, id+".log"), []byte(output), 0600); err != nil {
+		return "", err
+	}
+
+	saved, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err == nil && len(saved) > maxSavedOutputs {
+		// IDs are in base 36, so that their length is the same for centuries.
+		slices.Sort(saved)
+		for _, path := range saved[:len(saved)-maxSavedOutputs] {
+			_ = os.Remove(path)
+		}
+	}
+	return id, nil
+}
+
+// CommandOutput returns up to limit bytes, from offset, of the full output of
+// a command truncated by Run, and its size. A limit of zero reads up to the
+// output limit of the environment.
+func (env *Environment) CommandOutput(id string, offset, limit int) (string, int, error) {
+	if !outputIDPattern.MatchString(id) {
+		return "", 0, fmt.Errorf("invalid output ID %q", id)
+	}
+	dir, err := OutputDir(env.ID)
+	if err != nil {
+		return "", 0, err
+	}
+	f, err := os.Open(filepath.Join(dir, id+".log"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, fmt.Errorf("output %s not found: only the last %d outputs are kept", id, maxSavedOutputs)
+		}
+		return "", 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if limit <= 0 {
+		limit = env.outputLimit()
+	}
+	if offset < 0 || int64(offset) > stat.Size() {
+		return "", 0, fmt.Errorf("invalid offset %d: the output has %d bytes", offset, stat.Size())
+	}
+	buf := make([]byte, min(int64(limit), stat.Size()-int64(offset)))
+	if _, err := io.ReadFull(io.NewSectionReader(f, int64(offset), int64(len(buf))), buf); err != nil {
+		return "", 0, err
+	}
+	return string(buf), int(stat.Size()), nil
+}
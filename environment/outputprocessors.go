@@ -0,0 +1,182 @@
+package environment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// OutputProcessor transforms the output of the commands it matches before
+// Run returns it, e.g. to keep the errors of a noisy compiler only. The
+// audit log keeps the output as is.
+//
+// Example:
+//
+//	output_processors:
+//	  - {command: "^go (build|vet|test)", type: errors}
+//	  - {command: "^npm test", type: tail, lines: 30}
+//	  - {command: "kubectl .* -o json", type: json}
+type OutputProcessor struct {
+	// Command is a regular expression matched against the command, every command if empty.
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Type is the name of the processor, see RegisterOutputProcessor: json,
+	// head, tail, grep or errors.
+	Type string `json:"type" yaml:"type"`
+	// Lines is the number of lines kept by head, tail and errors.
+	Lines int `json:"lines,omitempty" yaml:"lines,omitempty"`
+	// Pattern is the regular expression matching the lines kept by grep.
+	Pattern string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+}
+
+// OutputProcessorFunc processes output as configured by p.
+type OutputProcessorFunc func(output string, p OutputProcessor) (string, error)
+
+var (
+	outputProcessorsMu sync.RWMutex
+	outputProcessors   = map[string]OutputProcessorFunc{
+		"json":   compactJSON,
+		"head":   headLines,
+		"tail":   tailLines,
+		"grep":   grepLines,
+		"errors": errorLines,
+	}
+)
+
+// RegisterOutputProcessor registers the output processor called name,
+// replacing the one with the same name if any.
+func RegisterOutputProcessor(name string, fn OutputProcessorFunc) {
+	outputProcessorsMu.Lock()
+	defer outputProcessorsMu.Unlock()
+	outputProcessors[name] = fn
+}
+
+func outputProcessor(name string) OutputProcessorFunc {
+	outputProcessorsMu.RLock()
+	defer outputProcessorsMu.RUnlock()
+	return outputProcessors[name]
+}
+
+func (p OutputProcessor) validate() error {
+	if outputProcessor(p.Type) == nil {
+		return fmt.Errorf("unknown output processor %q", p.Type)
+	}
+	if _, err := regexp.Compile(p.Command); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	if _, err := regexp.Compile(p.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	if p.Type == "grep" && p.Pattern == "" {
+		return errors.New("grep requires a pattern")
+	}
+	return nil
+}
+
+// processOutput applies, in order, the output processors of the environment
+// matching command to output. A failing processor is skipped.
+func (env *Environment) processOutput(command, output string) string {
+	for _, p := range env.OutputProcessors {
+		if p.Command != "" {
+			if matched, err := regexp.MatchString(p.Command, command); err != nil || !matched {
+				continue
+			}
+		}
+		fn := outputProcessor(p.Type)
+		if fn == nil {
+			continue
+		}
+		processed, err := fn(output, p)
+		if err != nil {
+			continue
+		}
+		output = processed
+	}
+	return output
+}
+
+func compactJSON(output string, _ OutputProcessor) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, []byte(strings.TrimSpace(output))); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func outputLines(output string) []string {
+	return strings.Split(strings.TrimRight(output, "\n"), "\n")
+}
+
+func headLines(output string, p OutputProcessor) (string, error) {
+	lines := outputLines(output)
+	n := orDefault(p.Lines, 50)
+	if len(lines) <= n {
+		return output, nil
+	}
+	return fmt.Sprintf("%s\n[... %d more lines ...]\n", strings.Join(lines[:n], "\n"), len(lines)-n), nil
+}
+
+func tailLines(output string, p OutputProcessor) (string, error) {
+	lines := outputLines(output)
+	n := orDefault(p.Lines, 50)
+	if len(lines) <= n {
+		return output, nil
+	}
+	return fmt.Sprintf("[... %d lines before ...]\n%s\n", len(lines)-n, strings.Join(lines[len(lines)-n:], "\n")), nil
+}
+
+func grepLines(output string, p OutputProcessor) (string, error) {
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return "", err
+	}
+	return keepLines(output, re.MatchString, p.Lines), nil
+}
+
+// compilerError matches the lines of compilers, linters and test runners
+// reporting errors, e.g. main.go:12:3: undefined: foo.
+var compilerError = regexp.MustCompile(`^\s*\S+:\d+(:\d+)?:|(?i)\b(error|fatal|panic|fail(ed|ure)?)\b`)
+
+func errorLines(output string, p OutputProcessor) (string, error) {
+	if !slices.ContainsFunc(outputLines(output), compilerError.MatchString) {
+		return output, nil
+	}
+	return keepLines(output, compilerError.MatchString, orDefault(p.Lines, 100)), nil
+}
+
+// keepLines returns the lines of output matching match, up to limit if not
+// zero, telling how many were left out.
+func keepLines(output string, match func(string) bool, limit int) string {
+	lines := outputLines(output)
+	kept := []string{}
+	for _, line := range lines {
+		if match(line) {
+			kept = append(kept, line)
+		}
+	}
+	more := 0
+	if limit > 0 && len(kept) > limit {
+		kept, more = kept[:limit], len(kept)-limit
+	}
+	omitted := len(lines) - len(kept)
+	if omitted == 0 {
+		return output
+	}
+	out := strings.Join(kept, "\n") + "\n"
+	if more > 0 {
+		out += fmt.Sprintf("[... %d more matching lines ...]\n", more)
+	}
+	return out + fmt.Sprintf("[%d of %d lines kept]\n", len(kept), len(lines))
+}
+
+// orDefault returns n, or def if n isn't positive.
+func orDefault(n, def int) int {
+	if n > 0 {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,279 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// packageManager installs system packages using cache volumes shared by all environments.
+type packageManager struct {
+	Name    string
+	Caches  []string
+	Install func(packages []string) string
+}
+
+var packageManagers = []*packageManager{
+	{
+		Name:   "apt-get",
+		Caches: []string{"/var/cache/apt", "/var/lib/apt/lists"},
+		Install: func(packages []string) string {
+			// Ubuntu/Debian images are configured to wipe the apt cache after each install, which defeats caching.
+			return "rm -f /etc/apt/apt.conf.d/docker-clean && apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + strings.Join(packages, " ")
+		},
+	},
+	{
+		Name:   "apk",
+		Caches: []string{"/var/cache/apk"},
+		Install: func(packages []string) string {
+			return "apk add " + strings.Join(packages, " ")
+		},
+	},
+	{
+		Name:   "dnf",
+		Caches: []string{"/var/cache/dnf"},
+		Install: func(packages []string) string {
+			return "dnf install -y --setopt=keepcache=1 " + strings.Join(packages, " ")
+		},
+	},
+}
+
+// detectPackageManager returns the system package manager available in container.
+func detectPackageManager(ctx context.Context, container *dagger.Container) (*packageManager, error) {
+	names := make([]string, 0, len(packageManagers))
+	for _, pm := range packageManagers {
+		names = append(names, pm.Name)
+	}
+	out, err := container.
+		WithExec([]string{"sh", "-c", "for pm in " + strings.Join(names, " ") + "; do command -v $pm >/dev/null && echo $pm && exit 0; done; exit 0"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect package manager: %w", err)
+	}
+	name := strings.TrimSpace(out)
+	for _, pm := range packageManagers {
+		if pm.Name == name {
+			return pm, nil
+		}
+	}
+	return nil, fmt.Errorf("no supported package manager (%s) found in base image", strings.Join(names, ", "))
+}
+
+// withPackages installs the environment's system packages in container.
+func (env *Environment) withPackages(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	pm, err := detectPackageManager(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorting the packages makes identical sets produce identical (cached) layers
+	packages := slices.Clone(env.Packages)
+	slices.Sort(packages)
+	packages = slices.Compact(packages)
+	for i, pkg := range packages {
+		packages[i] = shellQuote(pkg)
+	}
+
+	reportStage(ctx, StagePackages, 0, 0, "Installing packages with %s: %s", pm.Name, strings.Join(env.Packages, " "))
+	for _, cache := range pm.Caches {
+		container = container.WithMountedCache(cache, env.client.dag.CacheVolume("container-use-"+pm.Name+strings.ReplaceAll(cache, "/", "-")), dagger.ContainerWithMountedCacheOpts{
+			Sharing: dagger.CacheSharingModeLocked,
+		})
+	}
+
+	spec, err := env.rootExecSpec(ctx, container, []string{"sh", "-c", pm.Install(packages)}, false)
+	if err != nil {
+		return nil, err
+	}
+	container = container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	})
+	for _, cache := range pm.Caches {
+		container = container.WithoutMount(cache)
+	}
+
+	stopHeartbeat := heartbeat(ctx, "Installing packages")
+	defer stopHeartbeat()
+	if _, err := container.Sync(ctx); err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%s failed with exit code %d.\nstdout: %s\nstderr: %s", pm.Name, exitErr.ExitCode, env.redact(exitErr.Stdout), env.redact(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("failed to install packages: %s", env.redact(err.Error()))
+	}
+	return container, nil
+}
+
+// languageInstaller installs packages of a language ecosystem globally, with a
+// download cache shared by all environments.
+type languageInstaller struct {
+	Install func(packages []string) string
+	// Caches maps the environment variables configuring the cache directories to their path.
+	Caches map[string]string
+}
+
+var languageInstallers = map[string]*languageInstaller{
+	"pip": {
+		Install: func(packages []string) string { return "pip install " + strings.Join(packages, " ") },
+		Caches:  map[string]string{"PIP_CACHE_DIR": "/var/cache/container-use/pip"},
+	},
+	"npm": {
+		Install: func(packages []string) string { return "npm install -g " + strings.Join(packages, " ") },
+		Caches:  map[string]string{"npm_config_cache": "/var/cache/container-use/npm"},
+	},
+	"go": {
+		Install: func(packages []string) string { return "go install " + strings.Join(packages, " ") },
+		Caches: map[string]string{
+			"GOMODCACHE": "/var/cache/container-use/go-mod",
+			"GOCACHE":    "/var/cache/container-use/go-build",
+		},
+	},
+}
+
+// InstallPackages installs packages with manager: a system package manager
+// (apt, apk, dnf, or "system" for the one of the base image) or a language
+// package manager (pip, npm or go). The packages are recorded in the
+// environment, as packages or as a setup command, so they survive rebuilds.
+func (env *Environment) InstallPackages(ctx context.Context, explanation, manager string, packages []string) (rerr error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	if len(packages) == 0 {
+		return errors.New("no packages to install")
+	}
+	if env.isLocked(env.Source) {
+		return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Source, configDir, lockFile))
+	}
+	summary := fmt.Sprintf("Install %s with %s", strings.Join(packages, " "), manager)
+
+	previous := env.updateSettings()
+	defer func() {
+		if rerr != nil {
+			previous.restore(env)
+		}
+	}()
+
+	installer, isLanguage := languageInstallers[manager]
+	var command string
+	if isLanguage {
+		command = languageInstallCommand(manager, installer, packages)
+		env.SetupCommands = slices.Clone(env.SetupCommands)
+		if !slices.Contains(env.SetupCommands, command) {
+			env.SetupCommands = append(env.SetupCommands, command)
+		}
+	} else {
+		pm, err := detectPackageManager(ctx, env.container)
+		if err != nil {
+			return err
+		}
+		if manager == "apt" {
+			manager = "apt-get"
+		}
+		if manager != "system" && manager != pm.Name {
+			return fmt.Errorf("unsupported package manager %q: the base image uses %s (pip, npm and go are also supported)", manager, pm.Name)
+		}
+		quoted := make([]string, len(packages))
+		for i, pkg := range packages {
+			quoted[i] = shellQuote(pkg)
+		}
+		command = pm.Install(quoted)
+		env.Packages = slices.Clone(env.Packages)
+		for _, pkg := range packages {
+			if !slices.Contains(env.Packages, pkg) {
+				env.Packages = append(env.Packages, pkg)
+			}
+		}
+	}
+
+	if err := env.checkCommand(ctx, explanation, command); err != nil {
+		return err
+	}
+	if err := env.checkPolicyHook(ctx, PolicyRequest{
+		Operation:     "update",
+		Explanation:   explanation,
+		BaseImage:     env.BaseImage,
+		Packages:      env.Packages,
+		SetupCommands: env.SetupCommands,
+		Secrets:       env.Secrets,
+	}); err != nil {
+		return err
+	}
+
+	var container *dagger.Container
+	if isLanguage {
+		container, err = env.withLanguagePackages(ctx, manager, installer, packages, command)
+	} else {
+		container, err = env.withPackages(ctx, env.container)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := env.apply(ctx, summary, explanation, "", container); err != nil {
+		return err
+	}
+	return env.propagateToWorktree(ctx, change{Action: "install", Summary: summary}, explanation)
+}
+
+// languageInstallCommand returns the command installing packages with a
+// language package manager.
+func languageInstallCommand(manager string, installer *languageInstaller, packages []string) string {
+	quoted := make([]string, len(packages))
+	for i, pkg := range packages {
+		if manager == "go" && !strings.Contains(pkg, "@") {
+			pkg += "@latest"
+		}
+		quoted[i] = shellQuote(pkg)
+	}
+	return installer.Install(quoted)
+}
+
+// withLanguagePackages runs command, installing packages with a language
+// package manager, with the download caches of the manager mounted.
+func (env *Environment) withLanguagePackages(ctx context.Context, manager string, installer *languageInstaller, packages []string, command string) (*dagger.Container, error) {
+	reportProgress(ctx, "Installing packages with %s: %s", manager, strings.Join(packages, " "))
+	container := env.container
+	variables := slices.Sorted(maps.Keys(installer.Caches))
+	for _, variable := range variables {
+		cache := installer.Caches[variable]
+		container = container.
+			WithMountedCache(cache, env.client.dag.CacheVolume("container-use-"+manager+strings.ReplaceAll(cache, "/", "-")), dagger.ContainerWithMountedCacheOpts{
+				Sharing: dagger.CacheSharingModeShared,
+			}).
+			WithEnvVariable(variable, cache)
+	}
+	spec, err := env.rootExecSpec(ctx, container, []string{"sh", "-c", command}, false)
+	if err != nil {
+		return nil, err
+	}
+	container = container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	})
+	for _, variable := range variables {
+		container = container.WithoutMount(installer.Caches[variable]).WithoutEnvVariable(variable)
+	}
+
+	stopHeartbeat := heartbeat(ctx, "Installing packages")
+	defer stopHeartbeat()
+	if _, err := container.Sync(ctx); err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%s failed with exit code %d.\nstdout: %s\nstderr: %s", command, exitErr.ExitCode, env.redact(exitErr.Stdout), env.redact(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("failed to install packages: %s", env.redact(err.Error()))
+	}
+	return container, nil
+}
@@ -0,0 +1,244 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PluginTool is a project-specific tool declared by a repository, e.g. to
+// deploy a preview, served by the MCP server next to the built-in tools. Its
+// command runs in the environment like environment_run_cmd, with the
+// arguments of the call in its variables: CU_TOOL_ARGS holds them all as a
+// JSON object, and CU_ARG_<NAME> each of them (strings as is, other values
+// as JSON), e.g.
+//
+//	tools:
+//	  - name: deploy_preview
+//	    description: Deploy a preview of the current branch and return its URL.
+//	    command: ./scripts/deploy-preview.sh "$CU_ARG_TARGET"
+//	    input_schema:
+//	      type: object
+//	      properties:
+//	        target: {type: string, enum: [staging, qa]}
+//	      required: [target]
+type PluginTool struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	Command     string `yaml:"command"`
+	// Shell interprets Command, sh by default.
+	Shell string `yaml:"shell,omitempty"`
+	// InputSchema is the JSON schema of the arguments of the tool, an object.
+	InputSchema map[string]any `yaml:"input_schema,omitempty"`
+}
+
+// pluginToolNamePattern matches the names of plugin tools.
+var pluginToolNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// pluginArgPattern matches the names of the arguments of plugin tools, which
+// must be valid in variable names.
+var pluginArgPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pluginReservedArgs are the arguments of every plugin tool.
+var pluginReservedArgs = []string{"explanation", "environment_id"}
+
+// schema returns the JSON schema of the arguments of the tool.
+func (t *PluginTool) schema() (*jsonSchema, error) {
+	schema := &jsonSchema{Type: "object"}
+	if t.InputSchema == nil {
+		return schema, nil
+	}
+	data, err := json.Marshal(t.InputSchema)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("invalid input schema: %w", err)
+	}
+	if schema.Type != "object" {
+		return nil, errors.New("the input schema must be of type object")
+	}
+	for name := range schema.Properties {
+		if slices.Contains(pluginReservedArgs, name) {
+			return nil, fmt.Errorf("the argument %s is reserved", name)
+		}
+		if !pluginArgPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid argument name %q: must be letters, digits and underscores", name)
+		}
+	}
+	return schema, nil
+}
+
+func (t *PluginTool) validate() error {
+	if !pluginToolNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid tool name %q: must be lowercase letters, digits and underscores", t.Name)
+	}
+	if strings.HasPrefix(t.Name, "environment_") {
+		return fmt.Errorf("invalid tool name %q: the environment_ prefix is reserved for built-in tools", t.Name)
+	}
+	if t.Command == "" {
+		return fmt.Errorf("tool %s has no command", t.Name)
+	}
+	_, err := t.schema()
+	return err
+}
+
+// ToolDefinition is the MCP definition of a plugin tool.
+type ToolDefinition struct {
+	Name        string
+	Description string
+	// InputSchema is the JSON schema of the arguments of the tool, including
+	// the environment_id and explanation arguments of every tool.
+	InputSchema json.RawMessage
+}
+
+// LoadPluginTools returns the definitions of the plugin tools declared by the
+// repository at dir, if any.
+func LoadPluginTools(dir string) ([]ToolDefinition, error) {
+	cfg, err := LoadRepoConfig(dir)
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	definitions := make([]ToolDefinition, 0, len(cfg.Tools))
+	for _, tool := range cfg.Tools {
+		if err := tool.validate(); err != nil {
+			return nil, err
+		}
+		schema := map[string]any{"type": "object"}
+		for key, value := range tool.InputSchema {
+			schema[key] = value
+		}
+		properties := map[string]any{
+			"explanation": map[string]any{
+				"type":        "string",
+				"description": "One sentence explanation for why this tool is being called.",
+			},
+			"environment_id": map[string]any{
+				"type":        "string",
+				"description": "The ID of the environment to run the tool in.",
+			},
+		}
+		if declared, ok := tool.InputSchema["properties"].(map[string]any); ok {
+			for key, value := range declared {
+				properties[key] = value
+			}
+		}
+		schema["properties"] = properties
+		required := []any{"environment_id"}
+		if declared, ok := tool.InputSchema["required"].([]any); ok {
+			required = append(required, declared...)
+		}
+		schema["required"] = required
+		data, err := json.Marshal(schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input schema of tool %s: %w", tool.Name, err)
+		}
+		definitions = append(definitions, ToolDefinition{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: data,
+		})
+	}
+	return definitions, nil
+}
+
+// RunTool runs the plugin tool name, as declared by the repository of the
+// environment, with the arguments args. The arguments are validated against
+// the input schema of the tool first.
+func (env *Environment) RunTool(ctx context.Context, explanation, name string, args map[string]any) (string, error) {
+	cfg, err := LoadRepoConfig(env.Source)
+	if err != nil {
+		return "", err
+	}
+	var tool *PluginTool
+	if cfg != nil {
+		for i := range cfg.Tools {
+			if cfg.Tools[i].Name == name {
+				tool = &cfg.Tools[i]
+			}
+		}
+	}
+	if tool == nil {
+		return "", fmt.Errorf("the repository of environment %s doesn't declare the tool %s", env.ID, name)
+	}
+
+	toolArgs := map[string]any{}
+	for key, value := range args {
+		if !slices.Contains(pluginReservedArgs, key) {
+			toolArgs[key] = value
+		}
+	}
+	if err := tool.validateArgs(toolArgs); err != nil {
+		return "", err
+	}
+	vars, err := pluginToolVars(toolArgs)
+	if err != nil {
+		return "", err
+	}
+	shell := tool.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	_ = env.addGitNote(ctx, fmt.Sprintf("tool: %s %s\n\n", tool.Name, env.redact(vars[0])))
+	return env.run(ctx, explanation, tool.Command, shell, vars, false)
+}
+
+// validateArgs checks args against the input schema of the tool.
+func (t *PluginTool) validateArgs(args map[string]any) error {
+	schema, err := t.schema()
+	if err != nil {
+		return err
+	}
+	node := &yaml.Node{}
+	if err := node.Encode(args); err != nil {
+		return err
+	}
+	v := &schemaValidator{root: schema}
+	v.validate(node, schema, "")
+	if len(v.errors) == 0 {
+		return nil
+	}
+	problems := make([]string, 0, len(v.errors))
+	for _, problem := range v.errors {
+		if problem.Path == "" {
+			problems = append(problems, problem.Message)
+		} else {
+			problems = append(problems, problem.Path+": "+problem.Message)
+		}
+	}
+	return fmt.Errorf("invalid arguments for tool %s: %s", t.Name, strings.Join(problems, "; "))
+}
+
+// pluginToolVars returns the variables passing args to the command of a
+// plugin tool: CU_TOOL_ARGS first, then CU_ARG_<NAME> by name.
+func pluginToolVars(args map[string]any) ([]string, error) {
+	all, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	vars := []string{"CU_TOOL_ARGS=" + string(all)}
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := args[name].(string)
+		if !ok {
+			data, err := json.Marshal(args[name])
+			if err != nil {
+				return nil, err
+			}
+			value = string(data)
+		}
+		vars = append(vars, "CU_ARG_"+strings.ToUpper(name)+"="+value)
+	}
+	return vars, nil
+}
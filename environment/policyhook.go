@@ -0,0 +1,234 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dagger/container-use/telemetry"
+	"github.com/mitchellh/go-homedir"
+)
+
+// PolicyHookConfig delegates the authorization of operations to a centrally
+// managed policy engine, such as Open Policy Agent. The hook receives a
+// PolicyRequest and returns a PolicyDecision.
+//
+// Example (~/.config/container-use/policy-hook.json):
+//
+//	{"url": "http://localhost:8181/v1/data/container_use/decision"}
+//
+// or, evaluating a local rego policy:
+//
+//	{"command": ["opa", "eval", "--format", "raw", "--stdin-input", "--data", "policy.rego", "data.container_use.decision"]}
+type PolicyHookConfig struct {
+	// URL is an OPA Data API endpoint, sent {"input": request} and answering {"result": decision}.
+	URL string `json:"url,omitempty"`
+	// Command reads the request on its stdin and writes the decision on its stdout.
+	Command []string `json:"command,omitempty"`
+	// Timeout is the number of seconds to wait for a decision. Defaults to 10.
+	Timeout int `json:"timeout,omitempty"`
+	// FailOpen allows operations when the hook fails, instead of denying them.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+// PolicyRequest is the document the policy hook decides on.
+type PolicyRequest struct {
+	// Operation is one of run, update, upload or delete.
+	Operation   string     `json:"operation"`
+	Environment string     `json:"environment"`
+	Source      string     `json:"source"`
+	Client      ClientInfo `json:"client"`
+	Explanation string     `json:"explanation,omitempty"`
+	// Command is the command about to run.
+	Command string `json:"command,omitempty"`
+	// BaseImage, Packages, SetupCommands and Secrets are the requested configuration of an update.
+	// Secrets only lists their names.
+	BaseImage     string   `json:"base_image,omitempty"`
+	Packages      []string `json:"packages,omitempty"`
+	SetupCommands []string `json:"setup_commands,omitempty"`
+	Secrets       []string `json:"secrets,omitempty"`
+	// UploadSource and Path are the source and target of an upload.
+	UploadSource string `json:"upload_source,omitempty"`
+	Path         string `json:"path,omitempty"`
+}
+
+// PolicyDecision is the answer of the policy hook.
+type PolicyDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare boolean, as returned by rego rules like allow.
+func (d *PolicyDecision) UnmarshalJSON(data []byte) error {
+	var allow bool
+	if err := json.Unmarshal(data, &allow); err == nil {
+		*d = PolicyDecision{Allow: allow}
+		return nil
+	}
+	type decision PolicyDecision
+	return json.Unmarshal(data, (*decision)(d))
+}
+
+// PolicyDeniedError is returned when the policy hook denies an operation.
+type PolicyDeniedError struct {
+	Operation   string
+	Environment string
+	Reasons     []string
+}
+
+func (e *PolicyDeniedError) Error() string {
+	reason := ""
+	if len(e.Reasons) > 0 {
+		reason = ": " + strings.Join(e.Reasons, "; ")
+	}
+	return fmt.Sprintf("%s on environment %s is denied by policy%s", e.Operation, e.Environment, reason)
+}
+
+// DefaultPolicyHookPath returns the location of the policy hook configuration.
+func DefaultPolicyHookPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/policy-hook.json")
+}
+
+// LoadPolicyHookConfig reads the policy hook configuration. A missing file results in a nil configuration.
+func LoadPolicyHookConfig() (*PolicyHookConfig, error) {
+	configPath, err := DefaultPolicyHookPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cfg := &PolicyHookConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid policy hook configuration %s: %w", configPath, err)
+	}
+	if cfg.URL == "" && len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("invalid policy hook configuration %s: set url or command", configPath)
+	}
+	return cfg, nil
+}
+
+// Evaluate asks the policy hook for a decision on request.
+func (cfg *PolicyHookConfig) Evaluate(ctx context.Context, request *PolicyRequest) (*PolicyDecision, error) {
+	timeout := 10 * time.Second
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if cfg.URL != "" {
+		return cfg.evaluateURL(ctx, request)
+	}
+	return cfg.evaluateCommand(ctx, request)
+}
+
+func (cfg *PolicyHookConfig) evaluateURL(ctx context.Context, request *PolicyRequest) (*PolicyDecision, error) {
+	payload, err := json.Marshal(map[string]any{"input": request})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy hook returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		Result *PolicyDecision `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid policy decision: %w", err)
+	}
+	if result.Result == nil {
+		return &PolicyDecision{Reasons: []string{"no policy decision is defined"}}, nil
+	}
+	return result.Result, nil
+}
+
+func (cfg *PolicyHookConfig) evaluateCommand(ctx context.Context, request *PolicyRequest) (*PolicyDecision, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("policy hook failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return &PolicyDecision{Reasons: []string{"no policy decision is defined"}}, nil
+	}
+	decision := &PolicyDecision{}
+	if err := json.Unmarshal(out, decision); err != nil {
+		return nil, fmt.Errorf("invalid policy decision: %w", err)
+	}
+	return decision, nil
+}
+
+// checkPolicyHook submits the operation described by request to the policy
+// hook, if one is configured, recording denials in the audit log.
+func (env *Environment) checkPolicyHook(ctx context.Context, request PolicyRequest) error {
+	cfg, err := LoadPolicyHookConfig()
+	if err != nil || cfg == nil {
+		return err
+	}
+
+	request.Environment = env.ID
+	request.Source = env.Source
+	request.Client = ClientInfoFromContext(ctx)
+	secrets := make([]string, 0, len(request.Secrets))
+	for _, secret := range request.Secrets {
+		name, _, _ := strings.Cut(secret, "=")
+		secrets = append(secrets, name)
+	}
+	request.Secrets = secrets
+
+	decision, err := cfg.Evaluate(ctx, &request)
+	if err != nil {
+		if cfg.FailOpen {
+			_ = env.addGitNote(ctx, fmt.Sprintf("policy hook: allowed %s after failure (%s)\n\n", request.Operation, err))
+			return nil
+		}
+		decision = &PolicyDecision{Reasons: []string{err.Error()}}
+	}
+	if decision.Allow {
+		return nil
+	}
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("policy hook: denied %s (%s)\n\n", request.Operation, strings.Join(decision.Reasons, "; ")))
+	telemetry.Failure("policy_hook")
+	return &PolicyDeniedError{
+		Operation:   request.Operation,
+		Environment: env.ID,
+		Reasons:     decision.Reasons,
+	}
+}
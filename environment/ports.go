@@ -0,0 +1,200 @@
+package environment
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// portsDir is where the background commands of an environment report their listening sockets.
+	portsDir = "/run/container-use/ports"
+	// portsInterval is how often, in seconds, background commands report their listening sockets.
+	portsInterval = 2
+)
+
+// portsWatchScript runs "$@" while reporting the listening sockets of its
+// container, along with the processes owning them, in $CU_PORTS_FILE. Once
+// "$@" exits, its exit status is written in the exited directory next to it,
+// see waitProcess.
+var portsWatchScript = fmt.Sprintf(`command=$1
+shift
+file="$CU_PORTS_FILE"
+trap 'rm -f "$file" "$file.tmp"' EXIT
+"$@" &
+pid=$!
+(
+	while sleep %d; do
+		{
+			echo "# command $command"
+			echo "# time $(date +%%s)"
+			for proto in tcp tcp6 udp udp6; do
+				echo "# $proto"
+				tail -n +2 /proc/net/$proto 2>/dev/null
+			done
+			echo "# sockets"
+			for fd in /proc/[0-9]*/fd/*; do
+				link=$(readlink "$fd" 2>/dev/null) || continue
+				case "$link" in
+				socket:*)
+					p=${fd#/proc/}
+					inode=${link#socket:?}
+					echo "${inode%%?} $(cat /proc/${p%%%%/*}/comm 2>/dev/null)"
+					;;
+				esac
+			done
+		} >"$file.tmp" && mv "$file.tmp" "$file"
+	done
+) &
+watcher=$!
+wait $pid
+status=$?
+kill $watcher 2>/dev/null
+mkdir -p "${file%%/*}/exited" && echo "$status" >"${file%%/*}/exited/${file##*/}"
+exit $status`, portsInterval)
+
+// ListeningPort is a port a process of the environment listens on.
+type ListeningPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Process  string `json:"process,omitempty"`
+	// Command is the background command running the process.
+	Command string `json:"command,omitempty"`
+}
+
+func (env *Environment) portsCache() *dagger.CacheVolume {
+	return env.client.dag.CacheVolume(fmt.Sprintf("container-use-%s-ports", env.ID))
+}
+
+// watchPorts wraps the args of the background command of container so it
+// reports the ports it listens on to ListeningPorts. It returns the name of
+// its report, to wait for the command with.
+func (env *Environment) watchPorts(container *dagger.Container, command string, args []string) (*dagger.Container, []string, string) {
+	report := strconv.FormatInt(time.Now().UnixNano(), 10)
+	container = container.
+		WithMountedCache(portsDir, env.portsCache(), dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared, Owner: env.User.owner()}).
+		WithEnvVariable("CU_PORTS_FILE", portsDir+"/"+report)
+	return container, append([]string{"sh", "-c", portsWatchScript, "cu-ports", command}, args...), report
+}
+
+// waitProcess waits for the background command reporting its ports in report
+// to exit, and returns its exit status. It blocks until ctx is done if the
+// command is stopped instead.
+func (env *Environment) waitProcess(ctx context.Context, report string) (int, error) {
+	out, err := env.client.dag.Container().From(alpineImage).
+		WithMountedCache("/ports", env.portsCache(), dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared}).
+		WithEnvVariable("CACHEBUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", `while [ ! -f "$1" ]; do sleep 1; done; cat "$1"; rm -f "$1"`, "wait", "/ports/exited/" + report}).
+		Stdout(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// ListeningPorts returns the ports the background commands of the environment
+// (started with RunBackground or Expose) listen on, so they can be forwarded.
+// Commands started with the image entrypoint or default command aren't reported.
+func (env *Environment) ListeningPorts(ctx context.Context) ([]ListeningPort, error) {
+	out, err := env.client.dag.Container().From(alpineImage).
+		WithMountedCache("/ports", env.portsCache(), dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared}).
+		WithEnvVariable("CACHEBUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", `for f in /ports/*; do [ -f "$f" ] && cat "$f" && echo "# end"; done; true`}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list listening ports: %w", err)
+	}
+	return parsePortReports(out, time.Now()), nil
+}
+
+// parsePortReports parses the reports of portsWatchScript, ignoring the ones
+// of commands that stopped reporting.
+func parsePortReports(out string, now time.Time) []ListeningPort {
+	ports := []ListeningPort{}
+	var (
+		command, section string
+		reported         time.Time
+		sockets          []ListeningPort
+		inodes           []string
+		processes        map[string]string
+	)
+	for _, line := range strings.Split(out, "\n") {
+		if header, ok := strings.CutPrefix(line, "# "); ok {
+			key, value, _ := strings.Cut(header, " ")
+			switch key {
+			case "command":
+				command, sockets, inodes, processes = value, nil, nil, map[string]string{}
+			case "time":
+				seconds, _ := strconv.ParseInt(value, 10, 64)
+				reported = time.Unix(seconds, 0)
+			case "end":
+				if now.Sub(reported) > 5*portsInterval*time.Second {
+					continue
+				}
+				for i, socket := range sockets {
+					socket.Process = processes[inodes[i]]
+					socket.Command = command
+					if !slices.Contains(ports, socket) {
+						ports = append(ports, socket)
+					}
+				}
+			default:
+				section = key
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if section == "sockets" {
+			if len(fields) == 2 {
+				processes[fields[0]] = fields[1]
+			}
+			continue
+		}
+		if len(fields) < 10 {
+			continue
+		}
+		protocol := strings.TrimSuffix(section, "6")
+		// Listening TCP sockets are in the LISTEN (0A) state, bound UDP sockets in the CLOSE (07) state.
+		if protocol == "tcp" && fields[3] != "0A" || protocol == "udp" && fields[3] != "07" {
+			continue
+		}
+		address, port, ok := parseProcNetAddress(fields[1])
+		if !ok || port == 0 {
+			continue
+		}
+		sockets = append(sockets, ListeningPort{Port: port, Protocol: protocol, Address: address})
+		inodes = append(inodes, fields[9])
+	}
+	slices.SortFunc(ports, func(a, b ListeningPort) int { return a.Port - b.Port })
+	return ports
+}
+
+// parseProcNetAddress parses an address of /proc/net/{tcp,udp}{,6}: an IP in
+// hexadecimal, as 32-bit words in host (little endian) order, and a port.
+func parseProcNetAddress(s string) (string, int, bool) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, false
+	}
+	ip, err := hex.DecodeString(hexIP)
+	if err != nil || len(ip)%4 != 0 {
+		return "", 0, false
+	}
+	for i := 0; i < len(ip); i += 4 {
+		slices.Reverse(ip[i : i+4])
+	}
+	port, err := strconv.ParseInt(hexPort, 16, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	return net.IP(ip).String(), int(port), true
+}
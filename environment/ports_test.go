@@ -0,0 +1,89 @@
+package environment
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseProcNetAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		wantIP   string
+		wantPort int
+		wantOK   bool
+	}{
+		{address: "0100007F:1F90", wantIP: "127.0.0.1", wantPort: 8080, wantOK: true},
+		{address: "00000000:0050", wantIP: "0.0.0.0", wantPort: 80, wantOK: true},
+		{address: "00000000000000000000000000000000:0CEA", wantIP: "::", wantPort: 3306, wantOK: true},
+		{address: "0000000000000000FFFF00000100007F:1538", wantIP: "127.0.0.1", wantPort: 5432, wantOK: true},
+		{address: "0100007F", wantOK: false},
+		{address: "0100007G:0050", wantOK: false},
+		{address: "01007F:0050", wantOK: false},
+		{address: "0100007F:port", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ip, port, ok := parseProcNetAddress(tt.address)
+			if ok != tt.wantOK {
+				t.Fatalf("parseProcNetAddress(%q) ok = %v, want %v", tt.address, ok, tt.wantOK)
+			}
+			if ok && (ip != tt.wantIP || port != tt.wantPort) {
+				t.Errorf("parseProcNetAddress(%q) = %s, %d, want %s, %d", tt.address, ip, port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestParsePortReports(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	report := func(command string, reported time.Time, body string) string {
+		return "# command " + command + "\n# time " + strconv.FormatInt(reported.Unix(), 10) + "\n" + body + "# end\n"
+	}
+	server := `# tcp
+  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F91 0100007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+# udp
+   2: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1003 2 0000000000000000 0
+# tcp6
+   3: 00000000000000000000000000000000:0BB8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1004 1 0000000000000000 100 0 0 10 0
+# sockets
+1001 node
+1003 dnsmasq
+`
+
+	tests := []struct {
+		name string
+		out  string
+		want []ListeningPort
+	}{
+		{
+			name: "listening sockets",
+			out:  report("npm start", now.Add(-time.Second), server),
+			want: []ListeningPort{
+				{Port: 53, Protocol: "udp", Address: "0.0.0.0", Process: "dnsmasq", Command: "npm start"},
+				{Port: 3000, Protocol: "tcp", Address: "::", Command: "npm start"},
+				{Port: 8080, Protocol: "tcp", Address: "0.0.0.0", Process: "node", Command: "npm start"},
+			},
+		},
+		{
+			name: "stale report",
+			out:  report("npm start", now.Add(-time.Hour), server),
+			want: []ListeningPort{},
+		},
+		{
+			name: "no report",
+			out:  "",
+			want: []ListeningPort{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePortReports(tt.out, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePortReports() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package environment
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// dependencyPrefetcher downloads the dependencies locked by a project to the
+// cache of its package manager, shared by all environments.
+type dependencyPrefetcher struct {
+	// Manager names the cache volumes, shared with languageInstallers.
+	Manager string
+	// Files are the files the dependencies are prefetched from, the lockfile last.
+	Files []string
+	// Command downloads the dependencies. It does nothing if the package
+	// manager isn't in the base image.
+	Command string
+	// Caches maps the environment variables configuring the cache directories to their path.
+	Caches map[string]string
+}
+
+var dependencyPrefetchers = []*dependencyPrefetcher{
+	{
+		Manager: "npm",
+		Files:   []string{"package.json", "package-lock.json"},
+		Command: "command -v npm >/dev/null || exit 0; npm ci --ignore-scripts --no-audit --no-fund",
+		Caches:  languageInstallers["npm"].Caches,
+	},
+	{
+		Manager: "go",
+		Files:   []string{"go.mod", "go.sum"},
+		Command: "command -v go >/dev/null || exit 0; go mod download",
+		Caches:  map[string]string{"GOMODCACHE": languageInstallers["go"].Caches["GOMODCACHE"]},
+	},
+	{
+		Manager: "poetry",
+		Files:   []string{"pyproject.toml", "poetry.lock"},
+		Command: "command -v poetry >/dev/null || exit 0; poetry install --no-root --no-interaction",
+		Caches:  map[string]string{"POETRY_CACHE_DIR": "/var/cache/container-use/poetry"},
+	},
+	{
+		Manager: "pip",
+		Files:   []string{"requirements.txt"},
+		Command: "command -v pip >/dev/null || exit 0; pip download --quiet -r requirements.txt -d /tmp/container-use-prefetch",
+		Caches:  languageInstallers["pip"].Caches,
+	},
+}
+
+// prefetchers returns the prefetchers of the lockfiles found at the root of the worktree.
+func (env *Environment) prefetchers() []*dependencyPrefetcher {
+	if env.Worktree == "" {
+		return nil
+	}
+	found := []*dependencyPrefetcher{}
+	for _, prefetcher := range dependencyPrefetchers {
+		if !slices.ContainsFunc(prefetcher.Files, func(name string) bool {
+			_, err := os.Stat(filepath.Join(env.Worktree, name))
+			return err != nil
+		}) {
+			found = append(found, prefetcher)
+		}
+	}
+	return found
+}
+
+// withDependencyCache mounts the caches of prefetcher in container and points its package manager to them.
+func (env *Environment) withDependencyCache(container *dagger.Container, prefetcher *dependencyPrefetcher) *dagger.Container {
+	for _, variable := range slices.Sorted(maps.Keys(prefetcher.Caches)) {
+		cache := prefetcher.Caches[variable]
+		container = container.
+			WithMountedCache(cache, env.client.dag.CacheVolume("container-use-"+prefetcher.Manager+strings.ReplaceAll(cache, "/", "-")), dagger.ContainerWithMountedCacheOpts{
+				Sharing: dagger.CacheSharingModeShared,
+				Owner:   env.User.owner(),
+			}).
+			WithEnvVariable(variable, cache)
+	}
+	return container
+}
+
+// withDependencyCaches mounts the caches the dependencies of the project are
+// prefetched to in container, so that installing them there is fast.
+func (env *Environment) withDependencyCaches(container *dagger.Container) *dagger.Container {
+	for _, prefetcher := range env.prefetchers() {
+		container = env.withDependencyCache(container, prefetcher)
+	}
+	return container
+}
+
+// prefetchDependencies starts downloading, in parallel, the dependencies
+// locked by the project to the caches of their package managers, from the
+// base image, while the environment is set up. The returned function waits
+// for the downloads; failing ones are only logged, the dependencies being
+// installed later anyway.
+func (env *Environment) prefetchDependencies(ctx context.Context) func() {
+	prefetchers := env.prefetchers()
+	if len(prefetchers) == 0 {
+		return func() {}
+	}
+	wg := &sync.WaitGroup{}
+	for _, prefetcher := range prefetchers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files := env.client.dag.Host().Directory(env.Worktree, dagger.HostDirectoryOpts{Include: prefetcher.Files})
+			container := env.client.dag.Container().From(env.BaseImage).
+				WithDirectory(env.Workdir, files, dagger.ContainerWithDirectoryOpts{Owner: env.User.owner()}).
+				WithWorkdir(env.Workdir)
+			container = env.withProxy(container)
+			container = env.withDependencyCache(container, prefetcher)
+			if env.User != nil {
+				// The caches are written as the user of the environment, who installs the dependencies.
+				container = container.WithUser(env.User.owner()).WithEnvVariable("HOME", "/tmp")
+			}
+			container = container.WithExec([]string{"sh", "-c", prefetcher.Command})
+			if _, err := container.Sync(ctx); err != nil {
+				slog.Warn("Failed to prefetch dependencies", "environment.id", env.ID, "manager", prefetcher.Manager, "err", err)
+				return
+			}
+			reportProgress(ctx, "Prefetched %s dependencies from %s", prefetcher.Manager, prefetcher.Files[len(prefetcher.Files)-1])
+		}()
+	}
+	return wg.Wait
+}
@@ -0,0 +1,160 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// maxWarmContainers is the number of pre-warmed containers kept.
+const maxWarmContainers = 8
+
+// containerPool keeps provisioned containers, keyed by the settings they were
+// provisioned with, so environments with the same settings start instantly.
+type containerPool struct {
+	mu         sync.Mutex
+	enabled    bool
+	containers map[string]pooledContainer
+	// keys are ordered from the least to the most recently used.
+	keys []string
+}
+
+// pooledContainer is a provisioned container, along with the digest of the
+// base image it was built from.
+type pooledContainer struct {
+	container       *dagger.Container
+	baseImageDigest string
+}
+
+func (p *containerPool) get(key string) (*dagger.Container, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pooled, ok := p.containers[key]
+	if ok {
+		p.touch(key)
+	}
+	return pooled.container, pooled.baseImageDigest
+}
+
+func (p *containerPool) put(key string, container *dagger.Container, baseImageDigest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.enabled {
+		return
+	}
+	p.containers[key] = pooledContainer{container: container, baseImageDigest: baseImageDigest}
+	p.touch(key)
+	for len(p.keys) > maxWarmContainers {
+		delete(p.containers, p.keys[0])
+		p.keys = p.keys[1:]
+	}
+}
+
+func (p *containerPool) touch(key string) {
+	for i, k := range p.keys {
+		if k == key {
+			p.keys = append(p.keys[:i], p.keys[i+1:]...)
+			break
+		}
+	}
+	p.keys = append(p.keys, key)
+}
+
+// poolKey identifies the settings the container of the environment is
+// provisioned with. Environments linking services or using a Nix dev shell,
+// which depend on other environments or on the source code, can't be pooled.
+func (env *Environment) poolKey() (string, bool) {
+	return env.provisionKey(env.SetupCommands, env.SetupGroups)
+}
+
+// provisionKey identifies the settings of the environment with setupCommands
+// and setupGroups for setup steps, see poolKey.
+func (env *Environment) provisionKey(setupCommands []string, setupGroups [][]string) (string, bool) {
+	if len(env.Links) > 0 || len(env.Sidecars) > 0 || env.Nix != "" {
+		return "", false
+	}
+	settings, err := json.Marshal(struct {
+		BaseImage     string
+		Workdir       string
+		Packages      []string
+		SetupCommands []string
+		SetupGroups   [][]string
+		Secrets       []string
+		Env           []string
+		Ports         []int
+		Network       *NetworkPolicy
+		Hostname      string
+		Proxy         *ProxyConfig
+		ToolVersions  map[string]string
+	}{
+		env.BaseImage, env.Workdir, env.Packages, setupCommands, setupGroups, env.Secrets,
+		env.Env, env.Ports, env.Network, env.Hostname, env.Proxy, env.ToolVersions,
+	})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// Prewarm provisions, in the background, the container of the environments of
+// the repository at source, so that they start, and run their first command,
+// without waiting for their base image and setup commands, and downloads the
+// dependencies locked by the repository to the caches environments install
+// them from. Containers are then kept warm as environments with new settings
+// are built: environments created by this client start from them, see
+// provision, while the dependency caches are shared by all the clients of the
+// Dagger engine.
+func (c *Client) Prewarm(ctx context.Context, source string) error {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	c.pool.mu.Lock()
+	c.pool.enabled = true
+	c.pool.mu.Unlock()
+
+	env := &Environment{
+		client:    c,
+		ID:        "prewarm",
+		Name:      "prewarm",
+		Source:    localRepoPath,
+		Worktree:  localRepoPath, // to prefetch the dependencies from
+		BaseImage: defaultImage,
+		Workdir:   defaultWorkdir,
+	}
+	if err := env.configure(localRepoPath); err != nil {
+		return err
+	}
+	key, poolable := env.poolKey()
+	if !poolable {
+		return fmt.Errorf("environments of %s can't be pre-warmed: they use linked services or a Nix dev shell", localRepoPath)
+	}
+	go func() {
+		// The dependencies change independently of the container.
+		waitPrefetch := env.prefetchDependencies(ctx)
+		defer waitPrefetch()
+		if container, _ := c.pool.get(key); container != nil {
+			return
+		}
+
+		slog.Info("Pre-warming environment container", "source", localRepoPath, "base-image", env.BaseImage)
+		container, err := env.provision(ctx, env.client.dag.Host().Directory(localRepoPath))
+		if err == nil {
+			_, err = container.Sync(ctx)
+		}
+		if err != nil {
+			slog.Warn("Failed to pre-warm environment container", "source", localRepoPath, "err", err)
+			return
+		}
+		slog.Info("Pre-warmed environment container", "source", localRepoPath)
+	}()
+	return nil
+}
@@ -0,0 +1,104 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// heartbeatInterval is how often a long running operation reports it's still alive.
+const heartbeatInterval = 15 * time.Second
+
+// ProgressFunc receives human readable progress messages for long running operations.
+type ProgressFunc func(message string)
+
+type progressKey struct{}
+
+// WithProgress returns a context whose environment operations report their progress to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// Stage is a stage of the creation or update of an environment.
+type Stage string
+
+const (
+	StageWorktree  Stage = "worktree"
+	StageServices  Stage = "services"
+	StageImage     Stage = "image"
+	StagePackages  Stage = "packages"
+	StageSetup     Stage = "setup"
+	StageBootstrap Stage = "bootstrap"
+	StageSync      Stage = "sync"
+)
+
+// ProgressEvent reports a stage of the creation or update of an environment.
+type ProgressEvent struct {
+	Stage Stage `json:"stage"`
+	// Step and Steps locate the event in stages made of several steps, e.g.
+	// setup command 2 of 5. They are zero otherwise.
+	Step    int    `json:"step,omitempty"`
+	Steps   int    `json:"steps,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ProgressEvent) String() string {
+	if e.Steps > 0 {
+		return fmt.Sprintf("[%s %d/%d] %s", e.Stage, e.Step, e.Steps, e.Message)
+	}
+	return fmt.Sprintf("[%s] %s", e.Stage, e.Message)
+}
+
+// ProgressEventFunc receives the progress events of environment operations.
+type ProgressEventFunc func(event ProgressEvent)
+
+type progressEventKey struct{}
+
+// WithProgressEvents returns a context whose environment operations report their stages to fn,
+// e.g. to render a spinner. The events are also reported as messages to the ProgressFunc of ctx.
+func WithProgressEvents(ctx context.Context, fn ProgressEventFunc) context.Context {
+	return context.WithValue(ctx, progressEventKey{}, fn)
+}
+
+// reportStage reports that the operation reached step of steps (zero if the stage has a single step) of stage.
+func reportStage(ctx context.Context, stage Stage, step, steps int, format string, args ...any) {
+	event := ProgressEvent{Stage: stage, Step: step, Steps: steps, Message: fmt.Sprintf(format, args...)}
+	if fn, ok := ctx.Value(progressEventKey{}).(ProgressEventFunc); ok && fn != nil {
+		fn(event)
+	}
+	reportProgress(ctx, "%s", event)
+}
+
+func reportProgress(ctx context.Context, format string, args ...any) {
+	fn, ok := ctx.Value(progressKey{}).(ProgressFunc)
+	if !ok || fn == nil {
+		return
+	}
+	fn(fmt.Sprintf(format, args...))
+}
+
+// heartbeat periodically reports that the operation described by message is
+// still in progress, until the returned function is called.
+func heartbeat(ctx context.Context, message string) func() {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); !ok || fn == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		started := time.Now()
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reportProgress(ctx, "%s (%s elapsed)", message, time.Since(started).Round(time.Second))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
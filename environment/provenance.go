@@ -0,0 +1,144 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// provenanceNamespace is the namespace of SSH provenance signatures, to verify with
+// ssh-keygen -Y verify -n container-use-provenance.
+const provenanceNamespace = "container-use-provenance"
+
+// ProvenanceCommand is a command recorded in a provenance report.
+type ProvenanceCommand struct {
+	Command string    `json:"command"`
+	Client  string    `json:"client,omitempty"`
+	RanAt   time.Time `json:"ran_at"`
+}
+
+// Provenance describes how the code of an environment was produced.
+type Provenance struct {
+	Environment string `json:"environment"`
+	// SourceCommit is the commit of the source repository the environment started from.
+	SourceCommit    string              `json:"source_commit"`
+	BaseImage       string              `json:"base_image"`
+	BaseImageDigest string              `json:"base_image_digest"`
+	Packages        []string            `json:"packages,omitempty"`
+	SetupCommands   []string            `json:"setup_commands,omitempty"`
+	SetupGroups     [][]string          `json:"setup_groups,omitempty"`
+	Commands        []ProvenanceCommand `json:"commands"`
+	// Commit and Tree identify the resulting state of the environment branch.
+	Commit      string    `json:"commit"`
+	Tree        string    `json:"tree"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// SignedProvenance is a provenance report with a detached signature of its JSON payload.
+type SignedProvenance struct {
+	// Payload is the signed JSON encoding of the Provenance.
+	Payload json.RawMessage `json:"payload"`
+	// Signature is the armored signature of Payload, empty if no signing key is configured.
+	Signature string `json:"signature,omitempty"`
+	Signer    string `json:"signer,omitempty"`
+}
+
+// Provenance produces a report of how the environment's code was produced
+// (inputs, commands and resulting tree), signed with the key used to sign the
+// environment's commits if any (see SigningConfig).
+func (env *Environment) Provenance(ctx context.Context) (*SignedProvenance, error) {
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+
+	gitOutput := func(args ...string) (string, error) {
+		out, err := runGitCommand(ctx, worktreePath, args...)
+		return strings.TrimSpace(out), err
+	}
+	provenance := &Provenance{
+		Environment:   env.ID,
+		BaseImage:     env.BaseImage,
+		Packages:      env.Packages,
+		SetupCommands: env.SetupCommands,
+		SetupGroups:   env.SetupGroups,
+		Commands:      []ProvenanceCommand{},
+		GeneratedAt:   time.Now().UTC(),
+	}
+	if provenance.Commit, err = gitOutput("rev-parse", "HEAD"); err != nil {
+		return nil, err
+	}
+	if provenance.Tree, err = gitOutput("rev-parse", "HEAD^{tree}"); err != nil {
+		return nil, err
+	}
+	if provenance.SourceCommit, err = env.forkPoint(ctx, worktreePath); err != nil {
+		return nil, err
+	}
+	env.mu.Lock()
+	provenance.BaseImageDigest = env.BaseImageDigest
+	env.mu.Unlock()
+	if provenance.BaseImageDigest == "" {
+		return nil, fmt.Errorf("the digest of the base image %s wasn't recorded when environment %s was built: rebuild it to record it", env.BaseImage, env.ID)
+	}
+	for _, revision := range env.History {
+		if command, ok := strings.CutPrefix(revision.Name, "Run "); ok {
+			provenance.Commands = append(provenance.Commands, ProvenanceCommand{
+				Command: command,
+				Client:  revision.Client,
+				RanAt:   revision.CreatedAt,
+			})
+		}
+	}
+
+	payload, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	signed := &SignedProvenance{Payload: payload}
+	if signing := env.signingConfig(ctx); signing != nil {
+		if signed.Signature, err = signing.sign(ctx, payload); err != nil {
+			return nil, fmt.Errorf("failed to sign provenance: %w", err)
+		}
+		signed.Signer = signing.String()
+	}
+	return signed, nil
+}
+
+// sign returns an armored detached signature of payload.
+func (s *SigningConfig) sign(ctx context.Context, payload []byte) (string, error) {
+	var cmd *exec.Cmd
+	switch s.Format {
+	case "ssh":
+		if s.Key == "" {
+			return "", fmt.Errorf("ssh signing requires a key")
+		}
+		key, err := homedir.Expand(s.Key)
+		if err != nil {
+			return "", err
+		}
+		cmd = exec.CommandContext(ctx, "ssh-keygen", "-Y", "sign", "-q", "-f", key, "-n", provenanceNamespace)
+	case "", "openpgp":
+		args := []string{"--detach-sign", "--armor", "--batch"}
+		if s.Key != "" {
+			args = append(args, "--local-user", s.Key)
+		}
+		cmd = exec.CommandContext(ctx, "gpg", args...)
+	default:
+		return "", fmt.Errorf("unsupported signature format %q", s.Format)
+	}
+
+	cmd.Stdin = bytes.NewReader(payload)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,61 @@
+package environment
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// ProxyConfig configures the HTTP(S) proxy used inside an environment.
+// When unset, the proxy settings of the host are propagated.
+type ProxyConfig struct {
+	HTTPProxy  string `json:"http_proxy,omitempty" yaml:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty" yaml:"https_proxy,omitempty"`
+	NoProxy    string `json:"no_proxy,omitempty" yaml:"no_proxy,omitempty"`
+}
+
+func hostProxyConfig() *ProxyConfig {
+	lookup := func(name string) string {
+		if v := os.Getenv(strings.ToUpper(name)); v != "" {
+			return v
+		}
+		return os.Getenv(strings.ToLower(name))
+	}
+	return &ProxyConfig{
+		HTTPProxy:  lookup("HTTP_PROXY"),
+		HTTPSProxy: lookup("HTTPS_PROXY"),
+		NoProxy:    lookup("NO_PROXY"),
+	}
+}
+
+// withProxy sets the proxy variables (in both their upper and lower case forms) on container.
+// Proxy URLs embedding credentials are passed as secrets so they don't leak into the state.
+func (env *Environment) withProxy(container *dagger.Container) *dagger.Container {
+	proxy := env.Proxy
+	if proxy == nil {
+		proxy = hostProxyConfig()
+	}
+
+	for _, v := range []struct {
+		name  string
+		value string
+	}{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+		{"NO_PROXY", proxy.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		for _, name := range []string{v.name, strings.ToLower(v.name)} {
+			if u, err := url.Parse(v.value); err == nil && u.User != nil {
+				container = container.WithSecretVariable(name, env.client.dag.SetSecret("proxy-"+strings.ToLower(v.name), v.value))
+			} else {
+				container = container.WithEnvVariable(name, v.value)
+			}
+		}
+	}
+	return container
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PublishedImage records an image of the environment pushed to a registry.
+type PublishedImage struct {
+	Ref         string    `json:"ref"`
+	Digest      string    `json:"digest"`
+	Version     Version   `json:"version"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Publish pushes the current container of the environment, with its setup
+// applied, to the registry at ref. The pushed image is recorded in the
+// environment state so it can be reused as a base image by others.
+func (env *Environment) Publish(ctx context.Context, explanation, ref string) (*PublishedImage, error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	reportProgress(ctx, "Publishing environment %s to %s", env.ID, ref)
+	stopHeartbeat := heartbeat(ctx, "Pushing image")
+	image := env.container.WithWorkdir(env.Workdir)
+	if env.User != nil {
+		image = image.WithUser(env.User.owner())
+	}
+	digestRef, err := image.Publish(ctx, ref)
+	stopHeartbeat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish %s: %w", ref, err)
+	}
+
+	published := &PublishedImage{
+		Ref:         digestRef,
+		Digest:      imageDigest(digestRef),
+		Version:     env.History.LatestVersion(),
+		PublishedAt: time.Now(),
+	}
+	env.Images = append(env.Images, *published)
+	env.logf("[v%d] Published %s", published.Version, digestRef)
+
+	if err := env.propagateToWorktree(ctx, change{Action: "publish", Summary: "Publish " + ref}, explanation); err != nil {
+		return nil, err
+	}
+	return published, nil
+}
+
+// imageDigest returns the digest part of a ref@digest image reference.
+func imageDigest(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,271 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// ReconcileAction is a repair made (or, in dry run mode, to be made) by Reconcile.
+type ReconcileAction struct {
+	// Environment is the ID of the environment, if known.
+	Environment string `json:"environment,omitempty"`
+	// Path is the worktree or repository the problem was found in.
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Action  string `json:"action"`
+}
+
+func (a ReconcileAction) String() string {
+	if a.Environment != "" {
+		return fmt.Sprintf("%s: %s (%s): %s", a.Environment, a.Problem, a.Path, a.Action)
+	}
+	return fmt.Sprintf("%s (%s): %s", a.Problem, a.Path, a.Action)
+}
+
+// Reconcile scans the container-use repositories and worktrees for
+// inconsistencies left behind by interrupted operations and repairs them:
+//   - stale worktree registrations (the worktree directory is gone) are pruned,
+//   - environment branches without a worktree get their worktree repaired, or
+//     re-created after moving the existing directory aside,
+//   - worktree directories that don't belong to any environment are moved aside.
+//
+// Worktrees are never removed: they're moved to the trash directory, see
+// reconcileTrashDir, so their files can be recovered. With dryRun, nothing is
+// changed and the repairs that would be made are returned.
+func Reconcile(ctx context.Context, dryRun bool) ([]ReconcileAction, error) {
+	reposDir, err := homedir.Expand("~/.config/container-use/repos")
+	if err != nil {
+		return nil, err
+	}
+	worktreesDir, err := WorktreesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []ReconcileAction{}
+	// environments maps the worktree path of every environment branch found.
+	environments := map[string]bool{}
+
+	repos, err := os.ReadDir(reposDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		repoPath := filepath.Join(reposDir, repo.Name())
+
+		stale, err := runGitCommand(ctx, repoPath, "worktree", "prune", "--dry-run", "--verbose")
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(stale), "\n") {
+			if line == "" {
+				continue
+			}
+			actions = append(actions, ReconcileAction{
+				Path:    repoPath,
+				Problem: line,
+				Action:  "prune the stale worktree registration",
+			})
+		}
+		if !dryRun && strings.TrimSpace(stale) != "" {
+			if _, err := runGitCommand(ctx, repoPath, "worktree", "prune"); err != nil {
+				return nil, err
+			}
+		}
+
+		registered, err := registeredWorktrees(ctx, repoPath)
+		if err != nil {
+			return nil, err
+		}
+		branches, err := environmentBranches(ctx, repoPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range branches {
+			env := &Environment{ID: id}
+			worktreePath, err := env.GetWorktreePath()
+			if err != nil {
+				return nil, err
+			}
+			environments[worktreePath] = true
+			if registered[worktreePath] {
+				continue
+			}
+
+			action := ReconcileAction{
+				Environment: id,
+				Path:        worktreePath,
+				Problem:     "the environment branch has no worktree",
+				Action:      "re-create the worktree from the branch",
+			}
+			_, statErr := os.Lstat(worktreePath)
+			exists := statErr == nil
+			if exists {
+				action.Problem = "the worktree is not registered in " + repoPath
+				action.Action = "repair the worktree registration, or move the worktree aside and re-create it"
+			}
+			actions = append(actions, action)
+			if dryRun {
+				continue
+			}
+			if exists {
+				// The worktree may only have lost its registration, e.g. after the
+				// repository moved.
+				if _, err := runGitCommand(ctx, repoPath, "worktree", "repair", worktreePath); err == nil {
+					if registered, err := registeredWorktrees(ctx, repoPath); err == nil && registered[worktreePath] {
+						continue
+					}
+				}
+				if _, err := moveAside(worktreePath); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := runGitCommand(ctx, repoPath, "worktree", "add", worktreePath, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Worktrees are laid out as <worktrees dir>/<name>/<pet name>.
+	names, err := os.ReadDir(worktreesDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range names {
+		if !name.IsDir() {
+			continue
+		}
+		pets, err := os.ReadDir(filepath.Join(worktreesDir, name.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, pet := range pets {
+			worktreePath := filepath.Join(worktreesDir, name.Name(), pet.Name())
+			if environments[worktreePath] {
+				continue
+			}
+			actions = append(actions, ReconcileAction{
+				Environment: name.Name() + "/" + pet.Name(),
+				Path:        worktreePath,
+				Problem:     "the worktree doesn't belong to any environment",
+				Action:      "move the worktree to the trash directory",
+			})
+			if !dryRun {
+				if _, err := moveAside(worktreePath); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return actions, nil
+}
+
+// reconcileTrashDir returns the directory the worktrees set aside by
+// Reconcile are moved to.
+func reconcileTrashDir() (string, error) {
+	dir, err := trashDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "worktrees"), nil
+}
+
+// moveAside moves the worktree at worktreePath to the trash directory, and
+// returns its new path.
+func moveAside(worktreePath string) (string, error) {
+	dir, err := reconcileTrashDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s-%s", time.Now().UTC().Format("20060102T150405Z"), filepath.Base(filepath.Dir(worktreePath)), filepath.Base(worktreePath))
+	target := filepath.Join(dir, name)
+	if err := os.Rename(worktreePath, target); err != nil {
+		return "", fmt.Errorf("failed to move %s aside: %w", worktreePath, err)
+	}
+	return target, nil
+}
+
+// registeredWorktrees returns the paths of the worktrees registered in the repository.
+func registeredWorktrees(ctx context.Context, repoPath string) (map[string]bool, error) {
+	out, err := runGitCommand(ctx, repoPath, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	worktrees := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok {
+			worktrees[path] = true
+		}
+	}
+	return worktrees, nil
+}
+
+// environmentBranches returns the branches of the repository holding an
+// environment: the ones checked out in their worktree, or recoverable from
+// their worktree or state notes.
+func environmentBranches(ctx context.Context, repoPath string) ([]string, error) {
+	out, err := runGitCommand(ctx, repoPath, "for-each-ref", "--format=%(refname:short) %(objectname)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	notes := repoNotes(ctx, repoPath)
+	annotated, err := notes.list(ctx, repoPath, notes.stateRef())
+	if err != nil {
+		return nil, err
+	}
+	checkedOut, err := worktreeBranches(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		branch, commit, ok := strings.Cut(line, " ")
+		if !ok || !strings.Contains(branch, "/") {
+			continue
+		}
+		env := &Environment{ID: branch}
+		worktreePath, err := env.GetWorktreePath()
+		if err != nil {
+			return nil, err
+		}
+		_, statErr := os.Stat(filepath.Join(worktreePath, configDir, environmentFile))
+		if checkedOut[branch] == worktreePath || statErr == nil || annotated[commit] {
+			branches = append(branches, branch)
+		}
+	}
+	return branches, nil
+}
+
+// worktreeBranches maps the branches checked out in the worktrees of the
+// repository to the path of their worktree.
+func worktreeBranches(ctx context.Context, repoPath string) (map[string]string, error) {
+	out, err := runGitCommand(ctx, repoPath, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	branches := map[string]string{}
+	worktree := ""
+	for _, line := range strings.Split(out, "\n") {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok {
+			worktree = path
+		} else if branch, ok := strings.CutPrefix(line, "branch refs/heads/"); ok {
+			branches[branch] = worktree
+		}
+	}
+	return branches, nil
+}
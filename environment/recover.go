@@ -0,0 +1,169 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Recover rebuilds the registry of the client from the environments found on
+// disk, e.g. after a restart: the environment branches of the container-use
+// repositories, their worktree and their state notes. Recovered environments
+// don't have a container yet, see NeedsProvisioning.
+func (c *Client) Recover(ctx context.Context) ([]*Environment, error) {
+	sources, err := environmentSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := []*Environment{}
+	for _, id := range slices.Sorted(maps.Keys(sources)) {
+		if c.Get(id) != nil {
+			continue
+		}
+		env, err := c.recoverEnvironment(ctx, sources[id], id)
+		if err != nil {
+			slog.Warn("Failed to recover environment", "environment.id", id, "err", err)
+			continue
+		}
+		c.register(env)
+		recovered = append(recovered, env)
+	}
+	return recovered, nil
+}
+
+// findSource returns the source repository of the environment id.
+func findSource(ctx context.Context, id string) (string, error) {
+	sources, err := environmentSources(ctx)
+	if err != nil {
+		return "", err
+	}
+	source, ok := sources[id]
+	if !ok {
+		return "", &EnvNotFoundError{ID: id}
+	}
+	return source, nil
+}
+
+// environmentSources maps the IDs of the environments found in the
+// container-use repositories to the path of their source repository.
+func environmentSources(ctx context.Context) (map[string]string, error) {
+	reposDir, err := homedir.Expand("~/.config/container-use/repos")
+	if err != nil {
+		return nil, err
+	}
+	repos, err := os.ReadDir(reposDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sources := map[string]string{}
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		repoPath := filepath.Join(reposDir, repo.Name())
+
+		// The container-use repository is a bare clone of the source repository.
+		source, err := runGitCommand(ctx, repoPath, "config", "--get", "remote.origin.url")
+		if err != nil {
+			slog.Warn("Skipping repository without source", "repo", repoPath, "err", err)
+			continue
+		}
+		source = strings.TrimSpace(source)
+		if _, err := os.Stat(source); err != nil {
+			slog.Warn("Skipping repository whose source is gone", "repo", repoPath, "source", source)
+			continue
+		}
+
+		branches, err := environmentBranches(ctx, repoPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range branches {
+			sources[id] = source
+		}
+	}
+	return sources, nil
+}
+
+func (c *Client) recoverEnvironment(ctx context.Context, source, id string) (*Environment, error) {
+	name, _, _ := strings.Cut(id, "/")
+	env := &Environment{
+		ID:     id,
+		Name:   name,
+		Source: source,
+		client: c,
+	}
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(worktreePath); err != nil {
+		return nil, fmt.Errorf("missing worktree %s (run cu reconcile): %w", worktreePath, err)
+	}
+	env.Worktree = worktreePath
+
+	if err := env.load(worktreePath); err != nil {
+		return nil, fmt.Errorf("failed to load environment state: %w", err)
+	}
+	if err := env.loadStateFromNotes(ctx, worktreePath); err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+	return env, nil
+}
+
+// NeedsProvisioning reports whether the environment has no container, e.g.
+// because it was recovered from disk. Its container is built by Provision.
+func (env *Environment) NeedsProvisioning() bool {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.container == nil
+}
+
+// ensureProvisioned provisions the environment if it has no container, e.g.
+// because it was recovered or reaped. Operations using the container call it first.
+func (env *Environment) ensureProvisioned(ctx context.Context) error {
+	env.touch()
+	return env.Provision(ctx)
+}
+
+// Provision builds the container of an environment that needs provisioning,
+// from its configuration and worktree.
+func (env *Environment) Provision(ctx context.Context) error {
+	env.provisionMu.Lock()
+	defer env.provisionMu.Unlock()
+	if !env.NeedsProvisioning() {
+		return nil
+	}
+
+	reportProgress(ctx, "Provisioning environment %s", env.ID)
+	stopHeartbeat := heartbeat(ctx, "Provisioning environment")
+	defer stopHeartbeat()
+	container, err := env.buildBase(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := container.Sync(ctx); err != nil {
+		return fmt.Errorf("failed to provision environment %s: %w", env.ID, err)
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.container = container
+	if latest := env.History.Latest(); latest != nil && latest.container == nil {
+		latest.container = container
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package environment
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// redacted replaces the secrets masked by redact.
+const redacted = "[REDACTED]"
+
+// minSecretLength is the length under which known secret values aren't masked,
+// as they would match too much unrelated output.
+const minSecretLength = 6
+
+// credentialPatterns match common credentials. When a pattern has groups, only
+// the text between them is masked.
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),
+	regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`),
+	regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}\b`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\b`),
+	regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9._~+/-]{16,}=*`),
+	regexp.MustCompile(`(?i)(://[^/\s:@]+:)[^/\s@]+(@)`),
+	regexp.MustCompile(`(?i)((?:api[_-]?key|secret|token|password|passwd)["']?\s*[:=]\s*["']?)[^\s"',;]{8,}`),
+}
+
+// secretValues returns the values of the secrets known to the environment:
+// its file:// and env:// secrets, the ones referenced by its environment
+// variables, the sensitive host variables it forwards and the credentials of
+// its proxy.
+func (env *Environment) secretValues() []string {
+	values := []string{}
+	for _, secret := range env.Secrets {
+		_, ref, _ := strings.Cut(secret, "=")
+		if name, ok := strings.CutPrefix(ref, "env://"); ok {
+			values = append(values, os.Getenv(name))
+		} else if path, ok := strings.CutPrefix(ref, "file://"); ok {
+			values = append(values, env.fileSecret(path))
+		}
+	}
+	for _, name := range hostEnvAllowlist() {
+		if sensitiveEnv.MatchString(name) {
+			values = append(values, os.Getenv(name))
+		}
+	}
+	env.secretsMu.Lock()
+	values = append(values, env.resolvedSecrets...)
+	env.secretsMu.Unlock()
+	proxy := env.Proxy
+	if proxy == nil {
+		proxy = hostProxyConfig()
+	}
+	for _, proxyURL := range []string{proxy.HTTPProxy, proxy.HTTPSProxy} {
+		if u, err := url.Parse(proxyURL); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				values = append(values, password)
+			}
+		}
+	}
+
+	values = slices.DeleteFunc(values, func(v string) bool { return len(v) < minSecretLength })
+	// Mask longer values first, in case one contains another.
+	slices.SortFunc(values, func(a, b string) int { return len(b) - len(a) })
+	return slices.Compact(values)
+}
+
+// fileSecret returns the value of the file:// secret at path. It's read once
+// per environment: secretValues is called for every output redacted.
+func (env *Environment) fileSecret(path string) string {
+	env.secretsMu.Lock()
+	defer env.secretsMu.Unlock()
+	if value, ok := env.fileSecrets[path]; ok {
+		return value
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if env.fileSecrets == nil {
+		env.fileSecrets = map[string]string{}
+	}
+	env.fileSecrets[path] = strings.TrimSpace(string(data))
+	return env.fileSecrets[path]
+}
+
+// redact masks the known secret values and common credentials in s, before
+// it's returned to clients or persisted in notes and logs.
+func (env *Environment) redact(s string) string {
+	for _, value := range env.secretValues() {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	for _, pattern := range credentialPatterns {
+		if pattern.NumSubexp() > 0 {
+			s = pattern.ReplaceAllString(s, "${1}"+redacted+"${2}")
+		} else {
+			s = pattern.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
@@ -0,0 +1,24 @@
+package environment
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile clones src to dst, with perm, sharing their data until either is
+// modified. It returns errReflinkUnsupported if the file system can't.
+func cloneFile(src, dst string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) {
+			return errors.Join(errReflinkUnsupported, err)
+		}
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package environment
+
+import "os"
+
+// cloneFile returns errReflinkUnsupported: files can't be cloned on this system.
+func cloneFile(src, dst string, perm os.FileMode) error {
+	return errReflinkUnsupported
+}
@@ -0,0 +1,216 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// RevertToCommit resets the environment to its state at ref, a commit of the
+// environment branch (e.g. a hash or HEAD~2): its files, settings and
+// container, see containerAt. The rollback is recorded as a new commit so it
+// can itself be reverted.
+func (env *Environment) RevertToCommit(ctx context.Context, explanation, ref string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return err
+	}
+
+	out, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("unknown commit %q: %w", ref, err)
+	}
+	commit := strings.TrimSpace(out)
+	if _, err := runGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", commit, "HEAD"); err != nil {
+		return fmt.Errorf("commit %q is not part of the history of environment %s", ref, env.ID)
+	}
+
+	return env.restoreCommit(ctx, worktreePath, commit, "revert", "Revert to "+shortCommit(commit), explanation)
+}
+
+// Undo reverses the most recent operation recorded in the environment branch
+// (a file write, delete, command run...) as a new commit. Undoing again right
+// after reverses the operation before it, rather than the undo itself.
+func (env *Environment) Undo(ctx context.Context, explanation string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return err
+	}
+
+	out, err := runGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	head := strings.TrimSpace(out)
+	// undone is the commit of the operation to undo: HEAD, or the one before
+	// the operation reversed by the last undo if nothing happened since.
+	undone := head
+	if last, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", env.undoRef("head")); err == nil && strings.TrimSpace(last) == head {
+		if next, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", env.undoRef("next")); err == nil {
+			undone = strings.TrimSpace(next)
+		}
+	}
+	if !env.isOperationCommit(ctx, worktreePath, undone) {
+		return fmt.Errorf("environment %s has no operation to undo", env.ID)
+	}
+	subject, err := runGitCommand(ctx, worktreePath, "log", "-1", "--format=%s", undone)
+	if err != nil {
+		return err
+	}
+	// The first commit of the environment sets it up, it can't be undone.
+	out, err = runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", undone+"^")
+	if err != nil || !env.isOperationCommit(ctx, worktreePath, strings.TrimSpace(out)) {
+		return fmt.Errorf("environment %s has no operation to undo", env.ID)
+	}
+	target := strings.TrimSpace(out)
+
+	if err := env.restoreCommit(ctx, worktreePath, target, "undo", "Undo "+strings.TrimSpace(subject), explanation); err != nil {
+		return err
+	}
+	out, err = runGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, worktreePath, "update-ref", env.undoRef("head"), strings.TrimSpace(out)); err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, worktreePath, "update-ref", env.undoRef("next"), target)
+	return err
+}
+
+// undoRef returns the ref of the undo pointer name: head is the commit made by
+// the last undo, next the commit of the operation the next undo reverses.
+func (env *Environment) undoRef(name string) string {
+	return fmt.Sprintf("refs/container-use-undo/%s/%s", env.ID, name)
+}
+
+// isOperationCommit returns whether commit records an operation of the
+// environment: it has a state note and isn't part of the source branch.
+func (env *Environment) isOperationCommit(ctx context.Context, worktreePath, commit string) bool {
+	if _, err := env.Notes.show(ctx, worktreePath, env.Notes.stateRef(), commit); err != nil {
+		return false
+	}
+	forkPoint, err := env.forkPoint(ctx, worktreePath)
+	if err != nil {
+		return true
+	}
+	_, err = runGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", commit, forkPoint)
+	return err != nil
+}
+
+// restoreCommit brings the environment back to its state at commit, its files
+// and settings, and records the result as a new revision.
+func (env *Environment) restoreCommit(ctx context.Context, worktreePath, commit, action, summary, explanation string) (rerr error) {
+	out, err := runGitCommand(ctx, worktreePath, "diff", "--name-only", "--no-renames", "-z", commit, "HEAD")
+	if err != nil {
+		return err
+	}
+	changed := strings.Split(strings.TrimRight(out, "\x00"), "\x00")
+	if len(changed) == 1 && changed[0] == "" {
+		return fmt.Errorf("environment %s has no changes since %s", env.ID, shortCommit(commit))
+	}
+
+	if _, err := runGitCommand(ctx, worktreePath, "read-tree", "-u", "--reset", commit); err != nil {
+		return err
+	}
+
+	// The settings recorded at commit, see save, are now in the worktree.
+	recorded := &Environment{}
+	if err := recorded.load(worktreePath); err != nil {
+		return fmt.Errorf("failed to load the settings of environment %s at %s: %w", env.ID, shortCommit(commit), err)
+	}
+	previous := env.updateSettings()
+	defer func() {
+		if rerr != nil {
+			previous.restore(env)
+		}
+	}()
+	recorded.updateSettings().restore(env)
+
+	reportProgress(ctx, "Restoring %d files from %s", len(changed), shortCommit(commit))
+	container, err := env.containerAt(ctx, worktreePath, commit)
+	if err != nil {
+		return err
+	}
+
+	if err := env.apply(ctx, summary, explanation, "", container); err != nil {
+		return err
+	}
+	return env.propagateToWorktree(ctx, change{Action: action, Summary: summary}, explanation)
+}
+
+// containerAt returns the container of the environment recorded in the state
+// of commit, if it can still be loaded. Otherwise the container is built again
+// from the settings and files of the environment, which must be the ones at
+// commit: files that were never committed (binaries, excluded files) are lost.
+func (env *Environment) containerAt(ctx context.Context, worktreePath, commit string) (*dagger.Container, error) {
+	if buff, err := env.Notes.show(ctx, worktreePath, env.Notes.stateRef(), commit); err == nil {
+		var history History
+		if state, err := openState([]byte(buff)); err == nil && json.Unmarshal(state, &history) == nil && history.Latest() != nil {
+			recorded := history.Latest()
+			for _, revision := range env.History {
+				if revision.State == recorded.State && revision.container != nil {
+					return revision.container, nil
+				}
+			}
+			container := env.client.dag.LoadContainerFromID(dagger.ContainerID(recorded.State))
+			if _, err := container.Sync(ctx); err == nil {
+				return container, nil
+			}
+		}
+	}
+
+	reportProgress(ctx, "Rebuilding environment %s as of %s", env.ID, shortCommit(commit))
+	container, err := env.buildBase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return env.bootstrap(ctx, container)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// withWorktreeFiles copies files (relative to the worktree root) from the
+// worktree into the container, removing the ones missing from the worktree.
+func (env *Environment) withWorktreeFiles(container *dagger.Container, worktreePath string, files []string) *dagger.Container {
+	for _, file := range files {
+		target := path.Join(env.Workdir, file)
+		if _, err := os.Lstat(filepath.Join(worktreePath, file)); err != nil {
+			container = container.WithoutFile(target)
+			continue
+		}
+		container = container.WithFile(target, env.client.dag.Host().File(filepath.Join(worktreePath, file)), dagger.ContainerWithFileOpts{Owner: env.User.owner()})
+	}
+	return container
+}
@@ -0,0 +1,89 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// syftVersion is the release of syft generating SBOMs. It's built from
+	// source, whose checksum, syftModuleSum, is vouched for by the Go checksum
+	// database.
+	syftVersion   = "v1.18.1"
+	syftModuleSum = "h1:JZ7CLbeWrWolCZa4f6SJBLJ9qGBLFCzHrFd8c4bsm94="
+
+	// gitNotesSBOMRef holds the SBOM of the environment at each commit.
+	gitNotesSBOMRef = "container-use-sbom"
+)
+
+// SBOMFormats are the supported SBOM formats.
+var SBOMFormats = []string{"spdx-json", "cyclonedx-json"}
+
+// SBOM generates a software bill of materials of the environment container
+// (base image and installed packages) in the given format (spdx-json or
+// cyclonedx-json). The SBOM is stored in the container-use-sbom git notes of
+// the current commit of the environment.
+func (env *Environment) SBOM(ctx context.Context, format string) (string, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return "", err
+	}
+
+	if format == "" {
+		format = SBOMFormats[0]
+	}
+	if !slices.Contains(SBOMFormats, format) {
+		return "", fmt.Errorf("unsupported SBOM format %q, must be one of %v", format, SBOMFormats)
+	}
+
+	reportProgress(ctx, "Generating %s SBOM of environment %s", format, env.ID)
+	stopHeartbeat := heartbeat(ctx, "Generating SBOM")
+	sbom, err := env.client.dag.Container().
+		From(alpineImage).
+		WithFile("/syft", env.syft(), dagger.ContainerWithFileOpts{Permissions: 0755}).
+		WithMountedFile("/image.tar", env.container.AsTarball()).
+		WithExec([]string{"/syft", "scan", "oci-archive:/image.tar", "--quiet", "--output", format}).
+		Stdout(ctx)
+	stopHeartbeat()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate SBOM: %w", err)
+	}
+
+	f, err := os.CreateTemp(os.TempDir(), ".container-use-sbom-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(sbom); err != nil {
+		return "", err
+	}
+	if _, err := runGitCommand(ctx, env.Worktree, "notes", "--ref", gitNotesSBOMRef, "add", "-f", "-F", f.Name()); err != nil {
+		return "", err
+	}
+	if err := env.propagateGitNotes(ctx, gitNotesSBOMRef); err != nil {
+		return "", err
+	}
+	return sbom, nil
+}
+
+// syft returns the syft binary of syftVersion, built once its module matches syftModuleSum.
+func (env *Environment) syft() *dagger.File {
+	module := "github.com/anchore/syft@" + syftVersion
+	script := fmt.Sprintf(`set -e
+sum=$(go mod download -json %[1]s | sed -n 's/.*"Sum": "\(.*\)".*/\1/p')
+[ "$sum" = %[2]s ] || { echo "unexpected checksum of %[1]s: $sum" >&2; exit 1; }
+go install github.com/anchore/syft/cmd/syft@%[3]s`, module, shellQuote(syftModuleSum), syftVersion)
+	return env.client.dag.Container().
+		From(alpineImage).
+		WithExec([]string{"apk", "add", "--no-cache", "go"}).
+		WithMountedCache("/root/go/pkg/mod", env.client.dag.CacheVolume("container-use-syft-go-mod")).
+		WithEnvVariable("CGO_ENABLED", "0").
+		WithEnvVariable("GOTOOLCHAIN", "auto").
+		WithEnvVariable("GOBIN", "/out").
+		WithExec([]string{"sh", "-c", script}).
+		File("/out/syft")
+}
@@ -0,0 +1,261 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// ServiceLink binds a service exposed by another environment into this one.
+type ServiceLink struct {
+	// Alias is the hostname under which the service is reachable.
+	Alias       string `json:"alias"`
+	Environment string `json:"environment"`
+	Service     string `json:"service"`
+}
+
+// startService starts command in the background, exposing ports. Unless it
+// runs with the entrypoint, it returns the report of its ports to wait for it
+// with, see watchProcess.
+func (env *Environment) startService(ctx context.Context, command, shell string, ports []int, useEntrypoint bool) (*dagger.Service, string, error) {
+	args := []string{}
+	serviceState := env.container
+	var report string
+	if command != "" {
+		args = []string{shell, "-c", command}
+		if !useEntrypoint {
+			serviceState, args, report = env.watchPorts(serviceState, command, args)
+		}
+	}
+
+	// Expose ports
+	for _, port := range ports {
+		serviceState = serviceState.WithExposedPort(port, dagger.ContainerWithExposedPortOpts{
+			Protocol:    dagger.NetworkProtocolTcp,
+			Description: fmt.Sprintf("Port %d", port),
+		})
+	}
+
+	// Start the service
+	spec, err := env.execSpec(ctx, serviceState, args, useEntrypoint)
+	if err != nil {
+		return nil, "", err
+	}
+	svc, err := serviceState.AsService(dagger.ContainerAsServiceOpts{
+		Args:                     spec.Args,
+		UseEntrypoint:            spec.UseEntrypoint,
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	}).Start(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return nil, "", fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
+		}
+		return nil, "", err
+	}
+
+	env.mu.Lock()
+	if env.listeners == nil {
+		env.listeners = map[int]*dagger.Service{}
+	}
+	for _, port := range ports {
+		env.listeners[port] = svc
+	}
+	env.mu.Unlock()
+	return svc, report, nil
+}
+
+// listener returns the service of the background command exposing port.
+func (env *Environment) listener(port int) (*dagger.Service, error) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	svc, ok := env.listeners[port]
+	if !ok {
+		return nil, fmt.Errorf("no background command exposes port %d: start one with environment_run_cmd (background, ports)", port)
+	}
+	return svc, nil
+}
+
+// watchProcess publishes an EventProcessExited event when the background
+// command run by svc, reporting its ports in report, exits. The watch ends
+// when the service is stopped, see unwatch, or the environment deleted.
+// Commands run with the entrypoint don't report their ports, and aren't watched.
+func (env *Environment) watchProcess(svc *dagger.Service, report, command string) {
+	if report == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	env.mu.Lock()
+	if env.watchers == nil {
+		env.watchers = map[*dagger.Service]context.CancelFunc{}
+	}
+	env.watchers[svc] = cancel
+	env.mu.Unlock()
+
+	go func() {
+		defer func() {
+			env.mu.Lock()
+			env.unwatch(svc)
+			env.mu.Unlock()
+		}()
+		status, err := env.waitProcess(ctx, report)
+		if ctx.Err() != nil || env.client.Get(env.ID) == nil {
+			// The service was stopped, or the environment deleted.
+			return
+		}
+		message := fmt.Sprintf("Background command exited with status %d: %s", status, command)
+		if err != nil {
+			message = fmt.Sprintf("Background command exited: %s (%s)", command, err)
+		}
+		env.publish(context.Background(), EventProcessExited, message)
+	}()
+}
+
+// unwatch stops watching the background command run by svc, or all of them
+// without svc. It must be called with env.mu held.
+func (env *Environment) unwatch(svc *dagger.Service) {
+	for watched, cancel := range env.watchers {
+		if svc == nil || watched == svc {
+			cancel()
+			delete(env.watchers, watched)
+		}
+	}
+}
+
+// Expose starts command in the background as a service called name, which other
+// environments can reach by linking to it.
+func (env *Environment) Expose(ctx context.Context, explanation, name, command, shell string, ports []int) (EndpointMappings, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	done, err := env.client.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := env.checkWritable(ctx); err != nil {
+		return nil, err
+	}
+	if err := env.checkExec(ctx, explanation, command); err != nil {
+		return nil, err
+	}
+
+	svc, report, err := env.startService(ctx, command, shell, ports, false)
+	if err != nil {
+		return nil, err
+	}
+	env.watchProcess(svc, report, command)
+
+	env.mu.Lock()
+	if previous, ok := env.services[name]; ok {
+		env.unwatch(previous)
+		if _, err := previous.Stop(ctx); err != nil {
+			slog.Warn("Failed to stop previous service", "environment.id", env.ID, "service", name, "err", err)
+		}
+	}
+	if env.services == nil {
+		env.services = map[string]*dagger.Service{}
+	}
+	env.services[name] = svc
+	env.mu.Unlock()
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s & (service %s)\n\n", command, name))
+
+	endpoints := EndpointMappings{}
+	for _, port := range ports {
+		internalEndpoint, err := svc.Endpoint(ctx, dagger.ServiceEndpointOpts{
+			Port: port,
+		})
+		if err != nil {
+			return nil, err
+		}
+		endpoints[port] = &EndpointMapping{Internal: internalEndpoint}
+	}
+	return endpoints, nil
+}
+
+func (env *Environment) service(name string) *dagger.Service {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.services[name]
+}
+
+// Link makes the service exposed by target reachable from this environment under the alias hostname.
+// Links are saved with the environment, and preserved across rebuilds as long as the target service is running.
+func (env *Environment) Link(ctx context.Context, explanation, alias string, target *Environment, service string) error {
+	if err := validateHostname(alias); err != nil {
+		return err
+	}
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	svc := target.service(service)
+	if svc == nil {
+		return fmt.Errorf("environment %s has no service named %q", target.ID, service)
+	}
+
+	link := ServiceLink{
+		Alias:       alias,
+		Environment: target.ID,
+		Service:     service,
+	}
+	links := []ServiceLink{link}
+	for _, l := range env.Links {
+		if l.Alias != alias {
+			links = append(links, l)
+		}
+	}
+	env.Links = links
+
+	summary := fmt.Sprintf("Link %s to %s/%s", alias, target.ID, service)
+	if err := env.apply(ctx, summary, explanation, "", env.container.WithServiceBinding(alias, svc)); err != nil {
+		return err
+	}
+	return env.propagateToWorktree(ctx, change{Action: "link", Summary: summary}, explanation)
+}
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname checks name is a valid hostname (RFC 1123).
+func validateHostname(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q: must be 1 to 253 characters long", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q: labels must be 1 to 63 letters, digits or hyphens, not starting or ending with a hyphen", name)
+		}
+	}
+	return nil
+}
+
+// withLinks binds the linked services into container, skipping the ones that are no longer running.
+func (env *Environment) withLinks(container *dagger.Container) *dagger.Container {
+	for _, link := range env.Links {
+		target := env.client.Get(link.Environment)
+		if target == nil {
+			slog.Warn("Skipping link to unknown environment", "environment.id", env.ID, "link", link.Alias, "target", link.Environment)
+			continue
+		}
+		svc := target.service(link.Service)
+		if svc == nil {
+			slog.Warn("Skipping link to stopped service", "environment.id", env.ID, "link", link.Alias, "target", link.Environment, "service", link.Service)
+			continue
+		}
+		container = container.WithServiceBinding(link.Alias, svc)
+	}
+	return container
+}
@@ -0,0 +1,164 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// setupCheckpoint is the container left by the setup steps a provisioning
+// completed before failing or being canceled, identified by the settings it
+// was provisioned with up to those steps (see provisionKey).
+type setupCheckpoint struct {
+	key       string
+	container *dagger.Container
+}
+
+// setupStepKey identifies the settings the container is provisioned with up to
+// the setup step n, setup commands first, then setup groups.
+func (env *Environment) setupStepKey(n int) (string, bool) {
+	commands := env.SetupCommands[:min(n, len(env.SetupCommands))]
+	groups := env.SetupGroups[:max(n-len(env.SetupCommands), 0)]
+	return env.provisionKey(commands, groups)
+}
+
+// runSetup runs the setup commands, then the setup groups, of the
+// environment in container. If the previous provisioning failed or was
+// canceled, it resumes from the last setup step it completed with the same
+// settings, so that fixing a failing step doesn't run the ones before it again.
+func (env *Environment) runSetup(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	steps := len(env.SetupCommands) + len(env.SetupGroups)
+	previous := env.setupCheckpoint
+	env.setupCheckpoint = nil
+
+	var checkpoint *setupCheckpoint
+	start := 0
+	for n := steps; n > 0 && previous != nil; n-- {
+		key, resumable := env.setupStepKey(n)
+		if !resumable {
+			break
+		}
+		if key == previous.key {
+			checkpoint, container, start = previous, previous.container, n
+			reportStage(ctx, StageSetup, n, steps, "Resuming after setup step %d/%d", n, steps)
+			break
+		}
+	}
+
+	for i := start; i < steps; i++ {
+		var err error
+		if i < len(env.SetupCommands) {
+			command := env.SetupCommands[i]
+			reportStage(ctx, StageSetup, i+1, steps, "Running setup command: %s", command)
+			stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running setup command %d/%d", i+1, steps))
+			container, err = env.runSetupCommand(ctx, container, command)
+			stopHeartbeat()
+		} else {
+			group := env.SetupGroups[i-len(env.SetupCommands)]
+			reportStage(ctx, StageSetup, i+1, steps, "Running setup commands in parallel: %s", strings.Join(group, ", "))
+			stopHeartbeat := heartbeat(ctx, fmt.Sprintf("Running setup group %d/%d", i-len(env.SetupCommands)+1, len(env.SetupGroups)))
+			container, err = env.runSetupGroup(ctx, container, group)
+			stopHeartbeat()
+		}
+		if err != nil {
+			env.setupCheckpoint = checkpoint
+			var setupErr *SetupFailedError
+			if errors.As(err, &setupErr) {
+				setupErr.Step, setupErr.Steps, setupErr.Resumable = i+1, steps, checkpoint != nil
+			}
+			return nil, err
+		}
+		if key, resumable := env.setupStepKey(i + 1); resumable {
+			checkpoint = &setupCheckpoint{key: key, container: container}
+		}
+	}
+	return container, nil
+}
+
+// runSetupCommand runs the setup command in container, as root, and returns
+// the container it leaves. Its output is recorded in the audit log.
+func (env *Environment) runSetupCommand(ctx context.Context, container *dagger.Container, command string) (*dagger.Container, error) {
+	container, stdout, err := env.execSetupCommand(ctx, container, command)
+	if err := env.recordSetupCommand(ctx, command, stdout, err); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// execSetupCommand runs the setup command in container, as root, and returns the container it leaves and its output.
+func (env *Environment) execSetupCommand(ctx context.Context, container *dagger.Container, command string) (*dagger.Container, string, error) {
+	spec, err := env.rootExecSpec(ctx, container, []string{"sh", "-c", command}, false)
+	if err != nil {
+		return nil, "", err
+	}
+	container = container.WithExec(spec.Args, dagger.ContainerWithExecOpts{
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	})
+	stdout, err := container.Stdout(ctx)
+	return container, stdout, err
+}
+
+// recordSetupCommand records the outcome of the setup command in the audit
+// log, and returns the error describing its failure, if any.
+func (env *Environment) recordSetupCommand(ctx context.Context, command, stdout string, err error) error {
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			_ = env.addGitNote(ctx,
+				fmt.Sprintf("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n",
+					command,
+					exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr,
+				),
+			)
+			return &SetupFailedError{
+				Stage:    StageSetup,
+				Command:  command,
+				ExitCode: exitErr.ExitCode,
+				Output:   fmt.Sprintf("stdout: %s\nstderr: %s", env.redact(exitErr.Stdout), env.redact(exitErr.Stderr)),
+				Err:      err,
+			}
+		}
+
+		return fmt.Errorf("failed to execute setup command: %w", err)
+	}
+
+	_ = env.addGitNote(ctx, fmt.Sprintf("$ %s\n%s\n\n", command, stdout))
+	reportProgress(ctx, "$ %s\n%s", command, stdout)
+	return nil
+}
+
+// runSetupGroup runs the independent setup commands of group concurrently,
+// each in its own copy of container, and returns container with the files
+// they added or changed. Commands of a group must not change the same files,
+// and the files they delete are kept.
+func (env *Environment) runSetupGroup(ctx context.Context, container *dagger.Container, group []string) (*dagger.Container, error) {
+	results := make([]*dagger.Container, len(group))
+	outputs := make([]string, len(group))
+	errs := make([]error, len(group))
+	wg := &sync.WaitGroup{}
+	for i, command := range group {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], outputs[i], errs[i] = env.execSetupCommand(ctx, container, command)
+		}()
+	}
+	wg.Wait()
+	// The outcomes are recorded in the order of the group.
+	for i, command := range group {
+		errs[i] = env.recordSetupCommand(ctx, command, outputs[i], errs[i])
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	base := container.Rootfs()
+	for _, result := range results {
+		container = container.WithDirectory("/", base.Diff(result.Rootfs()))
+	}
+	return container, nil
+}
@@ -0,0 +1,67 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrShuttingDown is returned by operations started after Shutdown.
+var ErrShuttingDown = errors.New("container-use is shutting down")
+
+// begin registers an operation that Shutdown waits for. The returned function
+// must be called once the operation completes.
+func (c *Client) begin() (func(), error) {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	if c.closing {
+		return nil, ErrShuttingDown
+	}
+	c.active++
+	return func() {
+		c.opsMu.Lock()
+		defer c.opsMu.Unlock()
+		c.active--
+		if c.active == 0 && c.idle != nil {
+			close(c.idle)
+			c.idle = nil
+		}
+	}, nil
+}
+
+// Shutdown refuses new operations, waits for the in-flight ones (and their
+// commits) to complete until ctx is done, commits the writes pending, then
+// closes the environment logs.
+// The Dagger client must only be closed afterwards.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.opsMu.Lock()
+	c.closing = true
+	idle := make(chan struct{})
+	if c.active == 0 {
+		close(idle)
+	} else {
+		slog.Info("Waiting for in-flight operations", "count", c.active)
+		c.idle = idle
+	}
+	c.opsMu.Unlock()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		c.opsMu.Lock()
+		err = fmt.Errorf("gave up waiting for %d in-flight operations: %w", c.active, ctx.Err())
+		c.opsMu.Unlock()
+	}
+
+	for _, env := range c.List() {
+		if flushErr := env.flushPending(ctx); flushErr != nil {
+			slog.Error("Failed to commit pending writes", "environment.id", env.ID, "err", flushErr)
+		}
+		if closeErr := env.closeLog(); closeErr != nil {
+			slog.Error("Failed to close environment log", "environment.id", env.ID, "err", closeErr)
+		}
+	}
+	return err
+}
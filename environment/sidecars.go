@@ -0,0 +1,396 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// Sidecar is a service container, such as a database, started alongside an
+// environment and reachable from its commands under Name. Its data is kept in
+// a per-environment cache volume, so it survives rebuilds, and is initialized
+// from its seed scripts or snapshot.
+type Sidecar struct {
+	Name  string `json:"name" yaml:"name"`
+	Image string `json:"image" yaml:"image"`
+	// Env configures the service container.
+	Env   []string `json:"env,omitempty" yaml:"env,omitempty"`
+	Ports []int    `json:"ports,omitempty" yaml:"ports,omitempty"`
+	// DataDir is the directory of the service container its data is kept in.
+	DataDir string `json:"data_dir,omitempty" yaml:"data_dir,omitempty"`
+	// Connection are the variables, e.g. DATABASE_URL, set in the environment to connect to the service.
+	Connection []string `json:"connection,omitempty" yaml:"connection,omitempty"`
+	// Seed are SQL or fixture scripts (or directories of scripts), relative to
+	// the workdir, run in order by the service when its data is initialized.
+	Seed []string `json:"seed,omitempty" yaml:"seed,omitempty"`
+	// InitDir is the directory of the service container seed scripts are
+	// mounted in, /docker-entrypoint-initdb.d for databases supporting it.
+	InitDir string `json:"init_dir,omitempty" yaml:"init_dir,omitempty"`
+	// Snapshot is a tar archive of the data directory, relative to the workdir,
+	// restored when the service starts without data.
+	Snapshot string `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+	// DependsOn are the sidecars started, and ready, before this one, which can reach them by name.
+	DependsOn []string `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+	// Ready is a command, run in a container of the image, that succeeds
+	// once the service is ready, e.g. pg_isready -h postgres.
+	Ready string `json:"ready,omitempty" yaml:"ready,omitempty"`
+	// ReadyTimeout is how long, in seconds, the service has to become ready (60 by default).
+	ReadyTimeout int `json:"ready_timeout,omitempty" yaml:"ready_timeout,omitempty"`
+}
+
+// SidecarOptions customize the service started by AddService. Unset options
+// default to the ones of the service preset matching the image, if any.
+type SidecarOptions struct {
+	// Name is the hostname of the service, defaults to the image name (e.g. postgres).
+	Name         string
+	Env          []string
+	Ports        []int
+	DataDir      string
+	Connection   []string
+	Seed         []string
+	InitDir      string
+	Snapshot     string
+	DependsOn    []string
+	Ready        string
+	ReadyTimeout int
+}
+
+// sidecarPreset is the configuration of a common service image.
+type sidecarPreset struct {
+	env        []string
+	ports      []int
+	dataDir    string
+	initDir    string
+	ready      string
+	connection []string
+}
+
+// dockerInitDir is where the official database images look for initialization scripts.
+const dockerInitDir = "/docker-entrypoint-initdb.d"
+
+// sidecarPresets are the configurations of common services by image name.
+// "{{host}}" in connection variables and readiness commands is replaced by the name of the service.
+var sidecarPresets = map[string]sidecarPreset{
+	"postgres": {
+		env:     []string{"POSTGRES_USER=postgres", "POSTGRES_PASSWORD=postgres", "POSTGRES_DB=app"},
+		ports:   []int{5432},
+		dataDir: "/var/lib/postgresql/data",
+		initDir: dockerInitDir,
+		ready:   "pg_isready -h {{host}} -U postgres",
+		connection: []string{
+			"DATABASE_URL=postgres://postgres:postgres@{{host}}:5432/app?sslmode=disable",
+			"PGHOST={{host}}", "PGPORT=5432", "PGUSER=postgres", "PGPASSWORD=postgres", "PGDATABASE=app",
+		},
+	},
+	"mysql": {
+		env:        []string{"MYSQL_ROOT_PASSWORD=mysql", "MYSQL_DATABASE=app"},
+		ports:      []int{3306},
+		dataDir:    "/var/lib/mysql",
+		initDir:    dockerInitDir,
+		ready:      "mysqladmin ping -h {{host}} -uroot -pmysql --silent",
+		connection: []string{"DATABASE_URL=mysql://root:mysql@{{host}}:3306/app", "MYSQL_HOST={{host}}", "MYSQL_TCP_PORT=3306", "MYSQL_PWD=mysql"},
+	},
+	"mariadb": {
+		env:        []string{"MARIADB_ROOT_PASSWORD=mysql", "MARIADB_DATABASE=app"},
+		ports:      []int{3306},
+		dataDir:    "/var/lib/mysql",
+		initDir:    dockerInitDir,
+		ready:      "mariadb-admin ping -h {{host}} -uroot -pmysql --silent",
+		connection: []string{"DATABASE_URL=mysql://root:mysql@{{host}}:3306/app", "MYSQL_HOST={{host}}", "MYSQL_TCP_PORT=3306", "MYSQL_PWD=mysql"},
+	},
+	"redis": {
+		ports:      []int{6379},
+		dataDir:    "/data",
+		ready:      "redis-cli -h {{host}} ping",
+		connection: []string{"REDIS_URL=redis://{{host}}:6379"},
+	},
+	"valkey/valkey": {
+		ports:      []int{6379},
+		dataDir:    "/data",
+		ready:      "valkey-cli -h {{host}} ping",
+		connection: []string{"REDIS_URL=redis://{{host}}:6379"},
+	},
+	"mongo": {
+		ports:      []int{27017},
+		dataDir:    "/data/db",
+		initDir:    dockerInitDir,
+		ready:      "mongosh --quiet --host {{host}} --eval 'db.runCommand({ping: 1})'",
+		connection: []string{"MONGODB_URI=mongodb://{{host}}:27017/app"},
+	},
+}
+
+// serviceNamePattern matches the names of sidecars, which are hostnames.
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// imageName returns the name of image without its registry, tag and digest,
+// e.g. postgres for docker.io/library/postgres:16.
+func imageName(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	name = strings.TrimPrefix(name, "docker.io/")
+	return strings.TrimPrefix(name, "library/")
+}
+
+// newSidecar returns the sidecar running image, configured by opts on top of its preset.
+func newSidecar(image string, opts SidecarOptions) (*Sidecar, error) {
+	if image == "" {
+		return nil, errors.New("image is required")
+	}
+	name := imageName(image)
+	preset := sidecarPresets[name]
+	sidecar := &Sidecar{
+		Name:         opts.Name,
+		Image:        image,
+		Env:          preset.env,
+		Ports:        preset.ports,
+		DataDir:      preset.dataDir,
+		InitDir:      preset.initDir,
+		Connection:   preset.connection,
+		Seed:         opts.Seed,
+		Snapshot:     opts.Snapshot,
+		DependsOn:    opts.DependsOn,
+		Ready:        preset.ready,
+		ReadyTimeout: opts.ReadyTimeout,
+	}
+	if sidecar.Name == "" {
+		sidecar.Name = path.Base(name)
+	}
+	if !serviceNamePattern.MatchString(sidecar.Name) {
+		return nil, fmt.Errorf("invalid service name %q: it must be a valid hostname", sidecar.Name)
+	}
+	if opts.Env != nil {
+		sidecar.Env = opts.Env
+	}
+	if opts.Ports != nil {
+		sidecar.Ports = opts.Ports
+	}
+	if opts.DataDir != "" {
+		sidecar.DataDir = opts.DataDir
+	}
+	if opts.Connection != nil {
+		sidecar.Connection = opts.Connection
+	}
+	if opts.InitDir != "" {
+		sidecar.InitDir = opts.InitDir
+	}
+	if opts.Ready != "" {
+		sidecar.Ready = opts.Ready
+	}
+	if len(sidecar.Seed) > 0 && sidecar.InitDir == "" {
+		return nil, fmt.Errorf("image %s doesn't run initialization scripts: set the directory seed scripts are mounted in", image)
+	}
+	if sidecar.Snapshot != "" && sidecar.DataDir == "" {
+		return nil, fmt.Errorf("image %s has no known data directory: set the directory the snapshot is restored in", image)
+	}
+	if len(sidecar.Ports) == 0 {
+		return nil, fmt.Errorf("no known ports for image %s: set the ports of the service", image)
+	}
+	connection := make([]string, 0, len(sidecar.Connection))
+	for _, variable := range sidecar.Connection {
+		if _, _, ok := strings.Cut(variable, "="); !ok {
+			return nil, fmt.Errorf("invalid connection variable: %s", variable)
+		}
+		connection = append(connection, strings.ReplaceAll(variable, "{{host}}", sidecar.Name))
+	}
+	sidecar.Connection = connection
+	sidecar.Ready = strings.ReplaceAll(sidecar.Ready, "{{host}}", sidecar.Name)
+	return sidecar, nil
+}
+
+// options returns the options to configure the sidecar with AddService.
+func (s Sidecar) options() SidecarOptions {
+	return SidecarOptions{
+		Name:         s.Name,
+		Env:          s.Env,
+		Ports:        s.Ports,
+		DataDir:      s.DataDir,
+		Connection:   s.Connection,
+		Seed:         s.Seed,
+		InitDir:      s.InitDir,
+		Snapshot:     s.Snapshot,
+		DependsOn:    s.DependsOn,
+		Ready:        s.Ready,
+		ReadyTimeout: s.ReadyTimeout,
+	}
+}
+
+// resolveSidecars configures the sidecars of the environment, e.g. declared
+// in the repository configuration, with the presets of their images and
+// checks their dependencies.
+func (env *Environment) resolveSidecars() error {
+	sidecars := make([]Sidecar, 0, len(env.Sidecars))
+	for _, s := range env.Sidecars {
+		sidecar, err := newSidecar(s.Image, s.options())
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(sidecars, func(other Sidecar) bool { return other.Name == sidecar.Name }) {
+			return fmt.Errorf("duplicate service %s", sidecar.Name)
+		}
+		sidecars = append(sidecars, *sidecar)
+	}
+	if _, err := sidecarOrder(sidecars); err != nil {
+		return err
+	}
+	env.Sidecars = sidecars
+	return nil
+}
+
+// sidecarService returns the service of sidecar, bound to the sidecars it
+// depends on. Its seed scripts and snapshot are read from the worktree.
+func (env *Environment) sidecarService(sidecar Sidecar) (*dagger.Service, error) {
+	container := env.client.dag.Container().From(sidecar.Image)
+	for _, name := range sidecar.DependsOn {
+		i := slices.IndexFunc(env.Sidecars, func(s Sidecar) bool { return s.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("service %s depends on unknown service %s", sidecar.Name, name)
+		}
+		svc, err := env.sidecarService(env.Sidecars[i])
+		if err != nil {
+			return nil, err
+		}
+		container = container.WithServiceBinding(name, svc)
+	}
+	for _, variable := range sidecar.Env {
+		k, v, found := strings.Cut(variable, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid environment variable of service %s: %s", sidecar.Name, variable)
+		}
+		container = container.WithEnvVariable(k, v)
+	}
+	for i, seed := range sidecar.Seed {
+		source, err := env.worktreePath(seed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed of service %s: %w", sidecar.Name, err)
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed of service %s: %w", sidecar.Name, err)
+		}
+		if info.IsDir() {
+			container = container.WithDirectory(sidecar.InitDir, env.client.dag.Host().Directory(source))
+			continue
+		}
+		// Scripts are run in alphabetical order.
+		target := path.Join(sidecar.InitDir, fmt.Sprintf("%02d-%s", i, filepath.Base(source)))
+		container = container.WithFile(target, env.client.dag.Host().File(source), dagger.ContainerWithFileOpts{Permissions: 0755})
+	}
+	if sidecar.DataDir != "" {
+		volume := env.client.dag.CacheVolume(fmt.Sprintf("container-use-%s-service-%s-%s", env.ID, sidecar.Name, sidecar.dataKey()))
+		if sidecar.Snapshot != "" {
+			source, err := env.worktreePath(sidecar.Snapshot)
+			if err != nil {
+				return nil, fmt.Errorf("invalid snapshot of service %s: %w", sidecar.Name, err)
+			}
+			// The service depends on the restore, so it only starts once the snapshot is restored.
+			restored := env.client.dag.Container().From(alpineImage).
+				WithMountedCache("/data", volume, dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeLocked}).
+				WithMountedFile("/snapshot", env.client.dag.Host().File(source)).
+				WithExec([]string{"sh", "-c", `[ -n "$(ls -A /data)" ] || tar --numeric-owner -xpf /snapshot -C /data; touch /restored`}).
+				File("/restored")
+			container = container.WithFile("/tmp/container-use-restored", restored)
+		}
+		container = container.WithMountedCache(sidecar.DataDir, volume, dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeLocked})
+	}
+	for _, port := range sidecar.Ports {
+		container = container.WithExposedPort(port, dagger.ContainerWithExposedPortOpts{
+			Protocol:    dagger.NetworkProtocolTcp,
+			Description: fmt.Sprintf("%s port %d", sidecar.Name, port),
+		})
+	}
+	return container.AsService(dagger.ContainerAsServiceOpts{UseEntrypoint: true}), nil
+}
+
+// dataKey identifies the data of the sidecar, so it's initialized again,
+// in a new volume, when its image, configuration or seed change.
+func (s Sidecar) dataKey() string {
+	data, _ := json.Marshal([]any{s.Image, s.Env, s.Seed, s.InitDir, s.Snapshot})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// worktreePath returns the path on the host of p, relative to the workdir, rejecting paths outside of it.
+func (env *Environment) worktreePath(p string) (string, error) {
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("%s is not relative to the workdir", p)
+	}
+	return filepath.Join(env.Worktree, p), nil
+}
+
+// withSidecars binds the sidecars of the environment into container and sets their connection variables.
+func (env *Environment) withSidecars(container *dagger.Container) (*dagger.Container, error) {
+	sidecars, err := sidecarOrder(env.Sidecars)
+	if err != nil {
+		return nil, err
+	}
+	for _, sidecar := range sidecars {
+		svc, err := env.sidecarService(sidecar)
+		if err != nil {
+			return nil, err
+		}
+		container = container.WithServiceBinding(sidecar.Name, svc)
+		for _, variable := range sidecar.Connection {
+			k, v, _ := strings.Cut(variable, "=")
+			container = container.WithEnvVariable(k, v)
+		}
+	}
+	return container, nil
+}
+
+// AddService starts a service container running image, e.g. postgres:16,
+// reachable from the environment under its name, and sets the variables to
+// connect to it (e.g. DATABASE_URL) in the environment. Common databases and
+// caches are configured out of the box. The service is recorded in the state
+// of the environment, so it's started again when the environment is rebuilt.
+func (env *Environment) AddService(ctx context.Context, explanation, image string, opts SidecarOptions) (*Sidecar, error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	sidecar, err := newSidecar(image, opts)
+	if err != nil {
+		return nil, err
+	}
+	sidecars := append(slices.DeleteFunc(slices.Clone(env.Sidecars), func(s Sidecar) bool { return s.Name == sidecar.Name }), *sidecar)
+	if _, err := sidecarOrder(sidecars); err != nil {
+		return nil, err
+	}
+	svc, err := env.startSidecar(ctx, *sidecar)
+	if err != nil {
+		return nil, err
+	}
+
+	env.Sidecars = sidecars
+	container := env.container.WithServiceBinding(sidecar.Name, svc)
+	for _, variable := range sidecar.Connection {
+		k, v, _ := strings.Cut(variable, "=")
+		container = container.WithEnvVariable(k, v)
+	}
+	summary := fmt.Sprintf("Add service %s (%s)", sidecar.Name, sidecar.Image)
+	if err := env.apply(ctx, summary, explanation, "", container); err != nil {
+		return nil, err
+	}
+	if err := env.propagateToWorktree(ctx, change{Action: "add_service", Summary: summary}, explanation); err != nil {
+		return nil, err
+	}
+	return sidecar, nil
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SigningConfig configures how commits made by container-use are signed.
+//
+// When unset, the signing settings of the source repository's git
+// configuration (commit.gpgsign, gpg.format and user.signingkey) are used.
+type SigningConfig struct {
+	// Format is the signature format: "openpgp" (default), "ssh" or "x509".
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// Key is the signing key: a GPG key ID, or the path to an SSH key.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+func (s *SigningConfig) String() string {
+	format := s.Format
+	if format == "" {
+		format = "openpgp"
+	}
+	if s.Key == "" {
+		return format
+	}
+	return format + ":" + s.Key
+}
+
+// signingConfig returns the signing configuration for commits of the environment,
+// or nil if commits aren't signed.
+func (env *Environment) signingConfig(ctx context.Context) *SigningConfig {
+	if env.Signing != nil {
+		return env.Signing
+	}
+
+	gitConfig := func(key string) string {
+		out, err := runGitCommand(ctx, env.Source, "config", "--get", key)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(out)
+	}
+	if gitConfig("commit.gpgsign") != "true" {
+		return nil
+	}
+	return &SigningConfig{
+		Format: gitConfig("gpg.format"),
+		Key:    gitConfig("user.signingkey"),
+	}
+}
+
+// args returns the git arguments signing a commit with the given configuration.
+// They must come before the git subcommand.
+func (s *SigningConfig) args() []string {
+	args := []string{"-c", "commit.gpgsign=true"}
+	if s.Format != "" {
+		args = append(args, "-c", fmt.Sprintf("gpg.format=%s", s.Format))
+	}
+	if s.Key != "" {
+		args = append(args, "-c", fmt.Sprintf("user.signingkey=%s", s.Key))
+	}
+	return args
+}
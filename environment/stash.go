@@ -0,0 +1,274 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stash sets aside the changes made to the environment since a base commit
+// (by default its first commit) under the given name, and brings the
+// environment back to the base. Stashing doesn't add to the history of the
+// environment: its branch is moved back to the base, and the stashed commits
+// are kept in a ref. Stashed changes can be brought back with Unstash.
+func (env *Environment) Stash(ctx context.Context, explanation, name, base string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return err
+	}
+	ref, err := env.stashRef(ctx, worktreePath, name)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, worktreePath, "show-ref", "--verify", "--quiet", ref); err == nil {
+		return fmt.Errorf("stash %q already exists in environment %s", name, env.ID)
+	}
+
+	if base == "" {
+		if base, err = env.firstCommit(ctx, worktreePath); err != nil {
+			return err
+		}
+	}
+	out, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", base+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("unknown commit %q: %w", base, err)
+	}
+	base = strings.TrimSpace(out)
+	if _, err := runGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", base, "HEAD"); err != nil || !env.isOperationCommit(ctx, worktreePath, base) {
+		return fmt.Errorf("commit %q is not part of the history of environment %s", base, env.ID)
+	}
+	out, err = runGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	head := strings.TrimSpace(out)
+	if head == base {
+		return fmt.Errorf("environment %s has no changes since %s", env.ID, shortCommit(base))
+	}
+
+	// The stash is a commit with the current tree on top of the base, so that
+	// it holds exactly the stashed changes, whose second parent keeps the
+	// stashed commits. It isn't part of any branch.
+	out, err = runGitCommand(ctx, worktreePath, "commit-tree", "HEAD^{tree}", "-p", base, "-p", head, "-m", "Stash "+name+"\n\n"+explanation)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, worktreePath, "update-ref", ref, strings.TrimSpace(out)); err != nil {
+		return err
+	}
+
+	if err := env.moveTo(ctx, worktreePath, base); err != nil {
+		if _, delErr := runGitCommand(ctx, worktreePath, "update-ref", "-d", ref); delErr != nil {
+			return fmt.Errorf("%w (and failed to drop stash: %v)", err, delErr)
+		}
+		return err
+	}
+	env.logf("Stash %s: %s", name, explanation)
+	return nil
+}
+
+// Unstash re-applies the changes stashed under name and drops the stash. If
+// the environment hasn't changed since they were stashed, its branch is moved
+// back to the stashed commits. Otherwise, they're applied on top of the
+// current state of the environment: on conflicts, the environment is left
+// unchanged, the stash is kept and a *ConflictError is returned.
+func (env *Environment) Unstash(ctx context.Context, explanation, name string) error {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return err
+	}
+	ref, err := env.stashRef(ctx, worktreePath, name)
+	if err != nil {
+		return err
+	}
+	out, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return fmt.Errorf("no stash named %q in environment %s", name, env.ID)
+	}
+	stash := strings.TrimSpace(out)
+
+	base, err := runGitCommand(ctx, worktreePath, "rev-parse", stash+"^1")
+	if err != nil {
+		return err
+	}
+	head, err := runGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if stashed, err := runGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", stash+"^2"); err == nil && strings.TrimSpace(base) == strings.TrimSpace(head) {
+		if err := env.moveTo(ctx, worktreePath, strings.TrimSpace(stashed)); err != nil {
+			return err
+		}
+		env.logf("Unstash %s: %s", name, explanation)
+		_, err = runGitCommand(ctx, worktreePath, "update-ref", "-d", ref)
+		return err
+	}
+
+	patch, err := runGitCommand(ctx, worktreePath, "diff", "--binary", "--no-renames", stash+"^", stash)
+	if err != nil {
+		return err
+	}
+	patchFile, err := os.CreateTemp(os.TempDir(), ".container-use-stash-*.patch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(patchFile.Name())
+	defer patchFile.Close()
+	if _, err := patchFile.WriteString(patch); err != nil {
+		return err
+	}
+
+	if _, err := runGitCommand(ctx, worktreePath, "apply", "--3way", "--index", patchFile.Name()); err != nil {
+		conflicts, _ := runGitCommand(ctx, worktreePath, "diff", "--name-only", "--diff-filter=U")
+		if _, resetErr := runGitCommand(ctx, worktreePath, "reset", "--hard", "-q", "HEAD"); resetErr != nil {
+			return fmt.Errorf("failed to restore the worktree (%v): %w", err, resetErr)
+		}
+		if strings.TrimSpace(conflicts) == "" {
+			return err
+		}
+		return &ConflictError{Commit: stash, Files: strings.Split(strings.TrimSpace(conflicts), "\n")}
+	}
+
+	out, err = runGitCommand(ctx, worktreePath, "diff", "--name-only", "--no-renames", "-z", stash+"^", stash)
+	if err != nil {
+		return err
+	}
+	files := strings.Split(strings.TrimRight(out, "\x00"), "\x00")
+
+	container := env.withWorktreeFiles(env.container, worktreePath, files)
+	if err := env.apply(ctx, "Unstash "+name, explanation, "", container); err != nil {
+		return err
+	}
+	if err := env.propagateToWorktree(ctx, change{Action: "unstash", Summary: "Unstash " + name}, explanation); err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, worktreePath, "update-ref", "-d", ref)
+	return err
+}
+
+// moveTo moves the environment branch to commit, bringing the files of the
+// environment and its history back to their state there, without recording
+// a new revision.
+func (env *Environment) moveTo(ctx context.Context, worktreePath, commit string) error {
+	out, err := runGitCommand(ctx, worktreePath, "diff", "--name-only", "--no-renames", "-z", "HEAD", commit)
+	if err != nil {
+		return err
+	}
+	changed := strings.Split(strings.TrimRight(out, "\x00"), "\x00")
+	if _, err := runGitCommand(ctx, worktreePath, "reset", "--hard", "-q", commit); err != nil {
+		return err
+	}
+	container := env.withWorktreeFiles(env.container, worktreePath, changed)
+	if _, err := container.Sync(ctx); err != nil {
+		return err
+	}
+
+	// The history recorded at commit, in place of the current one.
+	current := env.History
+	env.History = nil
+	if err := env.loadStateFromNotes(ctx, worktreePath); err != nil {
+		env.History = current
+		return err
+	}
+	env.mu.Lock()
+	env.container = container
+	env.mu.Unlock()
+
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return err
+	}
+	_, err = runGitCommand(ctx, localRepoPath, "fetch", "container-use", "+"+env.ID+":refs/remotes/container-use/"+env.ID)
+	return err
+}
+
+// firstCommit returns the first commit of the environment, the one setting it up.
+func (env *Environment) firstCommit(ctx context.Context, worktreePath string) (string, error) {
+	forkPoint, err := env.forkPoint(ctx, worktreePath)
+	if err != nil {
+		return "", err
+	}
+	out, err := runGitCommand(ctx, worktreePath, "rev-list", "--reverse", "--first-parent", forkPoint+"..HEAD")
+	if err != nil {
+		return "", err
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	if first == "" {
+		return "", fmt.Errorf("environment %s has no commits", env.ID)
+	}
+	return first, nil
+}
+
+// Stashes lists the names of the stashes of the environment.
+func (env *Environment) Stashes(ctx context.Context) ([]string, error) {
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+	prefix := env.stashPrefix()
+	out, err := runGitCommand(ctx, worktreePath, "for-each-ref", "--format=%(refname)", prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, ref := range strings.Split(strings.TrimSpace(out), "\n") {
+		if ref != "" {
+			names = append(names, strings.TrimPrefix(ref, prefix))
+		}
+	}
+	return names, nil
+}
+
+func (env *Environment) stashPrefix() string {
+	return fmt.Sprintf("refs/container-use-stash/%s/", env.ID)
+}
+
+func (env *Environment) stashRef(ctx context.Context, worktreePath, name string) (string, error) {
+	ref := env.stashPrefix() + name
+	if name == "" {
+		return "", fmt.Errorf("stash name is required")
+	}
+	if _, err := runGitCommand(ctx, worktreePath, "check-ref-format", ref); err != nil {
+		return "", fmt.Errorf("invalid stash name %q", name)
+	}
+	return ref, nil
+}
+
+// forkPoint returns the commit where the environment branched off the source branch.
+func (env *Environment) forkPoint(ctx context.Context, worktreePath string) (string, error) {
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return "", err
+	}
+	branch, err := runGitCommand(ctx, localRepoPath, "branch", "--show-current")
+	if err != nil {
+		return "", err
+	}
+	branch = strings.TrimSpace(branch)
+	if branch == "" {
+		return "", fmt.Errorf("the source repository is not on a branch")
+	}
+	out, err := runGitCommand(ctx, worktreePath, "merge-base", "HEAD", branch)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
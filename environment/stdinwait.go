@@ -0,0 +1,121 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// stdinStallSeconds is how long a command must go without output before
+	// it's considered waiting for input.
+	stdinStallSeconds = 15
+	// stdinWaitExitCode is the exit code of stdinWatchScript when it stopped a
+	// command waiting for input, along with stdinWaitMarker on stderr.
+	stdinWaitExitCode = 97
+	stdinWaitMarker   = "container-use: command is waiting for input"
+)
+
+// stdinWatchScript runs "$@" with a stdin that never reaches EOF, as an
+// interactive terminal, and stops it once it waits for input: when its output
+// stalled and one of its processes is blocked reading its stdin, as told by
+// the syscall it's in (read or readv of fd 0, on amd64 and arm64).
+//
+// Its output is written to $CU_STREAM_DIR, if set, so it can be streamed.
+var stdinWatchScript = fmt.Sprintf(`dir=${CU_STREAM_DIR:-$(mktemp -d)}
+mkdir -p "$dir"
+trap 'rm -rf "$dir"' EXIT
+mkfifo "$dir/in"
+exec 3<>"$dir/in"
+"$@" <"$dir/in" >"$dir/out" 2>"$dir/err" &
+pid=$!
+(
+	last=-1
+	quiet=0
+	while sleep 1; do
+		size=$(cat "$dir/out" "$dir/err" | wc -c)
+		if [ "$size" != "$last" ]; then
+			last=$size
+			quiet=0
+			continue
+		fi
+		quiet=$((quiet + 1))
+		[ "$quiet" -ge %[1]d ] || continue
+
+		readers=""
+		waiting=""
+		for p in /proc/[0-9]*; do
+			[ "$(readlink "$p/fd/0" 2>/dev/null)" = "$dir/in" ] || continue
+			readers="$readers ${p#/proc/}"
+			set -- $(cat "$p/syscall" 2>/dev/null)
+			case "$(uname -m) $1 $2" in
+			"x86_64 0 0x0" | "x86_64 19 0x0" | "aarch64 63 0x0" | "aarch64 65 0x0") waiting=1 ;;
+			esac
+		done
+		if [ -n "$waiting" ]; then
+			touch "$dir/waiting"
+			kill -9 $readers 2>/dev/null
+			exit
+		fi
+	done
+) &
+watcher=$!
+wait $pid 2>/dev/null
+status=$?
+kill $watcher 2>/dev/null
+cat "$dir/out"
+cat "$dir/err" >&2
+if [ -f "$dir/waiting" ]; then
+	printf '\n%%s\n' '%[3]s' >&2
+	exit %[2]d
+fi
+exit $status`, stdinStallSeconds, stdinWaitExitCode, stdinWaitMarker)
+
+// watchStdin wraps the args of a command to stop it when it waits for input.
+// It's only used when the environment opted in with DetectInput: otherwise
+// commands read an empty stdin.
+func watchStdin(args []string) []string {
+	return append([]string{"sh", "-c", stdinWatchScript, "cu-run"}, args...)
+}
+
+// NeedsInputError is returned when a command was stopped because it waited for
+// interactive input. Commands can be re-run non-interactively (e.g. with a
+// --yes flag, or by piping the answers), or the user asked for the answers.
+type NeedsInputError struct {
+	Command string `json:"command"`
+	// Prompt is the last line printed by the command, usually the question it asked.
+	Prompt string `json:"prompt"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+func (e *NeedsInputError) Error() string {
+	return fmt.Sprintf("command %q is waiting for input (%q): re-run it non-interactively, e.g. with a --yes flag or by piping the answers, or ask the user", e.Command, e.Prompt)
+}
+
+// needsInput returns the NeedsInputError of a command stopped by stdinWatchScript, if it was.
+func needsInput(command string, exitCode int, stdout, stderr string) *NeedsInputError {
+	if exitCode != stdinWaitExitCode || !strings.Contains(stderr, stdinWaitMarker) {
+		return nil
+	}
+	stderr = strings.TrimSuffix(strings.TrimRight(stderr, "\n"), stdinWaitMarker)
+	prompt := lastLine(stderr)
+	if stdout != "" && !strings.HasSuffix(stdout, "\n") || prompt == "" {
+		prompt = lastLine(stdout)
+	}
+	return &NeedsInputError{
+		Command: command,
+		Prompt:  prompt,
+		Stdout:  stdout,
+		Stderr:  strings.TrimRight(stderr, "\n"),
+	}
+}
+
+// lastLine returns the last non-empty line of s, as displayed by a terminal.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	line := lines[len(lines)-1]
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,69 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNeedsInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode int
+		stdout   string
+		stderr   string
+		want     *NeedsInputError
+	}{
+		{
+			name:     "prompt on stdout",
+			exitCode: stdinWaitExitCode,
+			stdout:   "Installing...\nProceed? [y/N] ",
+			stderr:   "\n" + stdinWaitMarker + "\n",
+			want: &NeedsInputError{
+				Command: "cmd",
+				Prompt:  "Proceed? [y/N]",
+				Stdout:  "Installing...\nProceed? [y/N] ",
+			},
+		},
+		{
+			name:     "prompt on stderr",
+			exitCode: stdinWaitExitCode,
+			stdout:   "Installing...\n",
+			stderr:   "Password: \n" + stdinWaitMarker + "\n",
+			want: &NeedsInputError{
+				Command: "cmd",
+				Prompt:  "Password:",
+				Stdout:  "Installing...\n",
+				Stderr:  "Password: ",
+			},
+		},
+		{
+			name:     "prompt redrawn with carriage returns",
+			exitCode: stdinWaitExitCode,
+			stdout:   "? Pick a template\r? Pick a framework ",
+			stderr:   stdinWaitMarker + "\n",
+			want: &NeedsInputError{
+				Command: "cmd",
+				Prompt:  "? Pick a framework",
+				Stdout:  "? Pick a template\r? Pick a framework ",
+			},
+		},
+		{
+			name:     "command failing on its own",
+			exitCode: 1,
+			stdout:   "Proceed? [y/N] ",
+			stderr:   "aborted\n",
+		},
+		{
+			name:     "same exit code without the marker",
+			exitCode: stdinWaitExitCode,
+			stderr:   "error\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsInput("cmd", tt.exitCode, tt.stdout, tt.stderr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("needsInput() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
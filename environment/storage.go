@@ -0,0 +1,227 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// WorktreeStorageEnv overrides the storage driver of the worktrees of the storage configuration.
+const WorktreeStorageEnv = "CONTAINER_USE_WORKTREE_STORAGE"
+
+// WorktreeStorage is how the worktrees of environments are stored on the host.
+type WorktreeStorage string
+
+const (
+	// StorageDisk checks worktrees out in ~/.config/container-use/worktrees.
+	StorageDisk WorktreeStorage = "disk"
+	// StorageTmpfs checks worktrees out in memory, in StorageConfig.TmpfsDir.
+	// They're lost on reboot, and checked out again from their branch when
+	// the environment is opened.
+	StorageTmpfs WorktreeStorage = "tmpfs"
+	// StorageReflink checks worktrees out on disk, cloning the files unchanged
+	// in the source repository instead of writing them, on file systems
+	// supporting copy-on-write clones (Btrfs, XFS, APFS). Other files are
+	// checked out as with StorageDisk.
+	StorageReflink WorktreeStorage = "reflink"
+)
+
+// StorageConfig configures how environments are stored on the host.
+// Switching drivers leaves the existing worktrees behind: they're checked out
+// again from their branch.
+//
+// Example (~/.config/container-use/storage.json):
+//
+//	{
+//	  "worktrees": "tmpfs",
+//	  "tmpfs_dir": "/dev/shm/container-use"
+//	}
+type StorageConfig struct {
+	// Worktrees is the driver storing worktrees, disk by default.
+	Worktrees WorktreeStorage `json:"worktrees,omitempty"`
+	// TmpfsDir is the in-memory directory worktrees are stored in with the
+	// tmpfs driver, /dev/shm/container-use-<uid> by default on Linux.
+	TmpfsDir string `json:"tmpfs_dir,omitempty"`
+}
+
+// DefaultStorageConfigPath returns the location of the storage configuration.
+func DefaultStorageConfigPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/storage.json")
+}
+
+// LoadStorageConfig reads the storage configuration, with the driver of
+// WorktreeStorageEnv if set. A missing file results in an empty configuration.
+func LoadStorageConfig() (*StorageConfig, error) {
+	configPath, err := DefaultStorageConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &StorageConfig{}
+	data, err := os.ReadFile(configPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid storage configuration %s: %w", configPath, err)
+		}
+	}
+	if driver := os.Getenv(WorktreeStorageEnv); driver != "" {
+		cfg.Worktrees = WorktreeStorage(driver)
+	}
+	switch cfg.Worktrees {
+	case "", StorageDisk, StorageTmpfs, StorageReflink:
+	default:
+		return nil, fmt.Errorf("invalid worktree storage %q: must be %s, %s or %s", cfg.Worktrees, StorageDisk, StorageTmpfs, StorageReflink)
+	}
+	return cfg, nil
+}
+
+// errReflinkUnsupported is returned by cloneFile when the file system can't clone files.
+var errReflinkUnsupported = errors.New("copy-on-write clones aren't supported")
+
+// storageConfig is the storage configuration, read once: every path of the
+// process must agree on where worktrees are.
+var storageConfig = sync.OnceValues(LoadStorageConfig)
+
+// WorktreesDir returns the directory the worktrees are stored in, laid out as <name>/<pet name>.
+func WorktreesDir() (string, error) {
+	cfg, err := storageConfig()
+	if err != nil {
+		return "", err
+	}
+	if cfg.Worktrees != StorageTmpfs {
+		return homedir.Expand("~/.config/container-use/worktrees")
+	}
+	if cfg.TmpfsDir != "" {
+		dir, err := homedir.Expand(cfg.TmpfsDir)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "worktrees"), nil
+	}
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("tmpfs worktree storage needs tmpfs_dir on %s: set it to a RAM disk in %s", runtime.GOOS, "~/.config/container-use/storage.json")
+	}
+	return fmt.Sprintf("/dev/shm/container-use-%d/worktrees", os.Getuid()), nil
+}
+
+// addWorktree adds the worktree at worktreePath to the container-use
+// repository at cuRepoPath, with the git worktree add arguments args, using
+// the storage driver configured.
+func addWorktree(ctx context.Context, cuRepoPath, localRepoPath, worktreePath string, args ...string) error {
+	cfg, err := storageConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Worktrees != StorageReflink {
+		_, err := runGitCommand(ctx, cuRepoPath, append([]string{"worktree", "add"}, args...)...)
+		return err
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, append([]string{"worktree", "add", "--no-checkout"}, args...)...); err != nil {
+		return err
+	}
+	return checkoutReflink(ctx, localRepoPath, worktreePath)
+}
+
+// checkoutReflink checks out the worktree at worktreePath, added without
+// checkout, cloning the files identical in the source repository at
+// localRepoPath. The other files, and all of them if the file system can't
+// clone files, are checked out by git.
+func checkoutReflink(ctx context.Context, localRepoPath, worktreePath string) error {
+	if _, err := runGitCommand(ctx, worktreePath, "read-tree", "HEAD"); err != nil {
+		return err
+	}
+	entries, err := indexEntries(ctx, worktreePath)
+	if err != nil {
+		return err
+	}
+	sourceEntries, err := indexEntries(ctx, localRepoPath)
+	if err != nil {
+		return err
+	}
+	changed, err := runGitCommand(ctx, localRepoPath, "diff", "--name-only", "-z", "HEAD")
+	if err != nil {
+		return err
+	}
+	modified := map[string]bool{}
+	for _, path := range strings.Split(changed, "\x00") {
+		modified[path] = true
+	}
+
+	checkout := []string{}
+	cloned := 0
+	cloning := true
+	for path, entry := range entries {
+		regular := entry.mode == "100644" || entry.mode == "100755"
+		if !cloning || !regular || modified[path] || sourceEntries[path] != entry {
+			checkout = append(checkout, path)
+			continue
+		}
+		perm := os.FileMode(0644)
+		if entry.mode == "100755" {
+			perm = 0755
+		}
+		if err := cloneFile(filepath.Join(localRepoPath, path), filepath.Join(worktreePath, path), perm); err != nil {
+			if errors.Is(err, errReflinkUnsupported) {
+				slog.Warn("File system can't clone files, checking the worktree out", "path", worktreePath, "err", err)
+				cloning = false
+			}
+			checkout = append(checkout, path)
+			continue
+		}
+		cloned++
+	}
+	slog.Info("Cloned worktree files", "path", worktreePath, "cloned", cloned, "checked-out", len(checkout))
+
+	if len(checkout) > 0 {
+		cmd := exec.CommandContext(ctx, "git", "checkout-index", "--force", "-z", "--stdin")
+		cmd.Dir = worktreePath
+		cmd.Stdin = strings.NewReader(strings.Join(checkout, "\x00"))
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to check out worktree files: %w: %s", err, output)
+		}
+	}
+	// Cloned files don't have the stat information of the index yet.
+	_, err = runGitCommand(ctx, worktreePath, "update-index", "-q", "--refresh")
+	if err != nil && !strings.Contains(err.Error(), "needs update") {
+		return err
+	}
+	return nil
+}
+
+type indexEntry struct {
+	mode string
+	blob string
+}
+
+// indexEntries returns the entries of the index of the repository at dir by path.
+func indexEntries(ctx context.Context, dir string) (map[string]indexEntry, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "--stage", "-z")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the files of %s: %w", dir, err)
+	}
+	entries := map[string]indexEntry{}
+	for _, line := range strings.Split(string(output), "\x00") {
+		// <mode> <blob> <stage>\t<path>
+		info, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+		entries[path] = indexEntry{mode: fields[0], blob: fields[1]}
+	}
+	return entries, nil
+}
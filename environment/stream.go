@@ -0,0 +1,100 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// streamDir is where the output of commands is written while they run,
+	// so it can be streamed to the client.
+	streamDir = "/.container-use/stream"
+	// streamInterval is how often, in seconds, the output of commands is streamed.
+	streamInterval = 2
+	// maxStreamChunk is the size of the largest output chunk streamed at once:
+	// only the end of larger chunks is sent.
+	maxStreamChunk = 4096
+)
+
+func (env *Environment) streamCache() *dagger.CacheVolume {
+	return env.client.dag.CacheVolume(fmt.Sprintf("container-use-%s-stream", env.ID))
+}
+
+// streamOutput sets container up to stream the output of its next command
+// to the progress of ctx while it runs, if the client asked for progress.
+// It returns the container and the directory the output is written to, empty
+// if it isn't streamed. The command must be wrapped with stdinWatchScript,
+// which writes its output there.
+func (env *Environment) streamOutput(ctx context.Context, container *dagger.Container) (*dagger.Container, string) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); !ok || fn == nil {
+		return container, ""
+	}
+	dir := fmt.Sprintf("%s/%d", streamDir, time.Now().UnixNano())
+	container = container.
+		WithMountedCache(streamDir, env.streamCache(), dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared, Owner: env.User.owner()}).
+		WithEnvVariable("CU_STREAM_DIR", dir)
+	return container, dir
+}
+
+// withoutStream removes what streamOutput added to container.
+func withoutStream(container *dagger.Container) *dagger.Container {
+	return container.WithoutEnvVariable("CU_STREAM_DIR").WithoutMount(streamDir)
+}
+
+// pollStream reports the output written to the stream directory dir to the
+// progress of ctx, until the returned function is called.
+func (env *Environment) pollStream(ctx context.Context, dir string) func() {
+	if dir == "" {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		offsets := map[string]int{}
+		ticker := time.NewTicker(streamInterval * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				env.reportStream(ctx, dir, offsets)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// reportStream reports the output written to dir since offsets, by file.
+func (env *Environment) reportStream(ctx context.Context, dir string, offsets map[string]int) {
+	for _, name := range []string{"out", "err"} {
+		out, err := env.client.dag.Container().From(alpineImage).
+			WithMountedCache(streamDir, env.streamCache(), dagger.ContainerWithMountedCacheOpts{Sharing: dagger.CacheSharingModeShared}).
+			WithEnvVariable("CACHEBUSTER", time.Now().String()).
+			WithExec([]string{"sh", "-c", `[ -f "$1" ] && tail -c +"$2" "$1"; true`, "cu-stream", dir + "/" + name, fmt.Sprint(offsets[name] + 1)}).
+			Stdout(ctx)
+		if err != nil || out == "" {
+			continue
+		}
+		offsets[name] += len(out)
+		if len(out) > maxStreamChunk {
+			out = "..." + out[len(out)-maxStreamChunk:]
+		}
+		out = strings.TrimRight(env.redact(env.stripANSI(ctx, out)), "\n")
+		if name == "err" {
+			reportProgress(ctx, "stderr: %s", out)
+		} else {
+			reportProgress(ctx, "%s", out)
+		}
+	}
+}
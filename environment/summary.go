@@ -0,0 +1,148 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxSummaryOutput is the number of trailing characters of command output kept in summaries.
+const maxSummaryOutput = 2000
+
+// testCommand matches the commands running a test suite.
+var testCommand = regexp.MustCompile(`\b(go test|pytest|npm (run )?test|yarn test|pnpm test|cargo test|mvn test|gradle test|make test|rspec|jest|vitest)\b`)
+
+// CommandRun is a command run in an environment.
+type CommandRun struct {
+	Command string `json:"command"`
+	Output  string `json:"output,omitempty"`
+	// Test is set for commands running a test suite.
+	Test bool `json:"test,omitempty"`
+	// ExitCode is the exit status of the command. Failed commands are only
+	// recorded when they run a test suite, see Revision.FailedTests.
+	ExitCode int `json:"exit_code"`
+}
+
+// Summary describes the work done in an environment.
+type Summary struct {
+	Environment string       `json:"environment"`
+	Commands    []CommandRun `json:"commands"`
+	Diff        *Diff        `json:"diff"`
+}
+
+// Summarize describes the work done in the environment id of the repository
+// at source: the commands run, with the output and exit status of the test
+// runs, and the changes compared to the current branch.
+func Summarize(ctx context.Context, source, id string) (*Summary, error) {
+	localRepoPath, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, localRepoPath, "fetch", "container-use", id); err != nil {
+		return nil, err
+	}
+	head := "container-use/" + id
+
+	base, err := runGitCommand(ctx, localRepoPath, "branch", "--show-current")
+	if err != nil {
+		return nil, err
+	}
+	base = strings.TrimSpace(base)
+	if base == "" {
+		base = "HEAD"
+	}
+	diff, err := diffRefs(ctx, localRepoPath, base+"..."+head, base, head, DiffOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{Environment: id, Commands: []CommandRun{}, Diff: diff}
+	history, err := StateFromCommit(ctx, localRepoPath, head)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the history of %s: %w", id, err)
+	}
+	for _, revision := range history {
+		if command, ok := strings.CutPrefix(revision.Name, "Run "); ok {
+			run := CommandRun{Command: command, Test: testCommand.MatchString(command)}
+			if run.Test {
+				run.Output = tail(revision.Output, maxSummaryOutput)
+			}
+			summary.Commands = append(summary.Commands, run)
+		}
+		summary.Commands = append(summary.Commands, revision.FailedTests...)
+	}
+	return summary, nil
+}
+
+// recordFailedTest records a failed test run on the latest revision, since
+// failed commands don't make revisions of their own, for summaries to report it.
+func (env *Environment) recordFailedTest(ctx context.Context, command string, exitCode int, output string) error {
+	latest := env.History.Latest()
+	if env.Worktree == "" || latest == nil {
+		return nil
+	}
+	latest.FailedTests = append(latest.FailedTests, CommandRun{
+		Command:  command,
+		Output:   tail(output, maxSummaryOutput),
+		Test:     true,
+		ExitCode: exitCode,
+	})
+	if err := env.commitStateToNotes(ctx); err != nil {
+		return err
+	}
+	return env.propagateNotes(ctx, env.Notes.stateRef())
+}
+
+// status describes the exit status of a test run.
+func (run CommandRun) status() string {
+	if run.ExitCode == 0 {
+		return "passed"
+	}
+	return fmt.Sprintf("failed, exit code %d", run.ExitCode)
+}
+
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
+
+// Markdown renders the summary for humans, e.g. as a pull request comment.
+func (s *Summary) Markdown() string {
+	md := &strings.Builder{}
+	fmt.Fprintf(md, "### container-use environment `%s`\n\n", s.Environment)
+
+	fmt.Fprintf(md, "**Changes:** %d files, +%d -%d\n\n", len(s.Diff.Files), s.Diff.Additions, s.Diff.Deletions)
+	if len(s.Diff.Files) > 0 {
+		fmt.Fprintln(md, "| File | + | - |")
+		fmt.Fprintln(md, "| --- | --- | --- |")
+		for _, file := range s.Diff.Files {
+			if file.Binary {
+				fmt.Fprintf(md, "| `%s` | binary | |\n", file.Path)
+				continue
+			}
+			fmt.Fprintf(md, "| `%s` | %d | %d |\n", file.Path, file.Additions, file.Deletions)
+		}
+		fmt.Fprintln(md)
+	}
+
+	fmt.Fprintf(md, "**Commands run:** %d\n\n", len(s.Commands))
+	for _, run := range s.Commands {
+		if run.Test {
+			fmt.Fprintf(md, "- `%s` (%s)\n", run.Command, run.status())
+			continue
+		}
+		fmt.Fprintf(md, "- `%s`\n", run.Command)
+	}
+
+	for _, run := range s.Commands {
+		if !run.Test {
+			continue
+		}
+		fmt.Fprintf(md, "\n<details><summary>Test run: <code>%s</code> (%s)</summary>\n\n```\n%s\n```\n</details>\n", run.Command, run.status(), strings.TrimSpace(run.Output))
+	}
+	return md.String()
+}
@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSummaryMarkdown(t *testing.T) {
+	summary := &Summary{
+		Environment: "feature/fancy-mallard",
+		Diff: &Diff{
+			Additions: 12,
+			Deletions: 3,
+			Files: []FileDiff{
+				{Path: "main.go", Additions: 12, Deletions: 3},
+				{Path: "logo.png", Binary: true},
+			},
+		},
+		Commands: []CommandRun{
+			{Command: "go build ./..."},
+			{Command: "go test ./...", Test: true, Output: "ok  \texample.com/m\t0.1s\n"},
+			{Command: "go test -race ./...", Test: true, Output: "FAIL\texample.com/m\n", ExitCode: 1},
+		},
+	}
+
+	md := summary.Markdown()
+	for _, want := range []string{
+		"### container-use environment `feature/fancy-mallard`",
+		"**Changes:** 2 files, +12 -3",
+		"| `main.go` | 12 | 3 |",
+		"| `logo.png` | binary | |",
+		"**Commands run:** 3",
+		"- `go build ./...`\n",
+		"- `go test ./...` (passed)\n",
+		"- `go test -race ./...` (failed, exit code 1)\n",
+		"<summary>Test run: <code>go test -race ./...</code> (failed, exit code 1)</summary>",
+		"```\nFAIL\texample.com/m\n```",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Markdown() doesn't contain %q:\n%s", want, md)
+		}
+	}
+}
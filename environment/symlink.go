@@ -0,0 +1,156 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+// SymlinkPolicy is how symlinks are handled by Upload and FileRead.
+// Whatever the policy, symlinks leading out of the worktree aren't committed,
+// and symlinks leading out of uploaded directories are never followed.
+type SymlinkPolicy string
+
+const (
+	// SymlinkPreserve uploads symlinks as they are, and reads the files they
+	// lead to in the container. It's the default.
+	SymlinkPreserve SymlinkPolicy = "preserve"
+	// SymlinkFollow uploads the files and directories symlinks lead to
+	// instead of the symlinks, which must stay in the uploaded directory.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkReject fails uploads of directories with symlinks, and reads of symlinks.
+	SymlinkReject SymlinkPolicy = "reject"
+)
+
+func (p SymlinkPolicy) validate() error {
+	switch p {
+	case "", SymlinkPreserve, SymlinkFollow, SymlinkReject:
+		return nil
+	}
+	return fmt.Errorf("invalid symlink policy %q: must be %s, %s or %s", p, SymlinkPreserve, SymlinkFollow, SymlinkReject)
+}
+
+// symlinkEscapes returns whether the symlink name, relative to the host
+// directory root, leads out of root, either as written or once resolved.
+func symlinkEscapes(root, name string) (bool, error) {
+	p := filepath.Join(root, filepath.FromSlash(name))
+	target, err := os.Readlink(p)
+	if err != nil {
+		return false, err
+	}
+	if filepath.IsAbs(target) {
+		return true, nil
+	}
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(p), target))
+	if err != nil || !filepath.IsLocal(rel) {
+		return true, nil
+	}
+
+	// Symlinks it leads through may escape root.
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	rel, err = filepath.Rel(realRoot, resolved)
+	return err != nil || !filepath.IsLocal(rel), nil
+}
+
+// uploadSymlinks returns the symlinks of the upload of the host directory dir
+// described by manifest, checked against the symlink policy of the environment.
+func (env *Environment) uploadSymlinks(dir string, manifest *uploadManifest) ([]string, error) {
+	links := []string{}
+	for _, name := range slices.Sorted(maps.Keys(manifest.files)) {
+		if !manifest.files[name].symlink {
+			continue
+		}
+		switch env.Symlinks {
+		case SymlinkReject:
+			return nil, fmt.Errorf("%s is a symlink: the environment rejects the upload of symlinks", filepath.Join(dir, name))
+		case SymlinkFollow:
+			escapes, err := symlinkEscapes(dir, name)
+			if err != nil {
+				return nil, err
+			}
+			if escapes {
+				return nil, fmt.Errorf("%s is a symlink leading out of %s: it can't be followed", filepath.Join(dir, name), dir)
+			}
+		}
+		links = append(links, name)
+	}
+	return links, nil
+}
+
+// followUploadSymlinks returns container with the symlinks links of the host
+// directory dir, uploaded to target, replaced by what they lead to.
+// Dangling symlinks are left as they are.
+func (env *Environment) followUploadSymlinks(container *dagger.Container, dir, target string, links []string) *dagger.Container {
+	host := env.client.dag.Host()
+	for _, name := range links {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			slog.Warn("Failed to follow symlink, uploading it as is", "path", filepath.Join(dir, name), "err", err)
+			continue
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			continue
+		}
+		p := path.Join(target, name)
+		container = container.WithoutFile(p)
+		if info.IsDir() {
+			container = container.WithDirectory(p, host.Directory(resolved, dagger.HostDirectoryOpts{NoCache: true}), dagger.ContainerWithDirectoryOpts{Owner: env.User.owner()})
+		} else {
+			container = container.WithFile(p, host.File(resolved, dagger.HostFileOpts{NoCache: true}), dagger.ContainerWithFileOpts{Owner: env.User.owner()})
+		}
+	}
+	return container
+}
+
+// checkReadSymlink returns an error if the file p of the container is a
+// symlink the environment rejects reading.
+func (env *Environment) checkReadSymlink(ctx context.Context, p string) error {
+	if env.Symlinks != SymlinkReject {
+		return nil
+	}
+	_, err := env.container.WithExec([]string{"sh", "-c", `[ ! -L "$1" ]`, "sh", p}).Sync(ctx)
+	var exitErr *dagger.ExecError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%s is a symlink: the environment rejects reading symlinks", p)
+	}
+	return err
+}
+
+// committableSymlink returns whether the worktree file name is a symlink,
+// and if so, whether it can be committed: symlinks leading out of the
+// worktree are never committed, nor followed.
+func committableSymlink(worktreePath, name string) (symlink, ok bool) {
+	info, err := os.Lstat(filepath.Join(worktreePath, name))
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false, false
+	}
+	escapes, err := symlinkEscapes(worktreePath, filepath.ToSlash(name))
+	if err != nil {
+		slog.Warn("Failed to check symlink, not committing it", "path", name, "err", err)
+		return true, false
+	}
+	if escapes {
+		slog.Warn("Not committing symlink leading out of the worktree", "path", name)
+		return true, false
+	}
+	return true, true
+}
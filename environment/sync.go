@@ -0,0 +1,242 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// rebuildTriggers are the files whose changes require the environment to be rebuilt.
+var rebuildTriggers = []string{
+	RepoConfigFile,
+	".tool-versions",
+	".nvmrc",
+	".python-version",
+	"flake.nix",
+	"flake.lock",
+	"shell.nix",
+	bootstrapScript,
+}
+
+// SyncOpts configures how an environment catches up with its source branch.
+type SyncOpts struct {
+	// Rebase replays the environment's commits on top of the source branch
+	// instead of merging the source branch into the environment.
+	Rebase bool
+}
+
+// SyncResult reports the outcome of SyncWithSource.
+type SyncResult struct {
+	// Source is the source branch the environment was synced with.
+	Source string `json:"source"`
+	// UpToDate is set when the environment already contained the source branch.
+	UpToDate bool `json:"up_to_date,omitempty"`
+	// Commits is the number of source commits brought into the environment.
+	Commits int `json:"commits"`
+	// Files are the files changed by the sync.
+	Files []string `json:"files,omitempty"`
+	// Rebuilt is set when the environment was rebuilt because its configuration changed.
+	Rebuilt bool `json:"rebuilt,omitempty"`
+	// Conflicts lists the conflicting files when the sync was aborted.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// SyncWithSource brings the changes made to the branch currently checked out in
+// the source repository into the environment, by merging (or rebasing onto) it.
+// The environment is rebuilt if its configuration changed.
+//
+// On conflicts, the sync is aborted, the environment is left untouched and the
+// conflicting files are reported in the result.
+func (env *Environment) SyncWithSource(ctx context.Context, explanation string, opts SyncOpts) (_ *SyncResult, rerr error) {
+	unlock, err := env.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return nil, err
+	}
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+
+	branch, err := runGitCommand(ctx, localRepoPath, "branch", "--show-current")
+	if err != nil {
+		return nil, err
+	}
+	branch = strings.TrimSpace(branch)
+	if branch == "" {
+		return nil, fmt.Errorf("the source repository is not on a branch")
+	}
+	result := &SyncResult{Source: branch}
+
+	reportProgress(ctx, "Fetching %s from the source repository", branch)
+	if _, err := runGitCommand(ctx, localRepoPath, "push", "container-use", "--force", branch); err != nil {
+		return nil, err
+	}
+
+	if _, err := runGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", branch, "HEAD"); err == nil {
+		result.UpToDate = true
+		return result, nil
+	}
+	count, err := runGitCommand(ctx, worktreePath, "rev-list", "--count", "HEAD.."+branch)
+	if err != nil {
+		return nil, err
+	}
+	if result.Commits, err = strconv.Atoi(strings.TrimSpace(count)); err != nil {
+		return nil, fmt.Errorf("unexpected rev-list output %q: %w", count, err)
+	}
+
+	head, err := runGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	head = strings.TrimSpace(head)
+
+	args, _ := env.identityArgs(ctx)
+	if opts.Rebase {
+		reportProgress(ctx, "Rebasing onto %s", branch)
+		// Carry the notes (state, log, SBOMs) over to the rebased commits.
+		args = append(args, "-c", "notes.rewriteRef=refs/notes/*", "-c", "notes.rewrite.rebase=true", "rebase", branch)
+	} else {
+		reportProgress(ctx, "Merging %s", branch)
+		args = append(args, "merge", "--no-edit", "-m", fmt.Sprintf("Merge %s into environment %s", branch, env.ID), branch)
+	}
+	if _, err := runGitCommand(ctx, worktreePath, args...); err != nil {
+		conflicts, _ := runGitCommand(ctx, worktreePath, "diff", "--name-only", "--diff-filter=U")
+		abort := "merge"
+		if opts.Rebase {
+			abort = "rebase"
+		}
+		if _, abortErr := runGitCommand(ctx, worktreePath, abort, "--abort"); abortErr != nil {
+			return nil, fmt.Errorf("failed to abort %s (%v): %w", abort, err, abortErr)
+		}
+		if strings.TrimSpace(conflicts) == "" {
+			return nil, err
+		}
+		result.Conflicts = strings.Split(strings.TrimSpace(conflicts), "\n")
+		return result, nil
+	}
+	// Until the container is updated, failures move the branch back.
+	applied := false
+	defer func() {
+		if rerr != nil && !applied {
+			if _, err := runGitCommand(ctx, worktreePath, "reset", "--hard", head); err != nil {
+				rerr = fmt.Errorf("%w (and failed to reset the environment branch: %v)", rerr, err)
+			}
+		}
+	}()
+	if opts.Rebase && env.Notes.backend() == NotesFile {
+		if err := env.rewriteFileNotes(ctx, worktreePath, head, branch); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := runGitCommand(ctx, worktreePath, "diff", "--name-only", "--no-renames", "-z", head, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if files := strings.TrimRight(out, "\x00"); files != "" {
+		result.Files = strings.Split(files, "\x00")
+	}
+
+	container := env.withWorktreeFiles(env.container, worktreePath, result.Files)
+	if slices.ContainsFunc(result.Files, func(file string) bool { return slices.Contains(rebuildTriggers, file) }) {
+		cfg, err := LoadRepoConfig(worktreePath)
+		if err != nil {
+			return nil, err
+		}
+		if cfg != nil {
+			cfg.applyDefaults(env)
+			cfg.applyPolicies(env)
+		}
+		if env.ToolVersions, err = detectToolVersions(worktreePath); err != nil {
+			return nil, err
+		}
+
+		reportProgress(ctx, "Rebuilding environment %s", env.ID)
+		if container, err = env.buildBase(ctx); err != nil {
+			return nil, err
+		}
+		if container, err = env.bootstrap(ctx, container); err != nil {
+			return nil, err
+		}
+		result.Rebuilt = true
+	}
+
+	summary := "Sync with " + branch
+	if err := env.apply(ctx, summary, explanation, "", container); err != nil {
+		return nil, err
+	}
+	applied = true
+	if err := env.propagateToWorktree(ctx, change{Action: "sync", Summary: summary}, explanation); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// rewriteFileNotes copies the notes of the file notes backend of the commits
+// replayed by a rebase onto upstream to the commits replacing them, as
+// notes.rewriteRef does for git notes. The commits before the rebase are the
+// ones of oldHead. Rebasing keeps the order, author date and message of the
+// commits, which pairs them.
+func (env *Environment) rewriteFileNotes(ctx context.Context, worktreePath, oldHead, upstream string) error {
+	commits := func(rev string) ([][2]string, error) {
+		out, err := runGitCommand(ctx, worktreePath, "log", "--reverse", "--no-merges", "--format=%H%x00%at%x00%B%x01", rev, "--not", upstream)
+		if err != nil {
+			return nil, err
+		}
+		list := [][2]string{}
+		for _, record := range strings.Split(out, "\x01") {
+			hash, key, ok := strings.Cut(strings.TrimSpace(record), "\x00")
+			if ok {
+				list = append(list, [2]string{hash, key})
+			}
+		}
+		return list, nil
+	}
+	previous, err := commits(oldHead)
+	if err != nil {
+		return err
+	}
+	rewritten, err := commits("HEAD")
+	if err != nil {
+		return err
+	}
+	pending := map[string][]string{}
+	for _, c := range previous {
+		pending[c[1]] = append(pending[c[1]], c[0])
+	}
+
+	for _, c := range rewritten {
+		queue := pending[c[1]]
+		if len(queue) == 0 {
+			continue
+		}
+		pending[c[1]] = queue[1:]
+		for _, ref := range []string{env.Notes.logRef(), env.Notes.stateRef()} {
+			note, err := env.Notes.show(ctx, worktreePath, ref, queue[0])
+			if errors.Is(err, errNoNote) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := writeNoteRecord(ctx, worktreePath, ref, c[0], "add", note); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
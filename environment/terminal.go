@@ -0,0 +1,157 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/mitchellh/go-homedir"
+)
+
+// TerminalShells are the shells terminals can be opened with.
+var TerminalShells = []string{"sh", "bash", "zsh", "fish"}
+
+// TerminalConfig customizes the terminals opened in environments.
+//
+// Example (~/.config/container-use/terminal.json):
+//
+//	{
+//	  "shell": "zsh",
+//	  "dotfiles": "https://github.com/me/dotfiles",
+//	  "rc": ["alias ll='ls -la'"]
+//	}
+type TerminalConfig struct {
+	// Shell is the shell to open, installed if missing from the environment. Defaults to sh.
+	Shell string `json:"shell,omitempty"`
+	// Dotfiles is a git repository or a host directory of dotfiles, installed in
+	// the home directory with its install script (install.sh, bootstrap.sh or setup.sh)
+	// or, without one, by linking its dotfiles.
+	Dotfiles string `json:"dotfiles,omitempty"`
+	// RC are lines appended to the rc file of the shell.
+	RC []string `json:"rc,omitempty"`
+}
+
+// DefaultTerminalConfigPath returns the location of the terminal configuration.
+func DefaultTerminalConfigPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/terminal.json")
+}
+
+// LoadTerminalConfig reads the terminal configuration. A missing file results in an empty configuration.
+func LoadTerminalConfig() (*TerminalConfig, error) {
+	configPath, err := DefaultTerminalConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &TerminalConfig{}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid terminal configuration %s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+// rcFile returns the rc file of shell, relative to the home directory.
+func rcFile(shell string) string {
+	switch shell {
+	case "bash":
+		return ".bashrc"
+	case "zsh":
+		return ".zshrc"
+	case "fish":
+		return ".config/fish/config.fish"
+	default:
+		return ".profile"
+	}
+}
+
+// dotfilesScript installs the dotfiles cloned in ~/.dotfiles.
+const dotfilesScript = `set -e
+cd ~/.dotfiles
+for script in install.sh install bootstrap.sh bootstrap script/bootstrap setup.sh setup script/setup; do
+	if [ -f "$script" ]; then
+		chmod +x "$script"
+		exec "./$script"
+	fi
+done
+for file in .[!.]*; do
+	[ "$file" = .git ] || ln -sf ~/.dotfiles/"$file" ~/"$file"
+done
+`
+
+// Terminal opens an interactive shell in a copy of the environment, customized
+// by cfg. Changes made in the terminal are not saved.
+func (env *Environment) Terminal(ctx context.Context, cfg *TerminalConfig) error {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return err
+	}
+
+	container, shell, err := env.terminalContainer(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := container.Terminal(dagger.ContainerTerminalOpts{Cmd: env.User.wrap([]string{shell})}).Sync(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// terminalContainer returns a copy of the environment customized by cfg for
+// terminals, along with the shell to open.
+func (env *Environment) terminalContainer(ctx context.Context, cfg *TerminalConfig) (*dagger.Container, string, error) {
+	if cfg == nil {
+		cfg = &TerminalConfig{}
+	}
+	shell := cfg.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	if !slices.Contains(TerminalShells, shell) {
+		return nil, "", fmt.Errorf("unsupported shell %q, must be one of %s", shell, strings.Join(TerminalShells, ", "))
+	}
+
+	container := env.container
+	home := "/root"
+	if env.User != nil {
+		home = env.User.home()
+	}
+	if shell != "sh" {
+		pm, err := detectPackageManager(ctx, container)
+		if err != nil {
+			return nil, "", err
+		}
+		container = container.WithExec([]string{"sh", "-c", fmt.Sprintf("command -v %s >/dev/null || (%s)", shell, pm.Install([]string{shell}))})
+	}
+
+	if cfg.Dotfiles != "" {
+		reportProgress(ctx, "Installing dotfiles from %s", cfg.Dotfiles)
+		container = container.
+			WithDirectory(path.Join(home, ".dotfiles"), env.urlToDirectory(cfg.Dotfiles), dagger.ContainerWithDirectoryOpts{Owner: env.User.owner()}).
+			WithExec(env.User.wrap([]string{"sh", "-c", dotfilesScript}))
+	}
+
+	rc := cfg.RC
+	if len(rc) == 0 && shell == "bash" {
+		// Show the same pretty PS1 as for the default /bin/sh terminal in dagger
+		rc = []string{`export PS1="\033[33mdagger\033[0m \033[02m\$(pwd | sed \"s|^\$HOME|~|\")\033[0m \$ "`}
+	}
+	if len(rc) > 0 {
+		script := fmt.Sprintf("mkdir -p \"$(dirname ~/%[1]s)\" && cat >> ~/%[1]s", rcFile(shell))
+		container = container.
+			WithNewFile("/tmp/container-use-rc", strings.Join(rc, "\n")+"\n").
+			WithExec(env.User.wrap([]string{"sh", "-c", script + " < /tmp/container-use-rc"}))
+	}
+
+	return container, shell, nil
+}
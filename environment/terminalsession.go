@@ -0,0 +1,247 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
+)
+
+const (
+	// terminalAttachPort attaches clients to the tmux session of a persistent
+	// terminal. Clients send their size ("<cols>x<rows>\n") first, followed by
+	// " view" to only watch the session ("<cols>x<rows> view\n").
+	terminalAttachPort = 7681
+	// terminalCapturePort serves the scrollback of the tmux session.
+	terminalCapturePort = 7682
+)
+
+// terminalAttachScript (re)creates the tmux session and attaches to it.
+const terminalAttachScript = `read size mode
+export TERM="${TERM:-xterm-256color}"
+stty cols "${size%%x*}" rows "${size#*x}" 2>/dev/null
+if [ "$mode" = view ]; then
+	exec tmux attach-session -r -t cu
+fi
+exec tmux new-session -A -s cu %s
+`
+
+const terminalServiceScript = `tmux new-session -d -s cu %s
+socat TCP-LISTEN:%d,reuseaddr,fork SYSTEM:'tmux capture-pane -p -J -S - -t cu' &
+exec socat TCP-LISTEN:%d,reuseaddr,fork SYSTEM:/tmp/container-use-attach,pty,setsid,ctty,stderr
+`
+
+// TerminalSession is a persistent terminal of an environment: a tmux session
+// running in a service of the container-use server, which humans attach to
+// with cu terminal and can reattach to after a disconnection with their
+// scrollback intact. The size of the terminal is set when attaching.
+type TerminalSession struct {
+	Environment string `json:"environment"`
+	Shell       string `json:"shell"`
+	// Attach is the host address terminals attach to.
+	Attach string `json:"attach"`
+	// Capture is the host address serving the scrollback of the session.
+	Capture   string    `json:"capture"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func terminalSessionPath(id string) (string, error) {
+	return homedir.Expand(fmt.Sprintf("~/.config/container-use/terminals/%s.json", strings.ReplaceAll(id, "/", "_")))
+}
+
+// LoadTerminalSession returns the persistent terminal of the environment id,
+// or nil if it has none or its server is gone.
+func LoadTerminalSession(id string) (*TerminalSession, error) {
+	sessionPath, err := terminalSessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(sessionPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	session := &TerminalSession{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("invalid terminal session %s: %w", sessionPath, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", session.Capture, time.Second)
+	if err != nil {
+		// The container-use server hosting it exited.
+		_ = os.Remove(sessionPath)
+		return nil, nil
+	}
+	conn.Close()
+	return session, nil
+}
+
+// StartTerminalSession starts the persistent terminal of the environment,
+// customized by cfg, unless it already has one. The terminal lives as long as
+// the container-use server (or until the environment is reaped); commands run
+// in it don't change the environment.
+func (env *Environment) StartTerminalSession(ctx context.Context, cfg *TerminalConfig) (*TerminalSession, error) {
+	if err := env.ensureProvisioned(ctx); err != nil {
+		return nil, err
+	}
+
+	if session, err := LoadTerminalSession(env.ID); err != nil || session != nil {
+		return session, err
+	}
+
+	container, shell, err := env.terminalContainer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := detectPackageManager(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	reportProgress(ctx, "Starting terminal session of environment %s", env.ID)
+	spec, err := env.rootExecSpec(ctx, container, []string{"sh", "-c", fmt.Sprintf("command -v tmux >/dev/null && command -v socat >/dev/null || (%s)", pm.Install([]string{"tmux", "socat"}))}, false)
+	if err != nil {
+		return nil, err
+	}
+	container = container.
+		WithExec(spec.Args, dagger.ContainerWithExecOpts{InsecureRootCapabilities: spec.InsecureRootCapabilities}).
+		WithNewFile("/tmp/container-use-attach", fmt.Sprintf(terminalAttachScript, shell), dagger.ContainerWithNewFileOpts{Permissions: 0755}).
+		WithExposedPort(terminalAttachPort).
+		WithExposedPort(terminalCapturePort)
+
+	spec, err = env.execSpec(ctx, container, []string{"sh", "-c", fmt.Sprintf(terminalServiceScript, shell, terminalCapturePort, terminalAttachPort)}, false)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := container.AsService(dagger.ContainerAsServiceOpts{
+		Args:                     spec.Args,
+		InsecureRootCapabilities: spec.InsecureRootCapabilities,
+	}).Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	forwards := []dagger.PortForward{}
+	for _, port := range []int{terminalAttachPort, terminalCapturePort} {
+		forwards = append(forwards, dagger.PortForward{
+			Backend:  port,
+			Frontend: rand.Intn(1000) + 6000,
+			Protocol: dagger.NetworkProtocolTcp,
+		})
+	}
+	tunnel, err := env.client.dag.Host().Tunnel(svc, dagger.HostTunnelOpts{Ports: forwards}).Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env.trackService(svc)
+	env.trackService(tunnel)
+
+	session := &TerminalSession{
+		Environment: env.ID,
+		Shell:       shell,
+		StartedAt:   time.Now(),
+	}
+	if session.Attach, err = tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{Port: forwards[0].Frontend}); err != nil {
+		return nil, err
+	}
+	if session.Capture, err = tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{Port: forwards[1].Frontend}); err != nil {
+		return nil, err
+	}
+
+	sessionPath, err := terminalSessionPath(env.ID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(sessionPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sessionPath, data, 0600); err != nil {
+		return nil, err
+	}
+	_ = env.addGitNote(ctx, fmt.Sprintf("Started terminal session (%s)\n\n", shell))
+	return session, nil
+}
+
+// Scrollback returns the content of the terminal, including its scrollback,
+// so agents can inspect what the human did in it.
+func (s *TerminalSession) Scrollback(ctx context.Context) (string, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Capture)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to terminal session: %w", err)
+	}
+	defer conn.Close()
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// AttachTerminal attaches the terminal in to the session until the shell
+// exits or the connection is closed. Detach (ctrl-b d) to leave the session
+// running. With viewOnly, the terminal only watches the session: what's
+// typed in it, other than detaching, is ignored.
+func (s *TerminalSession) AttachTerminal(in *os.File, out io.Writer, viewOnly bool) error {
+	conn, err := net.Dial("tcp", s.Attach)
+	if err != nil {
+		return fmt.Errorf("failed to connect to terminal session: %w", err)
+	}
+	defer conn.Close()
+
+	cols, rows := 80, 24
+	if w, h, err := term.GetSize(int(in.Fd())); err == nil {
+		cols, rows = w, h
+	}
+	mode := ""
+	if viewOnly {
+		mode = " view"
+	}
+	if _, err := fmt.Fprintf(conn, "%dx%d%s\n", cols, rows, mode); err != nil {
+		return err
+	}
+	if term.IsTerminal(int(in.Fd())) {
+		state, err := term.MakeRaw(int(in.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(in.Fd()), state)
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, in)
+	}()
+	_, err = io.Copy(out, conn)
+	return err
+}
+
+// TerminalScrollback returns the redacted scrollback of the persistent terminal of the environment.
+func (env *Environment) TerminalScrollback(ctx context.Context) (string, error) {
+	session, err := LoadTerminalSession(env.ID)
+	if err != nil {
+		return "", err
+	}
+	if session == nil {
+		return "", fmt.Errorf("environment %s has no terminal session", env.ID)
+	}
+	out, err := session.Scrollback(ctx)
+	if err != nil {
+		return "", err
+	}
+	return env.redact(out), nil
+}
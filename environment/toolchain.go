@@ -0,0 +1,124 @@
+package environment
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// toolchain describes a sensible default environment for a project type.
+type toolchain struct {
+	Name          string
+	BaseImage     string
+	SetupCommands []string
+	Instructions  string
+	Nix           string
+	// PersistentDirs are the dependency directories of the toolchain.
+	PersistentDirs []string
+}
+
+func fileExists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+// goVersion returns the minor Go version (e.g. 1.24) declared in go.mod, if any.
+func goVersion(dir string) string {
+	f, err := os.Open(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "go" {
+			parts := strings.SplitN(fields[1], ".", 3)
+			if len(parts) >= 2 {
+				return parts[0] + "." + parts[1]
+			}
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func nodeInstallCommand(dir string) string {
+	switch {
+	case fileExists(dir, "pnpm-lock.yaml"):
+		return "pnpm install --frozen-lockfile"
+	case fileExists(dir, "yarn.lock"):
+		return "yarn install --frozen-lockfile"
+	case fileExists(dir, "package-lock.json"):
+		return "npm ci"
+	default:
+		return "npm install"
+	}
+}
+
+// detectToolchain guesses the toolchain needed by the project at dir from its manifest files.
+// It returns nil if the project type isn't recognized.
+func detectToolchain(dir string) *toolchain {
+	if nix := detectNix(dir); nix != "" {
+		return &toolchain{
+			Name:         "nix",
+			BaseImage:    nixImage,
+			Nix:          nix,
+			Instructions: "Nix project. Every command runs inside the project's Nix dev shell, add missing tools to the Nix configuration rather than installing them manually.",
+		}
+	}
+
+	switch {
+	case fileExists(dir, "go.mod"):
+		image := "golang:latest"
+		if v := goVersion(dir); v != "" {
+			image = "golang:" + v
+		}
+		return &toolchain{
+			Name:         "go",
+			BaseImage:    image,
+			Instructions: "Go project (go.mod). Download dependencies with `go mod download`, build with `go build ./...` and test with `go test ./...`.",
+		}
+	case fileExists(dir, "package.json"):
+		tc := &toolchain{
+			Name:           "node",
+			BaseImage:      "node:lts",
+			PersistentDirs: []string{"node_modules"},
+			Instructions:   "Node.js project (package.json). Install dependencies with `" + nodeInstallCommand(dir) + "` and look at the scripts in package.json to build and test.",
+		}
+		if fileExists(dir, "pnpm-lock.yaml") {
+			tc.SetupCommands = []string{"corepack enable"}
+		}
+		return tc
+	case fileExists(dir, "Cargo.toml"):
+		return &toolchain{
+			Name:           "rust",
+			BaseImage:      "rust:latest",
+			PersistentDirs: []string{"target"},
+			Instructions:   "Rust project (Cargo.toml). Build with `cargo build` and test with `cargo test`.",
+		}
+	case fileExists(dir, "requirements.txt"), fileExists(dir, "pyproject.toml"), fileExists(dir, "setup.py"):
+		install := "pip install -e ."
+		if fileExists(dir, "requirements.txt") {
+			install = "pip install -r requirements.txt"
+		}
+		return &toolchain{
+			Name:           "python",
+			BaseImage:      "python:3.12",
+			SetupCommands:  []string{"pip install --upgrade pip"},
+			Instructions:   "Python project. Install dependencies with `" + install + "` in the .venv virtualenv (`python -m venv .venv`) and run the tests with `python -m pytest` (install pytest if needed).",
+			PersistentDirs: []string{".venv"},
+		}
+	}
+	return nil
+}
+
+func (tc *toolchain) applyDefaults(env *Environment) {
+	env.BaseImage = tc.BaseImage
+	env.SetupCommands = tc.SetupCommands
+	env.Instructions = tc.Instructions
+	env.Nix = tc.Nix
+	env.PersistentDirs = tc.PersistentDirs
+}
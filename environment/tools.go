@@ -0,0 +1,52 @@
+package environment
+
+import (
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// toolsDir is where the tools wrapping the commands of environments (busybox,
+// iptables, setpriv) are mounted. They're built from alpine along with the
+// musl loader running them, so they work whatever the base image.
+const toolsDir = "/.container-use/tools"
+
+// toolsScript gathers the tools in /cu, along with the musl loader.
+const toolsScript = `set -e
+apk add --no-cache busybox iptables ip6tables setpriv
+mkdir -p /cu
+cp /lib/ld-musl-*.so.1 /cu/ld
+for tool in busybox iptables ip6tables setpriv; do
+	cp -L "$(command -v "$tool")" "/cu/$tool"
+done`
+
+// tools returns the root filesystem holding the tools, mounted at toolsDir.
+func (env *Environment) tools() *dagger.Directory {
+	return env.client.dag.Container().From(alpineImage).
+		WithExec([]string{"sh", "-c", toolsScript}).
+		Rootfs()
+}
+
+// withTools mounts the tools in container, if its commands need them.
+func (env *Environment) withTools(container *dagger.Container) *dagger.Container {
+	if !env.privileged() {
+		return container
+	}
+	return container.WithMountedDirectory(toolsDir, env.tools())
+}
+
+// toolArgs returns the args running the tool name with args.
+func toolArgs(name string, args ...string) []string {
+	return append([]string{toolsDir + "/cu/ld", "--library-path", toolsDir + "/lib:" + toolsDir + "/usr/lib", toolsDir + "/cu/" + name}, args...)
+}
+
+// toolFunctions defines the shell functions running the tools, for scripts
+// run by the tools' busybox sh.
+var toolFunctions = strings.Join([]string{
+	`tool() { name=$1; shift; XTABLES_LIBDIR=` + toolsDir + `/usr/lib/xtables ` + strings.Join(toolArgs(`"$name"`), " ") + ` "$@"; }`,
+	`iptables() { tool iptables "$@"; }`,
+	`ip6tables() { tool ip6tables "$@"; }`,
+	`setpriv() { tool setpriv "$@"; }`,
+	`hostname() { tool busybox hostname "$@"; }`,
+	`sleep() { tool busybox sleep "$@"; }`,
+}, "\n") + "\n"
@@ -0,0 +1,187 @@
+package environment
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// miseVersion is the release of mise installing the pinned tool versions.
+	miseVersion = "v2025.6.0"
+	// miseReleaseURL is where the assets of the mise release are downloaded from.
+	miseReleaseURL = "https://github.com/jdx/mise/releases/download/" + miseVersion + "/"
+)
+
+// detectToolVersions reads the tool versions pinned by the project at dir in
+// .tool-versions (asdf/mise), .nvmrc and .python-version files.
+func detectToolVersions(dir string) (map[string]string, error) {
+	versions := map[string]string{}
+
+	readLines := func(name string) ([]string, error) {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		defer f.Close()
+
+		lines := []string{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return lines, scanner.Err()
+	}
+
+	lines, err := readLines(".tool-versions")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			versions[fields[0]] = fields[1]
+		}
+	}
+
+	lines, err = readLines(".nvmrc")
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) > 0 {
+		_, hasNode := versions["node"]
+		_, hasNodeJS := versions["nodejs"]
+		if !hasNode && !hasNodeJS {
+			version := strings.TrimPrefix(lines[0], "v")
+			if strings.HasPrefix(version, "lts/") {
+				version = "lts"
+			}
+			versions["node"] = version
+		}
+	}
+
+	lines, err = readLines(".python-version")
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) > 0 {
+		versions["python"] = lines[0]
+	}
+
+	return versions, nil
+}
+
+// miseDirs returns the data and config directories of mise, in the home of
+// the user running the commands of the environment so they can use the tools
+// installed as root.
+func (env *Environment) miseDirs() (string, string) {
+	home := "/root"
+	if env.User != nil {
+		home = env.User.home()
+	}
+	return path.Join(home, ".local/share/mise"), path.Join(home, ".config/mise")
+}
+
+// miseBinary returns the mise binary of the pinned release for platform, once
+// its archive matches the checksums published with the release.
+func (env *Environment) miseBinary(ctx context.Context, platform dagger.Platform) (*dagger.File, error) {
+	var arch string
+	switch {
+	case strings.HasPrefix(string(platform), "linux/amd64"):
+		arch = "x64"
+	case strings.HasPrefix(string(platform), "linux/arm64"):
+		arch = "arm64"
+	default:
+		return nil, fmt.Errorf("pinned tool versions are not supported on %s", platform)
+	}
+	// The musl builds are static, and run on any base image.
+	name := fmt.Sprintf("mise-%s-linux-%s-musl.tar.gz", miseVersion, arch)
+
+	sums, err := env.client.dag.HTTP(miseReleaseURL + "SHASUMS256.txt").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the checksums of mise %s: %w", miseVersion, err)
+	}
+	expected, err := releaseChecksum(sums, name)
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf(`set -e
+echo %s | sha256sum -c -
+tar -xzf /mise.tar.gz -C /tmp`, shellQuote(expected+"  /mise.tar.gz"))
+	return env.client.dag.Container().From(alpineImage).
+		WithMountedFile("/mise.tar.gz", env.client.dag.HTTP(miseReleaseURL+name)).
+		WithExec([]string{"sh", "-c", script}).
+		File("/tmp/mise/bin/mise"), nil
+}
+
+// releaseChecksum returns the SHA-256 of name in sums, as written by sha256sum.
+func releaseChecksum(sums, name string) (string, error) {
+	for _, line := range strings.Split(sums, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		file := strings.TrimPrefix(strings.TrimPrefix(fields[1], "*"), "./")
+		if file == name && len(fields[0]) == 64 {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the checksums of mise %s", name, miseVersion)
+}
+
+// withToolVersions installs mise and the pinned tool versions in container.
+func (env *Environment) withToolVersions(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	tools := make([]string, 0, len(env.ToolVersions))
+	for tool, version := range env.ToolVersions {
+		tools = append(tools, shellQuote(tool+"@"+version))
+	}
+	sort.Strings(tools)
+
+	reportStage(ctx, StagePackages, 0, 0, "Installing pinned tool versions: %s", strings.Join(tools, ", "))
+	platform, err := container.Platform(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mise, err := env.miseBinary(ctx, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir, configDir := env.miseDirs()
+	script := "set -e\nmise use --global --yes " + strings.Join(tools, " ")
+	if owner := env.User.owner(); owner != "" {
+		script += fmt.Sprintf("\nchown -R %s %s %s", owner, shellQuote(dataDir), shellQuote(configDir))
+	}
+	spec, err := env.rootExecSpec(ctx, container, []string{"sh", "-c", script}, false)
+	if err != nil {
+		return nil, err
+	}
+	container = container.
+		WithFile("/usr/local/bin/mise", mise, dagger.ContainerWithFileOpts{Permissions: 0755}).
+		WithEnvVariable("MISE_DATA_DIR", dataDir).
+		WithEnvVariable("MISE_CONFIG_DIR", configDir).
+		WithEnvVariable("PATH", path.Join(dataDir, "shims")+":${PATH}", dagger.ContainerWithEnvVariableOpts{Expand: true}).
+		WithExec(spec.Args, dagger.ContainerWithExecOpts{
+			InsecureRootCapabilities: spec.InsecureRootCapabilities,
+		})
+
+	stopHeartbeat := heartbeat(ctx, "Installing pinned tool versions")
+	defer stopHeartbeat()
+	if _, err := container.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to install pinned tool versions: %w", err)
+	}
+	return container, nil
+}
@@ -0,0 +1,207 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// TrashRetentionEnv overrides the number of days deleted environments are kept.
+	TrashRetentionEnv = "CONTAINER_USE_TRASH_DAYS"
+
+	defaultTrashRetention = 7 * 24 * time.Hour
+)
+
+// TrashedEnvironment is a deleted environment that can still be restored.
+type TrashedEnvironment struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	DeletedAt time.Time `json:"deleted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func trashDir() (string, error) {
+	return homedir.Expand("~/.config/container-use/trash")
+}
+
+func trashPath(id string) (string, error) {
+	dir, err := trashDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strings.ReplaceAll(id, "/", "_")+".json"), nil
+}
+
+func trashRef(id string) string {
+	return "refs/container-use-trash/" + id
+}
+
+func trashRetention() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv(TrashRetentionEnv)); err == nil && days >= 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return defaultTrashRetention
+}
+
+// moveToTrash keeps the environment branch aside so the environment can be
+// restored after its deletion.
+func (env *Environment) moveToTrash(ctx context.Context) error {
+	localRepoPath, err := filepath.Abs(env.Source)
+	if err != nil {
+		return err
+	}
+	cuRepoPath, err := getRepoPath(localRepoPath)
+	if err != nil {
+		return err
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, "update-ref", trashRef(env.ID), "refs/heads/"+env.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	trashed := TrashedEnvironment{
+		ID:        env.ID,
+		Name:      env.Name,
+		Source:    localRepoPath,
+		DeletedAt: now,
+		ExpiresAt: now.Add(trashRetention()),
+	}
+	data, err := json.MarshalIndent(trashed, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := trashPath(env.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ListTrash returns the deleted environments that can still be restored, most recently deleted first.
+func ListTrash() ([]TrashedEnvironment, error) {
+	dir, err := trashDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	trash := []TrashedEnvironment{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var trashed TrashedEnvironment
+		if err := json.Unmarshal(data, &trashed); err != nil {
+			return nil, fmt.Errorf("invalid trash entry %s: %w", entry.Name(), err)
+		}
+		trash = append(trash, trashed)
+	}
+	sort.Slice(trash, func(i, j int) bool { return trash[i].DeletedAt.After(trash[j].DeletedAt) })
+	return trash, nil
+}
+
+// PurgeTrash permanently removes the deleted environments whose retention expired.
+func PurgeTrash(ctx context.Context) error {
+	trash, err := ListTrash()
+	if err != nil {
+		return err
+	}
+	for _, trashed := range trash {
+		if time.Now().Before(trashed.ExpiresAt) {
+			continue
+		}
+		slog.Info("Purging deleted environment", "environment.id", trashed.ID, "deleted-at", trashed.DeletedAt)
+		if err := removeFromTrash(ctx, trashed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeFromTrash(ctx context.Context, trashed TrashedEnvironment) error {
+	cuRepoPath, err := getRepoPath(trashed.Source)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cuRepoPath); err == nil {
+		if _, err := runGitCommand(ctx, cuRepoPath, "update-ref", "-d", trashRef(trashed.ID)); err != nil {
+			return err
+		}
+	}
+	path, err := trashPath(trashed.ID)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RestoreDeleted brings back the branch and worktree of a deleted environment.
+func RestoreDeleted(ctx context.Context, id string) (*TrashedEnvironment, error) {
+	trash, err := ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	var trashed *TrashedEnvironment
+	for i := range trash {
+		if trash[i].ID == id {
+			trashed = &trash[i]
+			break
+		}
+	}
+	if trashed == nil {
+		return nil, fmt.Errorf("environment %s is not in the trash", id)
+	}
+
+	cuRepoPath, err := getRepoPath(trashed.Source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, "show-ref", "--verify", "--quiet", "refs/heads/"+id); err == nil {
+		return nil, fmt.Errorf("environment %s already exists", id)
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, "branch", id, trashRef(id)); err != nil {
+		return nil, err
+	}
+
+	env := &Environment{ID: trashed.ID, Name: trashed.Name, Source: trashed.Source}
+	worktreePath, err := env.GetWorktreePath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, cuRepoPath, "worktree", "add", worktreePath, id); err != nil {
+		return nil, err
+	}
+	if _, err := runGitCommand(ctx, trashed.Source, "fetch", "container-use", id); err != nil {
+		return nil, err
+	}
+
+	if err := removeFromTrash(ctx, *trashed); err != nil {
+		return nil, err
+	}
+	return trashed, nil
+}
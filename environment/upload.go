@@ -0,0 +1,271 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// uploadedFile is the state of a file of an uploaded directory.
+type uploadedFile struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	// symlink is set if the file is a symlink, hash being the one of its target.
+	symlink bool
+}
+
+// uploadManifest describes a host directory as last uploaded to a target of
+// the container, so that uploading it again only transfers what changed.
+type uploadManifest struct {
+	files map[string]uploadedFile
+	dirs  []string
+	// digest is the digest of the target once uploaded: the manifest only
+	// describes the target if it didn't change since.
+	digest string
+}
+
+// hostDirectoryPath returns the host path of the directory source refers to,
+// if it's a host directory.
+func hostDirectoryPath(source string) (string, bool) {
+	if strings.HasPrefix(source, "git://") || strings.HasPrefix(source, "https://") {
+		return "", false
+	}
+	dir, err := filepath.Abs(strings.TrimPrefix(source, "file://"))
+	if err != nil {
+		return "", false
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return dir, true
+}
+
+// scanUpload returns the manifest of the host directory dir. The files whose
+// size and modification time are the ones of previous aren't hashed again.
+func scanUpload(dir string, previous *uploadManifest) (*uploadManifest, error) {
+	manifest := &uploadManifest{files: map[string]uploadedFile{}}
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if rel != "." {
+				manifest.dirs = append(manifest.dirs, rel)
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		file := uploadedFile{size: info.Size(), modTime: info.ModTime(), symlink: entry.Type()&fs.ModeSymlink != 0}
+		if previous != nil {
+			if known, ok := previous.files[rel]; ok && known.size == file.size && known.modTime.Equal(file.modTime) {
+				manifest.files[rel] = known
+				return nil
+			}
+		}
+		if file.hash, err = hashFile(p, entry); err != nil {
+			return err
+		}
+		manifest.files[rel] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func hashFile(p string, entry fs.DirEntry) (string, error) {
+	h := sha256.New()
+	if entry.Type()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "symlink:%s", target)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// globMeta are the characters with a meaning in the include patterns of host directories.
+const globMeta = `*?[]\!`
+
+// uploadDelta returns the files of current to transfer, changed or added
+// since previous, and the ones to remove. It returns false if the whole
+// directory must be transferred: directories were added or removed, or a
+// changed file has a name that can't be included on its own.
+func uploadDelta(previous, current *uploadManifest) (changed, removed []string, ok bool) {
+	if !slices.Equal(previous.dirs, current.dirs) {
+		return nil, nil, false
+	}
+	for _, name := range slices.Sorted(maps.Keys(current.files)) {
+		if known, found := previous.files[name]; found && known.hash == current.files[name].hash {
+			continue
+		}
+		if strings.ContainsAny(name, globMeta) {
+			return nil, nil, false
+		}
+		changed = append(changed, name)
+	}
+	for _, name := range slices.Sorted(maps.Keys(previous.files)) {
+		if _, found := current.files[name]; !found {
+			removed = append(removed, name)
+		}
+	}
+	return changed, removed, true
+}
+
+// hostUpload is the upload of a host directory to a target of the container, see withUpload.
+type hostUpload struct {
+	container *dagger.Container
+	// summary tells which files were transferred.
+	summary  string
+	transfer *Transfer
+	// transferred are the files transferred, and checksum the one of the
+	// target once uploaded, see verifyUpload.
+	transferred []string
+	checksum    string
+
+	key      string
+	target   string
+	manifest *uploadManifest
+}
+
+// withUpload returns container with the host directory dir uploaded to
+// target, transferring only the files that changed since it was last
+// uploaded there, if the target didn't change since. Once applied, the
+// upload must be recorded with recordUpload.
+func (s *Environment) withUpload(ctx context.Context, container *dagger.Container, dir, target string) (*hostUpload, error) {
+	key := dir + "\x00" + target
+	s.uploadsMu.Lock()
+	previous := s.uploads[key]
+	s.uploadsMu.Unlock()
+
+	current, err := scanUpload(dir, previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+	}
+	links, err := s.uploadSymlinks(dir, current)
+	if err != nil {
+		return nil, err
+	}
+	upload := &hostUpload{key: key, target: target, manifest: current}
+
+	if previous != nil {
+		digest, err := container.Directory(target).Digest(ctx)
+		if err == nil && digest == previous.digest {
+			if changed, removed, ok := uploadDelta(previous, current); ok {
+				if len(changed) > 0 {
+					container, upload.transfer = s.transferFiles(ctx, container, dir, target, changed, current)
+				}
+				upload.transferred = changed
+				if len(removed) > 0 {
+					paths := make([]string, len(removed))
+					for i, name := range removed {
+						paths[i] = path.Join(target, name)
+					}
+					container = container.WithoutFiles(paths)
+				}
+				if s.Symlinks == SymlinkFollow {
+					container = s.followUploadSymlinks(container, dir, target, links)
+				}
+				upload.container = container
+				upload.summary = fmt.Sprintf("Uploaded %d changed files, removed %d, %d unchanged", len(changed), len(removed), len(current.files)-len(changed))
+				if upload.transfer != nil {
+					upload.summary += " (" + upload.transfer.String() + ")"
+				}
+				return upload, nil
+			}
+		}
+	}
+
+	upload.container, upload.transfer = s.transferFiles(ctx, container, dir, target, nil, current)
+	if s.Symlinks == SymlinkFollow {
+		upload.container = s.followUploadSymlinks(upload.container, dir, target, links)
+	}
+	upload.transferred = slices.Collect(maps.Keys(current.files))
+	upload.summary = "Uploaded " + upload.transfer.String()
+	return upload, nil
+}
+
+// transferFiles returns container with the files of the host directory dir,
+// all of them if files is nil, copied to target: compressed if the
+// environment compresses transfers that large.
+func (s *Environment) transferFiles(ctx context.Context, container *dagger.Container, dir, target string, files []string, manifest *uploadManifest) (*dagger.Container, *Transfer) {
+	all := files == nil
+	if all {
+		files = slices.Sorted(maps.Keys(manifest.files))
+	}
+	transfer := &Transfer{Files: len(files)}
+	for _, name := range files {
+		transfer.Size += manifest.files[name].size
+	}
+
+	if c := s.compressionFor(transfer.Size); c != CompressionNone {
+		// Directories are created by the extraction of their files, but empty ones.
+		names := files
+		if all {
+			names = append(slices.Clone(manifest.dirs), files...)
+		}
+		compressed, size, err := s.withCompressedUpload(ctx, container, dir, target, names, c)
+		if err == nil {
+			transfer.Compression, transfer.CompressedSize = c, size
+			return compressed, transfer
+		}
+		slog.Warn("Failed to compress upload, uploading it uncompressed", "source", dir, "compression", c, "err", err)
+	}
+
+	// The host directory is always reloaded, so that the files are fresh.
+	opts := dagger.HostDirectoryOpts{NoCache: true}
+	if !all {
+		opts.Include = files
+	}
+	source := s.client.dag.Host().Directory(dir, opts)
+	return container.WithDirectory(target, source, dagger.ContainerWithDirectoryOpts{Owner: s.User.owner()}), transfer
+}
+
+// recordUpload records the manifest of upload, once applied, for the next
+// upload of the same directory to only transfer what changed.
+func (s *Environment) recordUpload(ctx context.Context, upload *hostUpload) {
+	digest, err := upload.container.Directory(upload.target).Digest(ctx)
+	if err != nil {
+		return
+	}
+	upload.manifest.digest = digest
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	if s.uploads == nil {
+		s.uploads = map[string]*uploadManifest{}
+	}
+	s.uploads[upload.key] = upload.manifest
+}
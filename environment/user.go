@@ -0,0 +1,122 @@
+package environment
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+
+	"dagger.io/dagger"
+)
+
+// defaultUID is the UID of the environment user when the host user is root.
+const defaultUID = 1000
+
+// UserConfig runs the commands of an environment as a non-root user, so the
+// files they write aren't owned by root.
+//
+// The UID and GID default to the ones of the host user, so files exported to
+// the worktree keep the right ownership. Packages and setup commands are still
+// installed as root. This requires `setpriv` (util-linux) to be available in
+// the base image.
+type UserConfig struct {
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	UID  int    `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID  int    `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
+// userNamePattern matches the portable names of users: lowercase letters,
+// digits, underscores and dashes, not starting with a dash or digit.
+var userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+func (u *UserConfig) validate() error {
+	if u == nil || u.Name == "" {
+		return nil
+	}
+	if !userNamePattern.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name %q: must be at most 32 lowercase letters, digits, underscores and dashes, starting with a letter or underscore", u.Name)
+	}
+	return nil
+}
+
+func (u *UserConfig) name() string {
+	if u.Name == "" {
+		return "agent"
+	}
+	return u.Name
+}
+
+// ids returns the UID and GID of the user, mapped to the host user by default.
+func (u *UserConfig) ids() (int, int) {
+	uid, gid := u.UID, u.GID
+	if uid == 0 {
+		uid = os.Getuid()
+		if uid <= 0 {
+			uid = defaultUID
+		}
+	}
+	if gid == 0 {
+		gid = os.Getgid()
+		if gid <= 0 {
+			gid = uid
+		}
+	}
+	return uid, gid
+}
+
+func (u *UserConfig) home() string {
+	return path.Join("/home", u.name())
+}
+
+// owner returns the owner of the files written in the environment, in the
+// "uid:gid" form expected by dagger, or "" for root.
+func (u *UserConfig) owner() string {
+	if u == nil {
+		return ""
+	}
+	uid, gid := u.ids()
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
+
+// setprivArgs returns the setpriv arguments switching to the user.
+func (u *UserConfig) setprivArgs() []string {
+	if u == nil {
+		return nil
+	}
+	uid, gid := u.ids()
+	return []string{"--reuid=" + strconv.Itoa(uid), "--regid=" + strconv.Itoa(gid), "--init-groups"}
+}
+
+// envArgs returns the env command setting the variables of the user.
+func (u *UserConfig) envArgs() []string {
+	if u == nil {
+		return nil
+	}
+	return []string{"env", "HOME=" + u.home(), "USER=" + u.name()}
+}
+
+// wrap wraps args to run them as the user. Switching users requires root.
+func (u *UserConfig) wrap(args []string) []string {
+	if u == nil {
+		return args
+	}
+	wrapped := append([]string{"setpriv"}, u.setprivArgs()...)
+	wrapped = append(wrapped, "--")
+	wrapped = append(wrapped, u.envArgs()...)
+	return append(wrapped, args...)
+}
+
+// withUser creates the user in container, unless an user with the same UID
+// exists, and gives it the workdir.
+func (env *Environment) withUser(container *dagger.Container) *dagger.Container {
+	u := env.User
+	uid, gid := u.ids()
+	script := fmt.Sprintf(`set -e
+grep -q '^[^:]*:[^:]*:%[2]d:' /etc/group || printf '%%s:x:%[2]d:\n' %[3]s >> /etc/group
+grep -q '^[^:]*:[^:]*:%[1]d:' /etc/passwd || printf '%%s:x:%[1]d:%[2]d::%%s:/bin/sh\n' %[3]s %[4]s >> /etc/passwd
+mkdir -p %[4]s %[5]s
+chown %[1]d:%[2]d %[4]s %[5]s
+`, uid, gid, shellQuote(u.name()), shellQuote(u.home()), shellQuote(env.Workdir))
+	return container.WithExec([]string{"sh", "-c", script})
+}
@@ -0,0 +1,38 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Builds the release archives of cu, along with the checksums.txt and
+# checksums.txt.sig cu upgrade verifies them with.
+#
+# VERSION is the version released, e.g. v0.4.2. RELEASE_SIGNING_KEY is the
+# Ed25519 private key (PEM) the checksums are signed with: its public key is
+# built into the binaries released.
+
+: "${VERSION:?set VERSION to the version released}"
+: "${RELEASE_SIGNING_KEY:?set RELEASE_SIGNING_KEY to the Ed25519 private key releases are signed with}"
+: "${PLATFORMS:=linux/amd64 linux/arm64 darwin/amd64 darwin/arm64}"
+: "${DIST:=dist}"
+
+which docker >/dev/null || ( echo "Please follow instructions to install Docker at https://docs.docker.com/get-started/get-docker/"; exit 1 )
+which openssl >/dev/null || ( echo "Please install OpenSSL 3 to sign the release"; exit 1 )
+
+# The raw 32 bytes public key ends the DER encoding.
+public_key=$(openssl pkey -in "$RELEASE_SIGNING_KEY" -pubout -outform DER | tail -c 32 | base64 | tr -d "\n")
+
+rm -rf "$DIST"
+mkdir -p "$DIST"
+for platform in $PLATFORMS; do
+    os=${platform%/*}
+    arch=${platform#*/}
+    build="$DIST/build/${os}_${arch}"
+    docker build --platform "$platform" \
+        --build-arg VERSION="$VERSION" \
+        --build-arg RELEASE_PUBLIC_KEY="$public_key" \
+        -o "$build" .
+    tar -czf "$DIST/container-use_${VERSION}_${os}_${arch}.tar.gz" -C "$build" cu
+done
+rm -rf "$DIST/build"
+
+(cd "$DIST" && sha256sum container-use_*.tar.gz > checksums.txt)
+openssl pkeyutl -sign -inkey "$RELEASE_SIGNING_KEY" -rawin -in "$DIST/checksums.txt" | base64 | tr -d "\n" > "$DIST/checksums.txt.sig"
+ls "$DIST"
@@ -0,0 +1,41 @@
+package mcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// errorHints are the actions suggested to agents for the errors with a code.
+var errorHints = map[environment.ErrorCode]string{
+	environment.CodeEnvNotFound:  "Check the environment ID with environment_list, or create the environment with environment_open.",
+	environment.CodeSetupFailed:  "Fix the failing command, or the packages and base image it needs, and call environment_update again.",
+	environment.CodeCommitFailed: "The change was made in the environment but isn't on its branch yet: it will be committed with the next change. Report the error to the user if it persists.",
+	environment.CodeImagePull:    "Check the base image exists and is public, or call environment_update with another base image.",
+	environment.CodeChecksum:     "The file was corrupted or is stale once transferred: retry the operation, and report the error to the user if it persists.",
+}
+
+// errorResult returns the result of a tool failing with err, as
+// mcp.NewToolResultErrorFromErr. Errors with a code are followed by their
+// code and the action suggested to the agent.
+func errorResult(text string, err error) *mcp.CallToolResult {
+	code := environment.Code(err)
+	if code == "" {
+		return mcp.NewToolResultErrorFromErr(text, err)
+	}
+	if text != "" {
+		text = fmt.Sprintf("%s: %v", text, err)
+	} else {
+		text = err.Error()
+	}
+	out, jsonErr := json.Marshal(struct {
+		Error environment.ErrorCode `json:"error"`
+		Hint  string                `json:"hint,omitempty"`
+	}{code, errorHints[code]})
+	if jsonErr != nil {
+		return mcp.NewToolResultError(text)
+	}
+	return mcp.NewToolResultError(fmt.Sprintf("%s\n\n%s", text, out))
+}
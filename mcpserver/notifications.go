@@ -0,0 +1,73 @@
+package mcpserver
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+var (
+	sessionEnvironmentsMu sync.Mutex
+	// sessionEnvironments maps session IDs to the IDs of the environments they used.
+	sessionEnvironments = map[string]map[string]bool{}
+)
+
+// trackEnvironment records that the session of ctx uses the environment envID,
+// so that it's notified of the changes made to it by others.
+func trackEnvironment(ctx context.Context, envID string) {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil || envID == "" {
+		return
+	}
+	if env := environmentsFromContext(ctx).Get(envID); env != nil {
+		envID = env.ID
+	}
+	sessionEnvironmentsMu.Lock()
+	defer sessionEnvironmentsMu.Unlock()
+	if sessionEnvironments[session.SessionID()] == nil {
+		sessionEnvironments[session.SessionID()] = map[string]bool{}
+	}
+	sessionEnvironments[session.SessionID()][envID] = true
+}
+
+// notifyStateChanges forwards the out-of-band changes of environments to the
+// sessions using them, as log messages, so agents don't act on stale state.
+// The session causing a change isn't notified of it.
+func notifyStateChanges(s *server.MCPServer, hooks *server.Hooks, envs environment.Environments) {
+	hooks.AddOnUnregisterSession(func(_ context.Context, session server.ClientSession) {
+		sessionEnvironmentsMu.Lock()
+		defer sessionEnvironmentsMu.Unlock()
+		delete(sessionEnvironments, session.SessionID())
+	})
+
+	envs.Subscribe(func(ctx context.Context, event environment.Event) {
+		origin := ""
+		if session := server.ClientSessionFromContext(ctx); session != nil {
+			origin = session.SessionID()
+		}
+
+		sessionEnvironmentsMu.Lock()
+		sessions := []string{}
+		for sessionID, envs := range sessionEnvironments {
+			if sessionID != origin && envs[event.Environment] {
+				sessions = append(sessions, sessionID)
+			}
+		}
+		sessionEnvironmentsMu.Unlock()
+
+		for _, sessionID := range sessions {
+			err := s.SendNotificationToSpecificClient(sessionID, "notifications/message", map[string]any{
+				"level":  mcp.LoggingLevelWarning,
+				"logger": "container-use",
+				"data":   event,
+			})
+			if err != nil {
+				slog.Debug("Failed to send state change notification", "session", sessionID, "environment.id", event.Environment, "err", err)
+			}
+		}
+	})
+}
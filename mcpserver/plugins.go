@@ -0,0 +1,68 @@
+package mcpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// pluginTools returns the tools declared by the repository at dir, see environment.PluginTool.
+func pluginTools(dir string) []*Tool {
+	definitions, err := environment.LoadPluginTools(dir)
+	if err != nil {
+		slog.Warn("Failed to load the tools of the repository", "err", err)
+		return nil
+	}
+	pluginTools := make([]*Tool, 0, len(definitions))
+	for _, definition := range definitions {
+		pluginTools = append(pluginTools, wrapTool(newPluginTool(definition)))
+	}
+	return pluginTools
+}
+
+func newPluginTool(definition environment.ToolDefinition) *Tool {
+	name := definition.Name
+	return &Tool{
+		Definition: mcp.NewToolWithRawSchema(name, definition.Description, definition.InputSchema),
+		Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			envID, err := request.RequireString("environment_id")
+			if err != nil {
+				return nil, err
+			}
+			env := environmentsFromContext(ctx).Get(envID)
+			if env == nil {
+				return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+			}
+			stdout, err := env.RunTool(ctx, request.GetString("explanation", ""), name, request.GetArguments())
+			var needsInput *environment.NeedsInputError
+			if errors.As(err, &needsInput) {
+				return needsInputResult(needsInput), nil
+			}
+			if err != nil {
+				return errorResult(fmt.Sprintf("failed to run tool %s", name), err), nil
+			}
+			return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/%s", stdout, env.Workdir, env.ID)), nil
+		},
+	}
+}
+
+// addPluginTools serves the tools declared by the repository at dir, unless
+// they're named like a built-in tool.
+func addPluginTools(s *server.MCPServer, dir string) {
+	builtin := map[string]bool{}
+	for _, t := range tools {
+		builtin[t.Definition.Name] = true
+	}
+	for _, t := range pluginTools(dir) {
+		if builtin[t.Definition.Name] {
+			slog.Warn("Skipping repository tool named like a built-in tool", "tool", t.Definition.Name)
+			continue
+		}
+		s.AddTool(t.Definition, t.Handler)
+	}
+}
@@ -0,0 +1,274 @@
+package mcpserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/mitchellh/go-homedir"
+)
+
+// readOnlyTools are the tools that never modify an environment.
+var readOnlyTools = []string{
+	"environment_file_read",
+	"environment_file_list",
+	"environment_diff",
+	"environment_compare",
+	"environment_attach",
+	"environment_provenance",
+	"environment_coverage",
+	"environment_lint",
+	"environment_remote_diff",
+	"environment_revision_diff",
+	"environment_history",
+	"environment_terminal_read",
+	"environment_run_output",
+	"environment_ports",
+	"environment_browser_navigate",
+	"environment_browser_console",
+	"environment_list",
+}
+
+// Policy restricts which tools and environments MCP clients are allowed to use.
+// Clients are identified by the identity the server authenticated them as,
+// never by the name they report: the --client flag of cu stdio, or over HTTP
+// the bearer token they send, see Tokens.
+type Policy struct {
+	// Default applies to clients without a dedicated entry. Nil allows
+	// everything, unless Clients has entries: clients without one are denied.
+	Default *ClientPolicy `json:"default,omitempty"`
+	// Clients maps client identities to their policy.
+	Clients map[string]*ClientPolicy `json:"clients,omitempty"`
+	// Tokens maps the bearer tokens HTTP clients authenticate with to their identity.
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+type ClientPolicy struct {
+	// ReadOnly restricts the client to tools that don't modify environments.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Tools the client may call (glob patterns). Empty allows all tools.
+	Tools []string `json:"tools,omitempty"`
+	// Environments the client may operate on (glob patterns matched against the environment ID or name). Empty allows all environments.
+	Environments []string `json:"environments,omitempty"`
+	// Repositories the client may create or operate on environments of (glob
+	// patterns matched against the absolute path of the source repository). Empty allows all repositories.
+	Repositories []string `json:"repositories,omitempty"`
+	// Quota limits the resources used by the client. Nil is unlimited.
+	Quota *Quota `json:"quota,omitempty"`
+
+	// deny denies everything, to clients the policy doesn't identify.
+	deny bool
+}
+
+// unidentified is the policy of the clients without an entry when the policy
+// has no default.
+var unidentified = &ClientPolicy{deny: true}
+
+// DefaultPolicyPath returns the location of the policy loaded when none is specified.
+func DefaultPolicyPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/policy.json")
+}
+
+// LoadPolicy reads a policy file. A missing file results in a nil (allow all) policy.
+func LoadPolicy(policyPath string) (*Policy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", policyPath, err)
+	}
+	return policy, nil
+}
+
+func (p *Policy) forClient(client string) *ClientPolicy {
+	if p == nil {
+		return nil
+	}
+	if cp, ok := p.Clients[client]; ok && client != "" && cp != nil {
+		return cp
+	}
+	if p.Default == nil && len(p.Clients) > 0 {
+		return unidentified
+	}
+	return p.Default
+}
+
+// identify returns the identity authenticated by token, if any.
+func (p *Policy) identify(token string) string {
+	if p == nil || token == "" {
+		return ""
+	}
+	for known, identity := range p.Tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return identity
+		}
+	}
+	return ""
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize checks whether client is allowed to call tool on the given environment.
+// env may be empty for tools that don't target an existing environment.
+func (p *Policy) Authorize(client, tool string, env ...string) error {
+	cp := p.forClient(client)
+	if cp == nil {
+		return nil
+	}
+	if cp.deny {
+		return errors.New("the client isn't identified: the policy only allows the clients it names")
+	}
+	if cp.ReadOnly && !slices.Contains(readOnlyTools, tool) {
+		return fmt.Errorf("client %q is read-only and may not call %s", client, tool)
+	}
+	if len(cp.Tools) > 0 && !matchAny(cp.Tools, tool) {
+		return fmt.Errorf("client %q is not allowed to call %s", client, tool)
+	}
+	if len(cp.Environments) > 0 && len(env) > 0 && !matchAny(cp.Environments, env...) {
+		return fmt.Errorf("client %q is not allowed to access environment %s", client, env[0])
+	}
+	return nil
+}
+
+// AuthorizeRepository checks whether client is allowed to use environments of
+// the source repository at repo.
+func (p *Policy) AuthorizeRepository(client, repo string) error {
+	cp := p.forClient(client)
+	if cp == nil {
+		return nil
+	}
+	if cp.deny {
+		return errors.New("the client isn't identified: the policy only allows the clients it names")
+	}
+	if len(cp.Repositories) == 0 {
+		return nil
+	}
+	if repo == "" {
+		return fmt.Errorf("client %q may only access some repositories, and the repository of the environment is unknown", client)
+	}
+	absRepo, err := filepath.Abs(repo)
+	if err != nil {
+		return err
+	}
+	if !matchAny(cp.Repositories, absRepo) {
+		return fmt.Errorf("client %q is not allowed to access repository %s", client, absRepo)
+	}
+	return nil
+}
+
+var (
+	clientsMu sync.Mutex
+	// clients maps session IDs to the identity reported by the client during initialization.
+	clients = map[string]mcp.Implementation{}
+)
+
+func trackClients(hooks *server.Hooks) {
+	hooks.AddAfterInitialize(func(ctx context.Context, _ any, request *mcp.InitializeRequest, _ *mcp.InitializeResult) {
+		session := server.ClientSessionFromContext(ctx)
+		if session == nil {
+			return
+		}
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		clients[session.SessionID()] = request.Params.ClientInfo
+	})
+	hooks.AddOnUnregisterSession(func(_ context.Context, session server.ClientSession) {
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		delete(clients, session.SessionID())
+	})
+}
+
+type identityKey struct{}
+
+// withIdentity returns a context carrying the identity the server
+// authenticated the client as.
+func withIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// clientFromContext returns the identity of the client issuing the current
+// request, which policies apply to, or an empty string if it isn't identified.
+func clientFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// identifyRequest authenticates the HTTP requests of clients with their bearer token, see Policy.Tokens.
+func identifyRequest(ctx context.Context, r *http.Request) context.Context {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return withIdentity(ctx, policy.identify(token))
+}
+
+// clientInfoFromContext returns the identity of the client issuing the current request.
+func clientInfoFromContext(ctx context.Context) environment.ClientInfo {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil {
+		return environment.ClientInfo{}
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	client := clients[session.SessionID()]
+	return environment.ClientInfo{
+		Name:     client.Name,
+		Version:  client.Version,
+		Session:  session.SessionID(),
+		Identity: clientFromContext(ctx),
+	}
+}
+
+// SetPolicy sets the policy applied to the clients of the server, along with
+// the calls authorized with AuthorizeCall.
+func SetPolicy(p *Policy) {
+	policy = p
+}
+
+// AuthorizeCall applies the policy and quotas of tool calls to a call made
+// over another transport, e.g. the HTTP API, by the client identity: the call
+// is checked as a call of tool with args on envs. The returned function must
+// be called once the call completes. Quota errors are *QuotaExceededError.
+func AuthorizeCall(ctx context.Context, envs environment.Environments, identity, tool string, args map[string]any) (func(), error) {
+	ctx = withEnvironments(withIdentity(ctx, identity), envs)
+	request := mcp.CallToolRequest{}
+	request.Params.Name = tool
+	request.Params.Arguments = args
+	if err := authorize(ctx, tool, request); err != nil {
+		return nil, err
+	}
+	release, quotaErr := checkQuota(ctx, tool, request)
+	if quotaErr != nil {
+		return nil, quotaErr
+	}
+	return release, nil
+}
+
+// AuthorizedEnvironments returns the environments of envs the client identity may list.
+func AuthorizedEnvironments(ctx context.Context, identity string, envs []*environment.Environment) []*environment.Environment {
+	return authorizedEnvironments(withIdentity(ctx, identity), "environment_list", envs)
+}
@@ -0,0 +1,103 @@
+package mcpserver
+
+import (
+	"testing"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := &Policy{
+		Default: &ClientPolicy{ReadOnly: true},
+		Clients: map[string]*ClientPolicy{
+			"coder": {
+				Tools:        []string{"environment_*"},
+				Environments: []string{"feature-*"},
+			},
+			"planner": {
+				Tools: []string{"environment_open", "environment_file_read"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		client  string
+		tool    string
+		envs    []string
+		wantErr bool
+	}{
+		{name: "no policy", client: "anyone", tool: "environment_run_cmd"},
+		{name: "tool glob", policy: policy, client: "coder", tool: "environment_run_cmd", envs: []string{"feature-x/fancy-mallard", "feature-x"}},
+		{name: "environment by name", policy: policy, client: "coder", tool: "environment_run_cmd", envs: []string{"abc/fancy-mallard", "feature-x"}},
+		{name: "environment not allowed", policy: policy, client: "coder", tool: "environment_run_cmd", envs: []string{"main/fancy-mallard", "main"}, wantErr: true},
+		{name: "no environment", policy: policy, client: "coder", tool: "environment_open"},
+		{name: "tool list", policy: policy, client: "planner", tool: "environment_file_read", envs: []string{"main"}},
+		{name: "tool not allowed", policy: policy, client: "planner", tool: "environment_run_cmd", wantErr: true},
+		{name: "default read-only", policy: policy, client: "reviewer", tool: "environment_diff"},
+		{name: "default read-only write", policy: policy, client: "reviewer", tool: "environment_file_write", wantErr: true},
+		{name: "unidentified client", policy: &Policy{Clients: policy.Clients}, client: "", tool: "environment_list", wantErr: true},
+		{name: "client without an entry", policy: &Policy{Clients: policy.Clients}, client: "reviewer", tool: "environment_list", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Authorize(tt.client, tt.tool, tt.envs...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authorize(%q, %q, %q) error = %v, want error %v", tt.client, tt.tool, tt.envs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyAuthorizeRepository(t *testing.T) {
+	policy := &Policy{
+		Clients: map[string]*ClientPolicy{
+			"ci":    {Repositories: []string{"/src/*"}},
+			"local": {},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		client  string
+		repo    string
+		wantErr bool
+	}{
+		{name: "allowed repository", client: "ci", repo: "/src/app"},
+		{name: "path cleaned", client: "ci", repo: "/src/other/../app"},
+		{name: "other repository", client: "ci", repo: "/home/me/app", wantErr: true},
+		{name: "nested repository", client: "ci", repo: "/src/app/vendor/lib", wantErr: true},
+		{name: "unknown repository", client: "ci", repo: "", wantErr: true},
+		{name: "unrestricted client", client: "local", repo: "/anywhere"},
+		{name: "unidentified client", client: "", repo: "/src/app", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.AuthorizeRepository(tt.client, tt.repo)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AuthorizeRepository(%q, %q) error = %v, want error %v", tt.client, tt.repo, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyIdentify(t *testing.T) {
+	policy := &Policy{Tokens: map[string]string{"s3cr3t": "coder"}}
+	tests := []struct {
+		name   string
+		policy *Policy
+		token  string
+		want   string
+	}{
+		{name: "known token", policy: policy, token: "s3cr3t", want: "coder"},
+		{name: "unknown token", policy: policy, token: "guess", want: ""},
+		{name: "no token", policy: policy, token: "", want: ""},
+		{name: "no policy", token: "s3cr3t", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.identify(tt.token); got != tt.want {
+				t.Errorf("identify(%q) = %q, want %q", tt.token, got, tt.want)
+			}
+		})
+	}
+}
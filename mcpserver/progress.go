@@ -0,0 +1,55 @@
+package mcpserver
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// progressNotifier forwards environment progress to the calling client.
+// If the client asked for progress (by sending a progress token), messages are sent
+// as progress notifications, otherwise they are sent as log messages.
+func progressNotifier(ctx context.Context, request mcp.CallToolRequest) environment.ProgressFunc {
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return nil
+	}
+
+	var token mcp.ProgressToken
+	if request.Params.Meta != nil {
+		token = request.Params.Meta.ProgressToken
+	}
+
+	var (
+		mu       sync.Mutex
+		progress int
+	)
+	return func(message string) {
+		var err error
+		if token != nil {
+			mu.Lock()
+			progress++
+			current := progress
+			mu.Unlock()
+
+			err = srv.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+				"progressToken": token,
+				"progress":      current,
+				"message":       message,
+			})
+		} else {
+			err = srv.SendNotificationToClient(ctx, "notifications/message", map[string]any{
+				"level":  mcp.LoggingLevelInfo,
+				"logger": request.Params.Name,
+				"data":   message,
+			})
+		}
+		if err != nil {
+			slog.Debug("Failed to send progress notification", "tool", request.Params.Name, "err", err)
+		}
+	}
+}
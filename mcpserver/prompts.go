@@ -0,0 +1,178 @@
+package mcpserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"gopkg.in/yaml.v3"
+)
+
+// maxPromptLog is the number of trailing characters of an environment log included in prompts.
+const maxPromptLog = 4000
+
+type Prompt struct {
+	Definition mcp.Prompt
+	Handler    server.PromptHandlerFunc
+}
+
+var prompts = []*Prompt{}
+
+func registerPrompt(prompt ...*Prompt) {
+	prompts = append(prompts, prompt...)
+}
+
+func init() {
+	registerPrompt(
+		SetupEnvironmentPrompt,
+		SummarizeDiffPrompt,
+		RecoverSetupPrompt,
+	)
+}
+
+func promptResult(description, text string) *mcp.GetPromptResult {
+	return mcp.NewGetPromptResult(description, []mcp.PromptMessage{
+		mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(text)),
+	})
+}
+
+var SetupEnvironmentPrompt = &Prompt{
+	Definition: mcp.NewPrompt("setup_environment",
+		mcp.WithPromptDescription("Set up a container-use environment for a repository, based on its files and configuration."),
+		mcp.WithArgument("source",
+			mcp.ArgumentDescription("The absolute path of the repository."),
+			mcp.RequiredArgument(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		source := request.Params.Arguments["source"]
+		if source == "" {
+			return nil, fmt.Errorf("source is required")
+		}
+
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return nil, err
+		}
+		files := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			files = append(files, name)
+		}
+
+		text := &strings.Builder{}
+		fmt.Fprintf(text, "Set up a container-use environment for the repository at %s.\n\n", source)
+		fmt.Fprintf(text, "Its top-level files are: %s\n\n", strings.Join(files, ", "))
+		cfg, err := environment.LoadRepoConfig(source)
+		if err != nil {
+			return nil, err
+		}
+		if cfg != nil {
+			out, err := yaml.Marshal(cfg)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(text, "It is configured with %s:\n\n```yaml\n%s```\n\n", environment.RepoConfigFile, out)
+		} else {
+			fmt.Fprintf(text, "It has no %s configuration file.\n\n", environment.RepoConfigFile)
+		}
+		text.WriteString(`Then:
+1. Call environment_open with the repository to create the environment.
+2. Read the build files (e.g. go.mod, package.json, pyproject.toml, Makefile, CI workflows) to find the toolchain, the dependencies and the test command.
+3. Call environment_update with a base image providing the toolchain, the system packages and the setup commands installing the dependencies, and instructions explaining how to build and test the project.
+4. Run the tests with environment_run_cmd to check the environment works, and fix it with environment_update until they do.
+`)
+		if cfg == nil {
+			fmt.Fprintf(text, "5. Suggest a %s file capturing the working setup so future environments start ready.\n", environment.RepoConfigFile)
+		}
+		return promptResult("Set up an environment for "+filepath.Base(source), text.String()), nil
+	},
+}
+
+var SummarizeDiffPrompt = &Prompt{
+	Definition: mcp.NewPrompt("summarize_environment_diff",
+		mcp.WithPromptDescription("Write a pull request description from the changes, commands and test runs of an environment."),
+		mcp.WithArgument("source",
+			mcp.ArgumentDescription("The absolute path of the repository."),
+			mcp.RequiredArgument(),
+		),
+		mcp.WithArgument("environment_id",
+			mcp.ArgumentDescription("The ID of the environment."),
+			mcp.RequiredArgument(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		source, envID := request.Params.Arguments["source"], request.Params.Arguments["environment_id"]
+		if source == "" || envID == "" {
+			return nil, fmt.Errorf("source and environment_id are required")
+		}
+		summary, err := environment.Summarize(ctx, source, envID)
+		if err != nil {
+			return nil, err
+		}
+
+		text := fmt.Sprintf(`Write a pull request description for the work done in environment %s.
+
+Open with one or two sentences saying what the change does and why, then list the notable changes and how they were tested.
+Only describe what the summary below shows: don't invent changes or test results.
+
+%s`, envID, summary.Markdown())
+		return promptResult("Summarize environment "+envID, text), nil
+	},
+}
+
+var RecoverSetupPrompt = &Prompt{
+	Definition: mcp.NewPrompt("recover_failed_setup",
+		mcp.WithPromptDescription("Diagnose and fix an environment whose setup failed, from its configuration and logs."),
+		mcp.WithArgument("environment_id",
+			mcp.ArgumentDescription("The ID of the environment."),
+			mcp.RequiredArgument(),
+		),
+		mcp.WithArgument("error",
+			mcp.ArgumentDescription("The error reported by the failed call, if any."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		envID := request.Params.Arguments["environment_id"]
+		if envID == "" {
+			return nil, fmt.Errorf("environment_id is required")
+		}
+
+		text := &strings.Builder{}
+		fmt.Fprintf(text, "The setup of environment %s failed.\n\n", envID)
+		if setupErr := request.Params.Arguments["error"]; setupErr != "" {
+			fmt.Fprintf(text, "The error was:\n\n```\n%s\n```\n\n", setupErr)
+		}
+		if env := environmentsFromContext(ctx).Get(envID); env != nil {
+			fmt.Fprintf(text, "Its current configuration is:\n\n- base image: %s\n", env.BaseImage)
+			if len(env.Packages) > 0 {
+				fmt.Fprintf(text, "- packages: %s\n", strings.Join(env.Packages, ", "))
+			}
+			for i, command := range env.SetupCommands {
+				fmt.Fprintf(text, "- setup command %d: `%s`\n", i+1, command)
+			}
+			text.WriteString("\n")
+		}
+		if logPath, err := environment.LogPath(envID); err == nil {
+			if log, err := os.ReadFile(logPath); err == nil && len(log) > 0 {
+				if len(log) > maxPromptLog {
+					log = log[len(log)-maxPromptLog:]
+				}
+				fmt.Fprintf(text, "The end of its log is:\n\n```\n%s\n```\n\n", log)
+			}
+		}
+		text.WriteString(`Find the setup command, package or base image causing the failure. Then fix it with environment_update, changing one thing at a time:
+a missing system package belongs in packages, a command failing because of a missing tool needs a base image providing it.
+Check the fix by running the failing command with environment_run_cmd before moving on.
+`)
+		return promptResult("Recover environment "+envID, text.String()), nil
+	},
+}
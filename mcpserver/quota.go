@@ -0,0 +1,160 @@
+package mcpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Quota limits the resources a client may use. Zero values are unlimited.
+type Quota struct {
+	// MaxEnvironmentsPerRepo is the number of environments the client may have open per repository.
+	MaxEnvironmentsPerRepo int `json:"max_environments_per_repo,omitempty"`
+	// MaxConcurrentRuns is the number of commands the client may run at the same time.
+	MaxConcurrentRuns int `json:"max_concurrent_runs,omitempty"`
+	// MaxDiskMB is the size, in megabytes, the workdir of an environment may
+	// grow to before the client is denied further changes to it.
+	MaxDiskMB int64 `json:"max_disk_mb,omitempty"`
+	// CallsPerMinute is the number of tools calls the client may make per minute.
+	CallsPerMinute int `json:"calls_per_minute,omitempty"`
+}
+
+// QuotaExceededError is returned when a client exceeds one of its quotas.
+type QuotaExceededError struct {
+	Client      string `json:"client"`
+	Quota       string `json:"quota"`
+	Limit       int64  `json:"limit"`
+	Current     int64  `json:"current"`
+	Environment string `json:"environment_id,omitempty"`
+	// Retryable is set when the call may succeed later without any action from the client.
+	Retryable bool `json:"retryable"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("client %q exceeded its %s quota (%d, limit %d)", e.Client, e.Quota, e.Current, e.Limit)
+}
+
+func quotaExceededResult(err *QuotaExceededError) *mcp.CallToolResult {
+	out, jsonErr := json.Marshal(struct {
+		Error string `json:"error"`
+		*QuotaExceededError
+	}{"quota_exceeded", err})
+	if jsonErr != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+	return mcp.NewToolResultError(fmt.Sprintf("%s\n\n%s", err, out))
+}
+
+var (
+	usageMu sync.Mutex
+	// runs counts the commands running for each client.
+	runs = map[string]int{}
+	// calls records the time of the tool calls of each client in the last minute.
+	calls = map[string][]time.Time{}
+)
+
+func (p *Policy) quota(client string) *Quota {
+	cp := p.forClient(client)
+	if cp == nil {
+		return nil
+	}
+	return cp.Quota
+}
+
+// checkQuota checks the call of tool against the quota of the calling client.
+// The returned function must be called once the call completes.
+func checkQuota(ctx context.Context, tool string, request mcp.CallToolRequest) (func(), *QuotaExceededError) {
+	client := clientFromContext(ctx)
+	q := policy.quota(client)
+	if q == nil {
+		return func() {}, nil
+	}
+
+	if q.CallsPerMinute > 0 {
+		if err := checkRate(client, q.CallsPerMinute); err != nil {
+			return nil, err
+		}
+	}
+
+	env := environmentsFromContext(ctx).Get(request.GetString("environment_id", ""))
+	if q.MaxEnvironmentsPerRepo > 0 {
+		repo := ""
+		switch {
+		case tool == "environment_open":
+			repo = request.GetString("source", "")
+		case tool == "environment_fork" && env != nil:
+			repo = env.Source
+		}
+		if repo != "" {
+			if current := openEnvironments(ctx, client, repo); current >= q.MaxEnvironmentsPerRepo {
+				return nil, &QuotaExceededError{Client: client, Quota: "max_environments_per_repo", Limit: int64(q.MaxEnvironmentsPerRepo), Current: int64(current)}
+			}
+		}
+	}
+
+	if q.MaxDiskMB > 0 && env != nil && !slices.Contains(readOnlyTools, tool) {
+		usage, err := env.DiskUsage(ctx)
+		if err != nil {
+			slog.Warn("Failed to check disk quota", "environment.id", env.ID, "err", err)
+		} else if usage/(1<<20) >= q.MaxDiskMB {
+			return nil, &QuotaExceededError{Client: client, Quota: "max_disk_mb", Limit: q.MaxDiskMB, Current: usage / (1 << 20), Environment: env.ID}
+		}
+	}
+
+	if q.MaxConcurrentRuns > 0 && tool == "environment_run_cmd" {
+		usageMu.Lock()
+		defer usageMu.Unlock()
+		if runs[client] >= q.MaxConcurrentRuns {
+			return nil, &QuotaExceededError{Client: client, Quota: "max_concurrent_runs", Limit: int64(q.MaxConcurrentRuns), Current: int64(runs[client]), Retryable: true}
+		}
+		runs[client]++
+		return func() {
+			usageMu.Lock()
+			defer usageMu.Unlock()
+			runs[client]--
+		}, nil
+	}
+	return func() {}, nil
+}
+
+// checkRate records a call of client, failing if it made limit calls in the last minute.
+func checkRate(client string, limit int) *QuotaExceededError {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	now := time.Now()
+	recent := slices.DeleteFunc(calls[client], func(t time.Time) bool {
+		return now.Sub(t) >= time.Minute
+	})
+	if len(recent) >= limit {
+		calls[client] = recent
+		return &QuotaExceededError{Client: client, Quota: "calls_per_minute", Limit: int64(limit), Current: int64(len(recent)), Retryable: true}
+	}
+	calls[client] = append(recent, now)
+	return nil
+}
+
+// openEnvironments returns the number of environments of repo the client
+// (an identity, see ClientInfo.Identity) operates on.
+func openEnvironments(ctx context.Context, client, repo string) int {
+	absRepo, err := filepath.Abs(repo)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, env := range environmentsFromContext(ctx).List() {
+		if envRepo, err := filepath.Abs(env.Source); err != nil || envRepo != absRepo {
+			continue
+		}
+		if client == "" || slices.Contains(env.Identities(), client) {
+			count++
+		}
+	}
+	return count
+}
@@ -3,14 +3,20 @@ package mcpserver
 import (
 	"context"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/rules"
+	"github.com/dagger/container-use/telemetry"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
@@ -56,19 +62,89 @@ type Tool struct {
 	Handler    server.ToolHandlerFunc
 }
 
-func RunStdioServer(ctx context.Context) error {
+// policy restricts the tools available to clients. Nil allows everything.
+var policy *Policy
+
+type environmentsKey struct{}
+
+// withEnvironments returns a context carrying the environments the tools operate on.
+func withEnvironments(ctx context.Context, envs environment.Environments) context.Context {
+	return context.WithValue(ctx, environmentsKey{}, envs)
+}
+
+// environmentsFromContext returns the environments the tools operate on, the
+// ones the server was started with.
+func environmentsFromContext(ctx context.Context) environment.Environments {
+	envs, _ := ctx.Value(environmentsKey{}).(environment.Environments)
+	return envs
+}
+
+// RunStdioServer serves MCP over stdin/stdout until ctx is done, operating on
+// envs. identity is the identity of the client, which the policy applies to.
+func RunStdioServer(ctx context.Context, envs environment.Environments, p *Policy, identity string) error {
+	s := newServer(envs, p)
+
+	slog.Info("starting server")
+	stdio := server.NewStdioServer(s)
+	// The stdio client is the one that started the server: its identity is
+	// set on the command line.
+	stdio.SetContextFunc(func(ctx context.Context) context.Context {
+		return withEnvironments(withIdentity(ctx, identity), envs)
+	})
+	err := stdio.Listen(ctx, os.Stdin, os.Stdout)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// RunSSEServer serves MCP over HTTP with server-sent events on addr until ctx
+// is done, operating on envs. Unlike the stdio server, it can be shared by
+// several clients, which may then collaborate in the same environments.
+func RunSSEServer(ctx context.Context, envs environment.Environments, p *Policy, addr string) error {
+	sse := server.NewSSEServer(newServer(envs, p), server.WithSSEContextFunc(func(ctx context.Context, r *http.Request) context.Context {
+		return withEnvironments(identifyRequest(ctx, r), envs)
+	}))
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("starting SSE server", "addr", addr)
+		errCh <- sse.Start(addr)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return sse.Shutdown(context.Background())
+	}
+}
+
+func newServer(envs environment.Environments, p *Policy) *server.MCPServer {
+	SetPolicy(p)
+
+	hooks := &server.Hooks{}
+	trackClients(hooks)
+
 	s := server.NewMCPServer(
 		"Dagger",
 		"1.0.0",
 		server.WithInstructions(rules.AgentRules),
+		server.WithLogging(),
+		server.WithHooks(hooks),
+		server.WithPromptCapabilities(false),
 	)
+	notifyStateChanges(s, hooks, envs)
 
 	for _, t := range tools {
 		s.AddTool(t.Definition, t.Handler)
 	}
-
-	slog.Info("starting server")
-	return server.ServeStdio(s)
+	// Tools declared by the repository the server runs in.
+	addPluginTools(s, ".")
+	for _, p := range prompts {
+		s.AddPrompt(p.Definition, p.Handler)
+	}
+	return s
 }
 
 var tools = []*Tool{}
@@ -87,32 +163,156 @@ func wrapTool(t *Tool) *Tool {
 			defer func() {
 				slog.Info("Tool call completed", "tool", t.Definition.Name, "err", rerr)
 			}()
-			return t.Handler(ctx, request)
+			telemetry.Count("tool_calls." + t.Definition.Name)
+			if err := authorize(ctx, t.Definition.Name, request); err != nil {
+				telemetry.Failure("permission")
+				return errorResult("permission denied", err), nil
+			}
+			trackEnvironment(ctx, request.GetString("environment_id", ""))
+			ctx = environment.WithProgress(ctx, progressNotifier(ctx, request))
+			ctx = environment.WithClientInfo(ctx, clientInfoFromContext(ctx))
+			// Recovered and reaped environments get their container on first
+			// use, before the quotas measure it.
+			for _, param := range []string{"environment_id", "other_environment_id", "target_environment_id"} {
+				if env := environmentsFromContext(ctx).Get(request.GetString(param, "")); env != nil {
+					if err := env.Activate(ctx); err != nil {
+						return errorResult("failed to provision environment", err), nil
+					}
+				}
+			}
+			release, quotaErr := checkQuota(ctx, t.Definition.Name, request)
+			if quotaErr != nil {
+				telemetry.Failure("quota")
+				return quotaExceededResult(quotaErr), nil
+			}
+			defer release()
+			result, err := t.Handler(ctx, request)
+			if err != nil || result != nil && result.IsError {
+				telemetry.Count("tool_errors." + t.Definition.Name)
+			}
+			return result, err
 		},
 	}
 }
 
+// authorize checks the request against the policy, using the targeted environment if any.
+func authorize(ctx context.Context, tool string, request mcp.CallToolRequest) error {
+	if policy == nil {
+		return nil
+	}
+	client := clientFromContext(ctx)
+	var envs []string
+	if envID := request.GetString("environment_id", ""); envID != "" {
+		envs = append(envs, envID)
+		if err := authorizeEnvironmentRepository(ctx, client, envID); err != nil {
+			return err
+		}
+		if env := environmentsFromContext(ctx).Get(envID); env != nil {
+			envs = append(envs, env.ID, env.Name)
+		}
+	} else if name := request.GetString("name", ""); name != "" {
+		envs = append(envs, name)
+	}
+	if source := request.GetString("source", ""); source != "" {
+		if err := policy.AuthorizeRepository(client, source); err != nil {
+			return err
+		}
+	}
+	if err := policy.Authorize(client, tool, envs...); err != nil {
+		return err
+	}
+	// Tools operating on two environments need access to both.
+	for _, param := range []string{"other_environment_id", "target_environment_id"} {
+		otherID := request.GetString(param, "")
+		if otherID == "" {
+			continue
+		}
+		others := []string{otherID}
+		if err := authorizeEnvironmentRepository(ctx, client, otherID); err != nil {
+			return err
+		}
+		if other := environmentsFromContext(ctx).Get(otherID); other != nil {
+			others = append(others, other.ID, other.Name)
+		}
+		if err := policy.Authorize(client, tool, others...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeEnvironmentRepository checks client may access the repository of
+// the environment envID. Environments this process doesn't know are denied
+// if the client is restricted to some repositories, since theirs is unknown.
+func authorizeEnvironmentRepository(ctx context.Context, client, envID string) error {
+	env := environmentsFromContext(ctx).Get(envID)
+	if env == nil {
+		return policy.AuthorizeRepository(client, "")
+	}
+	return policy.AuthorizeRepository(client, env.Source)
+}
+
+// authorizedEnvironments returns the environments of envs the client in ctx may access.
+func authorizedEnvironments(ctx context.Context, tool string, envs []*environment.Environment) []*environment.Environment {
+	if policy == nil {
+		return envs
+	}
+	client := clientFromContext(ctx)
+	return slices.DeleteFunc(envs, func(env *environment.Environment) bool {
+		return policy.Authorize(client, tool, env.ID, env.Name) != nil || policy.AuthorizeRepository(client, env.Source) != nil
+	})
+}
+
 func init() {
 	registerTool(
 		EnvironmentOpenTool,
+		EnvironmentAttachTool,
 		EnvironmentUpdateTool,
 
 		// EnvironmentListTool,
 		// EnvironmentHistoryTool,
 		// EnvironmentRevertTool,
+		EnvironmentRevertToCommitTool,
+		EnvironmentUndoTool,
+		EnvironmentStashTool,
+		EnvironmentUnstashTool,
 		// EnvironmentForkTool,
 
 		EnvironmentRunCmdTool,
-		// EnvironmentSetEnvTool,
+		EnvironmentRunOutputTool,
+		EnvironmentExposeTool,
+		EnvironmentLinkTool,
+		EnvironmentSetEnvTool,
 
 		// EnvironmentUploadTool,
 		// EnvironmentDownloadTool,
 		// EnvironmentDiffTool,
+		EnvironmentBranchDiffTool,
+		EnvironmentCompareTool,
+		EnvironmentSyncTool,
+		EnvironmentRunChecksTool,
+		EnvironmentProvenanceTool,
+		EnvironmentSBOMTool,
+		EnvironmentPublishTool,
+		EnvironmentCoverageTool,
+		EnvironmentLintTool,
+		EnvironmentArtifactsTool,
+		EnvironmentInstallTool,
+		EnvironmentTerminalTool,
+		EnvironmentTerminalReadTool,
+		EnvironmentPortsTool,
+		EnvironmentPreviewTool,
+		EnvironmentBrowserNavigateTool,
+		EnvironmentBrowserScreenshotTool,
+		EnvironmentBrowserConsoleTool,
+		EnvironmentAddServiceTool,
 
 		EnvironmentFileReadTool,
 		EnvironmentFileListTool,
 		EnvironmentFileWriteTool,
 		EnvironmentFileDeleteTool,
+		EnvironmentBeginBatchTool,
+		EnvironmentEndBatchTool,
 		// EnvironmentRevisionDiffTool,
 
 		EnvironmentCheckpointTool,
@@ -122,6 +322,7 @@ func init() {
 type EnvironmentResponse struct {
 	ID               string   `json:"id"`
 	BaseImage        string   `json:"base_image"`
+	Packages         []string `json:"packages,omitempty"`
 	SetupCommands    []string `json:"setup_commands"`
 	Instructions     string   `json:"instructions"`
 	Workdir          string   `json:"workdir"`
@@ -129,27 +330,32 @@ type EnvironmentResponse struct {
 	TrackingBranch   string   `json:"tracking_branch"`
 	CheckoutCommand  string   `json:"checkout_command_for_human"`
 	HostWorktreePath string   `json:"host_worktree_path"`
+	Clients          []string `json:"clients,omitempty"`
+	StateVersion     int64    `json:"state_version"`
 }
 
 func EnvironmentToCallResult(env *environment.Environment) (*mcp.CallToolResult, error) {
 	worktreePath, err := env.GetWorktreePath()
 	if err != nil {
-		return mcp.NewToolResultErrorFromErr("failed to get worktree", err), nil
+		return errorResult("failed to get worktree", err), nil
 	}
 	resp := &EnvironmentResponse{
 		ID:               env.ID,
 		Instructions:     env.Instructions,
 		BaseImage:        env.BaseImage,
+		Packages:         env.Packages,
 		SetupCommands:    env.SetupCommands,
 		Workdir:          env.Workdir,
 		Branch:           env.ID,
 		TrackingBranch:   fmt.Sprintf("container-use/%s", env.ID),
 		CheckoutCommand:  fmt.Sprintf("git checkout %s", env.ID),
 		HostWorktreePath: worktreePath,
+		Clients:          env.Clients(),
+		StateVersion:     env.StateVersion,
 	}
 	out, err := json.Marshal(resp)
 	if err != nil {
-		return mcp.NewToolResultErrorFromErr("failed to marshal response", err), nil
+		return errorResult("failed to marshal response", err), nil
 	}
 	return mcp.NewToolResultText(string(out)), nil
 }
@@ -183,13 +389,44 @@ DO NOT manually install toolchains inside the environment, instead explicitly ca
 			return nil, err
 		}
 		if err := validateName(name); err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid name", err), nil
+			return errorResult("invalid name", err), nil
 		}
 		// FIXME(aluzzardi): This should call `environment.Open` instead of `environment.Create` but it's currently broken
-		env, err := environment.Create(ctx, request.GetString("explanation", ""), source, name)
+		env, err := environmentsFromContext(ctx).Create(ctx, request.GetString("explanation", ""), source, name)
+		if err != nil {
+			return errorResult("failed to open environment", err), nil
+		}
+		return EnvironmentToCallResult(env)
+	},
+}
+
+var EnvironmentAttachTool = &Tool{
+	Definition: mcp.NewTool("environment_attach",
+		mcp.WithDescription(`Attach to an environment created by another client of this server or by another process, e.g. to collaborate with another agent or a human in the same workspace, or to resume work.
+Operations from all the attached clients are applied one at a time, in order, and are attributed to their client in the history.`,
+		),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this environment is being attached to."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment to attach to."),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("read_only",
+			mcp.Description("Attach in read-only mode: files, diffs and logs can be inspected but any change to the environment is rejected for the rest of the session. Defaults to false."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		// Environments created by another process are rehydrated from their persisted state.
+		env, err := environmentsFromContext(ctx).Open(ctx, envID)
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to open environment", err), nil
+			return errorResult("failed to open environment", err), nil
 		}
+		env.Attach(environment.ClientInfoFromContext(ctx), request.GetBool("read_only", false))
 		return EnvironmentToCallResult(env)
 	},
 }
@@ -215,6 +452,13 @@ var EnvironmentUpdateTool = &Tool{
 			mcp.Description("Change the base image for the environment."),
 			mcp.Required(),
 		),
+		mcp.WithString("workdir",
+			mcp.Description("The absolute path of the project in the container, for projects whose tooling hardcodes it (e.g. /app). Defaults to the current workdir."),
+		),
+		mcp.WithArray("packages",
+			mcp.Description("System packages to install with the package manager of the base image (apt, apk or dnf), e.g. [\"curl\", \"make\"]. Prefer this over installing packages in setup commands. Defaults to the current packages."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
 		mcp.WithArray("setup_commands",
 			mcp.Description("Commands that will be executed on top of the base image to set up the environment. Similar to `RUN` instructions in Dockerfiles."),
 			mcp.Required(),
@@ -233,15 +477,18 @@ Supported schemas are:
 			mcp.Required(),
 			mcp.Items(map[string]any{"type": "string"}),
 		),
+		mcp.WithNumber("state_version",
+			mcp.Description("The state_version of the environment this change is based on. If the environment changed since, the call fails and must be retried after re-reading the environment."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 		instructions, err := request.RequireString("instructions")
 		if err != nil {
@@ -260,8 +507,11 @@ Supported schemas are:
 			return nil, err
 		}
 
-		if err := env.Update(ctx, request.GetString("explanation", ""), instructions, baseImage, setupCommands, secrets); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to update environment", err), nil
+		packages := request.GetStringSlice("packages", env.Packages)
+		workdir := request.GetString("workdir", env.Workdir)
+
+		if err := env.Update(ctx, request.GetString("explanation", ""), instructions, baseImage, workdir, packages, setupCommands, secrets, int64(request.GetInt("state_version", 0))); err != nil {
+			return errorResult("failed to update environment", err), nil
 		}
 		return EnvironmentToCallResult(env)
 	},
@@ -275,7 +525,7 @@ var EnvironmentListTool = &Tool{
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		envs := environment.List()
+		envs := authorizedEnvironments(ctx, "environment_list", environmentsFromContext(ctx).List())
 		out, err := json.Marshal(envs)
 		if err != nil {
 			return nil, err
@@ -308,9 +558,9 @@ var EnvironmentForkTool = &Tool{
 			return nil, err
 		}
 
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
 		name, err := request.RequireString("name")
@@ -318,7 +568,7 @@ var EnvironmentForkTool = &Tool{
 			return nil, err
 		}
 		if err := validateName(name); err != nil {
-			return mcp.NewToolResultErrorFromErr("invalid name", err), nil
+			return errorResult("invalid name", err), nil
 		}
 
 		var version *environment.Version
@@ -328,7 +578,7 @@ var EnvironmentForkTool = &Tool{
 
 		fork, err := env.Fork(ctx, request.GetString("explanation", ""), name, version)
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to fork environment", err), nil
+			return errorResult("failed to fork environment", err), nil
 		}
 
 		return mcp.NewToolResultText("environment forked successfully into ID " + fork.ID), nil
@@ -352,9 +602,9 @@ var EnvironmentHistoryTool = &Tool{
 			return nil, err
 		}
 
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
 		history := env.History
@@ -387,9 +637,9 @@ var EnvironmentRevertTool = &Tool{
 			return nil, err
 		}
 
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
 		version, err := request.RequireInt("version")
@@ -398,16 +648,171 @@ var EnvironmentRevertTool = &Tool{
 		}
 
 		if err := env.Revert(ctx, request.GetString("explanation", ""), environment.Version(version)); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to revert environment", err), nil
+			return errorResult("failed to revert environment", err), nil
 		}
 
 		return mcp.NewToolResultText("environment reverted successfully"), nil
 	},
 }
 
+var EnvironmentRevertToCommitTool = &Tool{
+	Definition: mcp.NewTool("environment_revert_to_commit",
+		mcp.WithDescription("Reset the files of the environment to a previous commit of its branch, e.g. to go back to before the tests broke. The rollback is recorded as a new commit."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the environment is being reverted."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("ref",
+			mcp.Description("The commit to revert to, as a hash or a relative reference such as HEAD~2."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		ref, err := request.RequireString("ref")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.RevertToCommit(ctx, request.GetString("explanation", ""), ref); err != nil {
+			return errorResult("failed to revert environment", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("environment reverted to %s", ref)), nil
+	},
+}
+
+var EnvironmentUndoTool = &Tool{
+	Definition: mcp.NewTool("environment_undo",
+		mcp.WithDescription("Undo the most recent change to the environment (file write, file delete, command run...). The undo is recorded as a new commit."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the last change is being undone."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		if err := env.Undo(ctx, request.GetString("explanation", "")); err != nil {
+			return errorResult("failed to undo", err), nil
+		}
+		return mcp.NewToolResultText("last change undone"), nil
+	},
+}
+
+var EnvironmentStashTool = &Tool{
+	Definition: mcp.NewTool("environment_stash",
+		mcp.WithDescription("Set aside the changes made to the environment under a name, e.g. to put a half-working idea away and try something else. The files go back to their state when the environment was created (or at the given commit), without adding to the history of the environment. Use `environment_unstash` to bring the changes back."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these changes are being set aside."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("name",
+			mcp.Description("The name of the stash, e.g. \"caching-approach\"."),
+			mcp.Required(),
+		),
+		mcp.WithString("since",
+			mcp.Description("Only set aside the changes made after this commit of the environment branch. Defaults to the point where the environment was created."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		name, err := request.RequireString("name")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.Stash(ctx, request.GetString("explanation", ""), name, request.GetString("since", "")); err != nil {
+			return errorResult("failed to stash changes", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("changes stashed as %q", name)), nil
+	},
+}
+
+var EnvironmentUnstashTool = &Tool{
+	Definition: mcp.NewTool("environment_unstash",
+		mcp.WithDescription("Bring back changes set aside with `environment_stash`, on top of the current state of the environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these changes are being brought back."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("name",
+			mcp.Description("The name of the stash."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		name, err := request.RequireString("name")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.Unstash(ctx, request.GetString("explanation", ""), name); err != nil {
+			if stashes, listErr := env.Stashes(ctx); listErr == nil {
+				return errorResult(fmt.Sprintf("failed to unstash changes (available stashes: %s)", strings.Join(stashes, ", ")), err), nil
+			}
+			return errorResult("failed to unstash changes", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("stash %q applied", name)), nil
+	},
+}
+
+// needsInputResult reports a command stopped because it waited for interactive input.
+func needsInputResult(err *environment.NeedsInputError) *mcp.CallToolResult {
+	out, jsonErr := json.Marshal(struct {
+		Error string `json:"error"`
+		*environment.NeedsInputError
+	}{"needs_input", err})
+	if jsonErr != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+	return mcp.NewToolResultError(fmt.Sprintf("%s\n\n%s", err, out))
+}
+
 var EnvironmentRunCmdTool = &Tool{
 	Definition: mcp.NewTool("environment_run_cmd",
-		mcp.WithDescription("Run a command on behalf of the user in the terminal."),
+		mcp.WithDescription("Run a command on behalf of the user in the terminal. "+
+			"Long outputs are truncated in the middle: read the truncated part with environment_run_output, or filter the output (e.g. with grep or tail) instead."),
 		mcp.WithString("explanation",
 			mcp.Description("One sentence explanation for why this command is being run."),
 		),
@@ -440,9 +845,9 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 		command := request.GetString("command", "")
 		shell := request.GetString("shell", "sh")
@@ -457,7 +862,7 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 			}
 			endpoints, err := env.RunBackground(ctx, request.GetString("explanation", ""), command, shell, ports, request.GetBool("use_entrypoint", false))
 			if err != nil {
-				return mcp.NewToolResultErrorFromErr("failed to run command", err), nil
+				return errorResult("failed to run command", err), nil
 			}
 
 			out, err := json.Marshal(endpoints)
@@ -474,26 +879,36 @@ Background commands are unaffected by filesystem and any other kind of changes.
 		}
 
 		stdout, err := env.Run(ctx, request.GetString("explanation", ""), command, shell, request.GetBool("use_entrypoint", false))
+		var needsInput *environment.NeedsInputError
+		if errors.As(err, &needsInput) {
+			return needsInputResult(needsInput), nil
+		}
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to run command", err), nil
+			return errorResult("failed to run command", err), nil
 		}
 		return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/%s", stdout, env.Workdir, env.ID)), nil
 	},
 }
 
-var EnvironmentSetEnvTool = &Tool{
-	Definition: mcp.NewTool("environment_set_env",
-		mcp.WithDescription("Set environment variables for an environment."),
+var EnvironmentRunOutputTool = &Tool{
+	Definition: mcp.NewTool("environment_run_output",
+		mcp.WithDescription("Read the full output of a command whose output environment_run_cmd truncated."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why these environment variables are being set."),
+			mcp.Description("One sentence explanation for why this output is being read."),
 		),
 		mcp.WithString("environment_id",
-			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Description("The ID of the environment the command ran in."),
 			mcp.Required(),
 		),
-		mcp.WithArray("envs",
-			mcp.Description("The environment variables to set."),
-			mcp.Items(map[string]any{"type": "string"}),
+		mcp.WithString("output_id",
+			mcp.Description("The output ID given in the truncation marker of the output."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("offset",
+			mcp.Description("The byte offset to read from (default: 0)."),
+		),
+		mcp.WithNumber("limit",
+			mcp.Description("The number of bytes to read (default: the output limit of the environment)."),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -501,38 +916,47 @@ var EnvironmentSetEnvTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-		envs, err := request.RequireStringSlice("envs")
+		outputID, err := request.RequireString("output_id")
 		if err != nil {
 			return nil, err
 		}
-		if err := env.SetEnv(ctx, request.GetString("explanation", ""), envs); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to set environment variables", err), nil
+		offset := request.GetInt("offset", 0)
+		output, size, err := env.CommandOutput(outputID, offset, request.GetInt("limit", 0))
+		if err != nil {
+			return errorResult("failed to read output", err), nil
 		}
-		return mcp.NewToolResultText("environment variables set successfully"), nil
+		return mcp.NewToolResultText(fmt.Sprintf("[bytes %d-%d of %d]\n%s", offset, offset+len(output), size, output)), nil
 	},
 }
 
-var EnvironmentUploadTool = &Tool{
-	Definition: mcp.NewTool("environment_upload",
-		mcp.WithDescription("Upload files to an environment."),
+var EnvironmentExposeTool = &Tool{
+	Definition: mcp.NewTool("environment_expose",
+		mcp.WithDescription("Start a long running command (e.g. an API server) as a named service that other environments can reach through environment_link."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this file is being uploaded."),
+			mcp.Description("One sentence explanation for why this service is being exposed."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("source",
-			mcp.Description("The source directory to be uploaded to the environment. This can be a local folder (e.g. file://) or a URL to a git repository (e.g. https://github.com/user/repo.git, git@github.com:user/repo.git)"),
+		mcp.WithString("name",
+			mcp.Description("Name of the service, used by other environments to link to it."),
 			mcp.Required(),
 		),
-		mcp.WithString("target",
-			mcp.Description("The target destination in the environment where to upload files."),
+		mcp.WithString("command",
+			mcp.Description("The command starting the service. If empty, the environment's default command is used."),
+		),
+		mcp.WithString("shell",
+			mcp.Description("The shell that will be interpreting this command (default: sh)"),
+		),
+		mcp.WithArray("ports",
+			mcp.Description("Ports the service listens on."),
 			mcp.Required(),
+			mcp.Items(map[string]any{"type": "number"}),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -540,91 +964,111 @@ var EnvironmentUploadTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		source, err := request.RequireString("source")
+		name, err := request.RequireString("name")
 		if err != nil {
 			return nil, err
 		}
-		target, err := request.RequireString("target")
-		if err != nil {
-			return nil, err
+		if err := validateName(name); err != nil {
+			return errorResult("invalid name", err), nil
 		}
-
-		if err := env.Upload(ctx, request.GetString("explanation", ""), source, target); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to upload files", err), nil
+		ports := []int{}
+		if portList, ok := request.GetArguments()["ports"].([]any); ok {
+			for _, port := range portList {
+				ports = append(ports, int(port.(float64)))
+			}
 		}
 
-		return mcp.NewToolResultText("files uploaded successfully"), nil
+		endpoints, err := env.Expose(ctx, request.GetString("explanation", ""), name, request.GetString("command", ""), request.GetString("shell", "sh"), ports)
+		if err != nil {
+			return errorResult("failed to expose service", err), nil
+		}
+		out, err := json.Marshal(endpoints)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Service %s started. Endpoints are %s\n\nOther environments can reach it by calling environment_link with environment %s and service %s.", name, string(out), env.ID, name)), nil
 	},
 }
 
-var EnvironmentDownloadTool = &Tool{
-	Definition: mcp.NewTool("environment_download",
-		mcp.WithDescription("Download files from an environment to the local filesystem."),
+var EnvironmentLinkTool = &Tool{
+	Definition: mcp.NewTool("environment_link",
+		mcp.WithDescription("Make a service exposed by another environment reachable from this environment under a hostname."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this file is being downloaded."),
+			mcp.Description("One sentence explanation for why these environments are being linked."),
 		),
 		mcp.WithString("environment_id",
-			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Description("The ID of the environment that needs to reach the service."),
 			mcp.Required(),
 		),
-		mcp.WithString("source",
-			mcp.Description("The source directory to be downloaded from the environment."),
+		mcp.WithString("target_environment_id",
+			mcp.Description("The ID of the environment exposing the service."),
 			mcp.Required(),
 		),
-		mcp.WithString("target",
-			mcp.Description("The target destination on the local filesystem where to download files."),
+		mcp.WithString("service",
+			mcp.Description("Name of the service exposed with environment_expose."),
 			mcp.Required(),
 		),
+		mcp.WithString("alias",
+			mcp.Description("Hostname under which the service will be reachable. Defaults to the service name."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		source, err := request.RequireString("source")
+		targetID, err := request.RequireString("target_environment_id")
 		if err != nil {
 			return nil, err
 		}
-		target, err := request.RequireString("target")
+		target := environmentsFromContext(ctx).Get(targetID)
+		if target == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: targetID}), nil
+		}
+		service, err := request.RequireString("service")
 		if err != nil {
-			return nil, errors.New("target must be a string")
+			return nil, err
 		}
-
-		if err := env.Download(ctx, source, target); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to download files", err), nil
+		alias := request.GetString("alias", service)
+		// Linking reaches into the services of the target, so the client must
+		// be allowed to manage them.
+		if policy != nil {
+			if err := policy.Authorize(clientFromContext(ctx), "environment_expose", target.ID, target.Name); err != nil {
+				return errorResult("not allowed to link to the services of "+target.ID, err), nil
+			}
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("files downloaded successfully to %s", target)), nil
+		if err := env.Link(ctx, request.GetString("explanation", ""), alias, target, service); err != nil {
+			return errorResult("failed to link environments", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("service %s of %s is reachable from %s at hostname %s", service, target.ID, env.ID, alias)), nil
 	},
 }
 
-var EnvironmentDiffTool = &Tool{
-	Definition: mcp.NewTool("environment_remote_diff",
-		mcp.WithDescription("Diff files between an environment and the local filesystem or git repository."),
+var EnvironmentSetEnvTool = &Tool{
+	Definition: mcp.NewTool("environment_set_env",
+		mcp.WithDescription("Set environment variables for an environment. Variables are persisted and survive environment updates."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this diff is being run."),
+			mcp.Description("One sentence explanation for why these environment variables are being set."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("source",
-			mcp.Description("The source directory to be compared. This can be a local folder (e.g. file://) or a URL to a git repository (e.g. https://github.com/user/repo.git, git@github.com:user/repo.git)"),
-			mcp.Required(),
+		mcp.WithArray("envs",
+			mcp.Description("The environment variables to set, in KEY=VALUE format. VALUE can reference secrets of the environment and other variables, e.g. DATABASE_URL=postgres://app:${secret:DB_PASS}@db:5432/app or PATH=/opt/bin:${PATH}. Secrets are never exposed."),
+			mcp.Items(map[string]any{"type": "string"}),
 		),
-		mcp.WithString("target",
-			mcp.Description("The target destination on the environment filesystem where to compare against."),
-			mcp.Required(),
+		mcp.WithNumber("state_version",
+			mcp.Description("The state_version of the environment this change is based on. If the environment changed since, the call fails and must be retried after re-reading the environment."),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -632,51 +1076,896 @@ var EnvironmentDiffTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		source, err := request.RequireString("source")
+		envs, err := request.RequireStringSlice("envs")
 		if err != nil {
 			return nil, err
 		}
-		target, err := request.RequireString("target")
-		if err != nil {
-			return nil, errors.New("target must be a string")
+		if err := env.SetEnv(ctx, request.GetString("explanation", ""), envs, int64(request.GetInt("state_version", 0))); err != nil {
+			return errorResult("failed to set environment variables", err), nil
 		}
+		return mcp.NewToolResultText(fmt.Sprintf("environment variables set successfully (state_version %d)", env.StateVersion)), nil
+	},
+}
 
-		diff, err := env.RemoteDiff(ctx, source, target)
+var EnvironmentUploadTool = &Tool{
+	Definition: mcp.NewTool("environment_upload",
+		mcp.WithDescription("Upload files to an environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this file is being uploaded."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("source",
+			mcp.Description("The source directory to be uploaded to the environment. This can be a local folder (e.g. file://) or a URL to a git repository (e.g. https://github.com/user/repo.git, git@github.com:user/repo.git)"),
+			mcp.Required(),
+		),
+		mcp.WithString("target",
+			mcp.Description("The target destination in the environment where to upload files."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		source, err := request.RequireString("source")
+		if err != nil {
+			return nil, err
+		}
+		target, err := request.RequireString("target")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.Upload(ctx, request.GetString("explanation", ""), source, target); err != nil {
+			return errorResult("failed to upload files", err), nil
+		}
+
+		return mcp.NewToolResultText("files uploaded successfully"), nil
+	},
+}
+
+var EnvironmentDownloadTool = &Tool{
+	Definition: mcp.NewTool("environment_download",
+		mcp.WithDescription("Download files from an environment to the local filesystem."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this file is being downloaded."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("source",
+			mcp.Description("The source directory to be downloaded from the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("target",
+			mcp.Description("The target destination on the local filesystem where to download files."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		source, err := request.RequireString("source")
+		if err != nil {
+			return nil, err
+		}
+		target, err := request.RequireString("target")
+		if err != nil {
+			return nil, errors.New("target must be a string")
+		}
+
+		if err := env.Download(ctx, source, target); err != nil {
+			return errorResult("failed to download files", err), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("files downloaded successfully to %s", target)), nil
+	},
+}
+
+var EnvironmentDiffTool = &Tool{
+	Definition: mcp.NewTool("environment_remote_diff",
+		mcp.WithDescription("Diff files between an environment and the local filesystem or git repository."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this diff is being run."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("source",
+			mcp.Description("The source directory to be compared. This can be a local folder (e.g. file://) or a URL to a git repository (e.g. https://github.com/user/repo.git, git@github.com:user/repo.git)"),
+			mcp.Required(),
+		),
+		mcp.WithString("target",
+			mcp.Description("The target destination on the environment filesystem where to compare against."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		source, err := request.RequireString("source")
+		if err != nil {
+			return nil, err
+		}
+		target, err := request.RequireString("target")
+		if err != nil {
+			return nil, errors.New("target must be a string")
+		}
+
+		diff, err := env.RemoteDiff(ctx, source, target)
+		if err != nil {
+			return errorResult("failed to diff", err), nil
+		}
+
+		return mcp.NewToolResultText(diff), nil
+	},
+}
+
+var EnvironmentBranchDiffTool = &Tool{
+	Definition: mcp.NewTool("environment_diff",
+		mcp.WithDescription("Summarize the changes made in an environment compared to the source branch: files changed, additions and deletions, and optionally the full patch."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this diff is being computed."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("include_patch",
+			mcp.Description("Whether to include the full patch text. Defaults to false."),
+		),
+		mcp.WithArray("paths",
+			mcp.Description("Restrict the diff to these paths, relative to the repository root."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		diff, err := env.Diff(ctx, environment.DiffOpts{
+			Patch: request.GetBool("include_patch", false),
+			Paths: request.GetStringSlice("paths", nil),
+		})
+		if err != nil {
+			return errorResult("failed to diff", err), nil
+		}
+
+		out, err := json.Marshal(diff)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentCompareTool = &Tool{
+	Definition: mcp.NewTool("environment_compare",
+		mcp.WithDescription("Compare two environments created from the same repository, e.g. two forks trying different approaches: files changed between them, and differences in base image, environment variables, packages and setup commands."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these environments are being compared."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the first environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("other_environment_id",
+			mcp.Description("The ID of the environment to compare with."),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("include_patch",
+			mcp.Description("Whether to include the full patch text. Defaults to false."),
+		),
+		mcp.WithArray("paths",
+			mcp.Description("Restrict the file comparison to these paths, relative to the repository root."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		otherID, err := request.RequireString("other_environment_id")
+		if err != nil {
+			return nil, err
+		}
+		other := environmentsFromContext(ctx).Get(otherID)
+		if other == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: otherID}), nil
+		}
+
+		diff, err := environment.DiffEnvironments(ctx, env, other, environment.DiffOpts{
+			Patch: request.GetBool("include_patch", false),
+			Paths: request.GetStringSlice("paths", nil),
+		})
+		if err != nil {
+			return errorResult("failed to compare environments", err), nil
+		}
+
+		out, err := json.Marshal(diff)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentSyncTool = &Tool{
+	Definition: mcp.NewTool("environment_sync",
+		mcp.WithDescription("Bring the latest changes of the source branch into the environment, by merging it (or rebasing onto it). The environment is rebuilt if its configuration changed. On conflicts nothing is changed and the conflicting files are reported."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the environment is being synced."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("rebase",
+			mcp.Description("Rebase the environment's commits onto the source branch instead of merging. Defaults to false."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		result, err := env.SyncWithSource(ctx, request.GetString("explanation", ""), environment.SyncOpts{
+			Rebase: request.GetBool("rebase", false),
+		})
+		if err != nil {
+			return errorResult("failed to sync environment", err), nil
+		}
+
+		out, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Conflicts) > 0 {
+			return mcp.NewToolResultError(fmt.Sprintf("sync aborted because of conflicts, the environment is unchanged: %s", out)), nil
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentRunChecksTool = &Tool{
+	Definition: mcp.NewTool("environment_run_checks",
+		mcp.WithDescription("Run the checks defined by the repository's CI configuration (GitHub Actions workflow jobs, package.json scripts, Makefile targets) inside the environment, the way CI does, and report the result of each check. Checks don't modify the environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the checks are being run."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithArray("checks",
+			mcp.Description("Names of the checks to run. Defaults to all the checks."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithBoolean("list_only",
+			mcp.Description("Only list the available checks without running them. Defaults to false."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		var result any
+		if request.GetBool("list_only", false) {
+			result, err = env.CIChecks()
+		} else {
+			result, err = env.RunChecks(ctx, request.GetStringSlice("checks", nil))
+		}
+		if err != nil {
+			return errorResult("failed to run checks", err), nil
+		}
+
+		out, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentProvenanceTool = &Tool{
+	Definition: mcp.NewTool("environment_provenance",
+		mcp.WithDescription("Generate a provenance report of the environment (source commit, base image digest, packages, setup commands, commands run and resulting tree), signed with the repository's commit signing key if configured. Suitable for attaching to a pull request."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the provenance report is being generated."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		provenance, err := env.Provenance(ctx)
+		if err != nil {
+			return errorResult("failed to generate provenance", err), nil
+		}
+		out, err := json.Marshal(provenance)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentSBOMTool = &Tool{
+	Definition: mcp.NewTool("environment_sbom",
+		mcp.WithDescription("Generate a software bill of materials (SBOM) of the environment container: base image and installed packages. The SBOM is also stored in the git notes of the environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the SBOM is being generated."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("format",
+			mcp.Description("The SBOM format. Defaults to spdx-json."),
+			mcp.Enum(environment.SBOMFormats...),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		sbom, err := env.SBOM(ctx, request.GetString("format", ""))
+		if err != nil {
+			return errorResult("failed to generate SBOM", err), nil
+		}
+		return mcp.NewToolResultText(sbom), nil
+	},
+}
+
+var EnvironmentPublishTool = &Tool{
+	Definition: mcp.NewTool("environment_publish",
+		mcp.WithDescription("Publish the environment container, with its setup applied, as an OCI image to a registry so it can be reused as a base image. Returns the pushed image reference with its digest."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the environment is being published."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("ref",
+			mcp.Description("The image reference to push to, e.g. ghcr.io/org/dev-env:latest."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		ref, err := request.RequireString("ref")
+		if err != nil {
+			return nil, err
+		}
+
+		image, err := env.Publish(ctx, request.GetString("explanation", ""), ref)
+		if err != nil {
+			return errorResult("failed to publish environment", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Published %s (digest %s)", image.Ref, image.Digest)), nil
+	},
+}
+
+var EnvironmentCoverageTool = &Tool{
+	Definition: mcp.NewTool("environment_coverage",
+		mcp.WithDescription("Show the test coverage trend of the environment and the coverage delta between two versions, per file. Coverage is collected from lcov, Cobertura and Go cover profile reports after each test run."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the coverage is being checked."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("from_version",
+			mcp.Description("The version to compare from. Defaults to the previous version with coverage."),
+		),
+		mcp.WithNumber("to_version",
+			mcp.Description("The version to compare to. Defaults to the latest version with coverage."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		trend := env.CoverageTrend()
+		if len(trend) == 0 {
+			return mcp.NewToolResultError("no coverage recorded: run the tests with coverage enabled first"), nil
+		}
+		result := struct {
+			Trend []environment.CoveragePoint `json:"trend"`
+			Delta *environment.CoverageDelta  `json:"delta,omitempty"`
+		}{Trend: trend}
+		if len(trend) > 1 || request.GetInt("from_version", 0) != 0 {
+			result.Delta, err = env.CompareCoverage(
+				environment.Version(request.GetInt("from_version", 0)),
+				environment.Version(request.GetInt("to_version", 0)),
+			)
+			if err != nil {
+				return errorResult("failed to compare coverage", err), nil
+			}
+		}
+
+		out, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentLintTool = &Tool{
+	Definition: mcp.NewTool("environment_lint",
+		mcp.WithDescription("Run linters in the environment and return their diagnostics as structured file/line/severity records. Runs the linters configured in the repository (eslint, ruff, golangci-lint) unless some are given. Linting does not change the environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the linters are being run."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithArray("linters",
+			mcp.Description("The linters to run. Defaults to the linters configured for the repository."),
+			mcp.Items(map[string]any{"type": "string", "enum": environment.Linters()}),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		results, err := env.RunLinters(ctx, request.GetStringSlice("linters", nil))
+		if err != nil {
+			return errorResult("failed to run linters", err), nil
+		}
+		out, err := json.Marshal(results)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentArtifactsTool = &Tool{
+	Definition: mcp.NewTool("environment_artifacts",
+		mcp.WithDescription("Copy build outputs (binaries, packages, dist directories) from the environment to the host, without committing them to git."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the artifacts are being collected."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithArray("globs",
+			mcp.Description("Glob patterns of the artifacts, relative to the workdir, e.g. [\"dist/\", \"*.whl\"]. Defaults to common build output directories."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("target",
+			mcp.Description("The path of the host directory to copy the artifacts to, or of a .tar.gz archive to create, relative to the artifacts directory of the environment, e.g. \"release\" or \"app.tar.gz\"."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		target, err := request.RequireString("target")
+		if err != nil {
+			return nil, err
+		}
+
+		files, err := env.Artifacts(ctx, request.GetStringSlice("globs", nil), target)
+		if err != nil {
+			return errorResult("failed to collect artifacts", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Copied %d artifacts to %s:\n%s", len(files), target, strings.Join(files, "\n"))), nil
+	},
+}
+
+var EnvironmentInstallTool = &Tool{
+	Definition: mcp.NewTool("environment_install",
+		mcp.WithDescription("Install packages in the environment and persist them so they survive rebuilds. Prefer this over running install commands with environment_run_cmd, whose effects are lost when the environment is updated."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these packages are being installed."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("manager",
+			mcp.Description("The package manager: system (the one of the base image), apt, apk, dnf, pip, npm (global install) or go (go install)."),
+			mcp.Enum("system", "apt", "apk", "dnf", "pip", "npm", "go"),
+			mcp.Required(),
+		),
+		mcp.WithArray("packages",
+			mcp.Description("The packages to install, e.g. [\"curl\"], [\"requests==2.32.3\"] or [\"golang.org/x/tools/cmd/goimports@latest\"]."),
+			mcp.Items(map[string]any{"type": "string"}),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		manager, err := request.RequireString("manager")
+		if err != nil {
+			return nil, err
+		}
+		packages, err := request.RequireStringSlice("packages")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.InstallPackages(ctx, request.GetString("explanation", ""), manager, packages); err != nil {
+			return errorResult("failed to install packages", err), nil
+		}
+		return EnvironmentToCallResult(env)
+	},
+}
+
+var EnvironmentFileReadTool = &Tool{
+	Definition: mcp.NewTool("environment_file_read",
+		mcp.WithDescription("Read the contents of a file, specifying a line range or the entire file."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this file is being read."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("target_file",
+			mcp.Description("Path of the file to read, absolute or relative to the workdir"),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("should_read_entire_file",
+			mcp.Description("Whether to read the entire file. Defaults to false."),
+		),
+		mcp.WithNumber("start_line_one_indexed",
+			mcp.Description("The one-indexed line number to start reading from (inclusive)."),
+		),
+		mcp.WithNumber("end_line_one_indexed_inclusive",
+			mcp.Description("The one-indexed line number to end reading at (inclusive)."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		targetFile, err := request.RequireString("target_file")
+		if err != nil {
+			return nil, err
+		}
+		shouldReadEntireFile := request.GetBool("should_read_entire_file", false)
+		startLineOneIndexed := request.GetInt("start_line_one_indexed", 0)
+		endLineOneIndexedInclusive := request.GetInt("end_line_one_indexed_inclusive", 0)
+
+		fileContents, err := env.FileRead(ctx, targetFile, shouldReadEntireFile, startLineOneIndexed, endLineOneIndexedInclusive)
+		if err != nil {
+			return errorResult("failed to read file", err), nil
+		}
+
+		return mcp.NewToolResultText(fileContents), nil
+	},
+}
+
+var EnvironmentFileListTool = &Tool{
+	Definition: mcp.NewTool("environment_file_list",
+		mcp.WithDescription("List the contents of a directory"),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this directory is being listed."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("path",
+			mcp.Description("Path of the directory to list contents of, absolute or relative to the workdir"),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		path, err := request.RequireString("path")
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := env.FileList(ctx, path)
+		if err != nil {
+			return errorResult("failed to list directory", err), nil
+		}
+
+		return mcp.NewToolResultText(out), nil
+	},
+}
+
+var EnvironmentFileWriteTool = &Tool{
+	Definition: mcp.NewTool("environment_file_write",
+		mcp.WithDescription("Write the contents of a file."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this file is being written."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("target_file",
+			mcp.Description("Path of the file to write, absolute or relative to the workdir."),
+			mcp.Required(),
+		),
+		mcp.WithString("contents",
+			mcp.Description("Full text content of the file you want to write."),
+			mcp.Required(),
+		),
+		mcp.WithString("mode",
+			mcp.Description("Octal permissions of the file, e.g. 755 for scripts or 600 for files with credentials. Defaults to the permissions of the file replaced, or 644 for new files."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		targetFile, err := request.RequireString("target_file")
+		if err != nil {
+			return nil, err
+		}
+		contents, err := request.RequireString("contents")
+		if err != nil {
+			return nil, err
+		}
+
+		var mode os.FileMode
+		if m := request.GetString("mode", ""); m != "" {
+			perm, err := strconv.ParseUint(m, 8, 32)
+			if err != nil || perm > 0777 {
+				return mcp.NewToolResultError(fmt.Sprintf("invalid mode %q: must be octal permissions, e.g. 755", m)), nil
+			}
+			// 0 means the mode is unset, so a file without any permission can't be written.
+			if perm == 0 {
+				return mcp.NewToolResultError(fmt.Sprintf("invalid mode %q: the file must have some permissions, e.g. 600", m)), nil
+			}
+			mode = os.FileMode(perm)
+		}
+
+		if err := env.FileWrite(ctx, request.GetString("explanation", ""), targetFile, contents, mode); err != nil {
+			return errorResult("failed to write file", err), nil
+		}
+		if env.Batching() {
+			return mcp.NewToolResultText(fmt.Sprintf("file %s written successfully, changes will be pushed to container-use/%s with the next ones", targetFile, env.ID)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("file %s written successfully, changes pushed to container-use/%s", targetFile, env.ID)), nil
+	},
+}
+
+var EnvironmentFileDeleteTool = &Tool{
+	Definition: mcp.NewTool("environment_file_delete",
+		mcp.WithDescription("Deletes a file at the specified path."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this file is being deleted."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("target_file",
+			mcp.Description("Path of the file to delete, absolute or relative to the workdir."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		targetFile, err := request.RequireString("target_file")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.FileDelete(ctx, request.GetString("explanation", ""), targetFile); err != nil {
+			return errorResult("failed to delete file", err), nil
+		}
+		if env.Batching() {
+			return mcp.NewToolResultText(fmt.Sprintf("file %s deleted successfully, changes will be pushed to container-use/%s with the next ones", targetFile, env.ID)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("file %s deleted successfully, changes pushed to container-use/%s", targetFile, env.ID)), nil
+	},
+}
+
+var EnvironmentBeginBatchTool = &Tool{
+	Definition: mcp.NewTool("environment_begin_batch",
+		mcp.WithDescription("Start a batch of file writes and deletes, committed together by environment_end_batch instead of one by one. Use it before writing many files at once."),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to diff", err), nil
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
-		return mcp.NewToolResultText(diff), nil
+		if err := env.BeginBatch(ctx); err != nil {
+			return errorResult("failed to begin batch", err), nil
+		}
+		return mcp.NewToolResultText("batch started, call environment_end_batch once the files are written"), nil
 	},
 }
 
-var EnvironmentFileReadTool = &Tool{
-	Definition: mcp.NewTool("environment_file_read",
-		mcp.WithDescription("Read the contents of a file, specifying a line range or the entire file."),
+var EnvironmentEndBatchTool = &Tool{
+	Definition: mcp.NewTool("environment_end_batch",
+		mcp.WithDescription("End the batch started by environment_begin_batch, committing its file writes and deletes together."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this file is being read."),
+			mcp.Description("One sentence explanation for why the files of the batch were changed."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("target_file",
-			mcp.Description("Path of the file to read, absolute or relative to the workdir"),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		if err := env.EndBatch(ctx, request.GetString("explanation", "")); err != nil {
+			return errorResult("failed to end batch", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("batch ended, changes pushed to container-use/%s", env.ID)), nil
+	},
+}
+
+var EnvironmentRevisionDiffTool = &Tool{
+	Definition: mcp.NewTool("environment_revision_diff",
+		mcp.WithDescription("Diff files between multiple revisions of an environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this diff is being run."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithBoolean("should_read_entire_file",
-			mcp.Description("Whether to read the entire file. Defaults to false."),
+		mcp.WithString("path",
+			mcp.Description("The path within the environment to be diffed. Defaults to workdir."),
 		),
-		mcp.WithNumber("start_line_one_indexed",
-			mcp.Description("The one-indexed line number to start reading from (inclusive)."),
+		mcp.WithNumber("from_version",
+			mcp.Description("Compute the diff starting from this version"),
+			mcp.Required(),
 		),
-		mcp.WithNumber("end_line_one_indexed_inclusive",
-			mcp.Description("The one-indexed line number to end reading at (inclusive)."),
+		mcp.WithNumber("to_version",
+			mcp.Description("Compute the diff ending at this version. Defaults to latest version."),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -684,40 +1973,39 @@ var EnvironmentFileReadTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
-		targetFile, err := request.RequireString("target_file")
+		path := request.GetString("path", "")
+		fromVersion, err := request.RequireInt("from_version")
 		if err != nil {
 			return nil, err
 		}
-		shouldReadEntireFile := request.GetBool("should_read_entire_file", false)
-		startLineOneIndexed := request.GetInt("start_line_one_indexed", 0)
-		endLineOneIndexedInclusive := request.GetInt("end_line_one_indexed_inclusive", 0)
+		toVersion := request.GetInt("to_version", int(env.History.LatestVersion()))
 
-		fileContents, err := env.FileRead(ctx, targetFile, shouldReadEntireFile, startLineOneIndexed, endLineOneIndexedInclusive)
+		diff, err := env.RevisionDiff(ctx, path, environment.Version(fromVersion), environment.Version(toVersion))
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to read file", err), nil
+			return errorResult("failed to diff", err), nil
 		}
 
-		return mcp.NewToolResultText(fileContents), nil
+		return mcp.NewToolResultText(diff), nil
 	},
 }
 
-var EnvironmentFileListTool = &Tool{
-	Definition: mcp.NewTool("environment_file_list",
-		mcp.WithDescription("List the contents of a directory"),
+var EnvironmentCheckpointTool = &Tool{
+	Definition: mcp.NewTool("environment_checkpoint",
+		mcp.WithDescription("Checkpoints an environment in its current state as a container."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this directory is being listed."),
+			mcp.Description("One sentence explanation for why this checkpoint is being created."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("path",
-			mcp.Description("Path of the directory to list contents of, absolute or relative to the workdir"),
+		mcp.WithString("destination",
+			mcp.Description("Container image destination to checkpoint to (e.g. registry.com/user/image:tag"),
 			mcp.Required(),
 		),
 	),
@@ -726,128 +2014,273 @@ var EnvironmentFileListTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		destination, err := request.RequireString("destination")
+		if err != nil {
+			return nil, err
 		}
 
-		path, err := request.RequireString("path")
+		endpoint, err := env.Checkpoint(ctx, destination)
+		if err != nil {
+			return errorResult("failed to checkpoint", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Checkpoint pushed to %q. You MUST use the full content addressed (@sha256:...) reference in `docker` commands. The entrypoint is set to `sh`, keep that in mind when giving commands to the container.", endpoint)), nil
+	},
+}
+
+var EnvironmentTerminalTool = &Tool{
+	Definition: mcp.NewTool("environment_terminal",
+		mcp.WithDescription("Start a persistent terminal session in the environment for the user, who attaches to it with `cu terminal <environment_id>` and can reattach after a disconnection. Use environment_terminal_read to see what the user did in it. Commands run in the terminal don't change the environment."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the terminal is being started."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
 
-		out, err := env.FileList(ctx, path)
+		cfg, err := environment.LoadTerminalConfig()
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to list directory", err), nil
+			return errorResult("failed to load terminal configuration", err), nil
+		}
+		session, err := env.StartTerminalSession(ctx, cfg)
+		if err != nil {
+			return errorResult("failed to start terminal session", err), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Terminal session started (%s). Tell the user to attach to it with `cu terminal %s`.", session.Shell, env.ID)), nil
+	},
+}
+
+var EnvironmentTerminalReadTool = &Tool{
+	Definition: mcp.NewTool("environment_terminal_read",
+		mcp.WithDescription("Read the screen and scrollback of the persistent terminal session of the environment, to see what the user did in it."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the terminal is being read."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
 
+		out, err := env.TerminalScrollback(ctx)
+		if err != nil {
+			return errorResult("failed to read terminal session", err), nil
+		}
 		return mcp.NewToolResultText(out), nil
 	},
 }
 
-var EnvironmentFileWriteTool = &Tool{
-	Definition: mcp.NewTool("environment_file_write",
-		mcp.WithDescription("Write the contents of a file."),
+var EnvironmentPortsTool = &Tool{
+	Definition: mcp.NewTool("environment_ports",
+		mcp.WithDescription("List the ports the background commands of the environment listen on, with the process and command listening, so they can be offered for forwarding with environment_run_cmd's ports."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this file is being written."),
+			mcp.Description("One sentence explanation for why the ports are being listed."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("target_file",
-			mcp.Description("Path of the file to write, absolute or relative to the workdir."),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+
+		ports, err := env.ListeningPorts(ctx)
+		if err != nil {
+			return errorResult("failed to list listening ports", err), nil
+		}
+		out, err := json.Marshal(ports)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+var EnvironmentPreviewTool = &Tool{
+	Definition: mcp.NewTool("environment_preview",
+		mcp.WithDescription("Get a preview URL of a web page served by a background command of the environment (started with environment_run_cmd, background and ports), to share with the user. Optionally saves a screenshot of the page, taken by a headless browser, in the worktree so it can be shown."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the page is being previewed."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("contents",
-			mcp.Description("Full text content of the file you want to write."),
+		mcp.WithNumber("port",
+			mcp.Description("The port the page is served on, as passed to environment_run_cmd's ports."),
 			mcp.Required(),
 		),
+		mcp.WithString("path",
+			mcp.Description("The path of the page, e.g. /dashboard. Defaults to the root."),
+		),
+		mcp.WithString("screenshot",
+			mcp.Description("Where to save a PNG screenshot of the page, relative to the workdir, e.g. screenshots/dashboard.png. No screenshot is taken if empty."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		targetFile, err := request.RequireString("target_file")
+		port, err := request.RequireInt("port")
 		if err != nil {
 			return nil, err
 		}
-		contents, err := request.RequireString("contents")
+
+		preview, err := env.Preview(ctx, request.GetString("explanation", ""), port, request.GetString("path", ""), request.GetString("screenshot", ""))
+		if err != nil {
+			return errorResult("failed to preview page", err), nil
+		}
+		out, err := json.Marshal(preview)
 		if err != nil {
 			return nil, err
 		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
 
-		if err := env.FileWrite(ctx, request.GetString("explanation", ""), targetFile, contents); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to write file", err), nil
+var EnvironmentBrowserNavigateTool = &Tool{
+	Definition: mcp.NewTool("environment_browser_navigate",
+		mcp.WithDescription("Load a page served by a background command of the environment (started with environment_run_cmd, background and ports) in a headless Chromium browser, and return its DOM once its scripts ran along with the messages it logged to the console. Use it to verify web changes end to end."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why the page is being loaded."),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("port",
+			mcp.Description("The port the page is served on, as passed to environment_run_cmd's ports."),
+			mcp.Required(),
+		),
+		mcp.WithString("path",
+			mcp.Description("The path of the page, e.g. /login?next=%2F. Defaults to the root."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		env := environmentsFromContext(ctx).Get(envID)
+		if env == nil {
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
+		}
+		port, err := request.RequireInt("port")
+		if err != nil {
+			return nil, err
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("file %s written successfully, changes pushed to container-use/%s", targetFile, env.ID)), nil
+		page, err := env.Navigate(ctx, port, request.GetString("path", ""))
+		if err != nil {
+			return errorResult("failed to load page", err), nil
+		}
+		out, err := json.Marshal(page)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
 	},
 }
 
-var EnvironmentFileDeleteTool = &Tool{
-	Definition: mcp.NewTool("environment_file_delete",
-		mcp.WithDescription("Deletes a file at the specified path."),
+var EnvironmentBrowserScreenshotTool = &Tool{
+	Definition: mcp.NewTool("environment_browser_screenshot",
+		mcp.WithDescription("Take a screenshot of a page served by a background command of the environment with a headless Chromium browser, once its scripts ran. The screenshot is returned as an image, and saved in the worktree if path is set."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this file is being deleted."),
+			mcp.Description("One sentence explanation for why the screenshot is being taken."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("target_file",
-			mcp.Description("Path of the file to delete, absolute or relative to the workdir."),
+		mcp.WithNumber("port",
+			mcp.Description("The port the page is served on, as passed to environment_run_cmd's ports."),
 			mcp.Required(),
 		),
+		mcp.WithString("path",
+			mcp.Description("The path of the page, e.g. /dashboard. Defaults to the root."),
+		),
+		mcp.WithString("save_to",
+			mcp.Description("Where to save the PNG screenshot, relative to the workdir. The screenshot is only returned if empty."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		targetFile, err := request.RequireString("target_file")
+		port, err := request.RequireInt("port")
 		if err != nil {
 			return nil, err
 		}
+		saveTo := request.GetString("save_to", "")
 
-		if err := env.FileDelete(ctx, request.GetString("explanation", ""), targetFile); err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to delete file", err), nil
+		shot, err := env.Screenshot(ctx, request.GetString("explanation", ""), port, request.GetString("path", ""), saveTo)
+		if err != nil {
+			return errorResult("failed to take screenshot", err), nil
 		}
-
-		return mcp.NewToolResultText(fmt.Sprintf("file %s deleted successfully, changes pushed to container-use/%s", targetFile, env.ID)), nil
+		text := "Screenshot taken"
+		if saveTo != "" {
+			text = fmt.Sprintf("Screenshot saved to %s", saveTo)
+		}
+		return mcp.NewToolResultImage(text, base64.StdEncoding.EncodeToString(shot), "image/png"), nil
 	},
 }
 
-var EnvironmentRevisionDiffTool = &Tool{
-	Definition: mcp.NewTool("environment_revision_diff",
-		mcp.WithDescription("Diff files between multiple revisions of an environment."),
+var EnvironmentBrowserConsoleTool = &Tool{
+	Definition: mcp.NewTool("environment_browser_console",
+		mcp.WithDescription("Load a page served by a background command of the environment in a headless Chromium browser and return the messages it logged to the console, including uncaught errors."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this diff is being run."),
+			mcp.Description("One sentence explanation for why the console is being read."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("path",
-			mcp.Description("The path within the environment to be diffed. Defaults to workdir."),
-		),
-		mcp.WithNumber("from_version",
-			mcp.Description("Compute the diff starting from this version"),
+		mcp.WithNumber("port",
+			mcp.Description("The port the page is served on, as passed to environment_run_cmd's ports."),
 			mcp.Required(),
 		),
-		mcp.WithNumber("to_version",
-			mcp.Description("Compute the diff ending at this version. Defaults to latest version."),
+		mcp.WithString("path",
+			mcp.Description("The path of the page, e.g. /dashboard. Defaults to the root."),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -855,60 +2288,111 @@ var EnvironmentRevisionDiffTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-
-		path := request.GetString("path", "")
-		fromVersion, err := request.RequireInt("from_version")
+		port, err := request.RequireInt("port")
 		if err != nil {
 			return nil, err
 		}
-		toVersion := request.GetInt("to_version", int(env.History.LatestVersion()))
 
-		diff, err := env.RevisionDiff(ctx, path, environment.Version(fromVersion), environment.Version(toVersion))
+		page, err := env.Navigate(ctx, port, request.GetString("path", ""))
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to diff", err), nil
+			return errorResult("failed to load page", err), nil
 		}
-
-		return mcp.NewToolResultText(diff), nil
+		out, err := json.Marshal(page.Console)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
 	},
 }
 
-var EnvironmentCheckpointTool = &Tool{
-	Definition: mcp.NewTool("environment_checkpoint",
-		mcp.WithDescription("Checkpoints an environment in its current state as a container."),
+var EnvironmentAddServiceTool = &Tool{
+	Definition: mcp.NewTool("environment_add_service",
+		mcp.WithDescription("Start a service container, such as a database, alongside the environment, optionally seeded with data. The service is reachable from the environment under its name, the variables to connect to it (e.g. DATABASE_URL) are set in the environment, and it's started again, with its data, when the environment is rebuilt. postgres, mysql, mariadb, redis, valkey and mongo images are configured out of the box."),
 		mcp.WithString("explanation",
-			mcp.Description("One sentence explanation for why this checkpoint is being created."),
+			mcp.Description("One sentence explanation for why the service is being added."),
 		),
 		mcp.WithString("environment_id",
 			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
 			mcp.Required(),
 		),
-		mcp.WithString("destination",
-			mcp.Description("Container image destination to checkpoint to (e.g. registry.com/user/image:tag"),
+		mcp.WithString("image",
+			mcp.Description("The image of the service, e.g. postgres:16 or redis:7."),
 			mcp.Required(),
 		),
+		mcp.WithString("name",
+			mcp.Description("The hostname of the service. Defaults to the image name, e.g. postgres."),
+		),
+		mcp.WithArray("env",
+			mcp.Description("Environment variables of the service container (KEY=VALUE), replacing the defaults of the image."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("ports",
+			mcp.Description("Ports the service listens on. Required for images that aren't configured out of the box."),
+			mcp.Items(map[string]any{"type": "number"}),
+		),
+		mcp.WithArray("connection",
+			mcp.Description("Variables set in the environment to connect to the service (KEY=VALUE), replacing the defaults of the image. {{host}} is replaced by the name of the service."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("seed",
+			mcp.Description("SQL or fixture scripts (e.g. db/schema.sql, db/fixtures.sql), or directories of scripts, relative to the workdir, run in order when the service initializes its data. Changing them starts the service with fresh data."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("init_dir",
+			mcp.Description("The directory of the service container seed scripts are mounted in. Defaults to /docker-entrypoint-initdb.d for postgres, mysql, mariadb and mongo."),
+		),
+		mcp.WithString("snapshot",
+			mcp.Description("A tar archive of the data directory of the service, relative to the workdir, restored when the service starts without data."),
+		),
+		mcp.WithArray("depends_on",
+			mcp.Description("Services of the environment started, and ready, before this one, which can reach them by name."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("ready",
+			mcp.Description("A command, run in a container of the image, that succeeds once the service is ready, e.g. `pg_isready -h {{host}}`. Defaults to a check of the database for images configured out of the box."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		envID, err := request.RequireString("environment_id")
 		if err != nil {
 			return nil, err
 		}
-		env := environment.Get(envID)
+		env := environmentsFromContext(ctx).Get(envID)
 		if env == nil {
-			return mcp.NewToolResultError(fmt.Sprintf("environment %s not found", envID)), nil
+			return errorResult("", &environment.EnvNotFoundError{ID: envID}), nil
 		}
-		destination, err := request.RequireString("destination")
+		image, err := request.RequireString("image")
 		if err != nil {
 			return nil, err
 		}
+		opts := environment.SidecarOptions{
+			Name:       request.GetString("name", ""),
+			Env:        request.GetStringSlice("env", nil),
+			Connection: request.GetStringSlice("connection", nil),
+			Seed:       request.GetStringSlice("seed", nil),
+			InitDir:    request.GetString("init_dir", ""),
+			Snapshot:   request.GetString("snapshot", ""),
+			DependsOn:  request.GetStringSlice("depends_on", nil),
+			Ready:      request.GetString("ready", ""),
+		}
+		if portList, ok := request.GetArguments()["ports"].([]any); ok {
+			for _, port := range portList {
+				opts.Ports = append(opts.Ports, int(port.(float64)))
+			}
+		}
 
-		endpoint, err := env.Checkpoint(ctx, destination)
+		sidecar, err := env.AddService(ctx, request.GetString("explanation", ""), image, opts)
 		if err != nil {
-			return mcp.NewToolResultErrorFromErr("failed to checkpoint", err), nil
+			return errorResult("failed to add service", err), nil
 		}
-		return mcp.NewToolResultText(fmt.Sprintf("Checkpoint pushed to %q. You MUST use the full content addressed (@sha256:...) reference in `docker` commands. The entrypoint is set to `sh`, keep that in mind when giving commands to the container.", endpoint)), nil
+		out, err := json.Marshal(sidecar)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
 	},
 }
@@ -0,0 +1,344 @@
+// Package telemetry records anonymous usage counts (environments created,
+// commands run, tool calls and failure categories) to help prioritize fixes.
+//
+// Telemetry is opt-in and off by default. In local mode, counts are only
+// kept in ~/.config/container-use/telemetry, where they can be inspected with
+// cu telemetry show. Once turned on, daily counts are also sent to the
+// configured endpoint. Counts never include names, paths, commands or output:
+// only the number of times each event happened, along with a random
+// installation ID, the version and platform of container-use.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// ModeEnv overrides the telemetry mode of the configuration: off, local or on.
+// Telemetry is also off when DO_NOT_TRACK is set.
+const ModeEnv = "CONTAINER_USE_TELEMETRY"
+
+type Mode string
+
+const (
+	// ModeOff records nothing.
+	ModeOff Mode = "off"
+	// ModeLocal records counts on this machine only.
+	ModeLocal Mode = "local"
+	// ModeOn records counts and sends them to the endpoint.
+	ModeOn Mode = "on"
+)
+
+// Config is the telemetry configuration, in ~/.config/container-use/telemetry.json.
+type Config struct {
+	Mode Mode `json:"mode"`
+	// Endpoint is the URL daily reports are posted to in ModeOn.
+	Endpoint string `json:"endpoint,omitempty"`
+	// InstallationID anonymously identifies the reports of this machine.
+	InstallationID string `json:"installation_id,omitempty"`
+}
+
+// DefaultConfigPath returns the location of the telemetry configuration.
+func DefaultConfigPath() (string, error) {
+	return homedir.Expand("~/.config/container-use/telemetry.json")
+}
+
+func dataDir() (string, error) {
+	return homedir.Expand("~/.config/container-use/telemetry")
+}
+
+// LoadConfig reads the telemetry configuration, off if there is none.
+func LoadConfig() (*Config, error) {
+	configPath, err := DefaultConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Config{Mode: ModeOff}, nil
+		}
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid telemetry configuration %s: %w", configPath, err)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeOff
+	}
+	return cfg, nil
+}
+
+// SaveConfig writes the telemetry configuration, generating an installation ID if needed.
+func SaveConfig(cfg *Config) error {
+	switch cfg.Mode {
+	case ModeOff, ModeLocal:
+	case ModeOn:
+		if cfg.Endpoint == "" {
+			return errors.New("an endpoint is required to send telemetry")
+		}
+	default:
+		return fmt.Errorf("invalid telemetry mode %q", cfg.Mode)
+	}
+	if cfg.InstallationID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		cfg.InstallationID = hex.EncodeToString(id)
+	}
+	configPath, err := DefaultConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, data, 0600)
+}
+
+// EffectiveMode returns the mode telemetry runs in, taking ModeEnv and DO_NOT_TRACK into account.
+func EffectiveMode(cfg *Config) Mode {
+	if os.Getenv("DO_NOT_TRACK") != "" {
+		return ModeOff
+	}
+	switch Mode(os.Getenv(ModeEnv)) {
+	case ModeOff:
+		return ModeOff
+	case ModeLocal:
+		return ModeLocal
+	case ModeOn:
+		if cfg.Endpoint != "" {
+			return ModeOn
+		}
+		return ModeLocal
+	}
+	return cfg.Mode
+}
+
+// Report is the anonymous counts of an installation for a day.
+type Report struct {
+	InstallationID string `json:"installation_id"`
+	// Day is the UTC date, e.g. 2025-06-30.
+	Day     string           `json:"day"`
+	Version string           `json:"version"`
+	OS      string           `json:"os"`
+	Arch    string           `json:"arch"`
+	Counts  map[string]int64 `json:"counts"`
+}
+
+// Version is the version of container-use reported.
+var Version = "dev"
+
+// flushDelay is how long counts are buffered before being written.
+const flushDelay = 10 * time.Second
+
+var recorder = struct {
+	sync.Mutex
+	once    sync.Once
+	enabled bool
+	// file is where the counts of the process are written, per day.
+	file   string
+	day    string
+	counts map[string]int64
+	timer  *time.Timer
+}{}
+
+func enabled() bool {
+	recorder.once.Do(func() {
+		cfg, err := LoadConfig()
+		if err != nil {
+			slog.Warn("Failed to load telemetry configuration", "err", err)
+			return
+		}
+		recorder.enabled = EffectiveMode(cfg) != ModeOff
+		recorder.file = fmt.Sprintf("%d-%d.json", os.Getpid(), time.Now().UnixNano())
+	})
+	return recorder.enabled
+}
+
+// Count records that the event happened once, e.g. "environments_created".
+func Count(event string) {
+	if !enabled() {
+		return
+	}
+	recorder.Lock()
+	defer recorder.Unlock()
+	day := time.Now().UTC().Format(time.DateOnly)
+	if day != recorder.day && recorder.counts != nil {
+		flushLocked()
+	}
+	if recorder.counts == nil {
+		recorder.counts = map[string]int64{}
+	}
+	recorder.day = day
+	recorder.counts[event]++
+	if recorder.timer == nil {
+		recorder.timer = time.AfterFunc(flushDelay, Flush)
+	}
+}
+
+// Failure records a failure of the category, e.g. "command_exit".
+func Failure(category string) {
+	Count("failures." + category)
+}
+
+// Flush writes the recorded counts.
+func Flush() {
+	recorder.Lock()
+	defer recorder.Unlock()
+	flushLocked()
+}
+
+func flushLocked() {
+	recorder.timer = nil
+	if recorder.counts == nil {
+		return
+	}
+	dir, err := dataDir()
+	if err == nil {
+		dir = filepath.Join(dir, recorder.day)
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(recorder.counts); err == nil {
+			err = os.WriteFile(filepath.Join(dir, recorder.file), data, 0600)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to write telemetry", "err", err)
+	}
+	// Counts of the next day are written to a new file.
+	if recorder.day != time.Now().UTC().Format(time.DateOnly) {
+		recorder.counts = nil
+	}
+}
+
+// Reports returns the counts recorded on this machine, by day, oldest first.
+func Reports(cfg *Config) ([]*Report, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return nil, err
+	}
+	days, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	reports := []*Report{}
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		report := &Report{
+			InstallationID: cfg.InstallationID,
+			Day:            day.Name(),
+			Version:        Version,
+			OS:             runtime.GOOS,
+			Arch:           runtime.GOARCH,
+			Counts:         map[string]int64{},
+		}
+		files, err := os.ReadDir(filepath.Join(dir, day.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, day.Name(), file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			counts := map[string]int64{}
+			if err := json.Unmarshal(data, &counts); err != nil {
+				slog.Warn("Skipping invalid telemetry file", "file", file.Name(), "err", err)
+				continue
+			}
+			for event, count := range counts {
+				report.Counts[event] += count
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Purge deletes the counts recorded on this machine.
+func Purge() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Send posts the reports of the past days to the endpoint, when telemetry
+// is on, and deletes them once sent. The counts of today are sent tomorrow.
+func Send(ctx context.Context) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if EffectiveMode(cfg) != ModeOn {
+		return nil
+	}
+	reports, err := Reports(cfg)
+	if err != nil {
+		return err
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	for _, report := range reports {
+		if report.Day >= today {
+			continue
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Endpoint, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("telemetry endpoint returned %s", resp.Status)
+		}
+		if err := os.RemoveAll(filepath.Join(dir, report.Day)); err != nil {
+			return err
+		}
+	}
+	return nil
+}